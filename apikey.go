@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// apiKeyStore - the API key currently in use, swapped atomically when it is reloaded
+type apiKeyStore struct {
+	key atomic.Pointer[string]
+}
+
+// apiKeys - the API key for this process, loaded at startup and on SIGHUP
+var apiKeys = &apiKeyStore{}
+
+// apiKeyOverrideHeader - the header a client may send its own OpenWeather API key in (ALLOW_KEY_OVERRIDE)
+const apiKeyOverrideHeader = "X-OpenWeather-Key"
+
+// apiKeyOverride - the context key under which a request's own API key is carried
+type apiKeyOverride struct{}
+
+// withAPIKey - ctx carrying key, to be used instead of the process's key for the provider calls made with it
+func withAPIKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, apiKeyOverride{}, key)
+}
+
+// keyOverride - Middleware letting a request supply its own API key in the X-OpenWeather-Key header
+// For multi-tenant gateways: the key is used for the provider calls made for that request only, and a
+// malformed key is refused with a 400.  Weather fetched with a tenant's key is cached and coalesced apart
+// from everyone else's (see apiKeyScope), so a key the provider would refuse never gets weather paid for
+// with another.  The key itself is never logged.
+func keyOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.Header.Get(apiKeyOverrideHeader)
+		if raw == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := validateAPIKey(raw)
+		if err != nil {
+			slog.Info("input error: invalid "+apiKeyOverrideHeader, "error", err)
+			http.Error(w, "Invalid "+apiKeyOverrideHeader, http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withAPIKey(r.Context(), key)))
+	})
+}
+
+// apiKeyScope - a suffix keeping the cache and coalescer entries of a request that supplied its own API key
+// apart from the rest, empty for requests using the process's key.  The key is hashed, so it doesn't appear
+// in cache keys (or Redis).
+func apiKeyScope(ctx context.Context) string {
+	key, ok := ctx.Value(apiKeyOverride{}).(string)
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "#key:" + hex.EncodeToString(sum[:8])
+}
+
+// Get - the API key for ctx: the request's own key if it supplied one, otherwise the current key
+// Until a key has been loaded successfully we read the key source on every call, so a missing or malformed
+// key is reported to the caller rather than failing startup.
+func (s *apiKeyStore) Get(ctx context.Context) (string, error) {
+	if key, ok := ctx.Value(apiKeyOverride{}).(string); ok {
+		return key, nil
+	}
+	if key := s.key.Load(); key != nil {
+		return *key, nil
+	}
+	return getAPIKey(ctx)
+}
+
+// Reload - re-read and validate the key source, swapping in the new key if it is valid
+// On failure the previous key (if any) stays in use.
+func (s *apiKeyStore) Reload(ctx context.Context) error {
+	key, err := getAPIKey(ctx)
+	if err != nil {
+		slog.Error("API key reload failed, keeping the current key", "error", err)
+		return err
+	}
+	s.key.Store(&key)
+	slog.Info("API key loaded")
+	return nil
+}
+
+// reloadAPIKeyOnSignal - reload the API key each time the process receives SIGHUP, until ctx is done
+func reloadAPIKeyOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				_ = apiKeys.Reload(ctx)
+			}
+		}
+	}()
+}
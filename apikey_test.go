@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyReload(t *testing.T) {
+	const firstKey = "abcdef0123456789abcdef0123456789"
+	const secondKey = "0123456789abcdef0123456789abcdef"
+
+	keyFile := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(keyFile, []byte(firstKey+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		apiKeys = &apiKeyStore{}
+	})
+	cfg := defaultConfig()
+	cfg.SecretSource = fileSecretSource{path: keyFile}
+	withConfig(t, cfg)
+	apiKeys = &apiKeyStore{}
+
+	var mu sync.Mutex
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL.Query().Get("appid"))
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`))
+	}))
+	t.Cleanup(server.Close)
+	provider := newOpenWeatherProvider(server.URL)
+
+	fetch := func() {
+		t.Helper()
+		if _, err := provider.Fetch(context.Background(), weatherQuery{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if err := apiKeys.Reload(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fetch()
+
+	// rotate the key on disk: nothing changes until we reload
+	if err := os.WriteFile(keyFile, []byte(secondKey), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fetch()
+	if err := apiKeys.Reload(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fetch()
+
+	// a bad key is rejected and the current key stays in use
+	if err := os.WriteFile(keyFile, []byte("not-a-key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiKeys.Reload(context.Background()); err == nil {
+		t.Error("Expected error reloading a malformed key")
+	}
+	fetch()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{firstKey, firstKey, secondKey, secondKey}
+	if len(seen) != len(expected) {
+		t.Fatalf("Expected %d requests, got %d", len(expected), len(seen))
+	}
+	for i := range expected {
+		if seen[i] != expected[i] {
+			t.Errorf("request %d: expected key %s, got %s", i, expected[i], seen[i])
+		}
+	}
+}
+
+func TestReloadAPIKeyOnSignal(t *testing.T) {
+	const fakeApiKey = "abcdef0123456789abcdef0123456789"
+	t.Cleanup(func() {
+		_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		apiKeys = &apiKeyStore{}
+	})
+	_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+	apiKeys = &apiKeyStore{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	reloadAPIKeyOnSignal(ctx)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Skipf("cannot signal self: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for apiKeys.key.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("API key was not reloaded on SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPIKeyOverride(t *testing.T) {
+	const serverKey = "abcdef0123456789abcdef0123456789"
+	const tenantKey = "0123456789abcdef0123456789abcdef"
+	const refusedKey = "fedcba9876543210fedcba9876543210" // well-formed, but the upstream answers 401
+
+	// serve routes (with override enabled or not) in front of an upstream recording the keys it is sent
+	serve := func(t *testing.T, enabled bool) (mux *http.ServeMux, seen func() []string) {
+		t.Helper()
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+			apiKeys = &apiKeyStore{}
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", serverKey)
+		apiKeys = &apiKeyStore{}
+
+		var mu sync.Mutex
+		var keys []string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			keys = append(keys, r.URL.Query().Get("appid"))
+			mu.Unlock()
+			if r.URL.Query().Get("appid") == refusedKey {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`))
+		}))
+		t.Cleanup(upstream.Close)
+		cfg := defaultConfig()
+		cfg.Provider = newOpenWeatherProvider(upstream.URL)
+		cfg.KeyOverride = enabled
+		withConfig(t, cfg)
+		mux = http.NewServeMux()
+		setupRoutes(mux, cfg)
+		return mux, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Clone(keys)
+		}
+	}
+	get := func(mux *http.ServeMux, target, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if key != "" {
+			r.Header.Set(apiKeyOverrideHeader, key)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Valid override used", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelDebug)
+		mux, seen := serve(t, true)
+		if w := get(mux, "/weather?lat=1&lon=1", " "+tenantKey+" "); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		// ... for that request only
+		if w := get(mux, "/weather?lat=2&lon=2", ""); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if keys := seen(); !slices.Equal(keys, []string{tenantKey, serverKey}) {
+			t.Errorf("Expected the tenant's key then the server's, got %v", keys)
+		}
+		if strings.Contains(logs.String(), tenantKey) {
+			t.Errorf("Expected the key never to be logged: %s", logs.String())
+		}
+	})
+
+	t.Run("Cached weather not shared with an override", func(t *testing.T) {
+		mux, seen := serve(t, true)
+		if w := get(mux, "/weather?lat=1&lon=1", ""); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		// the same location, cached with the server's key, must not be served for a key the upstream refuses
+		if w := get(mux, "/weather?lat=1&lon=1", refusedKey); w.Code != http.StatusInternalServerError ||
+			!strings.Contains(w.Body.String(), "invalid API key") {
+			t.Errorf("Expected 500 invalid API key, got %d %q", w.Code, w.Body.String())
+		}
+		// while tenants with a key the upstream accepts get their own entry, reused from then on
+		for range 2 {
+			if w := get(mux, "/weather?lat=1&lon=1", tenantKey); w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+		if keys := seen(); !slices.Equal(keys, []string{serverKey, refusedKey, tenantKey}) {
+			t.Errorf("Expected one upstream request per key, got %v", keys)
+		}
+	})
+
+	t.Run("Invalid override rejected", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelDebug)
+		mux, seen := serve(t, true)
+		w := get(mux, "/weather?lat=1&lon=1", "not-a-valid-key")
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid X-OpenWeather-Key") {
+			t.Errorf("Expected 400 Invalid X-OpenWeather-Key, got %d %q", w.Code, w.Body.String())
+		}
+		if keys := seen(); len(keys) != 0 {
+			t.Errorf("Expected no upstream requests, got %d", len(keys))
+		}
+		if strings.Contains(logs.String(), "not-a-valid-key") {
+			t.Errorf("Expected the key never to be logged: %s", logs.String())
+		}
+	})
+
+	t.Run("Ignored when disabled", func(t *testing.T) {
+		mux, seen := serve(t, false)
+		for _, key := range []string{tenantKey, "not-a-valid-key"} {
+			if w := get(mux, "/weather?lat=1&lon=1", key); w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+		for _, key := range seen() {
+			if key != serverKey {
+				t.Errorf("Expected only the server's key upstream, got %s", key)
+			}
+		}
+	})
+}
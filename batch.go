@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// maxBatchBodyBytes - the largest POST /weather/batch body we will read
+const maxBatchBodyBytes = 64 << 10
+
+// batchConcurrency - how many of a batch's locations are fetched at once
+const batchConcurrency = 8
+
+// ndjsonContentType - a streamed batch: one JSON object per line
+const ndjsonContentType = "application/x-ndjson"
+
+// idempotencyKeyHeader - a batch sent with this is computed once, and replayed when the same key is sent
+// again within IDEMPOTENCY_TTL_SECONDS
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength - the longest Idempotency-Key we accept
+const maxIdempotencyKeyLength = 255
+
+// batchRequestBody - the JSON body accepted by POST /weather/batch
+// lat and lon are kept as json.Number so they go through the same validators as query parameters.
+type batchRequestBody struct {
+	Locations []struct {
+		Lat json.Number `json:"lat"`
+		Lon json.Number `json:"lon"`
+	} `json:"locations"`
+	Units string `json:"units"`
+}
+
+// BatchResponse - the weather at each location of a batch, in the order they were asked for
+type BatchResponse struct {
+	Results []locationWeather `json:"results"`
+}
+
+// batchLine - a line of a streamed batch: one location, and where it was in the request
+type batchLine struct {
+	Index int `json:"index"`
+	locationWeather
+}
+
+// batchWeatherHandler - POST /weather/batch, the weather at up to MAX_BATCH_SIZE locations
+// The locations are fetched concurrently.  One that can't be looked up (bad coordinates, outside the area
+// served, a provider failure) gets an error in place of its weather, and the rest are unaffected.  With
+// Accept: application/x-ndjson each result is written and flushed as a line of its own as soon as it is
+// ready, rather than all of them once the last is done.  A batch sent with an Idempotency-Key is answered
+// from the results stored for that key and batch, if there are any, rather than being fetched again.
+func batchWeatherHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body batchRequestBody
+	if !decodeJSONBody(w, r, maxBatchBodyBytes, &body) {
+		return
+	}
+	if len(body.Locations) == 0 {
+		slog.Info("input error: empty batch")
+		http.Error(w, "No locations", http.StatusBadRequest)
+		return
+	}
+	if len(body.Locations) > config.MaxBatchSize {
+		slog.Info("input error: batch too large", "locations", len(body.Locations), "max", config.MaxBatchSize)
+		http.Error(w, fmt.Sprintf("Too many locations (max %d)", config.MaxBatchSize), http.StatusBadRequest)
+		return
+	}
+	units, err := validateUnits(body.Units)
+	if err != nil {
+		slog.Info("input error", "error", err)
+		http.Error(w, "Invalid units", http.StatusBadRequest)
+		return
+	}
+
+	idempotencyKey := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		slog.Info("input error: idempotency key too long", "length", len(idempotencyKey))
+		http.Error(w, "Invalid "+idempotencyKeyHeader, http.StatusBadRequest)
+		return
+	}
+	var resultKey string
+	if idempotencyKey != "" && config.IdempotencyTTL > 0 {
+		resultKey = batchResultKey(r.Context(), idempotencyKey, body)
+	}
+
+	ctx := r.Context()
+	if config.RequestBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.RequestBudget)
+		defer cancel()
+	}
+
+	// results arrive in the order they complete; every one is received, even once the client has gone
+	results := make(chan batchLine)
+	stored, replayed := storedBatch(ctx, resultKey)
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+		go func() {
+			for i, location := range stored {
+				results <- batchLine{Index: i, locationWeather: location}
+			}
+			close(results)
+		}()
+	} else {
+		go func() {
+			var group errgroup.Group
+			group.SetLimit(batchConcurrency)
+			for i, location := range body.Locations {
+				group.Go(func() error {
+					results <- batchLine{Index: i, locationWeather: batchLocation(ctx, location.Lat, location.Lon, units)}
+					return nil // one failed location mustn't cancel the others
+				})
+			}
+			_ = group.Wait()
+			close(results)
+		}()
+	}
+
+	streamed := acceptsNDJSON(r)
+	var encoder *json.Encoder
+	var controller *http.ResponseController
+	if streamed {
+		controller = http.NewResponseController(w)
+		// the server's WriteTimeout is meant for ordinary responses; a streamed batch is written to until its
+		// slowest location is done, retries and all
+		if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+			slog.Debug("could not lift the write deadline for the batch", "error", err)
+		}
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		encoder = json.NewEncoder(w)
+	}
+	response := BatchResponse{Results: make([]locationWeather, len(body.Locations))}
+	for line := range results {
+		response.Results[line.Index] = line.locationWeather
+		if !streamed {
+			continue
+		}
+		if err := encoder.Encode(line); err != nil {
+			slog.Debug("error writing a batch line", "error", err)
+			continue
+		}
+		_ = controller.Flush()
+	}
+	if resultKey != "" && !replayed {
+		// kept even if the client has gone, as that is when it is most likely to retry
+		storeBatch(context.WithoutCancel(r.Context()), resultKey, response.Results)
+	}
+	if streamed {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("error writing the response", "error", err)
+	}
+}
+
+// batchResultKey - the cache key a batch's results are stored under for its Idempotency-Key
+// The batch itself is part of the key, so a key reused for a different batch gets that batch computed
+// rather than another's results.  So is the API key the request supplied (ALLOW_KEY_OVERRIDE), if any, so
+// one tenant can't replay a batch another paid for.
+func batchResultKey(ctx context.Context, idempotencyKey string, body batchRequestBody) string {
+	request, _ := json.Marshal(body) // a decoded body always encodes
+	sum := sha256.Sum256(append([]byte(idempotencyKey+"\n"), request...))
+	return "batch:" + hex.EncodeToString(sum[:]) + apiKeyScope(ctx)
+}
+
+// storedBatch - the results stored for resultKey, if there are any
+func storedBatch(ctx context.Context, resultKey string) ([]locationWeather, bool) {
+	if resultKey == "" {
+		return nil, false
+	}
+	stored, ok := config.Cache.GetResult(ctx, resultKey)
+	if !ok {
+		return nil, false
+	}
+	var results []locationWeather
+	if err := json.Unmarshal(stored, &results); err != nil {
+		slog.Warn("unreadable stored batch", "key", resultKey, "error", err)
+		return nil, false
+	}
+	return results, true
+}
+
+// storeBatch - keep a batch's results for replay, for IDEMPOTENCY_TTL_SECONDS
+func storeBatch(ctx context.Context, resultKey string, results []locationWeather) {
+	stored, err := json.Marshal(results)
+	if err != nil {
+		slog.Warn("batch not stored", "key", resultKey, "error", err)
+		return
+	}
+	config.Cache.SetResult(ctx, resultKey, stored, config.IdempotencyTTL)
+}
+
+// batchLocation - the weather at one location of a batch, or why we couldn't get it
+func batchLocation(ctx context.Context, lat, lon json.Number, units string) locationWeather {
+	latitude, err := validateLatitude(lat.String())
+	if err != nil {
+		metrics.countError(reasonInvalidLat)
+		return locationWeather{Error: err.Error()}
+	}
+	longitude, err := validateLongitude(lon.String())
+	if err != nil {
+		metrics.countError(reasonInvalidLon)
+		return locationWeather{Error: err.Error()}
+	}
+	result := locationWeather{Lat: latitude, Lon: longitude}
+	if !config.BoundingBox.Contains(latitude, longitude) {
+		result.Error = "coordinates are outside the area served"
+		return result
+	}
+
+	data, _, err := fetchWeather(ctx, weatherQuery{Lat: latitude, Lon: longitude})
+	if err != nil {
+		slog.Warn("batch fetch failed", "lat", latitude, "lon", longitude, "error", err)
+		metrics.countFetchError(err)
+		result.Error = fetchErrorMessage(err)
+		return result
+	}
+	weather := newWeatherResponse(data, responseOptions{Units: units})
+	result.Weather = &weather
+	return result
+}
+
+// acceptsNDJSON - whether the client asked for a streamed batch
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted)); err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postBatch - POST body to the batch handler with the given Accept header
+func postBatch(body, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/weather/batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	batchWeatherHandler(w, r)
+	return w
+}
+
+func TestBatchWeatherHandler(t *testing.T) {
+	const body = `{"locations":[{"lat":10,"lon":1},{"lat":999,"lon":1},{"lat":30,"lon":3},{"lat":20,"lon":2}]}`
+
+	t.Run("JSON in request order", func(t *testing.T) {
+		useComparedWeather(t, 0, map[float64]float64{10: 21.5, 20: 25})
+		w := postBatch(body, "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("Expected 200 JSON, got %d %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		var response BatchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("bad json response: %v", err)
+		}
+		if len(response.Results) != 4 {
+			t.Fatalf("Expected 4 results, got %+v", response.Results)
+		}
+		if first := response.Results[0]; first.Lat != 10 || first.Weather == nil || first.Weather.TemperatureC != 21.5 {
+			t.Errorf("Unexpected first result: %+v", first)
+		}
+		if second := response.Results[1]; second.Weather != nil || second.Error != "latitude out of range (-90 to 90 degrees): 999.000000" {
+			t.Errorf("Expected a latitude out of range error, got %+v", second)
+		}
+		if third := response.Results[2]; third.Weather != nil || third.Error != "weather provider returned status 503" {
+			t.Errorf("Expected a provider error, got %+v", third)
+		}
+		if fourth := response.Results[3]; fourth.Weather == nil || fourth.Weather.TemperatureC != 25 {
+			t.Errorf("Unexpected fourth result: %+v", fourth)
+		}
+	})
+
+	t.Run("Streamed NDJSON", func(t *testing.T) {
+		const delay = 300 * time.Millisecond
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			if q.Lat == 10 {
+				time.Sleep(delay) // the first location is the last to finish
+			}
+			if q.Lat == 30 {
+				return nil, &upstreamError{StatusCode: http.StatusServiceUnavailable}
+			}
+			return weatherDataFromJSON(t, fmt.Sprintf(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":%g}}`, q.Lat)), nil
+		}}
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		withConfig(t, cfg)
+		server := httptest.NewServer(http.HandlerFunc(batchWeatherHandler))
+		t.Cleanup(server.Close)
+
+		request, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Accept", "application/x-ndjson")
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		if resp.Header.Get("Content-Type") != ndjsonContentType {
+			t.Errorf("Expected %s, got %q", ndjsonContentType, resp.Header.Get("Content-Type"))
+		}
+
+		lines := map[int]batchLine{}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var line batchLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatalf("bad ndjson line %q: %v", scanner.Text(), err)
+			}
+			if _, repeated := lines[line.Index]; repeated {
+				t.Errorf("Index %d sent twice", line.Index)
+			}
+			if len(lines) == 0 && time.Since(start) >= delay {
+				t.Errorf("Expected the first line before the slowest location was done, took %s", time.Since(start))
+			}
+			lines[line.Index] = line
+		}
+		if len(lines) != 4 {
+			t.Fatalf("Expected one line per location, got %+v", lines)
+		}
+		for index, temp := range map[int]float64{0: 10, 3: 20} {
+			if lines[index].Weather == nil || lines[index].Weather.TemperatureC != temp {
+				t.Errorf("Index %d: expected %g°C, got %+v", index, temp, lines[index])
+			}
+		}
+		if lines[1].Error != "latitude out of range (-90 to 90 degrees): 999.000000" || lines[2].Error != "weather provider returned status 503" {
+			t.Errorf("Expected inline errors, got %+v and %+v", lines[1], lines[2])
+		}
+	})
+
+	t.Run("Streamed NDJSON outlives the server's write timeout", func(t *testing.T) {
+		const delay = 300 * time.Millisecond
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			if q.Lat == 10 {
+				time.Sleep(delay)
+			}
+			return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21}}`), nil
+		}}
+		cfg.WriteTimeout = 100 * time.Millisecond
+		withConfig(t, cfg)
+
+		// through the real routes, so the middlewares' response writers are in the way too
+		mux := http.NewServeMux()
+		setupRoutes(mux, cfg)
+		server := httptest.NewUnstartedServer(mux)
+		server.Config = newServer("", mux, cfg)
+		server.Start()
+		t.Cleanup(server.Close)
+
+		request, _ := http.NewRequest(http.MethodPost, server.URL+"/weather/batch",
+			strings.NewReader(`{"locations":[{"lat":10,"lon":1},{"lat":20,"lon":2}]}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Accept", "application/x-ndjson")
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var lines int
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines++
+		}
+		if lines != 2 || scanner.Err() != nil {
+			t.Errorf("Expected both lines despite the write timeout, got %d (%v)", lines, scanner.Err())
+		}
+	})
+
+	t.Run("Too many locations", func(t *testing.T) {
+		provider := useComparedWeather(t, 0, map[float64]float64{10: 21.5})
+		config.MaxBatchSize = 3
+		w := postBatch(body, ndjsonContentType)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Too many locations (max 3)") {
+			t.Errorf("Expected 400 Too many locations, got %d %q", w.Code, w.Body.String())
+		}
+		if provider.Calls() != 0 {
+			t.Error("Expected no provider calls")
+		}
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		useComparedWeather(t, 0, nil)
+		testCases := map[string]int{
+			`{"locations":[]}`: http.StatusBadRequest,
+			`{"locations":[{"lat":1,"lon":1}],"units":"x"}`: http.StatusBadRequest,
+			`[{"lat":1,"lon":1}]`:                           http.StatusBadRequest,
+		}
+		for body, expected := range testCases {
+			if w := postBatch(body, ""); w.Code != expected {
+				t.Errorf("%s: expected %d, got %d", body, expected, w.Code)
+			}
+		}
+		w := httptest.NewRecorder()
+		batchWeatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather/batch", nil))
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+			t.Errorf("Expected 405 with Allow: POST, got %d %q", w.Code, w.Header().Get("Allow"))
+		}
+	})
+}
+
+func TestBatchIdempotencyKey(t *testing.T) {
+	const body = `{"locations":[{"lat":10,"lon":1},{"lat":20,"lon":2}]}`
+	// post - send body with an Idempotency-Key (if key isn't empty)
+	post := func(key, body, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/weather/batch", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		batchWeatherHandler(w, r)
+		return w
+	}
+	// setup - a provider whose temperatures change with every call, and no caching of the weather itself
+	setup := func(t *testing.T) *mockProvider {
+		t.Helper()
+		var mu sync.Mutex
+		calls := 0
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			mu.Lock()
+			calls++
+			temp := q.Lat + float64(calls)
+			mu.Unlock()
+			return weatherDataFromJSON(t, fmt.Sprintf(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":%g}}`, temp)), nil
+		}}
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		cfg.Cache = newWeatherCache(0, 0, cfg.Clock)
+		cfg.Coalescer = newCoalescer(0)
+		withConfig(t, cfg)
+		return provider
+	}
+
+	t.Run("Repeated key", func(t *testing.T) {
+		provider := setup(t)
+		first := post("order-1", body, "")
+		if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("Expected a computed 200, got %d %q", first.Code, first.Header().Get("Idempotent-Replayed"))
+		}
+		calls := provider.Calls()
+		second := post("order-1", body, "")
+		if second.Code != http.StatusOK || second.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("Expected a replayed 200, got %d %q", second.Code, second.Header().Get("Idempotent-Replayed"))
+		}
+		if second.Body.String() != first.Body.String() {
+			t.Errorf("Expected the first results, got %s and then %s", first.Body.String(), second.Body.String())
+		}
+		if provider.Calls() != calls {
+			t.Errorf("Expected no more provider calls, got %d", provider.Calls()-calls)
+		}
+	})
+
+	t.Run("Replayed as NDJSON", func(t *testing.T) {
+		setup(t)
+		first := post("order-1", body, "")
+		var computed BatchResponse
+		if err := json.Unmarshal(first.Body.Bytes(), &computed); err != nil {
+			t.Fatalf("bad json response: %v", err)
+		}
+		second := post("order-1", body, "application/x-ndjson")
+		if second.Header().Get("Content-Type") != ndjsonContentType || second.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("Expected a replayed stream, got %q %q", second.Header().Get("Content-Type"),
+				second.Header().Get("Idempotent-Replayed"))
+		}
+		lines := strings.Split(strings.TrimSpace(second.Body.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("Expected 2 lines, got %q", second.Body.String())
+		}
+		for _, raw := range lines {
+			var line batchLine
+			if err := json.Unmarshal([]byte(raw), &line); err != nil {
+				t.Fatalf("bad json line %q: %v", raw, err)
+			}
+			if line.Weather.TemperatureC != computed.Results[line.Index].Weather.TemperatureC {
+				t.Errorf("Expected line %d to be replayed, got %s", line.Index, raw)
+			}
+		}
+	})
+
+	t.Run("Distinct key", func(t *testing.T) {
+		provider := setup(t)
+		first := post("order-1", body, "")
+		calls := provider.Calls()
+		second := post("order-2", body, "")
+		if second.Code != http.StatusOK || second.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("Expected a computed 200, got %d %q", second.Code, second.Header().Get("Idempotent-Replayed"))
+		}
+		if provider.Calls() != calls+2 {
+			t.Errorf("Expected both locations to be fetched again, got %d provider calls", provider.Calls()-calls)
+		}
+		if second.Body.String() == first.Body.String() {
+			t.Errorf("Expected fresh results, got the first again: %s", second.Body.String())
+		}
+	})
+
+	t.Run("Same key, different API keys", func(t *testing.T) {
+		provider := setup(t)
+		postWithAPIKey := func(apiKey string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPost, "/weather/batch", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Idempotency-Key", "order-1")
+			w := httptest.NewRecorder()
+			batchWeatherHandler(w, r.WithContext(withAPIKey(r.Context(), apiKey)))
+			return w
+		}
+		first := postWithAPIKey("abcdef0123456789abcdef0123456789")
+		calls := provider.Calls()
+		second := postWithAPIKey("0123456789abcdef0123456789abcdef")
+		if second.Code != http.StatusOK || second.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("Expected a computed 200, got %d %q", second.Code, second.Header().Get("Idempotent-Replayed"))
+		}
+		if calls != 2 || provider.Calls() != 2*calls {
+			t.Errorf("Expected the batch fetched once per API key, got %d and then %d provider calls", calls,
+				provider.Calls()-calls)
+		}
+		if second.Body.String() == first.Body.String() {
+			t.Errorf("Expected fresh results, got the first tenant's: %s", second.Body.String())
+		}
+	})
+
+	t.Run("Same key, different batch", func(t *testing.T) {
+		provider := setup(t)
+		_ = post("order-1", body, "")
+		calls := provider.Calls()
+		w := post("order-1", `{"locations":[{"lat":30,"lon":3}]}`, "")
+		if w.Header().Get("Idempotent-Replayed") != "" || provider.Calls() != calls+1 {
+			t.Errorf("Expected the new batch to be computed, got %q with %d provider calls",
+				w.Header().Get("Idempotent-Replayed"), provider.Calls()-calls)
+		}
+	})
+
+	t.Run("No key", func(t *testing.T) {
+		provider := setup(t)
+		_ = post("", body, "")
+		_ = post("", body, "")
+		if provider.Calls() != 4 {
+			t.Errorf("Expected every batch to be fetched, got %d provider calls", provider.Calls())
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		provider := setup(t)
+		config.IdempotencyTTL = 0
+		_ = post("order-1", body, "")
+		if w := post("order-1", body, ""); w.Header().Get("Idempotent-Replayed") != "" || provider.Calls() != 4 {
+			t.Errorf("Expected no replay with IDEMPOTENCY_TTL_SECONDS=0, got %d provider calls", provider.Calls())
+		}
+	})
+
+	t.Run("Key too long", func(t *testing.T) {
+		provider := setup(t)
+		w := post(strings.Repeat("k", maxIdempotencyKeyLength+1), body, "")
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid Idempotency-Key") {
+			t.Errorf("Expected 400 Invalid Idempotency-Key, got %d %q", w.Code, w.Body.String())
+		}
+		if provider.Calls() != 0 {
+			t.Errorf("Expected no provider calls, got %d", provider.Calls())
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen - the circuit breaker is failing requests fast while the provider recovers
+var errCircuitOpen = errors.New("weather provider unavailable (circuit open)")
+
+// breakerState - the state of a circuit breaker
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // requests flow normally
+	breakerOpen                         // requests fail fast until the cooldown ends
+	breakerHalfOpen                     // a single probe request is allowed through
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker - WeatherProvider wrapper that stops calling a failing provider for a while
+// After threshold consecutive failures the breaker opens and every call fails fast with errCircuitOpen.
+// Once cooldown has passed a single probe is let through: success closes the breaker, failure re-opens it.
+type circuitBreaker struct {
+	next      WeatherProvider
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// newCircuitBreaker - wrap next in a circuit breaker, timing its cooldown by clock
+func newCircuitBreaker(next WeatherProvider, threshold int, cooldown time.Duration, clock Clock) *circuitBreaker {
+	return &circuitBreaker{next: next, threshold: threshold, cooldown: cooldown, clock: clock}
+}
+
+// State - the current breaker state
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Fetch - call the wrapped provider unless the breaker is open
+func (b *circuitBreaker) Fetch(ctx context.Context, q weatherQuery) (*WeatherData, error) {
+	if !b.allow() {
+		return nil, errCircuitOpen
+	}
+	data, err := b.next.Fetch(ctx, q)
+	b.record(err)
+	return data, err
+}
+
+// Ping - forward health pings to the wrapped provider
+func (b *circuitBreaker) Ping(ctx context.Context) error {
+	if p, ok := b.next.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// allow - decide whether a call may go through, moving from open to half-open once the cooldown is over
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.clock.Now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.transition(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		// only one probe at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record - update the breaker with the outcome of a call
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+	if !countsAsFailure(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transition(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.clock.Now()
+		if b.state != breakerOpen {
+			b.transition(breakerOpen)
+		}
+	}
+}
+
+// transition - change state, logging and counting the change.  Caller must hold b.mu.
+func (b *circuitBreaker) transition(to breakerState) {
+	slog.Warn("circuit breaker state change", "from", b.state, "to", to, "failures", b.failures)
+	metrics.breakerTransitions.Add(1)
+	b.state = to
+}
+
+// countsAsFailure - whether err says something about the provider's health
+// Our own configuration problems and the provider rejecting a bad request don't.
+func countsAsFailure(err error) bool {
+	if err == nil || errors.Is(err, errInvalidAPIKey) {
+		return false
+	}
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.retryable()
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	failing := true
+	provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		if failing {
+			return nil, &upstreamError{StatusCode: http.StatusBadGateway}
+		}
+		return &WeatherData{}, nil
+	}}
+	clock := newFakeClock()
+	breaker := newCircuitBreaker(provider, 3, 20*time.Second, clock)
+	ctx := context.Background()
+
+	// consecutive failures open the breaker
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.Fetch(ctx, weatherQuery{}); errors.Is(err, errCircuitOpen) {
+			t.Fatalf("breaker opened after only %d failures", i)
+		}
+	}
+	if breaker.State() != breakerOpen {
+		t.Fatalf("Expected open breaker, got %s", breaker.State())
+	}
+
+	// while open, calls fail fast without reaching the provider
+	if _, err := breaker.Fetch(ctx, weatherQuery{}); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Expected errCircuitOpen, got %v", err)
+	}
+	if provider.Calls() != 3 {
+		t.Errorf("Expected 3 provider calls, got %d", provider.Calls())
+	}
+
+	// not until the cooldown is over
+	clock.Advance(19 * time.Second)
+	if _, err := breaker.Fetch(ctx, weatherQuery{}); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Expected errCircuitOpen before the cooldown ends, got %v", err)
+	}
+
+	// a failed half-open probe re-opens the breaker
+	clock.Advance(time.Second)
+	if _, err := breaker.Fetch(ctx, weatherQuery{}); errors.Is(err, errCircuitOpen) {
+		t.Fatal("Expected a probe after the cooldown")
+	}
+	if breaker.State() != breakerOpen {
+		t.Fatalf("Expected breaker to re-open, got %s", breaker.State())
+	}
+
+	// a successful half-open probe closes it
+	failing = false
+	clock.Advance(20 * time.Second)
+	if _, err := breaker.Fetch(ctx, weatherQuery{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if breaker.State() != breakerClosed {
+		t.Fatalf("Expected closed breaker, got %s", breaker.State())
+	}
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		return nil, errInvalidAPIKey
+	}}
+	breaker := newCircuitBreaker(provider, 1, time.Minute, realClock{})
+	for i := 0; i < 3; i++ {
+		_, _ = breaker.Fetch(context.Background(), weatherQuery{})
+	}
+	if breaker.State() != breakerClosed {
+		t.Errorf("Expected closed breaker, got %s", breaker.State())
+	}
+}
+
+func TestCircuitBreakerHandlerFastFail(t *testing.T) {
+	provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		return nil, &upstreamError{StatusCode: http.StatusServiceUnavailable}
+	}}
+	cfg := defaultConfig()
+	cfg.Provider = newCircuitBreaker(provider, 1, time.Minute, cfg.Clock)
+	cfg.Coalescer = newCoalescer(0)
+	withConfig(t, cfg)
+
+	for _, expected := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if w.Code != expected {
+			t.Errorf("Expected %d, got %d", expected, w.Code)
+		}
+	}
+	if provider.Calls() != 1 {
+		t.Errorf("Expected 1 provider call, got %d", provider.Calls())
+	}
+}
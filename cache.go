@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries - once the cache grows past this we sweep out expired entries on insert
+const maxCacheEntries = 10000
+
+// cacheEntry - a cached provider response
+type cacheEntry struct {
+	data      *WeatherData
+	fetchedAt time.Time
+	ttl       time.Duration // the cache's ttl, jittered for this entry
+}
+
+// maxCacheTTLJitter - the most CACHE_TTL_JITTER_PERCENT may be, so no entry's ttl is cut to nothing
+const maxCacheTTLJitter = 50
+
+// jitteredTTL - ttl moved up or down by a random amount of up to percent of it
+// Entries stored together (e.g. after a restart) then expire at different times, rather than all sending
+// their next request to the provider at once.
+func jitteredTTL(ttl time.Duration, percent int) time.Duration {
+	if percent <= 0 || ttl <= 0 {
+		return ttl
+	}
+	spread := int64(ttl) * int64(percent) / 100
+	return ttl + time.Duration(rand.Int64N(2*spread+1)-spread)
+}
+
+// trendWindow - a previous reading older than this is too old to say which way the temperature is going
+const trendWindow = time.Hour
+
+// reading - a temperature observed at a point in time
+type reading struct {
+	temp float64
+	at   time.Time
+}
+
+// readingPair - the latest reading for a key and the one before it
+type readingPair struct {
+	latest   reading
+	previous *reading
+}
+
+// Cache - somewhere provider responses are kept between requests
+// Entries are fresh for the backend's ttl, then may be served as stale for a further stale window.  The
+// backend also remembers the temperatures it was given, for the trend.  Backends log their own errors; a
+// cache that is unavailable just misses.
+type Cache interface {
+	// Get - look up an entry.  stale is true when the entry is past its ttl but still within the stale window.
+	Get(ctx context.Context, key string) (data *WeatherData, stale bool, ok bool)
+	// Set - store a freshly fetched entry
+	Set(ctx context.Context, key string, data *WeatherData)
+	// Previous - the temperature fetched before the latest one for key, if there is one within trendWindow
+	Previous(ctx context.Context, key string) (temp float64, ok bool)
+	// Len - the number of entries held (fresh or stale)
+	Len(ctx context.Context) (int, error)
+	// GetResult - look up a stored response (e.g. a batch's, by its Idempotency-Key)
+	GetResult(ctx context.Context, key string) (body []byte, ok bool)
+	// SetResult - store a response for ttl
+	SetResult(ctx context.Context, key string, body []byte, ttl time.Duration)
+}
+
+// storedResult - a response kept for replay until it expires
+type storedResult struct {
+	body    []byte
+	expires time.Time
+}
+
+// weatherCache - in-memory Cache of provider responses, the default backend
+// Entries are fresh for ttl, then retained for a further staleWindow so that they can be served if the
+// provider is unavailable.  The last two temperatures fetched for each key are kept (for up to trendWindow)
+// independently of the entries, so the trend survives an entry expiring.
+type weatherCache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	ttlJitter   int // CACHE_TTL_JITTER_PERCENT
+	staleWindow time.Duration
+	clock       Clock
+	entries     map[string]cacheEntry
+	readings    map[string]readingPair
+	results     map[string]storedResult
+}
+
+// newWeatherCache - create an empty cache, aging its entries by clock
+func newWeatherCache(ttl, staleWindow time.Duration, clock Clock) *weatherCache {
+	return &weatherCache{
+		ttl:         ttl,
+		staleWindow: staleWindow,
+		clock:       clock,
+		entries:     make(map[string]cacheEntry),
+		readings:    make(map[string]readingPair),
+		results:     make(map[string]storedResult),
+	}
+}
+
+// cacheKey - a key shared by nearby lookups, so they share an entry
+// By default coordinates are rounded to two decimal places (roughly 1km, though the cells narrow towards
+// the poles); CACHE_KEY_STRATEGY=geohash uses geohash cells instead, which stay closer to square.
+// Historical lookups are also keyed by their timestamp.  Lookups made for a request with its own API key use
+// requestCacheKey.
+func cacheKey(q weatherQuery) string {
+	key := fmt.Sprintf("%.2f,%.2f", q.Lat, q.Lon)
+	if config.CacheKeyStrategy == "geohash" {
+		key = geohash(q.Lat, q.Lon, config.GeohashPrecision)
+	}
+	if !q.At.IsZero() {
+		key += fmt.Sprintf("@%d", q.At.Unix())
+	}
+	return key
+}
+
+// requestCacheKey - the cache (and coalescer) key for q, looked up for a request with ctx
+func requestCacheKey(ctx context.Context, q weatherQuery) string {
+	return cacheKey(q) + apiKeyScope(ctx)
+}
+
+// Get - look up an entry.  stale is true when the entry is past its ttl but still within the stale window.
+func (c *weatherCache) Get(_ context.Context, key string) (data *WeatherData, stale bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[key]
+	if !found {
+		return nil, false, false
+	}
+	age := c.clock.Now().Sub(entry.fetchedAt)
+	if age < entry.ttl {
+		return entry.data, false, true
+	}
+	if age < entry.ttl+c.staleWindow {
+		return entry.data, true, true
+	}
+	delete(c.entries, key)
+	return nil, false, false
+}
+
+// Len - the number of entries held (fresh or stale)
+func (c *weatherCache) Len(_ context.Context) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), nil
+}
+
+// Set - store a freshly fetched entry
+func (c *weatherCache) Set(_ context.Context, key string, data *WeatherData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxCacheEntries {
+		for k, entry := range c.entries {
+			if c.clock.Now().Sub(entry.fetchedAt) >= entry.ttl+c.staleWindow {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.readings) >= maxCacheEntries {
+		for k, pair := range c.readings {
+			if c.clock.Now().Sub(pair.latest.at) >= trendWindow {
+				delete(c.readings, k)
+			}
+		}
+	}
+
+	now := c.clock.Now()
+	c.entries[key] = cacheEntry{data: data, fetchedAt: now, ttl: jitteredTTL(c.ttl, c.ttlJitter)}
+
+	pair := readingPair{latest: reading{temp: data.Main.Temperature, at: now}}
+	if last, ok := c.readings[key]; ok && now.Sub(last.latest.at) < trendWindow {
+		pair.previous = &last.latest
+	}
+	c.readings[key] = pair
+}
+
+// Previous - the temperature fetched before the latest one for key, if there is one within trendWindow
+func (c *weatherCache) Previous(_ context.Context, key string) (temp float64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pair, found := c.readings[key]
+	if !found || pair.previous == nil || c.clock.Now().Sub(pair.previous.at) >= trendWindow {
+		return 0, false
+	}
+	return pair.previous.temp, true
+}
+
+// GetResult - look up a stored response
+func (c *weatherCache) GetResult(_ context.Context, key string) (body []byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result, found := c.results[key]
+	if !found {
+		return nil, false
+	}
+	if !c.clock.Now().Before(result.expires) {
+		delete(c.results, key)
+		return nil, false
+	}
+	return result.body, true
+}
+
+// SetResult - store a response for ttl
+func (c *weatherCache) SetResult(_ context.Context, key string, body []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	if len(c.results) >= maxCacheEntries {
+		for k, result := range c.results {
+			if !now.Before(result.expires) {
+				delete(c.results, k)
+			}
+		}
+	}
+	c.results[key] = storedResult{body: body, expires: now.Add(ttl)}
+}
+
+// cacheStatus - where the data fetchWeather returned came from, as reported in the X-Cache header
+type cacheStatus string
+
+const (
+	cacheHit   cacheStatus = "HIT"   // a fresh cache entry
+	cacheMiss  cacheStatus = "MISS"  // the provider
+	cacheStale cacheStatus = "STALE" // an entry past its ttl, because the provider failed
+)
+
+// errObservationTooOld - the provider's observation is older than MAX_OBSERVATION_AGE_SECONDS
+var errObservationTooOld = errors.New("weather observation is too old")
+
+// checkObservationAge - errObservationTooOld if data was observed longer ago than config.MaxObservedAge
+// Historical lookups are old by design, and data without an observation time can't be judged, so both pass.
+func checkObservationAge(q weatherQuery, data *WeatherData) error {
+	if config.MaxObservedAge <= 0 || !q.At.IsZero() || data.Observed == 0 {
+		return nil
+	}
+	age := config.Clock.Now().Sub(time.Unix(data.Observed, 0))
+	if age > config.MaxObservedAge {
+		return fmt.Errorf("%w: observed %s ago (limit %s)", errObservationTooOld, age.Truncate(time.Second),
+			config.MaxObservedAge)
+	}
+	return nil
+}
+
+// fetchWeather - get weather for q from the cache, falling back to the provider
+// If the provider fails and we hold a stale entry, the stale entry is returned with status cacheStale.  An
+// entry whose observation has grown too old since it was cached is not served at all.
+func fetchWeather(ctx context.Context, q weatherQuery) (data *WeatherData, status cacheStatus, err error) {
+	key := requestCacheKey(ctx, q)
+	cached, cachedStale, found := config.Cache.Get(ctx, key)
+	if found && checkObservationAge(q, cached) != nil {
+		found = false
+	}
+	if found && !cachedStale {
+		metrics.cacheHits.Add(1)
+		return cached, cacheHit, nil
+	}
+	metrics.cacheMisses.Add(1)
+
+	data, _, err = refreshWeather(ctx, key, q)
+	if err != nil {
+		if found {
+			slog.Warn("serving stale weather", "key", key, "error", err)
+			return cached, cacheStale, nil
+		}
+		return nil, cacheMiss, err
+	}
+	return data, cacheMiss, nil
+}
+
+// refreshWeather - fetch q from the provider (sharing any in-flight fetch for key) and cache the result
+// An observation older than MAX_OBSERVATION_AGE_SECONDS is an error, and isn't cached.
+func refreshWeather(ctx context.Context, key string, q weatherQuery) (data *WeatherData, coalesced bool, err error) {
+	// the shared fetch must not be cancelled just because the request that started it goes away, but it
+	// does keep to that request's time budget
+	data, coalesced, err = config.Coalescer.Do(key, func() (*WeatherData, error) {
+		metrics.upstreamRequests.Add(1)
+		fetchCtx := context.WithoutCancel(ctx)
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			fetchCtx, cancel = context.WithDeadline(fetchCtx, deadline)
+			defer cancel()
+		}
+		data, err := config.Provider.Fetch(fetchCtx, q)
+		if err == nil {
+			data.FetchedAt = config.Clock.Now()
+		}
+		return data, err
+	})
+	if coalesced {
+		metrics.coalescedRequests.Add(1)
+	}
+	if err == nil {
+		if err = checkObservationAge(q, data); err != nil {
+			return nil, coalesced, err
+		}
+	}
+	if err == nil && !coalesced {
+		config.Cache.Set(ctx, key, data)
+	}
+	return data, coalesced, err
+}
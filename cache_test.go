@@ -0,0 +1,594 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// backdate - age a cache entry as if it had been fetched d ago
+func backdate(c *weatherCache, key string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[key]
+	entry.fetchedAt = entry.fetchedAt.Add(-d)
+	c.entries[key] = entry
+}
+
+func TestCacheKey(t *testing.T) {
+	if key := cacheKey(weatherQuery{Lat: 37.77491, Lon: -122.41942}); key != "37.77,-122.42" {
+		t.Errorf("Expected '37.77,-122.42', got '%s'", key)
+	}
+	if cacheKey(weatherQuery{Lat: 37.771, Lon: -122.419}) != cacheKey(weatherQuery{Lat: 37.774, Lon: -122.421}) {
+		t.Error("Expected nearby coordinates to share a cache key")
+	}
+}
+
+func TestGeohash(t *testing.T) {
+	// the canonical example from the geohash documentation
+	if hash := geohash(57.64911, 10.40744, 11); hash != "u4pruydqqvj" {
+		t.Errorf("Expected 'u4pruydqqvj', got '%s'", hash)
+	}
+	if hash := geohash(37.7749, -122.4194, 4); len(hash) != 4 {
+		t.Errorf("Expected a 4 character geohash, got '%s'", hash)
+	}
+}
+
+func TestGeohashCacheKey(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CacheKeyStrategy = "geohash"
+	cfg.GeohashPrecision = 5 // cells of roughly 5km by 5km
+	withConfig(t, cfg)
+
+	// a few hundred meters apart, in the middle of the same cell
+	if cacheKey(weatherQuery{Lat: 37.7749, Lon: -122.4194}) != cacheKey(weatherQuery{Lat: 37.7760, Lon: -122.4170}) {
+		t.Error("Expected nearby coordinates to share a geohash bucket")
+	}
+	// San Francisco and Oakland
+	if cacheKey(weatherQuery{Lat: 37.7749, Lon: -122.4194}) == cacheKey(weatherQuery{Lat: 37.8044, Lon: -122.2712}) {
+		t.Error("Expected distant coordinates to fall in different geohash buckets")
+	}
+	if key := cacheKey(weatherQuery{Lat: 37.7749, Lon: -122.4194}); key != "9q8yy" {
+		t.Errorf("Expected '9q8yy', got '%s'", key)
+	}
+	at := time.Unix(1700000000, 0)
+	if key := cacheKey(weatherQuery{Lat: 37.7749, Lon: -122.4194, At: at}); key != "9q8yy@1700000000" {
+		t.Errorf("Expected historical lookups to keep their timestamp, got '%s'", key)
+	}
+}
+
+func TestCacheTTLJitter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Within the jittered range", func(t *testing.T) {
+		c := newWeatherCache(100*time.Second, 0, realClock{})
+		c.ttlJitter = 10
+		ttls := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("k%d", i)
+			c.Set(ctx, key, &WeatherData{})
+			ttl := c.entries[key].ttl
+			if ttl < 90*time.Second || ttl > 110*time.Second {
+				t.Fatalf("Expected a ttl between 90s and 110s, got %v", ttl)
+			}
+			ttls[ttl] = true
+		}
+		if len(ttls) < 2 {
+			t.Error("Expected the ttls to be spread out")
+		}
+	})
+
+	t.Run("No jitter", func(t *testing.T) {
+		c := newWeatherCache(100*time.Second, 0, realClock{})
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("k%d", i)
+			c.Set(ctx, key, &WeatherData{})
+			if ttl := c.entries[key].ttl; ttl != 100*time.Second {
+				t.Fatalf("Expected exactly 100s, got %v", ttl)
+			}
+		}
+	})
+
+	t.Run("Entries expire at their own ttl", func(t *testing.T) {
+		c := newWeatherCache(100*time.Second, 0, realClock{})
+		c.Set(ctx, "k", &WeatherData{})
+		c.mu.Lock()
+		entry := c.entries["k"]
+		entry.ttl = 50 * time.Second
+		c.entries["k"] = entry
+		c.mu.Unlock()
+		backdate(c, "k", 60*time.Second)
+		if _, _, ok := c.Get(ctx, "k"); ok {
+			t.Error("Expected the entry to have expired at its jittered ttl")
+		}
+	})
+
+	t.Run("Config", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("CACHE_TTL_JITTER_PERCENT")
+		})
+		_ = os.Setenv("CACHE_TTL_JITTER_PERCENT", "20")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cache := cfg.Cache.(*weatherCache); cache.ttlJitter != 20 {
+			t.Errorf("Expected 20%% jitter, got %d", cache.ttlJitter)
+		}
+		for _, raw := range []string{"-1", "51", "lots"} {
+			_ = os.Setenv("CACHE_TTL_JITTER_PERCENT", raw)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected error for CACHE_TTL_JITTER_PERCENT=%s", raw)
+			}
+		}
+	})
+}
+
+func TestWeatherCache(t *testing.T) {
+	data := &WeatherData{}
+
+	t.Run("Fresh entry", func(t *testing.T) {
+		c := newWeatherCache(time.Minute, time.Minute, realClock{})
+		c.Set(context.Background(), "k", data)
+		got, stale, ok := c.Get(context.Background(), "k")
+		if !ok || stale || got != data {
+			t.Errorf("Expected fresh hit, got ok=%v stale=%v", ok, stale)
+		}
+	})
+
+	t.Run("Stale entry", func(t *testing.T) {
+		clock := newFakeClock()
+		c := newWeatherCache(time.Minute, time.Minute, clock)
+		c.Set(context.Background(), "k", data)
+		clock.Advance(90 * time.Second)
+		got, stale, ok := c.Get(context.Background(), "k")
+		if !ok || !stale || got != data {
+			t.Errorf("Expected stale hit, got ok=%v stale=%v", ok, stale)
+		}
+	})
+
+	t.Run("Expired entry", func(t *testing.T) {
+		clock := newFakeClock()
+		c := newWeatherCache(time.Minute, time.Minute, clock)
+		c.Set(context.Background(), "k", data)
+		clock.Advance(3 * time.Minute)
+		if _, _, ok := c.Get(context.Background(), "k"); ok {
+			t.Error("Expected miss for expired entry")
+		}
+		if len(c.entries) != 0 {
+			t.Error("Expected expired entry to be removed")
+		}
+	})
+
+	t.Run("TTL boundaries", func(t *testing.T) {
+		clock := newFakeClock()
+		c := newWeatherCache(time.Minute, 30*time.Second, clock)
+		c.Set(context.Background(), "k", data)
+
+		steps := []struct {
+			advance   time.Duration
+			ok, stale bool
+		}{
+			{59 * time.Second, true, false},
+			{time.Second, true, true}, // exactly the ttl
+			{29 * time.Second, true, true},
+			{time.Second, false, false}, // exactly ttl + stale window
+		}
+		for _, step := range steps {
+			clock.Advance(step.advance)
+			age := clock.Now().Sub(c.entries["k"].fetchedAt)
+			if _, stale, ok := c.Get(context.Background(), "k"); ok != step.ok || stale != step.stale {
+				t.Errorf("at %s: expected ok=%v stale=%v, got ok=%v stale=%v", age, step.ok, step.stale, ok, stale)
+			}
+		}
+	})
+
+	t.Run("Missing entry", func(t *testing.T) {
+		c := newWeatherCache(time.Minute, time.Minute, realClock{})
+		if _, _, ok := c.Get(context.Background(), "k"); ok {
+			t.Error("Expected miss")
+		}
+	})
+
+	t.Run("Stored result", func(t *testing.T) {
+		clock := newFakeClock()
+		c := newWeatherCache(0, 0, clock)
+		c.SetResult(context.Background(), "r", []byte("body"), time.Minute)
+		if body, ok := c.GetResult(context.Background(), "r"); !ok || string(body) != "body" {
+			t.Errorf("Expected the stored result, got %q (%v)", body, ok)
+		}
+		clock.Advance(time.Minute)
+		if _, ok := c.GetResult(context.Background(), "r"); ok {
+			t.Error("Expected the result to have expired")
+		}
+	})
+}
+
+func TestStaleWhileError(t *testing.T) {
+	const target = "/weather?lat=37.77&lon=-122.42"
+	key := cacheKey(weatherQuery{Lat: 37.77, Lon: -122.42})
+
+	setup := func(t *testing.T) (*mockProvider, *bool) {
+		failing := false
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			if failing {
+				return nil, fmt.Errorf("provider down")
+			}
+			return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`), nil
+		}}
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		cfg.Cache = newWeatherCache(time.Minute, 10*time.Minute, cfg.Clock)
+		cfg.Coalescer = newCoalescer(0)
+		withConfig(t, cfg)
+		return provider, &failing
+	}
+
+	t.Run("Fresh hit", func(t *testing.T) {
+		provider, _ := setup(t)
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", w.Code)
+			}
+			if w.Header().Get("X-Weather-Stale") != "" {
+				t.Error("Fresh response should not be marked stale")
+			}
+		}
+		if provider.Calls() != 1 {
+			t.Errorf("Expected 1 provider call, got %d", provider.Calls())
+		}
+	})
+
+	t.Run("Stale served when provider errors", func(t *testing.T) {
+		_, failing := setup(t)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		backdate(config.Cache.(*weatherCache), key, 2*time.Minute)
+		*failing = true
+
+		w = httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w.Header().Get("X-Weather-Stale") != "true" {
+			t.Error("Expected X-Weather-Stale: true")
+		}
+	})
+
+	t.Run("Hard failure without cache entry", func(t *testing.T) {
+		_, failing := setup(t)
+		*failing = true
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("Expected 500, got %d", w.Code)
+		}
+	})
+}
+
+func TestCacheStatus(t *testing.T) {
+	const target = "/weather?lat=37.77&lon=-122.42&format=json"
+	failing := false
+	provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		if failing {
+			return nil, fmt.Errorf("provider down")
+		}
+		return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`), nil
+	}}
+	clock := newFakeClock()
+	cache := newWeatherCache(time.Minute, 10*time.Minute, clock)
+	cfg := defaultConfig()
+	cfg.Provider = provider
+	cfg.Cache = cache
+	cfg.Coalescer = newCoalescer(0)
+	cfg.Clock = clock
+	withConfig(t, cfg)
+
+	get := func(t *testing.T) (*httptest.ResponseRecorder, WeatherResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		var response WeatherResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("bad json response: %v", err)
+		}
+		return w, response
+	}
+
+	var etag string
+	t.Run("Miss", func(t *testing.T) {
+		w, response := get(t)
+		if w.Header().Get("X-Cache") != "MISS" || response.Cached || response.CacheAge != nil {
+			t.Errorf("Expected a miss, got %q %t %v", w.Header().Get("X-Cache"), response.Cached, response.CacheAge)
+		}
+		etag = w.Header().Get("ETag")
+	})
+
+	t.Run("Hit within the ttl", func(t *testing.T) {
+		clock.Advance(30 * time.Second)
+		w, response := get(t)
+		if w.Header().Get("X-Cache") != "HIT" || !response.Cached {
+			t.Errorf("Expected a hit, got %q %t", w.Header().Get("X-Cache"), response.Cached)
+		}
+		if response.CacheAge == nil || *response.CacheAge != 30 {
+			t.Errorf("Expected a cache age of 30s, got %v", response.CacheAge)
+		}
+		if w.Header().Get("ETag") != etag {
+			t.Errorf("Expected the ETag not to depend on the cache, got %s and %s", etag, w.Header().Get("ETag"))
+		}
+		if provider.Calls() != 1 {
+			t.Errorf("Expected 1 provider call, got %d", provider.Calls())
+		}
+	})
+
+	t.Run("Stale within the stale window", func(t *testing.T) {
+		clock.Advance(2 * time.Minute)
+		failing = true
+		w, response := get(t)
+		if w.Header().Get("X-Cache") != "STALE" || w.Header().Get("X-Weather-Stale") != "true" || !response.Cached {
+			t.Errorf("Expected a stale hit, got %q %t", w.Header().Get("X-Cache"), response.Cached)
+		}
+		if response.CacheAge == nil || *response.CacheAge != 150 {
+			t.Errorf("Expected a cache age of 150s, got %v", response.CacheAge)
+		}
+	})
+}
+
+func TestMaxObservationAge(t *testing.T) {
+	const target = "/weather?lat=37.77&lon=-122.42&format=json"
+	clock := newFakeClock()
+	// observedAt - when the provider says its observation was made
+	var observedAt time.Time
+	failing := false
+	provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		if failing {
+			return nil, fmt.Errorf("provider down")
+		}
+		return weatherDataFromJSON(t, fmt.Sprintf(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20},"dt":%d}`,
+			observedAt.Unix())), nil
+	}}
+	setup := func(t *testing.T, maxAge time.Duration) {
+		t.Helper()
+		cache := newWeatherCache(time.Minute, 30*time.Minute, clock)
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		cfg.Cache = cache
+		cfg.Coalescer = newCoalescer(0)
+		cfg.Clock = clock
+		cfg.MaxObservedAge = maxAge
+		withConfig(t, cfg)
+		failing = false
+	}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		setup(t, defaultConfig().MaxObservedAge)
+		observedAt = clock.Now().Add(-24 * time.Hour)
+		if w := get(); w.Code != http.StatusOK {
+			t.Errorf("Expected a day-old observation to be served without a limit, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Fresh observation", func(t *testing.T) {
+		setup(t, time.Hour)
+		observedAt = clock.Now().Add(-10 * time.Minute)
+		if w := get(); w.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Over-age observation", func(t *testing.T) {
+		setup(t, time.Hour)
+		observedAt = clock.Now().Add(-2 * time.Hour)
+		calls := provider.Calls()
+		w := get()
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected 503, got %d: %s", w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), "weather observation is too old: observed 2h0m0s ago (limit 1h0m0s)") {
+			t.Errorf("Expected a note on the observation's age, got %q", w.Body.String())
+		}
+		// it wasn't cached, so the next request asks the provider again
+		_ = get()
+		if provider.Calls() != calls+2 {
+			t.Errorf("Expected the over-age observation not to be cached, got %d provider calls", provider.Calls()-calls)
+		}
+	})
+
+	t.Run("Cached observation ages past the limit", func(t *testing.T) {
+		setup(t, time.Hour)
+		observedAt = clock.Now().Add(-50 * time.Minute)
+		if w := get(); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+
+		// still fresh in the cache, but the provider is down and the observation now 70 minutes old
+		clock.Advance(20 * time.Minute)
+		failing = true
+		calls := provider.Calls()
+		w := get()
+		if w.Code == http.StatusOK {
+			t.Errorf("Expected the cached over-age observation not to be served, got %d: %s", w.Code, w.Body.String())
+		}
+		if provider.Calls() != calls+1 {
+			t.Errorf("Expected the provider to be asked for a newer observation")
+		}
+	})
+
+	t.Run("Stale but within the limit", func(t *testing.T) {
+		setup(t, time.Hour)
+		observedAt = clock.Now().Add(-10 * time.Minute)
+		if w := get(); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+
+		// past the cache ttl, and the provider's latest observation is older than the one we hold
+		clock.Advance(5 * time.Minute)
+		observedAt = clock.Now().Add(-3 * time.Hour)
+		w := get()
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "STALE" {
+			t.Errorf("Expected the stale entry in place of the over-age observation, got %d %q", w.Code,
+				w.Header().Get("X-Cache"))
+		}
+	})
+}
+
+func TestTemperatureTrend(t *testing.T) {
+	const target = "/weather?lat=37.77&lon=-122.42&format=json"
+
+	// each request fetches afresh (no caching), seeing the next temperature in temps
+	trends := func(t *testing.T, temps ...float64) []string {
+		var mu sync.Mutex
+		next := 0
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			data := weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}]}`)
+			data.Main.Temperature = temps[next]
+			next++
+			return data, nil
+		}}
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		cfg.Cache = newWeatherCache(0, 0, cfg.Clock)
+		cfg.Coalescer = newCoalescer(0)
+		cfg.Trend = true
+		withConfig(t, cfg)
+
+		var got []string
+		for range temps {
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+			var response WeatherResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("bad response: %v", err)
+			}
+			got = append(got, response.Trend)
+		}
+		return got
+	}
+
+	testCases := []struct {
+		name     string
+		temps    []float64
+		expected []string
+	}{
+		{"Rising", []float64{10, 12}, []string{"", "rising"}},
+		{"Falling", []float64{10, 8.5}, []string{"", "falling"}},
+		{"Steady within threshold", []float64{10, 10.4}, []string{"", "steady"}},
+		{"Compares with the previous reading only", []float64{10, 12, 11}, []string{"", "rising", "falling"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := trends(t, tc.temps...); !slices.Equal(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`)
+		config.Cache = newWeatherCache(0, 0, config.Clock)
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if strings.Contains(w.Body.String(), "trend") {
+				t.Errorf("Expected no trend, got %s", w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Old readings are forgotten", func(t *testing.T) {
+		clock := newFakeClock()
+		c := newWeatherCache(time.Minute, 0, clock)
+		c.Set(context.Background(), "k", &WeatherData{})
+		clock.Advance(2 * trendWindow)
+		c.Set(context.Background(), "k", &WeatherData{})
+		if _, ok := c.Previous(context.Background(), "k"); ok {
+			t.Error("Expected no previous reading")
+		}
+	})
+}
+
+func TestConcurrentWeatherRequests(t *testing.T) {
+	// each location's temperature is its latitude, so every response can be checked against its request
+	provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		return weatherDataFromJSON(t, fmt.Sprintf(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":%g}}`, q.Lat)), nil
+	}}
+	cfg := defaultConfig()
+	cfg.Provider = provider
+	cfg.Cache = newWeatherCache(time.Minute, time.Minute, cfg.Clock)
+	cfg.Trend = true
+	withConfig(t, cfg)
+	mux := http.NewServeMux()
+	setupRoutes(mux, cfg)
+
+	const workers, requests, locations = 16, 50, 5
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*requests)
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				// overlapping locations, plus one only this worker asks for
+				lat := float64((worker + i) % locations)
+				if i%10 == 0 {
+					lat = float64(10 + worker)
+				}
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/weather?lat=%g&lon=1&format=json", lat), nil))
+				if w.Code != http.StatusOK {
+					errs <- fmt.Errorf("lat %g: expected 200, got %d", lat, w.Code)
+					continue
+				}
+				// ... while the counters are being read
+				if i%7 == 0 {
+					for _, target := range []string{"/stats", "/metrics", "/health?verbose=true"} {
+						mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+					}
+				}
+				var response WeatherResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+					errs <- err
+					continue
+				}
+				if response.TemperatureC != lat {
+					errs <- fmt.Errorf("lat %g: got the weather for %g", lat, response.TemperatureC)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// the overlapping locations were fetched once each (plus one per worker-only location)
+	if entries, _ := config.Cache.Len(context.Background()); entries != locations+workers {
+		t.Errorf("Expected %d cache entries, got %d", locations+workers, entries)
+	}
+	if calls := provider.Calls(); calls > locations+workers {
+		t.Errorf("Expected at most %d provider calls, got %d", locations+workers, calls)
+	}
+}
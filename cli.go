@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Exit codes for the command line subcommands
+const (
+	exitOK      = 0
+	exitFailure = 1 // the weather couldn't be fetched, or a check failed
+	exitUsage   = 2 // bad arguments, as the flag package uses
+)
+
+// fetchArgs - the arguments to the fetch subcommand
+type fetchArgs struct {
+	Lat    float64
+	Lon    float64
+	Format string // text, json or xml
+	Units  string // metric, imperial or standard; empty to show both Fahrenheit and Celsius
+}
+
+// parseFetchArgs - parse and validate the fetch subcommand's flags (e.g. --lat 40.7 --lon -74)
+// Problems are reported on stderr, followed by the usage.
+func parseFetchArgs(args []string, stderr io.Writer) (fetchArgs, error) {
+	flags := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	lat := flags.String("lat", "", "latitude, -90 to 90 (required)")
+	lon := flags.String("lon", "", "longitude, -180 to 180 (required)")
+	format := flags.String("format", "text", "text, json or xml")
+	units := flags.String("units", "", "metric, imperial or standard")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintln(flags.Output(), "Usage: weather-service fetch --lat <latitude> --lon <longitude> [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return fetchArgs{}, err // already reported by the flag set
+	}
+
+	parsed, err := validateFetchArgs(flags, *lat, *lon, *format, *units)
+	if err != nil {
+		_, _ = fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		return fetchArgs{}, err
+	}
+	return parsed, nil
+}
+
+// validateFetchArgs - check the fetch flags with the same rules the http endpoint uses
+func validateFetchArgs(flags *flag.FlagSet, lat, lon, format, units string) (fetchArgs, error) {
+	var parsed fetchArgs
+	var err error
+	if flags.NArg() > 0 {
+		return parsed, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	if lat == "" || lon == "" {
+		return parsed, errors.New("--lat and --lon are required")
+	}
+	if parsed.Lat, err = validateLatitude(lat); err != nil {
+		return parsed, err
+	}
+	if parsed.Lon, err = validateLongitude(lon); err != nil {
+		return parsed, err
+	}
+	if parsed.Format, err = validateFormat(format); err != nil {
+		return parsed, err
+	}
+	if parsed.Units, err = validateUnits(units); err != nil {
+		return parsed, err
+	}
+	return parsed, nil
+}
+
+// runFetch - the fetch subcommand: get the weather once, print it to stdout and return the exit code
+// This goes through the configured provider chain and formatting, just as GET /weather does.
+func runFetch(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	parsed, err := parseFetchArgs(args, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		return exitUsage
+	}
+
+	weatherData, _, err := fetchWeather(ctx, weatherQuery{Lat: parsed.Lat, Lon: parsed.Lon})
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "weather-service fetch: %v\n", err)
+		return exitFailure
+	}
+	response := newWeatherResponse(weatherData, responseOptions{Units: parsed.Units})
+	body, _, err := encodeWeatherResponse(parsed.Format, response, "")
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "weather-service fetch: error encoding the response: %v\n", err)
+		return exitFailure
+	}
+	if parsed.Format == "text" {
+		body = append(body, '\n')
+	}
+	if _, err := stdout.Write(body); err != nil {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// checkLat, checkLon - where the check subcommand asks the provider for the weather (Greenwich)
+const (
+	checkLat = 51.4779
+	checkLon = -0.0015
+)
+
+// checkTimeout - how long the check subcommand waits for the provider
+const checkTimeout = 15 * time.Second
+
+// runCheck - the check subcommand: load the configuration, validate the API key and make one provider
+// request, printing PASS or FAIL for each to stdout and returning the exit code
+// Nothing is served, so this works as a container pre-start check or a CI smoke test.  load is how the
+// configuration is read (loadConfig outside of tests).
+func runCheck(ctx context.Context, args []string, stdout io.Writer, load func() (*Config, error)) int {
+	if len(args) > 0 {
+		_, _ = fmt.Fprintf(stdout, "Usage: weather-service check\nunexpected arguments: %s\n", strings.Join(args, " "))
+		return exitUsage
+	}
+	failed := false
+	report := func(name string, err error) {
+		if err != nil {
+			failed = true
+			_, _ = fmt.Fprintf(stdout, "FAIL  %s: %v\n", name, err)
+			return
+		}
+		_, _ = fmt.Fprintf(stdout, "PASS  %s\n", name)
+	}
+
+	cfg, err := load()
+	report("configuration", err)
+	if err != nil {
+		return exitFailure // the other checks need the configuration
+	}
+	config = cfg
+
+	_, err = getAPIKey(ctx)
+	report("api key", err)
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	_, err = config.Provider.Fetch(ctx, weatherQuery{Lat: checkLat, Lon: checkLon})
+	report("provider", err)
+
+	if failed {
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseFetchArgs(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		var stderr bytes.Buffer
+		parsed, err := parseFetchArgs([]string{"--lat", "40.7", "--lon=-74", "--format", "JSON", "--units", "metric"}, &stderr)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected := fetchArgs{Lat: 40.7, Lon: -74, Format: "json", Units: "metric"}
+		if parsed != expected {
+			t.Errorf("Expected %+v, got %+v", expected, parsed)
+		}
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		parsed, err := parseFetchArgs([]string{"-lat", "1", "-lon", "2"}, &bytes.Buffer{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if parsed.Format != "text" || parsed.Units != "" {
+			t.Errorf("Expected text and no units, got %+v", parsed)
+		}
+	})
+
+	t.Run("Help", func(t *testing.T) {
+		var stderr bytes.Buffer
+		if _, err := parseFetchArgs([]string{"--help"}, &stderr); !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("Expected flag.ErrHelp, got %v", err)
+		}
+		if !strings.Contains(stderr.String(), "Usage: weather-service fetch") {
+			t.Errorf("Expected the usage, got %q", stderr.String())
+		}
+	})
+
+	testCases := map[string][]string{
+		"Missing lon":        {"--lat", "1"},
+		"Unknown flag":       {"--lat", "1", "--lon", "2", "--zip", "10001"},
+		"Extra arguments":    {"--lat", "1", "--lon", "2", "now"},
+		"Latitude too large": {"--lat", "91", "--lon", "2"},
+		"Bad longitude":      {"--lat", "1", "--lon", "east"},
+		"Bad format":         {"--lat", "1", "--lon", "2", "--format", "yaml"},
+		"Bad units":          {"--lat", "1", "--lon", "2", "--units", "rankine"},
+	}
+	for name, args := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			if _, err := parseFetchArgs(args, &stderr); err == nil {
+				t.Error("Expected an error")
+			}
+			if !strings.Contains(stderr.String(), "Usage:") {
+				t.Errorf("Expected the usage on stderr, got %q", stderr.String())
+			}
+		})
+	}
+}
+
+func TestRunFetch(t *testing.T) {
+	t.Run("Text", func(t *testing.T) {
+		provider := useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25},"name":"Paris"}`)
+		var stdout, stderr bytes.Buffer
+		code := runFetch(context.Background(), []string{"--lat", "48.85", "--lon", "2.35"}, &stdout, &stderr)
+		if code != exitOK {
+			t.Fatalf("Expected exit code %d, got %d: %s", exitOK, code, stderr.String())
+		}
+		for _, expected := range []string{"Clear Sky", "Hot, 77°F (25°C)", "Paris"} {
+			if !strings.Contains(stdout.String(), expected) {
+				t.Errorf("Expected %q in %q", expected, stdout.String())
+			}
+		}
+		if !strings.HasSuffix(stdout.String(), "\n") {
+			t.Errorf("Expected a trailing newline: %q", stdout.String())
+		}
+		if provider.Calls() != 1 {
+			t.Errorf("Expected one provider call, got %d", provider.Calls())
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25}}`)
+		var stdout bytes.Buffer
+		if code := runFetch(context.Background(), []string{"--lat", "1", "--lon", "1", "--format", "json"}, &stdout,
+			&bytes.Buffer{}); code != exitOK {
+			t.Fatalf("Expected exit code %d, got %d", exitOK, code)
+		}
+		var response WeatherResponse
+		if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+			t.Fatalf("bad json output: %v", err)
+		}
+		if response.TemperatureC != 25 {
+			t.Errorf("Expected 25°C, got %+v", response)
+		}
+	})
+
+	t.Run("Invalid coordinates", func(t *testing.T) {
+		provider := useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25}}`)
+		var stdout, stderr bytes.Buffer
+		code := runFetch(context.Background(), []string{"--lat", "123", "--lon", "1"}, &stdout, &stderr)
+		if code != exitUsage {
+			t.Errorf("Expected exit code %d, got %d", exitUsage, code)
+		}
+		if stdout.Len() != 0 || !strings.Contains(stderr.String(), "latitude out of range") {
+			t.Errorf("Expected only the error on stderr, got %q and %q", stdout.String(), stderr.String())
+		}
+		if provider.Calls() != 0 {
+			t.Error("Expected no provider calls")
+		}
+	})
+
+	t.Run("Provider failure", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return nil, &upstreamError{StatusCode: 503}
+		}}
+		withConfig(t, cfg)
+		var stderr bytes.Buffer
+		if code := runFetch(context.Background(), []string{"--lat", "1", "--lon", "1"}, &bytes.Buffer{},
+			&stderr); code != exitFailure {
+			t.Errorf("Expected exit code %d, got %d", exitFailure, code)
+		}
+		if !strings.Contains(stderr.String(), "weather-service fetch:") {
+			t.Errorf("Expected the failure on stderr, got %q", stderr.String())
+		}
+	})
+}
+
+func TestRunCheck(t *testing.T) {
+	// useCheckConfig - have the check load a configuration using provider, with key as the API key
+	useCheckConfig := func(t *testing.T, key string, provider WeatherProvider) func() (*Config, error) {
+		t.Helper()
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", key)
+		withConfig(t, defaultConfig()) // restores the configuration the check replaces
+		return func() (*Config, error) {
+			cfg := defaultConfig()
+			cfg.Provider = provider
+			return cfg, nil
+		}
+	}
+	clearSky := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":12}}`), nil
+	}}
+
+	t.Run("All pass", func(t *testing.T) {
+		load := useCheckConfig(t, "abcdef0123456789abcdef0123456789", clearSky)
+		var stdout bytes.Buffer
+		if code := runCheck(context.Background(), nil, &stdout, load); code != exitOK {
+			t.Errorf("Expected exit code %d, got %d: %s", exitOK, code, stdout.String())
+		}
+		for _, expected := range []string{"PASS  configuration", "PASS  api key", "PASS  provider"} {
+			if !strings.Contains(stdout.String(), expected) {
+				t.Errorf("Expected %q in %q", expected, stdout.String())
+			}
+		}
+		if strings.Contains(stdout.String(), "FAIL") {
+			t.Errorf("Expected no failures: %s", stdout.String())
+		}
+	})
+
+	t.Run("Invalid key", func(t *testing.T) {
+		load := useCheckConfig(t, "not-a-key", newOpenWeatherProvider("http://127.0.0.1:1"))
+		var stdout bytes.Buffer
+		if code := runCheck(context.Background(), nil, &stdout, load); code != exitFailure {
+			t.Errorf("Expected exit code %d, got %d", exitFailure, code)
+		}
+		for _, expected := range []string{"PASS  configuration", "FAIL  api key: " + ErrMalformedAPIKey.Error(),
+			"FAIL  provider"} {
+			if !strings.Contains(stdout.String(), expected) {
+				t.Errorf("Expected %q in %q", expected, stdout.String())
+			}
+		}
+	})
+
+	t.Run("Provider failure", func(t *testing.T) {
+		load := useCheckConfig(t, "abcdef0123456789abcdef0123456789", &mockProvider{
+			fetch: func(q weatherQuery) (*WeatherData, error) {
+				return nil, &upstreamError{StatusCode: 503}
+			}})
+		var stdout bytes.Buffer
+		if code := runCheck(context.Background(), nil, &stdout, load); code != exitFailure {
+			t.Errorf("Expected exit code %d, got %d", exitFailure, code)
+		}
+		if !strings.Contains(stdout.String(), "PASS  api key") || !strings.Contains(stdout.String(), "FAIL  provider") {
+			t.Errorf("Expected only the provider to fail: %s", stdout.String())
+		}
+	})
+
+	t.Run("Invalid configuration", func(t *testing.T) {
+		withConfig(t, defaultConfig())
+		var stdout bytes.Buffer
+		code := runCheck(context.Background(), nil, &stdout, func() (*Config, error) {
+			return nil, errors.New("invalid OCEAN_POLICY (want allow, annotate or reject): drown")
+		})
+		if code != exitFailure {
+			t.Errorf("Expected exit code %d, got %d", exitFailure, code)
+		}
+		if !strings.Contains(stdout.String(), "FAIL  configuration: invalid OCEAN_POLICY") ||
+			strings.Contains(stdout.String(), "api key") {
+			t.Errorf("Expected only the configuration failure: %s", stdout.String())
+		}
+	})
+
+	t.Run("Unexpected arguments", func(t *testing.T) {
+		var stdout bytes.Buffer
+		if code := runCheck(context.Background(), []string{"now"}, &stdout, loadConfig); code != exitUsage {
+			t.Errorf("Expected exit code %d, got %d", exitUsage, code)
+		}
+	})
+}
@@ -0,0 +1,17 @@
+package main
+
+import "time"
+
+// Clock - the source of the current time
+// Components that expire or reset things take a Clock, so tests can move time along instead of sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock - Clock reading the system time
+type realClock struct{}
+
+// Now - the current system time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
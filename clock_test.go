@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock - Clock that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// newFakeClock - a fakeClock starting at a fixed time
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance - move the clock forward by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	if !clock.Now().Equal(start) {
+		t.Error("Expected the fake clock to stand still")
+	}
+	clock.Advance(90 * time.Second)
+	if elapsed := clock.Now().Sub(start); elapsed != 90*time.Second {
+		t.Errorf("Expected 90s to pass, got %s", elapsed)
+	}
+}
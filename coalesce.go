@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// coalescedCall - an upstream fetch shared by every request for the same key within the window
+type coalescedCall struct {
+	done chan struct{}
+	data *WeatherData
+	err  error
+}
+
+// coalescer - share one upstream fetch between requests for the same key
+// Requests arriving while a fetch is in flight, or within window of it starting, wait for and share its
+// result rather than calling the provider again.
+type coalescer struct {
+	mu     sync.Mutex
+	window time.Duration
+	calls  map[string]*coalescedCall
+}
+
+// newCoalescer - create a coalescer with the given window
+func newCoalescer(window time.Duration) *coalescer {
+	return &coalescer{
+		window: window,
+		calls:  make(map[string]*coalescedCall),
+	}
+}
+
+// Do - run fn for key unless a call for key is already in flight or within the window.
+// coalesced reports whether the result came from another request's call.
+func (c *coalescer) Do(key string, fn func() (*WeatherData, error)) (data *WeatherData, coalesced bool, err error) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.data, true, call.err
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	started := time.Now()
+	call.data, call.err = fn()
+	close(call.done)
+
+	// keep the call joinable until the window (measured from the start of the call) has passed
+	forget := func() {
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mu.Unlock()
+	}
+	if remaining := c.window - time.Since(started); remaining > 0 {
+		time.AfterFunc(remaining, forget)
+	} else {
+		forget()
+	}
+	return call.data, false, call.err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	t.Run("Staggered requests within the window share one fetch", func(t *testing.T) {
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			time.Sleep(10 * time.Millisecond)
+			return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`), nil
+		}}
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		cfg.Cache = newWeatherCache(0, 0, cfg.Clock) // make sure the cache isn't what saves us
+		cfg.Coalescer = newCoalescer(200 * time.Millisecond)
+		withConfig(t, cfg)
+
+		before := metrics.coalescedRequests.Load()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.771&lon=-122.419", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("Expected 200, got %d", w.Code)
+				}
+			}()
+			time.Sleep(20 * time.Millisecond)
+		}
+		wg.Wait()
+
+		if provider.Calls() != 1 {
+			t.Errorf("Expected 1 upstream call, got %d", provider.Calls())
+		}
+		if coalesced := metrics.coalescedRequests.Load() - before; coalesced != 4 {
+			t.Errorf("Expected 4 coalesced requests, got %d", coalesced)
+		}
+	})
+
+	t.Run("Requests after the window fetch again", func(t *testing.T) {
+		c := newCoalescer(10 * time.Millisecond)
+		calls := 0
+		fetch := func() (*WeatherData, error) {
+			calls++
+			return &WeatherData{}, nil
+		}
+		if _, coalesced, _ := c.Do("k", fetch); coalesced {
+			t.Error("First call should not be coalesced")
+		}
+		time.Sleep(30 * time.Millisecond)
+		if _, coalesced, _ := c.Do("k", fetch); coalesced {
+			t.Error("Call after the window should not be coalesced")
+		}
+		if calls != 2 {
+			t.Errorf("Expected 2 calls, got %d", calls)
+		}
+	})
+
+	t.Run("Distinct keys are not coalesced", func(t *testing.T) {
+		c := newCoalescer(time.Second)
+		calls := 0
+		fetch := func() (*WeatherData, error) {
+			calls++
+			return &WeatherData{}, nil
+		}
+		c.Do("a", fetch)
+		c.Do("b", fetch)
+		if calls != 2 {
+			t.Errorf("Expected 2 calls, got %d", calls)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// compareQueryParams - the query parameters /weather/compare understands
+var compareQueryParams = []string{"lat1", "lon1", "lat2", "lon2", "units"}
+
+// locationWeather - the weather at one location, or why we couldn't get it (a side of a comparison, or an
+// item of a batch)
+type locationWeather struct {
+	Lat     float64          `json:"lat"`
+	Lon     float64          `json:"lon"`
+	Weather *WeatherResponse `json:"weather,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// ComparisonResponse - the weather at two locations, side by side
+// Warmer and DeltaC are only set when we have the weather at both.
+type ComparisonResponse struct {
+	First  locationWeather `json:"first"`
+	Second locationWeather `json:"second"`
+	Warmer string          `json:"warmer,omitempty"`  // first, second or equal
+	DeltaC *float64        `json:"delta_c,omitempty"` // first minus second, in Celsius
+}
+
+// compareWeatherHandler - GET /weather/compare?lat1=&lon1=&lat2=&lon2=, the weather at two locations
+// Both are fetched concurrently.  If only one fetch fails, the other is still returned, with a note saying
+// why the first is missing; if both fail, the request fails as /weather would.
+func compareWeatherHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectUnknownQueryParams(w, r, compareQueryParams) {
+		return
+	}
+
+	params := r.URL.Query()
+	var response ComparisonResponse
+	var ok bool
+	if response.First.Lat, response.First.Lon, ok = comparedCoordinates(w, params, "1"); !ok {
+		return
+	}
+	if response.Second.Lat, response.Second.Lon, ok = comparedCoordinates(w, params, "2"); !ok {
+		return
+	}
+	units, err := validateUnits(params.Get("units"))
+	if err != nil {
+		slog.Info("input error", "error", err)
+		http.Error(w, "Invalid units", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if config.RequestBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.RequestBudget)
+		defer cancel()
+	}
+
+	sides := []*locationWeather{&response.First, &response.Second}
+	data := make([]*WeatherData, len(sides))
+	errs := make([]error, len(sides))
+	var group errgroup.Group
+	for i, side := range sides {
+		group.Go(func() error {
+			data[i], _, errs[i] = fetchWeather(ctx, weatherQuery{Lat: side.Lat, Lon: side.Lon})
+			return nil // one failed location mustn't cancel the other
+		})
+	}
+	_ = group.Wait()
+	if errs[0] != nil && errs[1] != nil {
+		writeFetchError(w, errs[0])
+		return
+	}
+
+	for i, side := range sides {
+		if errs[i] != nil {
+			slog.Warn("comparison fetch failed", "lat", side.Lat, "lon", side.Lon, "error", errs[i])
+			metrics.countFetchError(errs[i])
+			side.Error = fetchErrorMessage(errs[i])
+			continue
+		}
+		weather := newWeatherResponse(data[i], responseOptions{Units: units})
+		side.Weather = &weather
+	}
+	if response.First.Weather != nil && response.Second.Weather != nil {
+		delta := roundTo(response.First.Weather.TemperatureC-response.Second.Weather.TemperatureC, 2)
+		response.DeltaC = &delta
+		switch {
+		case delta > 0:
+			response.Warmer = "first"
+		case delta < 0:
+			response.Warmer = "second"
+		default:
+			response.Warmer = "equal"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("error writing the response", "error", err)
+	}
+}
+
+// comparedCoordinates - validate one location's coordinates, lat<n> and lon<n>
+// On failure the error response has already been written and ok is false.
+func comparedCoordinates(w http.ResponseWriter, params url.Values, n string) (latitude, longitude float64, ok bool) {
+	latitude, err := validateLatitude(params.Get("lat" + n))
+	if err != nil {
+		slog.Info("input error", "error", err)
+		metrics.countError(reasonInvalidLat)
+		http.Error(w, "Invalid lat"+n, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	longitude, err = validateLongitude(params.Get("lon" + n))
+	if err != nil {
+		slog.Info("input error", "error", err)
+		metrics.countError(reasonInvalidLon)
+		http.Error(w, "Invalid lon"+n, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if rejectOutsideBoundingBox(w, latitude, longitude) {
+		return 0, 0, false
+	}
+	return latitude, longitude, true
+}
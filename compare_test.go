@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useComparedWeather - serve a temperature per latitude; latitudes not in temps fail with a 503
+// Each fetch waits for delay.
+func useComparedWeather(t *testing.T, delay time.Duration, temps map[float64]float64) *mockProvider {
+	t.Helper()
+	provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		time.Sleep(delay)
+		temp, ok := temps[q.Lat]
+		if !ok {
+			return nil, &upstreamError{StatusCode: http.StatusServiceUnavailable}
+		}
+		return weatherDataFromJSON(t, fmt.Sprintf(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":%g}}`, temp)), nil
+	}}
+	cfg := defaultConfig()
+	cfg.Provider = provider
+	withConfig(t, cfg)
+	return provider
+}
+
+// getComparison - request a comparison, decoding the response
+func getComparison(t *testing.T, target string) ComparisonResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	compareWeatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response ComparisonResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("bad json response: %v", err)
+	}
+	return response
+}
+
+func TestCompareWeatherHandler(t *testing.T) {
+	t.Run("Both succeed", func(t *testing.T) {
+		const delay = 100 * time.Millisecond
+		useComparedWeather(t, delay, map[float64]float64{10: 21.5, 20: 25})
+		start := time.Now()
+		response := getComparison(t, "/weather/compare?lat1=10&lon1=1&lat2=20&lon2=2")
+		if elapsed := time.Since(start); elapsed >= 2*delay {
+			t.Errorf("Expected both locations to be fetched concurrently, took %s", elapsed)
+		}
+		if response.DeltaC == nil || *response.DeltaC != -3.5 || response.Warmer != "second" {
+			t.Errorf("Expected the second to be 3.5°C warmer, got %v %q", response.DeltaC, response.Warmer)
+		}
+		if response.First.Lat != 10 || response.First.Weather == nil || response.First.Weather.TemperatureC != 21.5 {
+			t.Errorf("Unexpected first location: %+v", response.First)
+		}
+		if response.Second.Lon != 2 || response.Second.Weather == nil || response.Second.Weather.Condition != "Clear Sky" {
+			t.Errorf("Unexpected second location: %+v", response.Second)
+		}
+		if response.First.Error != "" || response.Second.Error != "" {
+			t.Errorf("Expected no errors, got %q and %q", response.First.Error, response.Second.Error)
+		}
+	})
+
+	t.Run("Equal temperatures", func(t *testing.T) {
+		useComparedWeather(t, 0, map[float64]float64{10: 18, 20: 18})
+		response := getComparison(t, "/weather/compare?lat1=10&lon1=1&lat2=20&lon2=2&units=imperial")
+		if response.DeltaC == nil || *response.DeltaC != 0 || response.Warmer != "equal" {
+			t.Errorf("Expected equal temperatures, got %v %q", response.DeltaC, response.Warmer)
+		}
+		if response.First.Weather.Units != "imperial" {
+			t.Errorf("Expected imperial units, got %q", response.First.Weather.Units)
+		}
+	})
+
+	t.Run("One fails", func(t *testing.T) {
+		useComparedWeather(t, 0, map[float64]float64{10: 21.5})
+		response := getComparison(t, "/weather/compare?lat1=10&lon1=1&lat2=20&lon2=2")
+		if response.First.Weather == nil || response.First.Weather.TemperatureC != 21.5 {
+			t.Errorf("Expected the first location despite the second failing, got %+v", response.First)
+		}
+		if response.Second.Weather != nil || response.Second.Error != "weather provider returned status 503" {
+			t.Errorf("Expected an error note for the second location, got %+v", response.Second)
+		}
+		if response.DeltaC != nil || response.Warmer != "" {
+			t.Errorf("Expected no comparison, got %v %q", response.DeltaC, response.Warmer)
+		}
+	})
+
+	t.Run("Both fail", func(t *testing.T) {
+		useComparedWeather(t, 0, nil)
+		w := httptest.NewRecorder()
+		compareWeatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather/compare?lat1=10&lon1=1&lat2=20&lon2=2", nil))
+		// as /weather answers the same provider failure
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected 500, got %d", w.Code)
+		}
+	})
+
+	t.Run("Invalid coordinates", func(t *testing.T) {
+		testCases := map[string]string{
+			"lat1=91&lon1=1&lat2=20&lon2=2":   "Invalid lat1",
+			"lat1=10&lon1=x&lat2=20&lon2=2":   "Invalid lon1",
+			"lat1=10&lon1=1&lon2=2":           "Invalid lat2",
+			"lat1=10&lon1=1&lat2=20&lon2=181": "Invalid lon2",
+		}
+		for query, expected := range testCases {
+			provider := useComparedWeather(t, 0, map[float64]float64{10: 21.5, 20: 25})
+			w := httptest.NewRecorder()
+			compareWeatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather/compare?"+query, nil))
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), expected) {
+				t.Errorf("%s: expected 400 %s, got %d %q", query, expected, w.Code, w.Body.String())
+			}
+			if provider.Calls() != 0 {
+				t.Errorf("%s: expected no provider calls", query)
+			}
+		}
+	})
+
+	t.Run("Method not allowed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		compareWeatherHandler(w, httptest.NewRequest(http.MethodPost, "/weather/compare", nil))
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("Expected 405 with Allow: GET, HEAD, got %d %q", w.Code, w.Header().Get("Allow"))
+		}
+	})
+}
@@ -0,0 +1,775 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultOpenWeatherBaseURL - where we find the OpenWeather API unless told otherwise
+const defaultOpenWeatherBaseURL = "https://api.openweathermap.org"
+
+// defaultOpenWeatherAPIPath - the current weather endpoint, relative to the base URL
+const defaultOpenWeatherAPIPath = "/data/2.5/weather"
+
+// defaultOpenWeatherHistoryPath - the One Call historical (timemachine) endpoint, relative to the base URL
+const defaultOpenWeatherHistoryPath = "/data/3.0/onecall/timemachine"
+
+// maxTempDecimals - more precision than this is noise; OpenWeather reports two decimal places at most
+const maxTempDecimals = 3
+
+// maxWindDecimals - likewise for wind speeds, which OpenWeather reports to two decimal places of m/s
+const maxWindDecimals = 3
+
+// Config - runtime configuration, loaded from the environment at startup
+type Config struct {
+	ListenAddrs      []string                // HTTP_LISTEN_ADDR and HTTP_LISTEN_PORT, the host:port addresses we serve on
+	AllowHostname    bool                    // ALLOW_HOSTNAME, accept hostnames that resolve in HTTP_LISTEN_ADDR, not just IPs
+	TLSCertFile      string                  // TLS_CERT_FILE, serve https with this certificate (and TLS_KEY_FILE)
+	TLSKeyFile       string                  // TLS_KEY_FILE
+	TLS              *tls.Config             // TLS_MIN_VERSION and TLS_CIPHER_SUITES
+	BasePath         string                  // BASE_PATH, the path prefix we are served under behind a reverse proxy
+	BaseURL          string                  // OPENWEATHER_BASE_URL
+	APIPath          string                  // OPENWEATHER_API_PATH
+	HistoryPath      string                  // OPENWEATHER_HISTORY_PATH
+	ProxyURL         *url.URL                // OPENWEATHER_PROXY_URL, overriding HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+	StreamInterval   time.Duration           // STREAM_INTERVAL_SECONDS
+	StreamHeartbeat  time.Duration           // STREAM_HEARTBEAT_SECONDS
+	CacheTTL         time.Duration           // CACHE_TTL_SECONDS
+	CacheTTLJitter   int                     // CACHE_TTL_JITTER_PERCENT, spread each entry's ttl by up to this much either way
+	CacheBackend     string                  // CACHE_BACKEND, memory (default) or redis
+	RedisAddr        string                  // REDIS_ADDR, the Redis server when CACHE_BACKEND=redis
+	CacheKeyStrategy string                  // CACHE_KEY_STRATEGY, round (default) or geohash
+	OceanPolicy      string                  // OCEAN_POLICY, allow (default), annotate or reject responses naming no place
+	NotFoundPolicy   string                  // NOT_FOUND_POLICY, passthrough (default) or structured provider 404s
+	GeohashPrecision int                     // CACHE_GEOHASH_PRECISION, geohash length when keying by geohash
+	StaleWindow      time.Duration           // STALE_WHILE_ERROR_SECONDS
+	MaxObservedAge   time.Duration           // MAX_OBSERVATION_AGE_SECONDS, refuse observations older than this (0 = no limit)
+	CoalesceWindow   time.Duration           // COALESCE_WINDOW_MS
+	StrictQuery      bool                    // STRICT_QUERY
+	PostEnabled      bool                    // WEATHER_POST_ENABLED, accept POST /weather with a JSON body
+	KeyOverride      bool                    // ALLOW_KEY_OVERRIDE, let requests send their own API key in X-OpenWeather-Key
+	DebugEndpoints   bool                    // DEBUG_ENDPOINTS, serve /debug/config
+	RetryAttempts    int                     // RETRY_MAX_ATTEMPTS
+	RetryBackoff     time.Duration           // RETRY_BACKOFF_MS
+	RetryBackoffCap  time.Duration           // RETRY_BACKOFF_CAP_MS, the most the backoff doubles to
+	RetryJitter      string                  // RETRY_JITTER, none (default), full or equal
+	ProviderMode     string                  // OPENWEATHER_MODE, json (default) or xml, what we ask the current weather API for
+	RequestBudget    time.Duration           // REQUEST_BUDGET_MS, total time a request may spend on the provider (0 = unlimited)
+	HealthTimeout    time.Duration           // HEALTH_TIMEOUT_MS, how long /health may take before it answers 503 (0 = unlimited)
+	WeatherTimeout   time.Duration           // WEATHER_TIMEOUT_MS, the same for /weather
+	ShutdownTimeout  time.Duration           // SHUTDOWN_TIMEOUT_SECONDS, how long in-flight requests get to finish on shutdown
+	ReadTimeout      time.Duration           // HTTP_READ_TIMEOUT_SECONDS, to read a whole request, body included (0 = unlimited)
+	WriteTimeout     time.Duration           // HTTP_WRITE_TIMEOUT_SECONDS, to write a response (0 = unlimited; not applied to /weather/stream or NDJSON batches)
+	IdleTimeout      time.Duration           // HTTP_IDLE_TIMEOUT_SECONDS, how long a keep-alive connection may sit idle
+	LogLevel         slog.Level              // LOG_LEVEL
+	BreakerFailures  int                     // BREAKER_FAILURE_THRESHOLD (0 disables the breaker)
+	BreakerCooldown  time.Duration           // BREAKER_COOLDOWN_SECONDS
+	ProviderChain    []string                // PROVIDER_CHAIN, providers to try in order (openweather, stub)
+	MaxUpstream      int                     // MAX_UPSTREAM_CONCURRENCY, provider calls in flight at once (0 = unlimited)
+	MaxBatchSize     int                     // MAX_BATCH_SIZE, the most locations a POST /weather/batch may ask for
+	IdempotencyTTL   time.Duration           // IDEMPOTENCY_TTL_SECONDS, how long a batch is replayed for its Idempotency-Key (0 = never)
+	QueueDepth       int                     // QUEUE_DEPTH, calls over the concurrency limit that may wait for a slot
+	QueueWait        time.Duration           // QUEUE_WAIT_MS, how long a queued call waits before it is rejected (0 = no queue)
+	DefaultLocation  *weatherQuery           // DEFAULT_LAT and DEFAULT_LON, used when a request has neither
+	Locations        map[string]weatherQuery // LOCATION_<NAME>="lat,lon", queried with location=<name>
+	WarmCoords       []weatherQuery          // WARM_COORDS, locations kept warm in the cache
+	WarmInterval     time.Duration           // WARM_INTERVAL_SECONDS (defaults to 3/4 of the cache TTL)
+	BoundingBox      *boundingBox            // BBOX_MIN_LAT, BBOX_MAX_LAT, BBOX_MIN_LON and BBOX_MAX_LON
+	StrictCoords     bool                    // STRICT_COORDS, warn about coordinates that look swapped
+	CoordRegion      *boundingBox            // COORD_REGION_*, where clients' coordinates are expected (defaults to the bounding box)
+	InferUnits       bool                    // INFER_UNITS, pick units from the country or Accept-Language when none are asked for
+	TempDecimals     int                     // TEMP_DECIMALS, decimal places in formatted temperatures
+	WindDecimals     int                     // WIND_DECIMALS, decimal places in wind speeds
+	Trend            bool                    // TREND_ENABLED, report the temperature trend since the previous reading
+	TrendThreshold   float64                 // TREND_THRESHOLD_C, changes no larger than this are "steady"
+	AlertAbove       *float64                // ALERT_TEMP_ABOVE_C (°C, or e.g. 95F), hotter readings get X-Temp-Alert: above
+	AlertBelow       *float64                // ALERT_TEMP_BELOW_C (°C, or e.g. 263K), colder readings get X-Temp-Alert: below
+	TrustedProxies   []netip.Prefix          // TRUSTED_PROXIES, peers whose X-Forwarded-For we believe
+	ResponseTemplate *template.Template      // RESPONSE_TEMPLATE or RESPONSE_TEMPLATE_FILE, for the text format
+	SecretSource     SecretSource            // SECRET_SOURCE, where the API key is read from
+	Provider         WeatherProvider
+	Geocoder         zipGeocoder
+	Enrichers        map[string]Enricher // by the name clients include them with
+	Cache            Cache
+	Coalescer        *coalescer
+	Clock            Clock // what the handlers take the current time from
+}
+
+// config - the active configuration used by the http handlers
+var config = defaultConfig()
+
+// defaultConfig - configuration used when nothing is set in the environment
+func defaultConfig() *Config {
+	clock := realClock{}
+	return &Config{
+		BaseURL:          defaultOpenWeatherBaseURL,
+		APIPath:          defaultOpenWeatherAPIPath,
+		HistoryPath:      defaultOpenWeatherHistoryPath,
+		StreamInterval:   30 * time.Second,
+		StreamHeartbeat:  15 * time.Second,
+		CacheTTL:         2 * time.Minute,
+		CacheBackend:     "memory",
+		CacheKeyStrategy: "round",
+		OceanPolicy:      "allow",
+		NotFoundPolicy:   "passthrough",
+		GeohashPrecision: 6,
+		CoalesceWindow:   200 * time.Millisecond,
+		RetryAttempts:    3,
+		RetryBackoff:     200 * time.Millisecond,
+		RetryBackoffCap:  10 * time.Second,
+		RetryJitter:      "none",
+		ProviderMode:     "json",
+		ShutdownTimeout:  10 * time.Second,
+		ReadTimeout:      10 * time.Second,
+		WriteTimeout:     30 * time.Second,
+		IdleTimeout:      2 * time.Minute,
+		TrendThreshold:   0.5,
+		BreakerFailures:  5,
+		BreakerCooldown:  30 * time.Second,
+		ProviderChain:    []string{"openweather"},
+		MaxBatchSize:     50,
+		WindDecimals:     1,
+		IdempotencyTTL:   time.Hour,
+		SecretSource:     envSecretSource{name: "OPENWEATHER_API_KEY"},
+		Provider:         newOpenWeatherProvider(defaultOpenWeatherBaseURL),
+		Geocoder:         newOpenWeatherGeocoder(defaultOpenWeatherBaseURL),
+		Enrichers:        newOpenWeatherEnrichers(defaultOpenWeatherBaseURL, newUpstreamTransport(nil)),
+		Cache:            newWeatherCache(2*time.Minute, 0, clock),
+		Coalescer:        newCoalescer(200 * time.Millisecond),
+		Clock:            clock,
+	}
+}
+
+// loadConfig - build the Config from environment variables, validating each value
+func loadConfig() (*Config, error) {
+	return loadConfigWithClock(realClock{})
+}
+
+// loadConfigWithClock - loadConfig, with the handlers, the cache and the circuit breaker all telling the time by clock
+// Tests pass a fake clock, so moving config.Clock along ages everything together.
+func loadConfigWithClock(clock Clock) (*Config, error) {
+	cfg := defaultConfig()
+	cfg.Clock = clock
+
+	var err error
+	if cfg.AllowHostname, err = getEnvBool("ALLOW_HOSTNAME", false); err != nil {
+		return nil, err
+	}
+	// only serving needs HTTP_LISTEN_ADDR (check and fetch don't), so main insists on it rather than us
+	if rawAddrs, set := os.LookupEnv("HTTP_LISTEN_ADDR"); set {
+		listenAddrs, err := listenAddresses(rawAddrs, os.Getenv("HTTP_LISTEN_PORT"), cfg.AllowHostname)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ListenAddrs = listenAddrs
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("OPENWEATHER_BASE_URL")); raw != "" {
+		cfg.BaseURL = strings.TrimSuffix(raw, "/")
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("OPENWEATHER_API_PATH")); raw != "" {
+		if !strings.HasPrefix(raw, "/") {
+			return nil, fmt.Errorf("OPENWEATHER_API_PATH must start with '/': %s", raw)
+		}
+		cfg.APIPath = raw
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("OPENWEATHER_HISTORY_PATH")); raw != "" {
+		if !strings.HasPrefix(raw, "/") {
+			return nil, fmt.Errorf("OPENWEATHER_HISTORY_PATH must start with '/': %s", raw)
+		}
+		cfg.HistoryPath = raw
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("OPENWEATHER_PROXY_URL")); raw != "" {
+		proxyURL, err := url.Parse(raw)
+		if err != nil || proxyURL.Host == "" ||
+			(proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5") {
+			// not echoed back: proxy URLs often carry credentials
+			return nil, fmt.Errorf("invalid OPENWEATHER_PROXY_URL: must be an http, https or socks5 URL with a host")
+		}
+		cfg.ProxyURL = proxyURL
+	}
+
+	interval, err := getEnvInt("STREAM_INTERVAL_SECONDS", int(cfg.StreamInterval/time.Second), 1)
+	if err != nil {
+		return nil, err
+	}
+	cfg.StreamInterval = time.Duration(interval) * time.Second
+
+	heartbeat, err := getEnvInt("STREAM_HEARTBEAT_SECONDS", int(cfg.StreamHeartbeat/time.Second), 1)
+	if err != nil {
+		return nil, err
+	}
+	cfg.StreamHeartbeat = time.Duration(heartbeat) * time.Second
+
+	ttl, err := getEnvInt("CACHE_TTL_SECONDS", int(cfg.CacheTTL/time.Second), 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.CacheTTL = time.Duration(ttl) * time.Second
+	if cfg.CacheTTLJitter, err = getEnvInt("CACHE_TTL_JITTER_PERCENT", 0, 0); err != nil {
+		return nil, err
+	}
+	if cfg.CacheTTLJitter > maxCacheTTLJitter {
+		return nil, fmt.Errorf("CACHE_TTL_JITTER_PERCENT must be at most %d: %d", maxCacheTTLJitter, cfg.CacheTTLJitter)
+	}
+
+	cfg.TLSCertFile = strings.TrimSpace(os.Getenv("TLS_CERT_FILE"))
+	cfg.TLSKeyFile = strings.TrimSpace(os.Getenv("TLS_KEY_FILE"))
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.TLS, err = loadTLSConfig(); err != nil {
+		return nil, err
+	}
+
+	if cfg.BasePath, err = loadBasePath(os.Getenv("BASE_PATH")); err != nil {
+		return nil, err
+	}
+
+	switch raw := strings.ToLower(strings.TrimSpace(os.Getenv("CACHE_BACKEND"))); raw {
+	case "":
+	case "memory", "redis":
+		cfg.CacheBackend = raw
+	default:
+		return nil, fmt.Errorf("invalid CACHE_BACKEND (want memory or redis): %s", raw)
+	}
+	cfg.RedisAddr = strings.TrimSpace(os.Getenv("REDIS_ADDR"))
+	if cfg.CacheBackend == "redis" && cfg.RedisAddr == "" {
+		return nil, fmt.Errorf("CACHE_BACKEND=redis requires REDIS_ADDR")
+	}
+
+	switch raw := strings.ToLower(strings.TrimSpace(os.Getenv("CACHE_KEY_STRATEGY"))); raw {
+	case "":
+	case "round", "geohash":
+		cfg.CacheKeyStrategy = raw
+	default:
+		return nil, fmt.Errorf("invalid CACHE_KEY_STRATEGY (want round or geohash): %s", raw)
+	}
+	if cfg.GeohashPrecision, err = getEnvInt("CACHE_GEOHASH_PRECISION", cfg.GeohashPrecision, 1); err != nil {
+		return nil, err
+	}
+	if cfg.GeohashPrecision > maxGeohashPrecision {
+		return nil, fmt.Errorf("CACHE_GEOHASH_PRECISION must be at most %d: %d", maxGeohashPrecision, cfg.GeohashPrecision)
+	}
+
+	switch raw := strings.ToLower(strings.TrimSpace(os.Getenv("OCEAN_POLICY"))); raw {
+	case "":
+	case "allow", "annotate", "reject":
+		cfg.OceanPolicy = raw
+	default:
+		return nil, fmt.Errorf("invalid OCEAN_POLICY (want allow, annotate or reject): %s", raw)
+	}
+	switch raw := strings.ToLower(strings.TrimSpace(os.Getenv("NOT_FOUND_POLICY"))); raw {
+	case "":
+	case "passthrough", "structured":
+		cfg.NotFoundPolicy = raw
+	default:
+		return nil, fmt.Errorf("invalid NOT_FOUND_POLICY (want passthrough or structured): %s", raw)
+	}
+
+	if cfg.SecretSource, err = loadSecretSource(); err != nil {
+		return nil, err
+	}
+
+	if cfg.WarmCoords, err = parseWarmCoords(os.Getenv("WARM_COORDS")); err != nil {
+		return nil, err
+	}
+	// refresh before entries expire, so warm locations never miss
+	defaultWarmInterval := max(cfg.CacheTTL*3/4, time.Second)
+	warmInterval, err := getEnvInt("WARM_INTERVAL_SECONDS", int(defaultWarmInterval/time.Second), 1)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WarmInterval = time.Duration(warmInterval) * time.Second
+
+	staleWindow, err := getEnvInt("STALE_WHILE_ERROR_SECONDS", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.StaleWindow = time.Duration(staleWindow) * time.Second
+
+	maxObservationAge, err := getEnvInt("MAX_OBSERVATION_AGE_SECONDS", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxObservedAge = time.Duration(maxObservationAge) * time.Second
+
+	coalesceWindow, err := getEnvInt("COALESCE_WINDOW_MS", int(cfg.CoalesceWindow/time.Millisecond), 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.CoalesceWindow = time.Duration(coalesceWindow) * time.Millisecond
+
+	if cfg.StrictQuery, err = getEnvBool("STRICT_QUERY", false); err != nil {
+		return nil, err
+	}
+	if cfg.PostEnabled, err = getEnvBool("WEATHER_POST_ENABLED", false); err != nil {
+		return nil, err
+	}
+	if cfg.KeyOverride, err = getEnvBool("ALLOW_KEY_OVERRIDE", false); err != nil {
+		return nil, err
+	}
+	if cfg.DebugEndpoints, err = getEnvBool("DEBUG_ENDPOINTS", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.DefaultLocation, err = loadDefaultLocation(); err != nil {
+		return nil, err
+	}
+
+	if cfg.BoundingBox, err = loadBoundingBox("BBOX_"); err != nil {
+		return nil, err
+	}
+	if cfg.DefaultLocation != nil && !cfg.BoundingBox.Contains(cfg.DefaultLocation.Lat, cfg.DefaultLocation.Lon) {
+		return nil, fmt.Errorf("DEFAULT_LAT/DEFAULT_LON is outside the configured bounding box")
+	}
+
+	if cfg.Locations, err = loadLocations(os.Environ()); err != nil {
+		return nil, err
+	}
+	for name, location := range cfg.Locations {
+		if !cfg.BoundingBox.Contains(location.Lat, location.Lon) {
+			return nil, fmt.Errorf("location %s is outside the configured bounding box", name)
+		}
+	}
+
+	if cfg.StrictCoords, err = getEnvBool("STRICT_COORDS", false); err != nil {
+		return nil, err
+	}
+	if cfg.CoordRegion, err = loadBoundingBox("COORD_REGION_"); err != nil {
+		return nil, err
+	}
+	if cfg.CoordRegion == nil {
+		cfg.CoordRegion = cfg.BoundingBox
+	}
+	if cfg.StrictCoords && cfg.CoordRegion == nil {
+		return nil, fmt.Errorf("STRICT_COORDS requires COORD_REGION_* or BBOX_* to be set")
+	}
+
+	if cfg.InferUnits, err = getEnvBool("INFER_UNITS", false); err != nil {
+		return nil, err
+	}
+	if cfg.TempDecimals, err = getEnvInt("TEMP_DECIMALS", cfg.TempDecimals, 0); err != nil {
+		return nil, err
+	}
+	if cfg.TempDecimals > maxTempDecimals {
+		return nil, fmt.Errorf("TEMP_DECIMALS must be at most %d: %d", maxTempDecimals, cfg.TempDecimals)
+	}
+	if cfg.WindDecimals, err = getEnvInt("WIND_DECIMALS", cfg.WindDecimals, 0); err != nil {
+		return nil, err
+	}
+	if cfg.WindDecimals > maxWindDecimals {
+		return nil, fmt.Errorf("WIND_DECIMALS must be at most %d: %d", maxWindDecimals, cfg.WindDecimals)
+	}
+
+	if cfg.Trend, err = getEnvBool("TREND_ENABLED", false); err != nil {
+		return nil, err
+	}
+	if cfg.TrendThreshold, err = getEnvFloat("TREND_THRESHOLD_C", cfg.TrendThreshold, 0); err != nil {
+		return nil, err
+	}
+	if cfg.AlertAbove, err = getEnvOptionalTemperature("ALERT_TEMP_ABOVE_C"); err != nil {
+		return nil, err
+	}
+	if cfg.AlertBelow, err = getEnvOptionalTemperature("ALERT_TEMP_BELOW_C"); err != nil {
+		return nil, err
+	}
+	if cfg.AlertAbove != nil && cfg.AlertBelow != nil && *cfg.AlertAbove <= *cfg.AlertBelow {
+		return nil, fmt.Errorf("ALERT_TEMP_ABOVE_C must be greater than ALERT_TEMP_BELOW_C")
+	}
+
+	if cfg.TrustedProxies, err = loadTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		return nil, err
+	}
+
+	if cfg.ResponseTemplate, err = loadResponseTemplate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.LogLevel, err = parseLogLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		return nil, err
+	}
+
+	if cfg.RetryAttempts, err = getEnvInt("RETRY_MAX_ATTEMPTS", cfg.RetryAttempts, 1); err != nil {
+		return nil, err
+	}
+	backoff, err := getEnvInt("RETRY_BACKOFF_MS", int(cfg.RetryBackoff/time.Millisecond), 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RetryBackoff = time.Duration(backoff) * time.Millisecond
+	backoffCap, err := getEnvInt("RETRY_BACKOFF_CAP_MS", int(cfg.RetryBackoffCap/time.Millisecond), 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RetryBackoffCap = time.Duration(backoffCap) * time.Millisecond
+	if cfg.RetryBackoffCap < cfg.RetryBackoff {
+		return nil, fmt.Errorf("RETRY_BACKOFF_CAP_MS must be at least RETRY_BACKOFF_MS (%d): %d", backoff, backoffCap)
+	}
+	if raw := strings.ToLower(strings.TrimSpace(os.Getenv("RETRY_JITTER"))); raw != "" {
+		if !slices.Contains(retryJitters, raw) {
+			return nil, fmt.Errorf("invalid RETRY_JITTER (want none, full or equal): %s", raw)
+		}
+		cfg.RetryJitter = raw
+	}
+	if raw := strings.ToLower(strings.TrimSpace(os.Getenv("OPENWEATHER_MODE"))); raw != "" {
+		if !slices.Contains(openWeatherModes, raw) {
+			return nil, fmt.Errorf("invalid OPENWEATHER_MODE (want json or xml): %s", raw)
+		}
+		cfg.ProviderMode = raw
+	}
+	// One Call only answers in JSON
+	if cfg.ProviderMode == "xml" && isOneCallPath(cfg.APIPath) {
+		return nil, fmt.Errorf("OPENWEATHER_MODE=xml needs the current weather API, not %s", cfg.APIPath)
+	}
+
+	budget, err := getEnvInt("REQUEST_BUDGET_MS", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RequestBudget = time.Duration(budget) * time.Millisecond
+
+	healthTimeout, err := getEnvInt("HEALTH_TIMEOUT_MS", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.HealthTimeout = time.Duration(healthTimeout) * time.Millisecond
+
+	weatherTimeout, err := getEnvInt("WEATHER_TIMEOUT_MS", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WeatherTimeout = time.Duration(weatherTimeout) * time.Millisecond
+
+	shutdownTimeout, err := getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", int(cfg.ShutdownTimeout/time.Second), 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ShutdownTimeout = time.Duration(shutdownTimeout) * time.Second
+
+	// slow clients mustn't be able to hold connections open indefinitely
+	readTimeout, err := getEnvInt("HTTP_READ_TIMEOUT_SECONDS", int(cfg.ReadTimeout/time.Second), 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ReadTimeout = time.Duration(readTimeout) * time.Second
+	writeTimeout, err := getEnvInt("HTTP_WRITE_TIMEOUT_SECONDS", int(cfg.WriteTimeout/time.Second), 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WriteTimeout = time.Duration(writeTimeout) * time.Second
+	idleTimeout, err := getEnvInt("HTTP_IDLE_TIMEOUT_SECONDS", int(cfg.IdleTimeout/time.Second), 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.IdleTimeout = time.Duration(idleTimeout) * time.Second
+
+	if cfg.BreakerFailures, err = getEnvInt("BREAKER_FAILURE_THRESHOLD", cfg.BreakerFailures, 0); err != nil {
+		return nil, err
+	}
+	cooldown, err := getEnvInt("BREAKER_COOLDOWN_SECONDS", int(cfg.BreakerCooldown/time.Second), 1)
+	if err != nil {
+		return nil, err
+	}
+	cfg.BreakerCooldown = time.Duration(cooldown) * time.Second
+
+	if raw := strings.TrimSpace(os.Getenv("PROVIDER_CHAIN")); raw != "" {
+		cfg.ProviderChain = nil
+		for _, name := range strings.Split(raw, ",") {
+			cfg.ProviderChain = append(cfg.ProviderChain, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+	var chain []namedProvider
+	for _, name := range cfg.ProviderChain {
+		provider, err := newNamedProvider(cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, namedProvider{name: name, provider: provider})
+	}
+	cfg.Provider = chain[0].provider
+	if len(chain) > 1 {
+		cfg.Provider = newFailoverProvider(chain...)
+	}
+
+	if cfg.MaxBatchSize, err = getEnvInt("MAX_BATCH_SIZE", cfg.MaxBatchSize, 1); err != nil {
+		return nil, err
+	}
+	idempotencyTTL, err := getEnvInt("IDEMPOTENCY_TTL_SECONDS", int(cfg.IdempotencyTTL/time.Second), 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.IdempotencyTTL = time.Duration(idempotencyTTL) * time.Second
+	if cfg.MaxUpstream, err = getEnvInt("MAX_UPSTREAM_CONCURRENCY", 0, 0); err != nil {
+		return nil, err
+	}
+	queueWait, err := getEnvInt("QUEUE_WAIT_MS", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.QueueWait = time.Duration(queueWait) * time.Millisecond
+	// by default as many calls may wait as may be in flight
+	if cfg.QueueDepth, err = getEnvInt("QUEUE_DEPTH", cfg.MaxUpstream, 0); err != nil {
+		return nil, err
+	}
+	if cfg.QueueWait > 0 && cfg.MaxUpstream == 0 {
+		return nil, fmt.Errorf("QUEUE_WAIT_MS requires MAX_UPSTREAM_CONCURRENCY to be set")
+	}
+	if cfg.MaxUpstream > 0 {
+		cfg.Provider = newConcurrencyLimiter(cfg.Provider, cfg.MaxUpstream).withQueue(cfg.QueueDepth, cfg.QueueWait)
+	}
+
+	geocoder := newOpenWeatherGeocoder(cfg.BaseURL)
+	geocoder.client.Transport = newUpstreamTransport(cfg.ProxyURL)
+	cfg.Geocoder = geocoder
+	cfg.Enrichers = newOpenWeatherEnrichers(cfg.BaseURL, newUpstreamTransport(cfg.ProxyURL))
+
+	if cfg.CacheBackend == "redis" {
+		cache := newRedisCache(cfg.RedisAddr, cfg.CacheTTL, cfg.StaleWindow, cfg.Clock)
+		cache.ttlJitter = cfg.CacheTTLJitter
+		cfg.Cache = cache
+	} else {
+		cache := newWeatherCache(cfg.CacheTTL, cfg.StaleWindow, cfg.Clock)
+		cache.ttlJitter = cfg.CacheTTLJitter
+		cfg.Cache = cache
+	}
+	cfg.Coalescer = newCoalescer(cfg.CoalesceWindow)
+	return cfg, nil
+}
+
+// newNamedProvider - build the PROVIDER_CHAIN entry called name
+// The OpenWeather provider sits behind the circuit breaker (when enabled), so a chain fails over to the
+// next provider immediately while OpenWeather is known to be down.
+func newNamedProvider(cfg *Config, name string) (WeatherProvider, error) {
+	switch name {
+	case "openweather":
+		provider := newOpenWeatherProvider(cfg.BaseURL)
+		provider.apiPath = cfg.APIPath
+		provider.historyPath = cfg.HistoryPath
+		provider.client.Transport = newUpstreamTransport(cfg.ProxyURL)
+		provider.maxAttempts = cfg.RetryAttempts
+		provider.backoff = cfg.RetryBackoff
+		provider.backoffCap = cfg.RetryBackoffCap
+		provider.jitter = cfg.RetryJitter
+		provider.mode = cfg.ProviderMode
+		provider.keepRaw = cfg.DebugEndpoints
+		if cfg.BreakerFailures > 0 {
+			return newCircuitBreaker(provider, cfg.BreakerFailures, cfg.BreakerCooldown, cfg.Clock), nil
+		}
+		return provider, nil
+	case "stub":
+		return stubProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider in PROVIDER_CHAIN: %q", name)
+	}
+}
+
+// loadResponseTemplate - compile RESPONSE_TEMPLATE, or the contents of RESPONSE_TEMPLATE_FILE (not both)
+func loadResponseTemplate() (*template.Template, error) {
+	text := os.Getenv("RESPONSE_TEMPLATE")
+	if path := strings.TrimSpace(os.Getenv("RESPONSE_TEMPLATE_FILE")); path != "" {
+		if text != "" {
+			return nil, fmt.Errorf("RESPONSE_TEMPLATE and RESPONSE_TEMPLATE_FILE are mutually exclusive")
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading RESPONSE_TEMPLATE_FILE: %w", err)
+		}
+		text = string(contents)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	tmpl, err := parseResponseTemplate(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// loadDefaultLocation - read DEFAULT_LAT/DEFAULT_LON, which must be set together (or not at all)
+func loadDefaultLocation() (*weatherQuery, error) {
+	rawLat := strings.TrimSpace(os.Getenv("DEFAULT_LAT"))
+	rawLon := strings.TrimSpace(os.Getenv("DEFAULT_LON"))
+	if rawLat == "" && rawLon == "" {
+		return nil, nil
+	}
+	if rawLat == "" || rawLon == "" {
+		return nil, fmt.Errorf("DEFAULT_LAT and DEFAULT_LON must be set together")
+	}
+	lat, err := validateLatitude(rawLat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEFAULT_LAT: %w", err)
+	}
+	lon, err := validateLongitude(rawLon)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEFAULT_LON: %w", err)
+	}
+	return &weatherQuery{Lat: lat, Lon: lon}, nil
+}
+
+// loadBasePath - normalize BASE_PATH to a leading slash and no trailing slash ("" if we are served at /)
+func loadBasePath(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(raw, "?#{} ") {
+		return "", fmt.Errorf("invalid BASE_PATH: %s", raw)
+	}
+	basePath := path.Clean("/" + raw)
+	if basePath == "/" {
+		return "", nil
+	}
+	return basePath, nil
+}
+
+// loadTrustedProxies - parse TRUSTED_PROXIES, a comma separated list of CIDRs (e.g. 10.0.0.0/8,::1/128)
+func loadTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(raw, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// boundingBox - the region a deployment serves; requests for coordinates outside it are refused
+type boundingBox struct {
+	MinLat, MaxLat float64
+	MinLon, MaxLon float64
+}
+
+// Contains - whether the coordinates are inside the box (edges included).  A nil box contains everything.
+func (b *boundingBox) Contains(lat, lon float64) bool {
+	if b == nil {
+		return true
+	}
+	return lat >= b.MinLat && lat <= b.MaxLat && lon >= b.MinLon && lon <= b.MaxLon
+}
+
+// loadBoundingBox - read the prefix MIN_LAT, MAX_LAT, MIN_LON and MAX_LON limits (e.g. BBOX_MIN_LAT), which
+// must be set all together (or not at all)
+func loadBoundingBox(prefix string) (*boundingBox, error) {
+	names := []string{prefix + "MIN_LAT", prefix + "MAX_LAT", prefix + "MIN_LON", prefix + "MAX_LON"}
+	var raw []string
+	for _, name := range names {
+		if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+			raw = append(raw, value)
+		}
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if len(raw) != len(names) {
+		return nil, fmt.Errorf("%s must be set together", strings.Join(names, ", "))
+	}
+
+	var box boundingBox
+	var err error
+	if box.MinLat, err = validateLatitude(raw[0]); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", names[0], err)
+	}
+	if box.MaxLat, err = validateLatitude(raw[1]); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", names[1], err)
+	}
+	if box.MinLon, err = validateLongitude(raw[2]); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", names[2], err)
+	}
+	if box.MaxLon, err = validateLongitude(raw[3]); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", names[3], err)
+	}
+	if box.MinLat > box.MaxLat || box.MinLon > box.MaxLon {
+		return nil, fmt.Errorf("bounding box minimums must not exceed its maximums")
+	}
+	return &box, nil
+}
+
+// getEnvInt - read an integer environment variable, returning def when it is unset
+// Values below min are rejected.
+func getEnvInt(name string, def, min int) (int, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, raw)
+	}
+	if n < min {
+		return 0, fmt.Errorf("%s must be at least %d: %d", name, min, n)
+	}
+	return n, nil
+}
+
+// getEnvFloat - read a decimal environment variable, returning def when it is unset
+// Values below min are rejected.
+func getEnvFloat(name string, def, min float64) (float64, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid %s: %s", name, raw)
+	}
+	if f < min {
+		return 0, fmt.Errorf("%s must be at least %g: %g", name, min, f)
+	}
+	return f, nil
+}
+
+// getEnvOptionalTemperature - read a temperature environment variable in Celsius, returning nil when it is unset
+// The value is Celsius unless it ends in a unit: 95F and 308.15K are both 35°C.
+func getEnvOptionalTemperature(name string) (*float64, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return nil, nil
+	}
+	number, unit := raw, "C"
+	if last := raw[len(raw)-1:]; strings.ContainsAny(last, "CcFfKk") {
+		number, unit = strings.TrimSpace(raw[:len(raw)-1]), last
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("invalid %s: %s", name, raw)
+	}
+	celsius, err := toCelsius(value, unit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return &celsius, nil
+}
+
+// getEnvBool - read a boolean environment variable, returning def when it is unset
+func getEnvBool(name string, def bool) (bool, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", name, raw)
+	}
+	return b, nil
+}
@@ -0,0 +1,913 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withConfig - install cfg as the active configuration for the duration of the test
+func withConfig(t *testing.T, cfg *Config) {
+	t.Helper()
+	previous := config
+	config = cfg
+	t.Cleanup(func() {
+		config = previous
+	})
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.BaseURL != defaultOpenWeatherBaseURL {
+			t.Errorf("Expected base URL %s, got %s", defaultOpenWeatherBaseURL, cfg.BaseURL)
+		}
+		if cfg.StreamInterval != 30*time.Second {
+			t.Errorf("Expected 30s stream interval, got %v", cfg.StreamInterval)
+		}
+		if cfg.Provider == nil {
+			t.Error("Expected a provider")
+		}
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_BASE_URL")
+			_ = os.Unsetenv("STREAM_INTERVAL_SECONDS")
+		})
+		_ = os.Setenv("OPENWEATHER_BASE_URL", "http://localhost:9999/")
+		_ = os.Setenv("STREAM_INTERVAL_SECONDS", "5")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.BaseURL != "http://localhost:9999" {
+			t.Errorf("Expected trimmed base URL, got %s", cfg.BaseURL)
+		}
+		if cfg.StreamInterval != 5*time.Second {
+			t.Errorf("Expected 5s stream interval, got %v", cfg.StreamInterval)
+		}
+	})
+
+	t.Run("API path override", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_PATH")
+		})
+		_ = os.Setenv("OPENWEATHER_API_PATH", "/data/3.0/onecall")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.APIPath != "/data/3.0/onecall" {
+			t.Errorf("Expected /data/3.0/onecall, got %s", cfg.APIPath)
+		}
+		if provider := cfg.Provider.(*circuitBreaker).next.(*openWeatherProvider); provider.apiPath != cfg.APIPath {
+			t.Errorf("Expected provider to use %s, got %s", cfg.APIPath, provider.apiPath)
+		}
+
+		_ = os.Setenv("OPENWEATHER_API_PATH", "data/3.0/onecall")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for a path without a leading '/'")
+		}
+	})
+
+	t.Run("Default location", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("DEFAULT_LAT")
+			_ = os.Unsetenv("DEFAULT_LON")
+		})
+		_ = os.Setenv("DEFAULT_LAT", "37.77")
+		_ = os.Setenv("DEFAULT_LON", "-122.42")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.DefaultLocation == nil || *cfg.DefaultLocation != (weatherQuery{Lat: 37.77, Lon: -122.42}) {
+			t.Errorf("unexpected default location: %v", cfg.DefaultLocation)
+		}
+
+		_ = os.Setenv("DEFAULT_LAT", "97.77")
+		if _, err := loadConfig(); !errors.Is(err, ErrLatitudeOutOfRange) {
+			t.Errorf("Expected out of range error, got %v", err)
+		}
+
+		_ = os.Unsetenv("DEFAULT_LAT")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error when only DEFAULT_LON is set")
+		}
+	})
+
+	t.Run("Temperature decimals", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("TEMP_DECIMALS")
+		})
+		_ = os.Setenv("TEMP_DECIMALS", "2")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.TempDecimals != 2 {
+			t.Errorf("Expected 2 decimals, got %d", cfg.TempDecimals)
+		}
+		for _, raw := range []string{"-1", "4", "two"} {
+			_ = os.Setenv("TEMP_DECIMALS", raw)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected error for TEMP_DECIMALS=%s", raw)
+			}
+		}
+	})
+
+	t.Run("Wind decimals", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("WIND_DECIMALS")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.WindDecimals != 1 {
+			t.Errorf("Expected 1 decimal by default, got %d", cfg.WindDecimals)
+		}
+		_ = os.Setenv("WIND_DECIMALS", "0")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.WindDecimals != 0 {
+			t.Errorf("Expected 0 decimals, got %d", cfg.WindDecimals)
+		}
+		for _, raw := range []string{"-1", "4", "two"} {
+			_ = os.Setenv("WIND_DECIMALS", raw)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected error for WIND_DECIMALS=%s", raw)
+			}
+		}
+	})
+
+	t.Run("Trend", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("TREND_ENABLED")
+			_ = os.Unsetenv("TREND_THRESHOLD_C")
+		})
+		_ = os.Setenv("TREND_ENABLED", "true")
+		_ = os.Setenv("TREND_THRESHOLD_C", "1.5")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !cfg.Trend || cfg.TrendThreshold != 1.5 {
+			t.Errorf("unexpected trend config: %v %v", cfg.Trend, cfg.TrendThreshold)
+		}
+		for _, raw := range []string{"-1", "NaN", "warm"} {
+			_ = os.Setenv("TREND_THRESHOLD_C", raw)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected error for TREND_THRESHOLD_C=%s", raw)
+			}
+		}
+	})
+
+	t.Run("One clock", func(t *testing.T) {
+		cfg, err := loadConfigWithClock(newFakeClock())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if breaker, ok := cfg.Provider.(*circuitBreaker); !ok || breaker.clock != cfg.Clock {
+			t.Errorf("Expected the circuit breaker to tell the time by config.Clock, got %#v", cfg.Provider)
+		}
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`), nil
+		}}
+		cfg.Provider = provider
+		cfg.Coalescer = newCoalescer(0) // its window runs on timers, so only the cache can answer the repeats
+		withConfig(t, cfg)
+
+		get := func() {
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", w.Code)
+			}
+		}
+		get()
+		get()
+		if provider.Calls() != 1 {
+			t.Fatalf("Expected the second request served from the cache, got %d provider calls", provider.Calls())
+		}
+		config.Clock.(*fakeClock).Advance(cfg.CacheTTL + time.Second)
+		get()
+		if provider.Calls() != 2 {
+			t.Errorf("Expected the cache entry to expire with config.Clock, got %d provider calls", provider.Calls())
+		}
+	})
+
+	t.Run("Temperature alerts", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("ALERT_TEMP_ABOVE_C")
+			_ = os.Unsetenv("ALERT_TEMP_BELOW_C")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.AlertAbove != nil || cfg.AlertBelow != nil {
+			t.Error("Expected no alert thresholds by default")
+		}
+
+		_ = os.Setenv("ALERT_TEMP_ABOVE_C", "35")
+		_ = os.Setenv("ALERT_TEMP_BELOW_C", "-10.5")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.AlertAbove == nil || *cfg.AlertAbove != 35 || cfg.AlertBelow == nil || *cfg.AlertBelow != -10.5 {
+			t.Errorf("unexpected alert thresholds: %v %v", cfg.AlertAbove, cfg.AlertBelow)
+		}
+
+		_ = os.Setenv("ALERT_TEMP_ABOVE_C", "95F")
+		_ = os.Setenv("ALERT_TEMP_BELOW_C", " 263.15 k")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.AlertAbove == nil || math.Abs(*cfg.AlertAbove-35) > 1e-9 ||
+			cfg.AlertBelow == nil || math.Abs(*cfg.AlertBelow+10) > 1e-9 {
+			t.Errorf("Expected thresholds converted to Celsius, got %v %v", *cfg.AlertAbove, *cfg.AlertBelow)
+		}
+
+		_ = os.Setenv("ALERT_TEMP_BELOW_C", "40")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for a lower threshold above the upper one")
+		}
+		_ = os.Setenv("ALERT_TEMP_BELOW_C", "cold")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for ALERT_TEMP_BELOW_C=cold")
+		}
+		_ = os.Setenv("ALERT_TEMP_BELOW_C", "F")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for a unit without a value")
+		}
+	})
+
+	t.Run("Bounding box", func(t *testing.T) {
+		names := []string{"BBOX_MIN_LAT", "BBOX_MAX_LAT", "BBOX_MIN_LON", "BBOX_MAX_LON", "DEFAULT_LAT", "DEFAULT_LON"}
+		t.Cleanup(func() {
+			for _, name := range names {
+				_ = os.Unsetenv(name)
+			}
+		})
+		set := func(values ...string) {
+			for i, name := range names {
+				if i < len(values) {
+					_ = os.Setenv(name, values[i])
+				} else {
+					_ = os.Unsetenv(name)
+				}
+			}
+		}
+
+		set("37", "41", "-109.05", "-102.05")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if *cfg.BoundingBox != (boundingBox{MinLat: 37, MaxLat: 41, MinLon: -109.05, MaxLon: -102.05}) {
+			t.Errorf("unexpected bounding box: %+v", cfg.BoundingBox)
+		}
+
+		for _, values := range [][]string{
+			{"37", "41", "-109.05"},                           // incomplete
+			{"41", "37", "-109.05", "-102.05"},                // min above max
+			{"37", "91", "-109.05", "-102.05"},                // out of range
+			{"37", "41", "-109.05", "-102.05", "40.7", "-74"}, // default location outside
+		} {
+			set(values...)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected error for %v", values)
+			}
+		}
+	})
+
+	t.Run("Proxy override", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_PROXY_URL")
+		})
+		_ = os.Setenv("OPENWEATHER_PROXY_URL", "http://proxy.example.com:3128")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		provider := cfg.Provider.(*circuitBreaker).next.(*openWeatherProvider)
+		transport := provider.client.Transport.(*http.Transport)
+		req := httptest.NewRequest(http.MethodGet, defaultOpenWeatherBaseURL+defaultOpenWeatherAPIPath, nil)
+		proxyURL, err := transport.Proxy(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if proxyURL == nil || proxyURL.String() != "http://proxy.example.com:3128" {
+			t.Errorf("Expected the override proxy, got %v", proxyURL)
+		}
+
+		for _, raw := range []string{"proxy.example.com:3128", "ftp://proxy.example.com", "http://"} {
+			_ = os.Setenv("OPENWEATHER_PROXY_URL", raw)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected error for OPENWEATHER_PROXY_URL=%s", raw)
+			}
+		}
+	})
+
+	t.Run("Provider chain", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("PROVIDER_CHAIN")
+		})
+		_ = os.Setenv("PROVIDER_CHAIN", "openweather, stub")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		failover, ok := cfg.Provider.(*failoverProvider)
+		if !ok || len(failover.chain) != 2 {
+			t.Fatalf("Expected a two provider failover chain, got %T", cfg.Provider)
+		}
+		if _, ok := failover.chain[1].provider.(stubProvider); !ok {
+			t.Errorf("Expected the stub provider second, got %T", failover.chain[1].provider)
+		}
+
+		_ = os.Setenv("PROVIDER_CHAIN", "openweather,darksky")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for unknown provider")
+		}
+	})
+
+	t.Run("Cache warming", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("WARM_COORDS")
+			_ = os.Unsetenv("CACHE_TTL_SECONDS")
+		})
+		_ = os.Setenv("WARM_COORDS", "40.71,-74.01")
+		_ = os.Setenv("CACHE_TTL_SECONDS", "60")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(cfg.WarmCoords) != 1 || cfg.WarmInterval != 45*time.Second {
+			t.Errorf("unexpected warming config: %v every %v", cfg.WarmCoords, cfg.WarmInterval)
+		}
+
+		_ = os.Setenv("WARM_COORDS", "40.71")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for malformed WARM_COORDS")
+		}
+	})
+
+	t.Run("Upstream concurrency limit", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("MAX_UPSTREAM_CONCURRENCY")
+		})
+		_ = os.Setenv("MAX_UPSTREAM_CONCURRENCY", "8")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		limiter, ok := cfg.Provider.(*concurrencyLimiter)
+		if !ok || cap(limiter.slots) != 8 {
+			t.Fatalf("Expected a limit of 8, got %T", cfg.Provider)
+		}
+		if limiter.queue != nil {
+			t.Error("Expected no queue without QUEUE_WAIT_MS")
+		}
+	})
+
+	t.Run("Route timeouts", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("HEALTH_TIMEOUT_MS")
+			_ = os.Unsetenv("WEATHER_TIMEOUT_MS")
+		})
+		_ = os.Setenv("HEALTH_TIMEOUT_MS", "500")
+		_ = os.Setenv("WEATHER_TIMEOUT_MS", "15000")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.HealthTimeout != 500*time.Millisecond || cfg.WeatherTimeout != 15*time.Second {
+			t.Errorf("Expected 500ms and 15s, got %s and %s", cfg.HealthTimeout, cfg.WeatherTimeout)
+		}
+	})
+
+	t.Run("Trusted proxies", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("TRUSTED_PROXIES")
+		})
+		_ = os.Setenv("TRUSTED_PROXIES", " 10.1.2.3/8, ::1/128 ,")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+		if !slices.Equal(cfg.TrustedProxies, expected) {
+			t.Errorf("Expected %v, got %v", expected, cfg.TrustedProxies)
+		}
+
+		for _, raw := range []string{"10.0.0.1", "10.0.0.0/33", "proxy.internal/24"} {
+			_ = os.Setenv("TRUSTED_PROXIES", raw)
+			if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "TRUSTED_PROXIES") {
+				t.Errorf("%s: expected a TRUSTED_PROXIES error, got %v", raw, err)
+			}
+		}
+	})
+
+	t.Run("Shutdown timeout", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("SHUTDOWN_TIMEOUT_SECONDS")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.ShutdownTimeout != 10*time.Second {
+			t.Errorf("Expected a 10s default, got %s", cfg.ShutdownTimeout)
+		}
+		_ = os.Setenv("SHUTDOWN_TIMEOUT_SECONDS", "45")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.ShutdownTimeout != 45*time.Second {
+			t.Errorf("Expected 45s, got %s", cfg.ShutdownTimeout)
+		}
+		_ = os.Setenv("SHUTDOWN_TIMEOUT_SECONDS", "-1")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected an error for a negative timeout")
+		}
+	})
+
+	t.Run("Ocean policy", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OCEAN_POLICY")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.OceanPolicy != "allow" {
+			t.Errorf("Expected allow by default, got %q", cfg.OceanPolicy)
+		}
+		_ = os.Setenv("OCEAN_POLICY", " Reject ")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.OceanPolicy != "reject" {
+			t.Errorf("Expected reject, got %q", cfg.OceanPolicy)
+		}
+		_ = os.Setenv("OCEAN_POLICY", "drown")
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "OCEAN_POLICY") {
+			t.Errorf("Expected an OCEAN_POLICY error, got %v", err)
+		}
+	})
+
+	t.Run("Retry jitter", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("RETRY_JITTER")
+			_ = os.Unsetenv("RETRY_BACKOFF_CAP_MS")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.RetryJitter != "none" || cfg.RetryBackoffCap != 10*time.Second {
+			t.Errorf("Expected no jitter and a 10s cap by default, got %q and %s", cfg.RetryJitter, cfg.RetryBackoffCap)
+		}
+		_ = os.Setenv("RETRY_JITTER", " Equal ")
+		_ = os.Setenv("RETRY_BACKOFF_CAP_MS", "1500")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.RetryJitter != "equal" || cfg.RetryBackoffCap != 1500*time.Millisecond {
+			t.Errorf("Expected equal jitter and a 1.5s cap, got %q and %s", cfg.RetryJitter, cfg.RetryBackoffCap)
+		}
+		_ = os.Setenv("RETRY_BACKOFF_CAP_MS", "100")
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "RETRY_BACKOFF_CAP_MS") {
+			t.Errorf("Expected a cap below the backoff to be refused, got %v", err)
+		}
+		_ = os.Setenv("RETRY_BACKOFF_CAP_MS", "1500")
+		_ = os.Setenv("RETRY_JITTER", "decorrelated")
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "RETRY_JITTER") {
+			t.Errorf("Expected a RETRY_JITTER error, got %v", err)
+		}
+	})
+
+	t.Run("Batch size", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("MAX_BATCH_SIZE")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.MaxBatchSize != 50 {
+			t.Errorf("Expected 50 by default, got %d", cfg.MaxBatchSize)
+		}
+		_ = os.Setenv("MAX_BATCH_SIZE", "200")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.MaxBatchSize != 200 {
+			t.Errorf("Expected 200, got %d", cfg.MaxBatchSize)
+		}
+		_ = os.Setenv("MAX_BATCH_SIZE", "0")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected an error for an empty batch size")
+		}
+	})
+
+	t.Run("Not found policy", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("NOT_FOUND_POLICY")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.NotFoundPolicy != "passthrough" {
+			t.Errorf("Expected passthrough by default, got %q", cfg.NotFoundPolicy)
+		}
+		_ = os.Setenv("NOT_FOUND_POLICY", "Structured")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.NotFoundPolicy != "structured" {
+			t.Errorf("Expected structured, got %q", cfg.NotFoundPolicy)
+		}
+		_ = os.Setenv("NOT_FOUND_POLICY", "ignore")
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "NOT_FOUND_POLICY") {
+			t.Errorf("Expected a NOT_FOUND_POLICY error, got %v", err)
+		}
+	})
+
+	t.Run("Max observation age", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("MAX_OBSERVATION_AGE_SECONDS")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.MaxObservedAge != 0 {
+			t.Errorf("Expected no limit by default, got %s", cfg.MaxObservedAge)
+		}
+		_ = os.Setenv("MAX_OBSERVATION_AGE_SECONDS", "3600")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.MaxObservedAge != time.Hour {
+			t.Errorf("Expected 1h, got %s", cfg.MaxObservedAge)
+		}
+		_ = os.Setenv("MAX_OBSERVATION_AGE_SECONDS", "-1")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected an error for a negative age")
+		}
+	})
+
+	t.Run("Idempotency ttl", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("IDEMPOTENCY_TTL_SECONDS")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.IdempotencyTTL != time.Hour {
+			t.Errorf("Expected an hour by default, got %s", cfg.IdempotencyTTL)
+		}
+		_ = os.Setenv("IDEMPOTENCY_TTL_SECONDS", "0")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.IdempotencyTTL != 0 {
+			t.Errorf("Expected replays to be disabled, got %s", cfg.IdempotencyTTL)
+		}
+		_ = os.Setenv("IDEMPOTENCY_TTL_SECONDS", "-1")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected an error for a negative ttl")
+		}
+	})
+
+	t.Run("Debug endpoints", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("DEBUG_ENDPOINTS")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.DebugEndpoints {
+			t.Error("Expected the debug endpoints to be off by default")
+		}
+		_ = os.Setenv("DEBUG_ENDPOINTS", "true")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !cfg.DebugEndpoints {
+			t.Error("Expected the debug endpoints to be on")
+		}
+	})
+
+	t.Run("Listen addresses", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("HTTP_LISTEN_ADDR")
+			_ = os.Unsetenv("HTTP_LISTEN_PORT")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.ListenAddrs != nil {
+			t.Errorf("Expected no listen addresses without HTTP_LISTEN_ADDR, got %v", cfg.ListenAddrs)
+		}
+
+		_ = os.Setenv("HTTP_LISTEN_PORT", "8080")
+		testCases := map[string][]string{
+			"127.0.0.1":           {"127.0.0.1:8080"},
+			"::1":                 {"[::1]:8080"},
+			"[::1]":               {"[::1]:8080"},
+			"[2001:db8::1]:9090":  {"[2001:db8::1]:9090"},
+			"":                    {":8080"},
+			"127.0.0.1,::1":       {"127.0.0.1:8080", "[::1]:8080"},
+			"0.0.0.0, [::]:8443 ": {"0.0.0.0:8080", "[::]:8443"},
+		}
+		for rawAddrs, expected := range testCases {
+			_ = os.Setenv("HTTP_LISTEN_ADDR", rawAddrs)
+			cfg, err := loadConfig()
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", rawAddrs, err)
+				continue
+			}
+			if !slices.Equal(cfg.ListenAddrs, expected) {
+				t.Errorf("%q: expected %v, got %v", rawAddrs, expected, cfg.ListenAddrs)
+			}
+		}
+
+		for _, rawAddrs := range []string{"invalid_address", "127.0.0.1,[::1]:0"} {
+			_ = os.Setenv("HTTP_LISTEN_ADDR", rawAddrs)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected an error for HTTP_LISTEN_ADDR=%q", rawAddrs)
+			}
+		}
+		_ = os.Setenv("HTTP_LISTEN_ADDR", "127.0.0.1")
+		_ = os.Unsetenv("HTTP_LISTEN_PORT")
+		if _, err := loadConfig(); err == nil || err.Error() != "missing port (HTTP_LISTEN_PORT not set)" {
+			t.Errorf("Expected a missing port error, got %v", err)
+		}
+	})
+
+	t.Run("OpenWeather mode", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_MODE")
+			_ = os.Unsetenv("OPENWEATHER_API_PATH")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.ProviderMode != "json" {
+			t.Errorf("Expected json by default, got %s", cfg.ProviderMode)
+		}
+
+		_ = os.Setenv("OPENWEATHER_MODE", " XML ")
+		cfg, err = loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if provider := cfg.Provider.(*circuitBreaker).next.(*openWeatherProvider); cfg.ProviderMode != "xml" || provider.mode != "xml" {
+			t.Errorf("Expected xml, got %s (provider %s)", cfg.ProviderMode, provider.mode)
+		}
+
+		_ = os.Setenv("OPENWEATHER_API_PATH", "/data/3.0/onecall")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected an error for xml with the One Call API")
+		}
+		_ = os.Unsetenv("OPENWEATHER_API_PATH")
+		_ = os.Setenv("OPENWEATHER_MODE", "yaml")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected an error for an unknown mode")
+		}
+	})
+
+	t.Run("Allow hostname", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("ALLOW_HOSTNAME")
+			_ = os.Unsetenv("HTTP_LISTEN_ADDR")
+			_ = os.Unsetenv("HTTP_LISTEN_PORT")
+		})
+		_ = os.Setenv("HTTP_LISTEN_ADDR", "localhost")
+		_ = os.Setenv("HTTP_LISTEN_PORT", "8080")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected an error for a hostname without ALLOW_HOSTNAME")
+		}
+
+		_ = os.Setenv("ALLOW_HOSTNAME", "true")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !cfg.AllowHostname || !slices.Equal(cfg.ListenAddrs, []string{"localhost:8080"}) {
+			t.Errorf("Expected localhost:8080 to be allowed, got %t %v", cfg.AllowHostname, cfg.ListenAddrs)
+		}
+
+		_ = os.Setenv("ALLOW_HOSTNAME", "sometimes")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected an error for an invalid ALLOW_HOSTNAME")
+		}
+	})
+
+	t.Run("Server timeouts", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("HTTP_READ_TIMEOUT_SECONDS")
+			_ = os.Unsetenv("HTTP_WRITE_TIMEOUT_SECONDS")
+			_ = os.Unsetenv("HTTP_IDLE_TIMEOUT_SECONDS")
+		})
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.ReadTimeout != 10*time.Second || cfg.WriteTimeout != 30*time.Second || cfg.IdleTimeout != 2*time.Minute {
+			t.Errorf("Expected 10s, 30s and 2m by default, got %s, %s and %s", cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout)
+		}
+		_ = os.Setenv("HTTP_READ_TIMEOUT_SECONDS", "5")
+		_ = os.Setenv("HTTP_WRITE_TIMEOUT_SECONDS", "0")
+		_ = os.Setenv("HTTP_IDLE_TIMEOUT_SECONDS", "60")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.ReadTimeout != 5*time.Second || cfg.WriteTimeout != 0 || cfg.IdleTimeout != time.Minute {
+			t.Errorf("Expected 5s, 0 and 1m, got %s, %s and %s", cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout)
+		}
+		_ = os.Setenv("HTTP_WRITE_TIMEOUT_SECONDS", "soon")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected an error for an invalid write timeout")
+		}
+	})
+
+	t.Run("Upstream queue", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("MAX_UPSTREAM_CONCURRENCY")
+			_ = os.Unsetenv("QUEUE_WAIT_MS")
+			_ = os.Unsetenv("QUEUE_DEPTH")
+		})
+		_ = os.Setenv("QUEUE_WAIT_MS", "250")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for QUEUE_WAIT_MS without MAX_UPSTREAM_CONCURRENCY")
+		}
+
+		_ = os.Setenv("MAX_UPSTREAM_CONCURRENCY", "8")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		limiter := cfg.Provider.(*concurrencyLimiter)
+		if cap(limiter.queue) != 8 || limiter.queueWait != 250*time.Millisecond {
+			t.Errorf("Expected a queue of 8 waiting 250ms, got %d waiting %s", cap(limiter.queue), limiter.queueWait)
+		}
+
+		_ = os.Setenv("QUEUE_DEPTH", "3")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if limiter = cfg.Provider.(*concurrencyLimiter); cap(limiter.queue) != 3 {
+			t.Errorf("Expected a queue of 3, got %d", cap(limiter.queue))
+		}
+
+		_ = os.Setenv("QUEUE_DEPTH", "-1")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for a negative QUEUE_DEPTH")
+		}
+	})
+
+	t.Run("Strict coordinates", func(t *testing.T) {
+		names := []string{"COORD_REGION_MIN_LAT", "COORD_REGION_MAX_LAT", "COORD_REGION_MIN_LON", "COORD_REGION_MAX_LON"}
+		t.Cleanup(func() {
+			_ = os.Unsetenv("STRICT_COORDS")
+			_ = os.Unsetenv("BBOX_MIN_LAT")
+			_ = os.Unsetenv("BBOX_MAX_LAT")
+			_ = os.Unsetenv("BBOX_MIN_LON")
+			_ = os.Unsetenv("BBOX_MAX_LON")
+			for _, name := range names {
+				_ = os.Unsetenv(name)
+			}
+		})
+		_ = os.Setenv("STRICT_COORDS", "true")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for STRICT_COORDS without a region")
+		}
+
+		for i, value := range []string{"35", "60", "-10", "30"} {
+			_ = os.Setenv(names[i], value)
+		}
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !cfg.StrictCoords || *cfg.CoordRegion != (boundingBox{MinLat: 35, MaxLat: 60, MinLon: -10, MaxLon: 30}) {
+			t.Errorf("unexpected region: %v %+v", cfg.StrictCoords, cfg.CoordRegion)
+		}
+
+		// without COORD_REGION_*, the bounding box is the region
+		for _, name := range names {
+			_ = os.Unsetenv(name)
+		}
+		_ = os.Setenv("BBOX_MIN_LAT", "37")
+		_ = os.Setenv("BBOX_MAX_LAT", "41")
+		_ = os.Setenv("BBOX_MIN_LON", "-109.05")
+		_ = os.Setenv("BBOX_MAX_LON", "-102.05")
+		if cfg, err = loadConfig(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.CoordRegion != cfg.BoundingBox {
+			t.Errorf("Expected the bounding box as the region, got %+v", cfg.CoordRegion)
+		}
+	})
+
+	t.Run("Base path", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("BASE_PATH")
+		})
+		for raw, expected := range map[string]string{
+			"":                     "",
+			"/":                    "",
+			"/api/weather-service": "/api/weather-service",
+			"api/weather-service/": "/api/weather-service",
+		} {
+			_ = os.Setenv("BASE_PATH", raw)
+			cfg, err := loadConfig()
+			if err != nil {
+				t.Fatalf("BASE_PATH=%q: unexpected error: %v", raw, err)
+			}
+			if cfg.BasePath != expected {
+				t.Errorf("BASE_PATH=%q: expected %q, got %q", raw, expected, cfg.BasePath)
+			}
+		}
+		_ = os.Setenv("BASE_PATH", "/api?x=1")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for a BASE_PATH with a query")
+		}
+	})
+
+	t.Run("Cache key strategy", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("CACHE_KEY_STRATEGY")
+			_ = os.Unsetenv("CACHE_GEOHASH_PRECISION")
+		})
+		_ = os.Setenv("CACHE_KEY_STRATEGY", "geohash")
+		_ = os.Setenv("CACHE_GEOHASH_PRECISION", "5")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.CacheKeyStrategy != "geohash" || cfg.GeohashPrecision != 5 {
+			t.Errorf("Expected geohash keys of precision 5, got %s/%d", cfg.CacheKeyStrategy, cfg.GeohashPrecision)
+		}
+		for _, raw := range []string{"0", "13"} {
+			_ = os.Setenv("CACHE_GEOHASH_PRECISION", raw)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected error for CACHE_GEOHASH_PRECISION=%s", raw)
+			}
+		}
+		_ = os.Unsetenv("CACHE_GEOHASH_PRECISION")
+		_ = os.Setenv("CACHE_KEY_STRATEGY", "grid")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for CACHE_KEY_STRATEGY=grid")
+		}
+	})
+
+	t.Run("Invalid boolean", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("STRICT_QUERY")
+		})
+		_ = os.Setenv("STRICT_QUERY", "maybe")
+		if _, err := loadConfig(); err == nil {
+			t.Error("Expected error for STRICT_QUERY=maybe")
+		}
+		_ = os.Setenv("STRICT_QUERY", "true")
+		cfg, err := loadConfig()
+		if err != nil || !cfg.StrictQuery {
+			t.Errorf("Expected strict query mode, got %v (%v)", cfg, err)
+		}
+	})
+
+	t.Run("Invalid stream interval", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("STREAM_INTERVAL_SECONDS")
+		})
+		for _, raw := range []string{"0", "-1", "soon"} {
+			_ = os.Setenv("STREAM_INTERVAL_SECONDS", raw)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected error for STREAM_INTERVAL_SECONDS=%s", raw)
+			}
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// debugConfigHandler - GET /debug/config, the effective configuration with its secrets redacted
+// Only served with DEBUG_ENDPOINTS=true; it shows which settings took effect, which helps when a deployment
+// doesn't behave as its environment suggests it should.
+func debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(debugConfig(r.Context(), config)); err != nil {
+		slog.Error("error writing the config", "error", err)
+	}
+}
+
+// debugConfig - cfg as /debug/config shows it, by field name
+// Nothing that could carry a secret is shown as it is: the API key is masked, URLs lose any password and
+// appid, and the backends (provider, cache and so on) are shown only by type.
+func debugConfig(ctx context.Context, cfg *Config) map[string]any {
+	view := map[string]any{}
+	value := reflect.ValueOf(cfg).Elem()
+	for i := range value.NumField() {
+		if field := value.Type().Field(i); field.IsExported() {
+			view[field.Name] = debugValue(value.Field(i))
+		}
+	}
+	// the process's key, not one a request may have brought with it
+	key, err := apiKeys.Get(context.WithoutCancel(ctx))
+	if err != nil {
+		view["APIKey"] = "invalid: " + err.Error()
+	} else {
+		view["APIKey"] = maskSecret(key)
+	}
+	return view
+}
+
+// debugValue - one Config field, in a form that is safe and readable as JSON
+func debugValue(v reflect.Value) any {
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface || v.Kind() == reflect.Map) && v.IsNil() {
+		return nil
+	}
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return value.String()
+	case slog.Level:
+		return value.String()
+	case string:
+		if strings.Contains(value, "://") {
+			return redactURL(redactPassword(value))
+		}
+		return value
+	case *url.URL:
+		return redactURL(value.Redacted())
+	case *tls.Config:
+		suites := make([]string, len(value.CipherSuites))
+		for i, suite := range value.CipherSuites {
+			suites[i] = tls.CipherSuiteName(suite)
+		}
+		return map[string]any{"MinVersion": tls.VersionName(value.MinVersion), "CipherSuites": suites}
+	case *template.Template:
+		return "custom"
+	case map[string]Enricher:
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	if v.Kind() == reflect.Interface || (v.Kind() == reflect.Pointer && v.Elem().Kind() == reflect.Struct &&
+		!hasExportedFields(v.Elem().Type())) {
+		return fmt.Sprintf("%T", v.Interface())
+	}
+	return v.Interface()
+}
+
+// hasExportedFields - whether t has any fields JSON would show
+func hasExportedFields(t reflect.Type) bool {
+	for i := range t.NumField() {
+		if t.Field(i).IsExported() {
+			return true
+		}
+	}
+	return false
+}
+
+// redactPassword - raw with the password of any userinfo masked (e.g. a proxy's credentials)
+func redactPassword(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(unparseable url)"
+	}
+	return u.Redacted()
+}
+
+// maskSecret - all but the last four characters of a secret, so it can be told apart from another
+// Secrets too short for that to be safe are masked completely.
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) < 16 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
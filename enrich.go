@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultOpenWeatherAirPollutionPath - the current air pollution endpoint, relative to the base URL
+const defaultOpenWeatherAirPollutionPath = "/data/2.5/air_pollution"
+
+// defaultOpenWeatherOneCallPath - the One Call endpoint (current conditions, including the UV index)
+const defaultOpenWeatherOneCallPath = "/data/3.0/onecall"
+
+// enrichment names, as clients ask for them with include=
+const (
+	includeAirQuality = "air_quality"
+	includeUV         = "uv"
+	includeForecast   = "forecast"
+	includeAlerts     = "alerts"
+)
+
+// knownIncludes - every enrichment a client may ask for, whether or not it is configured
+var knownIncludes = []string{includeAirQuality, includeUV, includeForecast, includeAlerts}
+
+// ErrUnknownInclude - include named something that isn't an enrichment
+var ErrUnknownInclude = errors.New("unknown include")
+
+// errNoEnricher - the enrichment is one we know of, but nothing is configured to fetch it
+var errNoEnricher = errors.New("no enricher configured")
+
+// Enricher - a source of extra data for a weather response, fetched alongside the weather itself
+// The returned func merges what was fetched into the response.
+type Enricher interface {
+	Enrich(ctx context.Context, q weatherQuery) (func(*WeatherResponse), error)
+}
+
+// enrichmentLabels - how each enrichment is labelled in the text response
+var enrichmentLabels = map[string]string{
+	includeAirQuality: "Air Quality",
+	includeUV:         "UV Index",
+	includeForecast:   "Forecast",
+	includeAlerts:     "Alerts",
+}
+
+// airQuality - the OpenWeather air quality index, 1 (good) to 5 (very poor)
+type airQuality struct {
+	Index       int    `json:"index" xml:"index"`
+	Description string `json:"description" xml:"description"`
+}
+
+// enrichmentError - an enrichment that was asked for but couldn't be fetched
+type enrichmentError struct {
+	Name  string `json:"name" xml:"name,attr"`
+	Error string `json:"error" xml:",chardata"`
+}
+
+// validateIncludes - the enrichments named in include (comma separated), in order and without repeats
+// Empty names are skipped, so an empty include asks for nothing; a name that isn't in knownIncludes is an
+// error.
+func validateIncludes(raw string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || slices.Contains(names, name) {
+			continue
+		}
+		if !slices.Contains(knownIncludes, name) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownInclude, name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// enrichmentRun - the enrichments being fetched for a single request
+type enrichmentRun struct {
+	group  errgroup.Group
+	names  []string
+	merges []func(*WeatherResponse)
+	errs   []error
+}
+
+// startEnrichments - start fetching the named enrichments concurrently
+// They all share ctx, and so the request's deadline.
+func startEnrichments(ctx context.Context, q weatherQuery, names []string) *enrichmentRun {
+	run := &enrichmentRun{
+		names:  names,
+		merges: make([]func(*WeatherResponse), len(names)),
+		errs:   make([]error, len(names)),
+	}
+	for i, name := range names {
+		enricher, ok := config.Enrichers[name]
+		if !ok {
+			run.errs[i] = errNoEnricher
+			continue
+		}
+		run.group.Go(func() error {
+			run.merges[i], run.errs[i] = enricher.Enrich(ctx, q)
+			return nil // one failed enrichment mustn't cancel the others
+		})
+	}
+	return run
+}
+
+// apply - wait for the enrichments, merge them into response and note the ones that failed
+func (run *enrichmentRun) apply(response *WeatherResponse) {
+	_ = run.group.Wait()
+	for i, name := range run.names {
+		if err := run.errs[i]; err != nil {
+			slog.Warn("enrichment failed", "include", name, "error", err)
+			response.EnrichmentErrors = append(response.EnrichmentErrors,
+				enrichmentError{Name: name, Error: fetchErrorMessage(err)})
+			continue
+		}
+		run.merges[i](response)
+	}
+}
+
+// fetchErrorMessage - what we tell clients about a failed fetch that doesn't fail their whole request (an
+// enrichment, or one side of a comparison).  The detail stays in our logs.
+func fetchErrorMessage(err error) string {
+	var upstreamErr *upstreamError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timed out"
+	case errors.Is(err, errObservationTooOld):
+		return "observation too old"
+	case errors.As(err, &upstreamErr):
+		return fmt.Sprintf("weather provider returned status %d", upstreamErr.StatusCode)
+	default:
+		return "unavailable"
+	}
+}
+
+// airQualityDescription - the OpenWeather name for an air quality index
+func airQualityDescription(index int) string {
+	switch index {
+	case 1:
+		return "Good"
+	case 2:
+		return "Fair"
+	case 3:
+		return "Moderate"
+	case 4:
+		return "Poor"
+	case 5:
+		return "Very Poor"
+	default:
+		return "Unknown"
+	}
+}
+
+// uvRisk - the WHO exposure category for a UV index
+func uvRisk(index float64) string {
+	switch {
+	case index < 3:
+		return "Low"
+	case index < 6:
+		return "Moderate"
+	case index < 8:
+		return "High"
+	case index < 11:
+		return "Very High"
+	default:
+		return "Extreme"
+	}
+}
+
+// openWeatherEnricher - the parts of an Enricher backed by an OpenWeather endpoint
+type openWeatherEnricher struct {
+	baseURL string
+	path    string
+	client  *http.Client
+}
+
+// get - fetch the endpoint for q, with extra query parameters, decoding the response into v
+func (e *openWeatherEnricher) get(ctx context.Context, q weatherQuery, extra url.Values, v any) error {
+	apiKey, err := apiKeys.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidAPIKey, err)
+	}
+	params := url.Values{}
+	for name, values := range extra {
+		params[name] = values
+	}
+	params.Set("lat", strconv.FormatFloat(q.Lat, 'f', 6, 64))
+	params.Set("lon", strconv.FormatFloat(q.Lon, 'f', 6, 64))
+	params.Set("appid", apiKey)
+	requestURL := e.baseURL + e.path + "?" + params.Encode()
+
+	slog.Debug("enrichment request", "url", redactURL(requestURL))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		// the url.Error carries the full request URL, which includes our API key
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%w: %w", errRequestFailed, err)
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			slog.Warn("error closing body", "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return &upstreamError{StatusCode: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After")}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidResponse, err)
+	}
+	return nil
+}
+
+// airQualityEnricher - Enricher adding the air quality index from the OpenWeather air pollution API
+type airQualityEnricher struct {
+	openWeatherEnricher
+}
+
+// Enrich - get the current air quality index
+func (e *airQualityEnricher) Enrich(ctx context.Context, q weatherQuery) (func(*WeatherResponse), error) {
+	var pollution struct {
+		List []struct {
+			Main struct {
+				AQI int `json:"aqi"`
+			} `json:"main"`
+		} `json:"list"`
+	}
+	if err := e.get(ctx, q, nil, &pollution); err != nil {
+		return nil, err
+	}
+	if len(pollution.List) == 0 {
+		return nil, fmt.Errorf("%w: no air quality data", errInvalidResponse)
+	}
+	index := pollution.List[0].Main.AQI
+	return func(response *WeatherResponse) {
+		response.AirQuality = &airQuality{Index: index, Description: airQualityDescription(index)}
+	}, nil
+}
+
+// uvEnricher - Enricher adding the UV index from the OpenWeather One Call API
+type uvEnricher struct {
+	openWeatherEnricher
+}
+
+// Enrich - get the current UV index
+func (e *uvEnricher) Enrich(ctx context.Context, q weatherQuery) (func(*WeatherResponse), error) {
+	var oneCall struct {
+		Current *struct {
+			UVI float64 `json:"uvi"`
+		} `json:"current"`
+	}
+	// we only want current conditions, not the forecasts One Call includes by default
+	extra := url.Values{"exclude": {"minutely,hourly,daily,alerts"}}
+	if err := e.get(ctx, q, extra, &oneCall); err != nil {
+		return nil, err
+	}
+	if oneCall.Current == nil {
+		return nil, fmt.Errorf("%w: no current conditions", errInvalidResponse)
+	}
+	index := oneCall.Current.UVI
+	return func(response *WeatherResponse) {
+		response.UVIndex = &index
+		response.UVRisk = uvRisk(index)
+	}, nil
+}
+
+// newOpenWeatherEnrichers - the enrichers clients can include, backed by OpenWeather at baseURL
+func newOpenWeatherEnrichers(baseURL string, transport http.RoundTripper) map[string]Enricher {
+	client := &http.Client{Timeout: upstreamTimeout, Transport: transport}
+	return map[string]Enricher{
+		includeAirQuality: &airQualityEnricher{openWeatherEnricher{baseURL, defaultOpenWeatherAirPollutionPath, client}},
+		includeUV:         &uvEnricher{openWeatherEnricher{baseURL, defaultOpenWeatherOneCallPath, client}},
+	}
+}
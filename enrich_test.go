@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockEnricher - Enricher calling enrich, and counting the calls
+type mockEnricher struct {
+	calls  atomic.Int32
+	enrich func(ctx context.Context) (func(*WeatherResponse), error)
+}
+
+func (e *mockEnricher) Enrich(ctx context.Context, _ weatherQuery) (func(*WeatherResponse), error) {
+	e.calls.Add(1)
+	return e.enrich(ctx)
+}
+
+// useEnrichers - serve the given weather, with mock air quality and UV enrichers
+// Each enricher waits for delay; uvErr makes the UV enricher fail.
+func useEnrichers(t *testing.T, delay time.Duration, uvErr error) (air, uv *mockEnricher) {
+	t.Helper()
+	useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`)
+	air = &mockEnricher{enrich: func(ctx context.Context) (func(*WeatherResponse), error) {
+		time.Sleep(delay)
+		return func(response *WeatherResponse) {
+			response.AirQuality = &airQuality{Index: 2, Description: airQualityDescription(2)}
+		}, nil
+	}}
+	uv = &mockEnricher{enrich: func(ctx context.Context) (func(*WeatherResponse), error) {
+		time.Sleep(delay)
+		if uvErr != nil {
+			return nil, uvErr
+		}
+		return func(response *WeatherResponse) {
+			index := 5.2
+			response.UVIndex = &index
+			response.UVRisk = uvRisk(index)
+		}, nil
+	}}
+	config.Enrichers = map[string]Enricher{includeAirQuality: air, includeUV: uv}
+	return air, uv
+}
+
+// getWeatherJSON - request the weather as json, decoding the response
+func getWeatherJSON(t *testing.T, target string) WeatherResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response WeatherResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("bad json response: %v", err)
+	}
+	return response
+}
+
+func TestEnrichments(t *testing.T) {
+	t.Run("All succeed", func(t *testing.T) {
+		const delay = 100 * time.Millisecond
+		useEnrichers(t, delay, nil)
+		start := time.Now()
+		response := getWeatherJSON(t, "/weather?lat=1&lon=1&format=json&include=air_quality,uv")
+		if elapsed := time.Since(start); elapsed >= 2*delay {
+			t.Errorf("Expected the enrichments to run concurrently, took %s", elapsed)
+		}
+		if response.AirQuality == nil || response.AirQuality.Index != 2 || response.AirQuality.Description != "Fair" {
+			t.Errorf("Expected air quality 2 (Fair), got %+v", response.AirQuality)
+		}
+		if response.UVIndex == nil || *response.UVIndex != 5.2 || response.UVRisk != "Moderate" {
+			t.Errorf("Expected UV index 5.2 (Moderate), got %v %s", response.UVIndex, response.UVRisk)
+		}
+		if len(response.EnrichmentErrors) != 0 {
+			t.Errorf("Expected no enrichment errors, got %+v", response.EnrichmentErrors)
+		}
+		if response.Condition != "Clear Sky" {
+			t.Errorf("Expected the weather as well, got %+v", response)
+		}
+	})
+
+	t.Run("One fails", func(t *testing.T) {
+		useEnrichers(t, 0, &upstreamError{StatusCode: http.StatusUnauthorized})
+		response := getWeatherJSON(t, "/weather?lat=1&lon=1&format=json&include=air_quality,uv")
+		if response.AirQuality == nil || response.AirQuality.Index != 2 {
+			t.Errorf("Expected air quality despite the UV failure, got %+v", response.AirQuality)
+		}
+		if response.UVIndex != nil {
+			t.Errorf("Expected no UV index, got %v", *response.UVIndex)
+		}
+		expected := []enrichmentError{{Name: "uv", Error: "weather provider returned status 401"}}
+		if !slices.Equal(response.EnrichmentErrors, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, response.EnrichmentErrors)
+		}
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&include=air_quality,uv", nil))
+		for _, expected := range []string{"\n  Air Quality : Fair (2)", "\n  UV Index    : weather provider returned status 401"} {
+			if !strings.Contains(w.Body.String(), expected) {
+				t.Errorf("Expected %q in %s", expected, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		useEnrichers(t, 0, nil)
+		config.RequestBudget = 50 * time.Millisecond
+		config.Enrichers[includeUV] = &mockEnricher{enrich: func(ctx context.Context) (func(*WeatherResponse), error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}}
+		response := getWeatherJSON(t, "/weather?lat=1&lon=1&format=json&include=uv")
+		expected := []enrichmentError{{Name: "uv", Error: "timed out"}}
+		if !slices.Equal(response.EnrichmentErrors, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, response.EnrichmentErrors)
+		}
+	})
+
+	t.Run("None requested", func(t *testing.T) {
+		air, uv := useEnrichers(t, 0, nil)
+		response := getWeatherJSON(t, "/weather?lat=1&lon=1&format=json")
+		if response.AirQuality != nil || response.UVIndex != nil || response.EnrichmentErrors != nil {
+			t.Errorf("Expected no enrichments, got %+v", response)
+		}
+		if air.calls.Load() != 0 || uv.calls.Load() != 0 {
+			t.Error("Expected no enrichment calls")
+		}
+	})
+
+	t.Run("Unknown include", func(t *testing.T) {
+		air, _ := useEnrichers(t, 0, nil)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&include=air_quality,pollen", nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid include") {
+			t.Errorf("Expected 400 Invalid include, got %d %q", w.Code, w.Body.String())
+		}
+		if air.calls.Load() != 0 {
+			t.Error("Expected no enrichment calls")
+		}
+	})
+
+	t.Run("Not configured", func(t *testing.T) {
+		useEnrichers(t, 0, nil)
+		response := getWeatherJSON(t, "/weather?lat=1&lon=1&format=json&include=forecast,air_quality")
+		if response.AirQuality == nil {
+			t.Error("Expected air quality")
+		}
+		expected := []enrichmentError{{Name: "forecast", Error: "unavailable"}}
+		if !slices.Equal(response.EnrichmentErrors, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, response.EnrichmentErrors)
+		}
+	})
+
+	t.Run("Historical lookups", func(t *testing.T) {
+		air, _ := useEnrichers(t, 0, nil)
+		target := "/weather?lat=1&lon=1&format=json&include=air_quality&timestamp=" +
+			strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+		if response := getWeatherJSON(t, target); response.AirQuality != nil {
+			t.Errorf("Expected no air quality for a historical lookup, got %+v", response.AirQuality)
+		}
+		if air.calls.Load() != 0 {
+			t.Error("Expected no enrichment calls")
+		}
+	})
+}
+
+func TestValidateIncludes(t *testing.T) {
+	testCases := map[string][]string{
+		"":                          nil,
+		"uv":                        {"uv"},
+		"air_quality, UV":           {"air_quality", "uv"},
+		"uv,forecast,alerts":        {"uv", "forecast", "alerts"},
+		"uv,uv,air_quality,UV":      {"uv", "air_quality"},
+		" , ,":                      nil,
+		"alerts,,forecast,":         {"alerts", "forecast"},
+		"air_quality , air_quality": {"air_quality"},
+	}
+	for raw, expected := range testCases {
+		names, err := validateIncludes(raw)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", raw, err)
+		}
+		if !slices.Equal(names, expected) {
+			t.Errorf("%q: expected %v, got %v", raw, expected, names)
+		}
+	}
+
+	for _, raw := range []string{"pollen", "uv,pollen", "air quality", "uv;alerts"} {
+		if _, err := validateIncludes(raw); !errors.Is(err, ErrUnknownInclude) {
+			t.Errorf("%q: expected ErrUnknownInclude, got %v", raw, err)
+		}
+	}
+}
+
+func TestOpenWeatherEnrichers(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.Unsetenv("OPENWEATHER_API_KEY")
+	})
+	_ = os.Setenv("OPENWEATHER_API_KEY", "abcdef0123456789abcdef0123456789")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case defaultOpenWeatherAirPollutionPath:
+			_, _ = w.Write([]byte(`{"coord":{"lon":1,"lat":1},"list":[{"main":{"aqi":4},"components":{"co":201.94}}]}`))
+		case defaultOpenWeatherOneCallPath:
+			if r.URL.Query().Get("exclude") == "" {
+				t.Error("Expected the forecasts to be excluded")
+			}
+			_, _ = w.Write([]byte(`{"lat":1,"lon":1,"current":{"temp":20,"uvi":9.1}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	enrichers := newOpenWeatherEnrichers(server.URL, http.DefaultTransport)
+	var response WeatherResponse
+	for _, name := range []string{includeAirQuality, includeUV} {
+		merge, err := enrichers[name].Enrich(context.Background(), weatherQuery{Lat: 1, Lon: 1})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		merge(&response)
+	}
+	if response.AirQuality == nil || *response.AirQuality != (airQuality{Index: 4, Description: "Poor"}) {
+		t.Errorf("Expected air quality 4 (Poor), got %+v", response.AirQuality)
+	}
+	if response.UVIndex == nil || *response.UVIndex != 9.1 || response.UVRisk != "Very High" {
+		t.Errorf("Expected UV index 9.1 (Very High), got %v %s", response.UVIndex, response.UVRisk)
+	}
+
+	t.Run("Upstream error", func(t *testing.T) {
+		enrichers := newOpenWeatherEnrichers(server.URL+"/missing", http.DefaultTransport)
+		_, err := enrichers[includeUV].Enrich(context.Background(), weatherQuery{Lat: 1, Lon: 1})
+		var upstreamErr *upstreamError
+		if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected a 404 upstream error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// namedProvider - a provider in a failover chain, with the name used to configure it
+type namedProvider struct {
+	name     string
+	provider WeatherProvider
+}
+
+// failoverProvider - WeatherProvider that tries each provider in turn until one succeeds
+type failoverProvider struct {
+	chain []namedProvider
+}
+
+// newFailoverProvider - create a failover provider trying chain in order
+func newFailoverProvider(chain ...namedProvider) *failoverProvider {
+	return &failoverProvider{chain: chain}
+}
+
+// Fetch - fetch from the first provider that succeeds
+// If every provider fails, the errors are joined so callers can still classify them with errors.Is/As.
+func (f *failoverProvider) Fetch(ctx context.Context, q weatherQuery) (*WeatherData, error) {
+	var errs []error
+	for _, p := range f.chain {
+		data, err := p.provider.Fetch(ctx, q)
+		if err == nil {
+			return data, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break // nobody is waiting for an answer any more
+		}
+		slog.Warn("weather provider failed, trying the next", "provider", p.name, "error", err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Ping - the chain is reachable if any of its providers is
+func (f *failoverProvider) Ping(ctx context.Context) error {
+	var errs []error
+	for _, p := range f.chain {
+		pp, ok := p.provider.(pinger)
+		if !ok {
+			return nil
+		}
+		err := pp.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// stubProvider - WeatherProvider returning the same mild, clear reading for every query
+// Useful for local development, and as the last link of a PROVIDER_CHAIN so that clients always get an
+// answer (the X-Weather-Source header tells them it isn't real).
+type stubProvider struct{}
+
+// Fetch - return the canned reading
+func (stubProvider) Fetch(_ context.Context, _ weatherQuery) (*WeatherData, error) {
+	data := &WeatherData{Source: "stub"}
+	data.Weather = append(data.Weather, struct {
+		ID          int    `json:"id"`
+		Description string `json:"description"`
+		Icon        string `json:"icon"`
+	}{ID: 800, Description: "clear sky", Icon: "01d"})
+	data.Main.Temperature = 20
+	data.Main.Humidity = 50
+	return data, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFailoverProvider(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+	failing := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		return nil, &upstreamError{StatusCode: http.StatusBadGateway}
+	}}
+	secondary := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		data := weatherDataFromJSON(t, payload)
+		data.Source = "secondary"
+		return data, nil
+	}}
+
+	t.Run("Falls over to the secondary", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Provider = newFailoverProvider(
+			namedProvider{name: "primary", provider: failing},
+			namedProvider{name: "secondary", provider: secondary})
+		withConfig(t, cfg)
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w.Header().Get("X-Weather-Source") != "secondary" {
+			t.Errorf("Expected X-Weather-Source: secondary, got '%s'", w.Header().Get("X-Weather-Source"))
+		}
+		if failing.Calls() != 1 || secondary.Calls() != 1 {
+			t.Errorf("Expected one call to each provider, got %d and %d", failing.Calls(), secondary.Calls())
+		}
+	})
+
+	t.Run("Every provider fails", func(t *testing.T) {
+		provider := newFailoverProvider(
+			namedProvider{name: "primary", provider: failing},
+			namedProvider{name: "backup", provider: failing})
+		_, err := provider.Fetch(context.Background(), weatherQuery{})
+		var upstreamErr *upstreamError
+		if !errors.As(err, &upstreamErr) {
+			t.Fatalf("Expected the upstream errors to be preserved, got %v", err)
+		}
+	})
+
+	t.Run("Stub provider", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Provider = stubProvider{}
+		withConfig(t, cfg)
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w.Header().Get("X-Weather-Source") != "stub" {
+			t.Errorf("Expected X-Weather-Source: stub, got '%s'", w.Header().Get("X-Weather-Source"))
+		}
+	})
+}
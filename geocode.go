@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// defaultOpenWeatherZipPath - the geocoding by ZIP code endpoint, relative to the base URL
+const defaultOpenWeatherZipPath = "/geo/1.0/zip"
+
+// errZipNotFound - the geocoder doesn't know the ZIP code
+var errZipNotFound = errors.New("unknown ZIP code")
+
+// zipPattern - a five digit US ZIP code, optionally followed by ",US"
+var zipPattern = regexp.MustCompile(`^[0-9]{5}(,(?i:us))?$`)
+
+// validateZip - Verify a ZIP code parameter, returning it in the "NNNNN,US" form the geocoder expects
+func validateZip(raw string) (string, error) {
+	zip := strings.ReplaceAll(strings.TrimSpace(raw), " ", "")
+	if !zipPattern.MatchString(zip) {
+		return "", fmt.Errorf("invalid ZIP code: %s", raw)
+	}
+	return zip[:5] + ",US", nil
+}
+
+// zipGeocoder - resolves ZIP codes to coordinates
+type zipGeocoder interface {
+	LookupZip(ctx context.Context, zip string) (weatherQuery, error)
+}
+
+// openWeatherGeocoder - zipGeocoder backed by the OpenWeather geocoding API
+// ZIP codes don't move, so every successful lookup is remembered for the life of the process.
+type openWeatherGeocoder struct {
+	baseURL string
+	zipPath string
+	client  *http.Client
+	known   sync.Map // zip -> weatherQuery
+}
+
+// newOpenWeatherGeocoder - create an OpenWeather geocoder for the given base URL
+func newOpenWeatherGeocoder(baseURL string) *openWeatherGeocoder {
+	return &openWeatherGeocoder{
+		baseURL: baseURL,
+		zipPath: defaultOpenWeatherZipPath,
+		client:  &http.Client{Timeout: upstreamTimeout, Transport: newUpstreamTransport(nil)},
+	}
+}
+
+// LookupZip - the coordinates of a (validated) ZIP code
+func (g *openWeatherGeocoder) LookupZip(ctx context.Context, zip string) (weatherQuery, error) {
+	if q, ok := g.known.Load(zip); ok {
+		return q.(weatherQuery), nil
+	}
+
+	apiKey, err := apiKeys.Get(ctx)
+	if err != nil {
+		return weatherQuery{}, fmt.Errorf("%w: %w", errInvalidAPIKey, err)
+	}
+	params := url.Values{}
+	params.Set("zip", zip)
+	params.Set("appid", apiKey)
+	requestURL := g.baseURL + g.zipPath + "?" + params.Encode()
+
+	slog.Debug("geocoding request", "url", redactURL(requestURL))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		// the url.Error carries the full request URL, which includes our API key
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return weatherQuery{}, fmt.Errorf("%w: %w", errRequestFailed, err)
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			slog.Warn("error closing body", "error", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return weatherQuery{}, fmt.Errorf("%w: %s", errZipNotFound, zip)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return weatherQuery{}, &upstreamError{StatusCode: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After")}
+	}
+
+	var location struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&location); err != nil {
+		return weatherQuery{}, fmt.Errorf("%w: %w", errInvalidResponse, err)
+	}
+	q := weatherQuery{Lat: location.Lat, Lon: location.Lon}
+	g.known.Store(zip, q)
+	return q, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// mockGeocoder - zipGeocoder resolving from a fixed table
+type mockGeocoder map[string]weatherQuery
+
+func (g mockGeocoder) LookupZip(_ context.Context, zip string) (weatherQuery, error) {
+	if q, ok := g[zip]; ok {
+		return q, nil
+	}
+	return weatherQuery{}, fmt.Errorf("%w: %s", errZipNotFound, zip)
+}
+
+func TestValidateZip(t *testing.T) {
+	testCases := []struct {
+		raw      string
+		expected string
+		valid    bool
+	}{
+		{"90210", "90210,US", true},
+		{"90210,US", "90210,US", true},
+		{"90210,us", "90210,US", true},
+		{" 90210, US ", "90210,US", true},
+		{"9021", "", false},
+		{"902101", "", false},
+		{"90210-1234", "", false},
+		{"90210,CA", "", false},
+		{"abcde", "", false},
+		{"", "", false},
+	}
+	for _, tc := range testCases {
+		got, err := validateZip(tc.raw)
+		if (err == nil) != tc.valid || got != tc.expected {
+			t.Errorf("validateZip(%q) = %q, %v", tc.raw, got, err)
+		}
+	}
+}
+
+func TestZipLookup(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+	beverlyHills := weatherQuery{Lat: 34.0901, Lon: -118.4065}
+
+	request := func(t *testing.T, target string) (*httptest.ResponseRecorder, *weatherQuery) {
+		provider := useWeather(t, payload)
+		config.Geocoder = mockGeocoder{"90210,US": beverlyHills}
+		var requested *weatherQuery
+		fetch := provider.fetch
+		provider.fetch = func(q weatherQuery) (*WeatherData, error) {
+			requested = &q
+			return fetch(q)
+		}
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w, requested
+	}
+
+	t.Run("Valid zip", func(t *testing.T) {
+		w, requested := request(t, "/weather?zip=90210")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if requested == nil || *requested != beverlyHills {
+			t.Errorf("Expected the zip's coordinates, got %v", requested)
+		}
+	})
+
+	testCases := []struct {
+		name     string
+		target   string
+		expected int
+	}{
+		{"Invalid zip format", "/weather?zip=9021x", http.StatusBadRequest},
+		{"Zip with lat/lon", "/weather?zip=90210&lat=1&lon=1", http.StatusBadRequest},
+		{"Unknown zip", "/weather?zip=00000", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, requested := request(t, tc.target)
+			if w.Code != tc.expected {
+				t.Fatalf("Expected %d, got %d", tc.expected, w.Code)
+			}
+			if requested != nil {
+				t.Error("Expected no weather lookup")
+			}
+		})
+	}
+}
+
+func TestOpenWeatherGeocoder(t *testing.T) {
+	const fakeApiKey = "abcdef0123456789abcdef0123456789"
+	t.Cleanup(func() {
+		_ = os.Unsetenv("OPENWEATHER_API_KEY")
+	})
+	_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path != "/geo/1.0/zip" || r.URL.Query().Get("appid") != fakeApiKey {
+			t.Errorf("unexpected request: %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("zip") != "90210,US" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"zip":"90210","name":"Beverly Hills","lat":34.0901,"lon":-118.4065,"country":"US"}`))
+	}))
+	t.Cleanup(server.Close)
+	geocoder := newOpenWeatherGeocoder(server.URL)
+
+	for i := 0; i < 2; i++ {
+		q, err := geocoder.LookupZip(context.Background(), "90210,US")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if q != (weatherQuery{Lat: 34.0901, Lon: -118.4065}) {
+			t.Errorf("unexpected coordinates: %v", q)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected the second lookup to be remembered, got %d calls", calls.Load())
+	}
+
+	if _, err := geocoder.LookupZip(context.Background(), "00000,US"); !errors.Is(err, errZipNotFound) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+}
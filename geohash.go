@@ -0,0 +1,38 @@
+package main
+
+// geohashAlphabet - the geohash base32 alphabet (no a, i, l or o)
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// maxGeohashPrecision - 12 characters is already finer than a centimeter
+const maxGeohashPrecision = 12
+
+// geohash - encode coordinates as a geohash of the given length
+// Each character adds five bits, alternately halving the longitude and latitude ranges, so points that
+// share a prefix share a cell.  See https://en.wikipedia.org/wiki/Geohash.
+func geohash(lat, lon float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	evenBit := true // longitude first
+	bits, ch := 0, 0
+	for len(hash) < precision {
+		r, v := &latRange, lat
+		if evenBit {
+			r, v = &lonRange, lon
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		evenBit = !evenBit
+		if bits++; bits == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
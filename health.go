@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pingTimeout - how long the verbose health check waits on the provider
+const pingTimeout = 2 * time.Second
+
+// pinger - a dependency that can report whether it is reachable
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// dependencyCheck - the result of checking a single dependency
+type dependencyCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Entries *int   `json:"entries,omitempty"`
+}
+
+// healthReport - the verbose health check response
+type healthReport struct {
+	Status string                     `json:"status"`
+	Checks map[string]dependencyCheck `json:"checks"`
+}
+
+// newDependencyCheck - a passing check for a nil error, a failing one otherwise
+func newDependencyCheck(err error) dependencyCheck {
+	if err != nil {
+		return dependencyCheck{Status: "fail", Message: err.Error()}
+	}
+	return dependencyCheck{Status: "ok"}
+}
+
+// checkDependencies - check the api key, the provider and the cache
+func checkDependencies(ctx context.Context) healthReport {
+	report := healthReport{Status: "ok", Checks: map[string]dependencyCheck{}}
+
+	_, err := getAPIKey(ctx)
+	report.Checks["api_key"] = newDependencyCheck(err)
+
+	if p, ok := config.Provider.(pinger); ok {
+		pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		report.Checks["provider"] = newDependencyCheck(p.Ping(pingCtx))
+		cancel()
+	} else {
+		report.Checks["provider"] = dependencyCheck{Status: "unknown"}
+	}
+
+	if entries, err := config.Cache.Len(ctx); err != nil {
+		report.Checks["cache"] = newDependencyCheck(err)
+	} else {
+		report.Checks["cache"] = dependencyCheck{Status: "ok", Entries: &entries}
+	}
+
+	for _, check := range report.Checks {
+		if check.Status == "fail" {
+			report.Status = "degraded"
+		}
+	}
+	return report
+}
+
+// wantsVerboseHealth - the detailed report is requested with ?verbose=true or Accept: application/json
+func wantsVerboseHealth(r *http.Request) bool {
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// healthCheck - provide a simple healthcheck response
+// The default plain "ok" is a liveness probe; the verbose report checks our dependencies and returns 503
+// if any of them fail.
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// HEAD gets the same status and headers as GET, but no body
+	head := r.Method == http.MethodHead
+
+	if !wantsVerboseHealth(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if head {
+			return
+		}
+		if _, err := w.Write([]byte("ok")); err != nil {
+			slog.Error("healthcheck failed", "error", err)
+		}
+		return
+	}
+
+	report := checkDependencies(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if head {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("healthcheck failed", "error", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+	t.Run("Simple liveness response", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		healthCheck(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w.Body.String() != "ok" {
+			t.Errorf("Expected 'ok', got '%s'", w.Body.String())
+		}
+	})
+
+	t.Run("HEAD has no body", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		healthCheck(w, httptest.NewRequest(http.MethodHead, "/health", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("Expected empty body, got '%s'", w.Body.String())
+		}
+	})
+
+	t.Run("Other methods are not allowed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		healthCheck(w, httptest.NewRequest(http.MethodPost, "/health", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("Expected 405, got %d", w.Code)
+		}
+		if w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("Expected Allow: GET, HEAD, got '%s'", w.Header().Get("Allow"))
+		}
+	})
+
+	t.Run("Verbose response with healthy dependencies", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", "abcdef0123456789abcdef0123456789")
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized) // any answer means it's reachable
+		}))
+		t.Cleanup(upstream.Close)
+		cfg := defaultConfig()
+		cfg.Provider = newOpenWeatherProvider(upstream.URL)
+		cfg.Cache.Set(context.Background(), "1.00,1.00", &WeatherData{})
+		withConfig(t, cfg)
+
+		w := httptest.NewRecorder()
+		healthCheck(w, httptest.NewRequest(http.MethodGet, "/health?verbose=true", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		var report healthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("invalid json: %v", err)
+		}
+		if report.Status != "ok" {
+			t.Errorf("Expected status ok, got %s", report.Status)
+		}
+		for _, name := range []string{"api_key", "provider", "cache"} {
+			if report.Checks[name].Status != "ok" {
+				t.Errorf("Expected %s check ok, got %+v", name, report.Checks[name])
+			}
+		}
+		if entries := report.Checks["cache"].Entries; entries == nil || *entries != 1 {
+			t.Errorf("Expected 1 cache entry, got %v", entries)
+		}
+	})
+
+	t.Run("Verbose response via Accept with a missing key", func(t *testing.T) {
+		_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{}
+		withConfig(t, cfg)
+
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		healthCheck(w, req)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected 503, got %d", w.Code)
+		}
+		var report healthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("invalid json: %v", err)
+		}
+		if report.Status != "degraded" || report.Checks["api_key"].Status != "fail" {
+			t.Errorf("unexpected report: %+v", report)
+		}
+		if report.Checks["provider"].Status != "unknown" {
+			t.Errorf("Expected unknown provider status, got %+v", report.Checks["provider"])
+		}
+	})
+}
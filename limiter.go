@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errUpstreamBusy - the concurrency limit on provider calls has been reached
+var errUpstreamBusy = errors.New("too many concurrent weather provider requests")
+
+// concurrencyLimiter - WeatherProvider wrapper capping the number of calls in flight
+// Calls over the limit fail immediately with errUpstreamBusy rather than piling up behind a slow provider,
+// unless a queue is configured: then up to queue-depth of them wait as long as queueWait for a slot.
+type concurrencyLimiter struct {
+	next      WeatherProvider
+	slots     chan struct{}
+	queue     chan struct{} // one token per call waiting for a slot; nil when calls never wait
+	queueWait time.Duration
+}
+
+// newConcurrencyLimiter - wrap next, allowing at most limit concurrent calls
+func newConcurrencyLimiter(next WeatherProvider, limit int) *concurrencyLimiter {
+	return &concurrencyLimiter{next: next, slots: make(chan struct{}, limit)}
+}
+
+// withQueue - let up to depth calls over the limit wait as long as wait for a slot
+func (l *concurrencyLimiter) withQueue(depth int, wait time.Duration) *concurrencyLimiter {
+	if depth > 0 && wait > 0 {
+		l.queue = make(chan struct{}, depth)
+		l.queueWait = wait
+	}
+	return l
+}
+
+// Fetch - call the wrapped provider if a slot is free, or frees up while the call waits in the queue
+func (l *concurrencyLimiter) Fetch(ctx context.Context, q weatherQuery) (*WeatherData, error) {
+	if err := l.acquire(ctx); err != nil {
+		metrics.upstreamRejected.Add(1)
+		return nil, err
+	}
+	defer func() { <-l.slots }()
+	return l.next.Fetch(ctx, q)
+}
+
+// acquire - take a slot, queueing for one if the queue has room
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}: // a nil queue is never ready, so without one we fall through
+	default:
+		return errUpstreamBusy
+	}
+	defer func() { <-l.queue }()
+
+	timer := time.NewTimer(l.queueWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errUpstreamBusy
+	case <-ctx.Done():
+		return errUpstreamBusy
+	}
+}
+
+// Ping - pass health checks through to the wrapped provider (they don't take a slot)
+func (l *concurrencyLimiter) Ping(ctx context.Context) error {
+	if p, ok := l.next.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
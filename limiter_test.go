@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	const limit = 2
+	release := make(chan struct{})
+	slow := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		<-release
+		return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`), nil
+	}}
+	cfg := defaultConfig()
+	cfg.Provider = newConcurrencyLimiter(slow, limit)
+	cfg.Cache = newWeatherCache(0, 0, cfg.Clock)
+	cfg.Coalescer = newCoalescer(0)
+	withConfig(t, cfg)
+
+	// fill every slot with a request the provider is sitting on
+	var wg sync.WaitGroup
+	codes := make([]int, limit)
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/weather?lat=%d&lon=1", i), nil))
+			codes[i] = w.Code
+		}(i)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for slow.Calls() < limit {
+		if time.Now().After(deadline) {
+			t.Fatal("requests never reached the provider")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rejected := metrics.upstreamRejected.Load()
+	w := httptest.NewRecorder()
+	weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=50&lon=1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when saturated, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+	if metrics.upstreamRejected.Load()-rejected != 1 {
+		t.Error("Expected the rejection to be counted")
+	}
+
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d: expected 200, got %d", i, code)
+		}
+	}
+
+	// the slots are free again
+	w = httptest.NewRecorder()
+	weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=50&lon=1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 once slots are released, got %d", w.Code)
+	}
+}
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	const wait = 200 * time.Millisecond
+	weather := `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+
+	t.Run("Burst within the queue", func(t *testing.T) {
+		// each call holds its slot briefly, so the queued ones are admitted well within the wait
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			time.Sleep(20 * time.Millisecond)
+			return weatherDataFromJSON(t, weather), nil
+		}}
+		limiter := newConcurrencyLimiter(provider, 1).withQueue(3, wait)
+
+		var wg sync.WaitGroup
+		errs := make([]error, 4)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = limiter.Fetch(context.Background(), weatherQuery{Lat: float64(i)})
+			}(i)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				t.Errorf("call %d: unexpected error: %v", i, err)
+			}
+		}
+		if provider.Calls() != 4 {
+			t.Errorf("Expected 4 provider calls, got %d", provider.Calls())
+		}
+	})
+
+	t.Run("Burst overflowing the queue", func(t *testing.T) {
+		release := make(chan struct{})
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			<-release
+			return weatherDataFromJSON(t, weather), nil
+		}}
+		limiter := newConcurrencyLimiter(provider, 1).withQueue(1, wait)
+		defer close(release)
+
+		// one call holds the only slot
+		go func() { _, _ = limiter.Fetch(context.Background(), weatherQuery{}) }()
+		deadline := time.Now().Add(2 * time.Second)
+		for provider.Calls() < 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("call never reached the provider")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		// the next one waits in the queue, and gives up after the configured wait
+		queued := make(chan time.Duration)
+		go func() {
+			start := time.Now()
+			if _, err := limiter.Fetch(context.Background(), weatherQuery{}); !errors.Is(err, errUpstreamBusy) {
+				t.Errorf("Expected errUpstreamBusy for the queued call, got %v", err)
+			}
+			queued <- time.Since(start)
+		}()
+		for len(limiter.queue) < 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// with the queue full, the one after that is turned away straight away
+		start := time.Now()
+		if _, err := limiter.Fetch(context.Background(), weatherQuery{}); !errors.Is(err, errUpstreamBusy) {
+			t.Errorf("Expected errUpstreamBusy with a full queue, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed >= wait {
+			t.Errorf("Expected an immediate rejection with a full queue, took %s", elapsed)
+		}
+
+		elapsed := <-queued
+		if elapsed < wait || elapsed > wait+150*time.Millisecond {
+			t.Errorf("Expected the queued call to wait about %s, took %s", wait, elapsed)
+		}
+	})
+
+	t.Run("Rejected with 503", func(t *testing.T) {
+		release := make(chan struct{})
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			<-release
+			return weatherDataFromJSON(t, weather), nil
+		}}
+		cfg := defaultConfig()
+		cfg.Provider = newConcurrencyLimiter(provider, 1).withQueue(1, 50*time.Millisecond)
+		cfg.Cache = newWeatherCache(0, 0, cfg.Clock)
+		cfg.Coalescer = newCoalescer(0)
+		withConfig(t, cfg)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			weatherHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		}()
+		for provider.Calls() < 1 {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=2&lon=1", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 after waiting in the queue, got %d", w.Code)
+		}
+		close(release)
+		<-done
+	})
+}
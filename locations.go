@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// locationEnvPrefix - environment variables naming a location, e.g. LOCATION_HQ="37.77,-122.42"
+const locationEnvPrefix = "LOCATION_"
+
+// loadLocations - parse the LOCATION_* variables in environ (as from os.Environ) into named locations
+// Names are case-insensitive, so LOCATION_HQ is queried as location=hq (or HQ).
+func loadLocations(environ []string) (map[string]weatherQuery, error) {
+	locations := map[string]weatherQuery{}
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		alias, found := strings.CutPrefix(name, locationEnvPrefix)
+		if !found {
+			continue
+		}
+		if alias == "" {
+			return nil, fmt.Errorf("%s needs a location name after the prefix", name)
+		}
+		q, err := parseCoordPair(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		locations[strings.ToLower(alias)] = q
+	}
+	return locations, nil
+}
+
+// coordinatesFromLocation - resolve the location parameter to the coordinates the operator named
+// location can't be combined with lat/lon or zip, and unknown names are a 404.  On failure the error
+// response has already been written and ok is false.
+func coordinatesFromLocation(w http.ResponseWriter, params url.Values) (latitude, longitude float64, ok bool) {
+	if params.Has("lat") || params.Has("lon") || params.Has("zip") {
+		slog.Info("input error: location combined with lat/lon or zip")
+		http.Error(w, "location cannot be combined with lat/lon or zip", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	name := strings.ToLower(strings.TrimSpace(params.Get("location")))
+	location, found := config.Locations[name]
+	if !found {
+		slog.Info("input error: unknown location", "location", name)
+		http.Error(w, "Unknown location", http.StatusNotFound)
+		return 0, 0, false
+	}
+	return location.Lat, location.Lon, true
+}
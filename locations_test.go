@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLoadLocations(t *testing.T) {
+	locations, err := loadLocations([]string{"LOCATION_HQ=37.77,-122.42", "LOCATION_Lab= 51.51, -0.13 ", "PATH=/usr/bin"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(locations) != 2 {
+		t.Fatalf("Expected 2 locations, got %v", locations)
+	}
+	if locations["hq"] != (weatherQuery{Lat: 37.77, Lon: -122.42}) {
+		t.Errorf("unexpected hq: %+v", locations["hq"])
+	}
+	if locations["lab"] != (weatherQuery{Lat: 51.51, Lon: -0.13}) {
+		t.Errorf("unexpected lab: %+v", locations["lab"])
+	}
+
+	for _, environ := range [][]string{
+		{"LOCATION_HQ=37.77"},
+		{"LOCATION_HQ=137.77,-122.42"},
+		{"LOCATION_HQ=37.77,west"},
+		{"LOCATION_=37.77,-122.42"},
+	} {
+		if _, err := loadLocations(environ); err == nil {
+			t.Errorf("Expected error for %v", environ)
+		}
+	}
+}
+
+func TestLocationsConfig(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.Unsetenv("LOCATION_HQ")
+	})
+	_ = os.Setenv("LOCATION_HQ", "37.77,-122.42")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Locations["hq"] != (weatherQuery{Lat: 37.77, Lon: -122.42}) {
+		t.Errorf("unexpected locations: %+v", cfg.Locations)
+	}
+
+	_ = os.Setenv("LOCATION_HQ", "somewhere")
+	if _, err := loadConfig(); err == nil {
+		t.Error("Expected an invalid LOCATION_HQ to fail startup")
+	}
+}
+
+func TestWeatherByLocation(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+
+	testCases := []struct {
+		name     string
+		target   string
+		expected int
+	}{
+		{"Known alias", "/weather?location=hq", http.StatusOK},
+		{"Any case", "/weather?location=HQ", http.StatusOK},
+		{"Unknown alias", "/weather?location=moon", http.StatusNotFound},
+		{"Combined with lat/lon", "/weather?location=hq&lat=1&lon=1", http.StatusBadRequest},
+		{"Combined with zip", "/weather?location=hq&zip=94103", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := useWeather(t, payload)
+			var requested weatherQuery
+			provider.fetch = func(q weatherQuery) (*WeatherData, error) {
+				requested = q
+				return weatherDataFromJSON(t, payload), nil
+			}
+			config.Locations = map[string]weatherQuery{"hq": {Lat: 37.77, Lon: -122.42}}
+
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			if w.Code != tc.expected {
+				t.Fatalf("Expected %d, got %d", tc.expected, w.Code)
+			}
+			if tc.expected == http.StatusOK && requested != (weatherQuery{Lat: 37.77, Lon: -122.42}) {
+				t.Errorf("Expected the hq coordinates, got %+v", requested)
+			}
+			if tc.expected != http.StatusOK && provider.Calls() != 0 {
+				t.Error("Rejected requests should not reach the provider")
+			}
+		})
+	}
+}
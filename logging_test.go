@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs - send the default logger's output at level to a buffer for the duration of the test
+func captureLogs(t *testing.T, level slog.Level) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(newLogger(&buf, level))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+	return &buf
+}
+
+func TestParseLogLevel(t *testing.T) {
+	testCases := []struct {
+		raw      string
+		expected slog.Level
+		valid    bool
+	}{
+		{"", slog.LevelInfo, true},
+		{"debug", slog.LevelDebug, true},
+		{"INFO", slog.LevelInfo, true},
+		{"warn", slog.LevelWarn, true},
+		{"error", slog.LevelError, true},
+		{"verbose", slog.LevelInfo, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run("Level "+tc.raw, func(t *testing.T) {
+			level, err := parseLogLevel(tc.raw)
+			if (err == nil) != tc.valid {
+				t.Fatalf("Unexpected error result: %v", err)
+			}
+			if level != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, level)
+			}
+		})
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	redacted := redactURL("https://api.openweathermap.org/data/2.5/weather?appid=abcdef0123456789abcdef0123456789&lat=1")
+	if strings.Contains(redacted, "abcdef0123456789") {
+		t.Errorf("API key leaked: %s", redacted)
+	}
+	if !strings.Contains(redacted, "appid=REDACTED") || !strings.Contains(redacted, "lat=1") {
+		t.Errorf("unexpected redacted url: %s", redacted)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	handler := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			slog.Error("something broke", "error", fmt.Errorf("boom"))
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+
+	t.Run("Info level logs the access line", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelInfo)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hello?secret=x", nil))
+		line := logs.String()
+		for _, expected := range []string{"msg=request", "method=GET", "path=/hello", "status=200", "bytes=5", "duration="} {
+			if !strings.Contains(line, expected) {
+				t.Errorf("Expected %q in access log: %s", expected, line)
+			}
+		}
+		if strings.Contains(line, "secret") {
+			t.Errorf("query string leaked into access log: %s", line)
+		}
+	})
+
+	t.Run("Warn level suppresses access lines but keeps errors", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelWarn)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hello", nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fail", nil))
+		output := logs.String()
+		if strings.Contains(output, "msg=request") {
+			t.Errorf("Expected no access log at warn level: %s", output)
+		}
+		if !strings.Contains(output, "level=ERROR") || !strings.Contains(output, "something broke") {
+			t.Errorf("Expected error log at warn level: %s", output)
+		}
+	})
+}
@@ -1,152 +1,729 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 // WeatherData - structure of the JSON response from OpenWeather API
 type WeatherData struct {
 	Weather []struct {
+		ID          int    `json:"id"`
 		Description string `json:"description"`
+		Icon        string `json:"icon"`
 	} `json:"weather"`
 	Main struct {
 		Temperature float64 `json:"temp"`
+		Humidity    float64 `json:"humidity"`
 	} `json:"main"`
+	Name string `json:"name"`
+	Sys  struct {
+		Country string `json:"country"`
+	} `json:"sys"`
+	Wind *struct {
+		Speed   float64 `json:"speed"`
+		Degrees float64 `json:"deg"`
+	} `json:"wind"`
+	Observed  int64           `json:"dt"` // when the provider observed the conditions (unix seconds)
+	Source    string          `json:"-"`  // the name of the provider that supplied the data
+	FetchedAt time.Time       `json:"-"`  // when we fetched it from the provider
+	Raw       json.RawMessage `json:"-"`  // the provider's response as JSON, kept for raw=true (DEBUG_ENDPOINTS)
 }
 
-// getAPIKey - Fetch the OpenWeather API key
+// Validation errors.  Functions wrap these with the offending value, so callers can classify a failure
+// with errors.Is while the message stays human-readable.
+var (
+	ErrMissingAPIKey       = errors.New("OPENWEATHER_API_KEY is not set")
+	ErrMalformedAPIKey     = errors.New("API key failed pattern check")
+	ErrInvalidLatitude     = errors.New("invalid latitude format")
+	ErrLatitudeOutOfRange  = errors.New("latitude out of range (-90 to 90 degrees)")
+	ErrInvalidLongitude    = errors.New("invalid longitude format")
+	ErrLongitudeOutOfRange = errors.New("longitude out of range (-180 to 180 degrees)")
+)
+
+// getAPIKey - Fetch the OpenWeather API key from the configured SecretSource and validate it
 //
-// ToDo: in a production environment we should be pulling this from a secret vault, not opsys env var.
 // ToDo: validating the apiKey will have performance implications at scale, and pre-validating the source
 //
 //	may be the better solution.
-func getAPIKey() (string, error) {
+func getAPIKey(ctx context.Context) (string, error) {
+	apiKey, err := config.SecretSource.Get(ctx)
+	if err != nil {
+		return "", err
+	}
+	return validateAPIKey(apiKey)
+}
+
+// validateAPIKey - check that key (once trimmed) looks like an OpenWeather API key
+func validateAPIKey(apiKey string) (string, error) {
 	const apiKeyRegex = "^[a-f0-9]{32}$"
-	apiKey := strings.TrimSpace(os.Getenv("OPENWEATHER_API_KEY"))
+	apiKey = strings.TrimSpace(apiKey)
 	if apiKey == "" {
-		return apiKey, fmt.Errorf("OPENWEATHER_API_KEY is not set")
+		return apiKey, ErrMissingAPIKey
 	}
 	pattern := regexp.MustCompile(apiKeyRegex)
 	if !pattern.MatchString(apiKey) {
-		return apiKey, fmt.Errorf("API key failed pattern check")
+		return apiKey, ErrMalformedAPIKey
 	} else {
 		return apiKey, nil
 	}
 }
 
-// validateLatitude - Verify that the given latitude is valid
-// We don't want to pass unsanitized information to a vendor's API
+// maxCoordinateLength - longest raw lat/lon string we will attempt to parse
+// Anything longer is not a sensible coordinate, and we don't want ParseFloat churning on a huge input.
+const maxCoordinateLength = 32
+
+// coordinateErrors - the errors validateCoordinate wraps, for each coordinate it validates
+var coordinateErrors = map[string]struct{ invalid, outOfRange error }{
+	"latitude":  {ErrInvalidLatitude, ErrLatitudeOutOfRange},
+	"longitude": {ErrInvalidLongitude, ErrLongitudeOutOfRange},
+}
+
+// validateCoordinate - parse raw as the named coordinate ("latitude" or "longitude"), between min and max
+// We don't want to pass unsanitized information to a vendor's API.  Surrounding whitespace is ignored, and
+// a leading + or - sign is fine; NaN and infinities are not numbers we can look up.  Failures wrap the
+// coordinate's invalid or out of range error, with the offending value.
+func validateCoordinate(raw string, min, max float64, name string) (float64, error) {
+	errs := coordinateErrors[name]
+	raw = strings.TrimSpace(raw)
+	if len(raw) > maxCoordinateLength {
+		return 0, fmt.Errorf("%w: too long (max %d characters): %d", errs.invalid, maxCoordinateLength, len(raw))
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("%w: %s", errs.invalid, raw)
+	}
+	if value < min || value > max {
+		return 0, fmt.Errorf("%w: %f", errs.outOfRange, value)
+	}
+	return value + 0, nil // -0 + 0 is +0
+}
+
+// validateLatitude - Verify that the given latitude is valid (-90 to 90)
 func validateLatitude(raw string) (float64, error) {
-	lat, err := strconv.ParseFloat(raw, 64)
+	return validateCoordinate(raw, -90, 90, "latitude")
+}
+
+// validateLongitude - Verify that the given longitude is valid (-180 to 180)
+func validateLongitude(raw string) (float64, error) {
+	return validateCoordinate(raw, -180, 180, "longitude")
+}
+
+// earliestHistoricalTime - the provider has no historical data before this
+var earliestHistoricalTime = time.Date(1979, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// validateTimestamp - Verify a historical lookup time (Unix seconds).  Empty means current weather.
+// The time must be in the past and no earlier than the provider's history goes back.
+func validateTimestamp(raw string, now time.Time) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(raw, 10, 64)
 	if err != nil {
-		return 0, fmt.Errorf("invalid latitude format: %s", raw)
+		return time.Time{}, fmt.Errorf("invalid timestamp: %s", raw)
 	}
-	if lat < -90 || lat > 90 {
-		return 0, fmt.Errorf("latitude out of range (-90 to 90 degrees): %f", lat)
+	at := time.Unix(seconds, 0)
+	if at.After(now) {
+		return time.Time{}, fmt.Errorf("timestamp is in the future: %s", raw)
 	}
-	return lat, nil
+	if at.Before(earliestHistoricalTime) {
+		return time.Time{}, fmt.Errorf("timestamp is before %s: %s", earliestHistoricalTime.Format(time.DateOnly), raw)
+	}
+	return at, nil
 }
 
-// validateLongitude - Verify that the given longitude is valid
-// We don't want to pass unsanitized information to a vendor's API
-func validateLongitude(raw string) (float64, error) {
-	lon, err := strconv.ParseFloat(raw, 64)
+// weatherQueryParams - the query parameters understood by the weather endpoints
+var weatherQueryParams = []string{"lat", "lon", "zip", "location", "format", "emoji", "all_units", "timestamp", "units", "include", "exclude", "pretty", "indent", "raw"}
+
+// unknownQueryParams - list (sorted) any query parameters not in allowed
+func unknownQueryParams(r *http.Request, allowed []string) []string {
+	var unknown []string
+	for name := range r.URL.Query() {
+		if !slices.Contains(allowed, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
+
+// rejectUnknownQueryParams - in strict mode, reject requests carrying query parameters we don't recognize
+// This catches typos such as latt= or lng= which would otherwise surface as a confusing missing parameter.
+// Returns true if the request was rejected (and the error response written).
+func rejectUnknownQueryParams(w http.ResponseWriter, r *http.Request, allowed []string) bool {
+	if !config.StrictQuery {
+		return false
+	}
+	if unknown := unknownQueryParams(r, allowed); len(unknown) > 0 {
+		slog.Info("input error: unknown query parameters", "params", unknown)
+		http.Error(w, "Unknown query parameters: "+strings.Join(unknown, ", "), http.StatusBadRequest)
+		return true
+	}
+	return false
+}
+
+// singleValueQueryParams - query parameters that only make sense once
+// Go takes the first of repeated values, which could hide a client bug (e.g. ?lat=10&lat=20).
+var singleValueQueryParams = []string{"lat", "lon", "units", "format"}
+
+// duplicateQueryParams - list (sorted) the parameters in names the request repeats
+func duplicateQueryParams(r *http.Request, names []string) []string {
+	var duplicates []string
+	for name, values := range r.URL.Query() {
+		if len(values) > 1 && slices.Contains(names, name) {
+			duplicates = append(duplicates, name)
+		}
+	}
+	slices.Sort(duplicates)
+	return duplicates
+}
+
+// rejectDuplicateQueryParams - in strict mode, reject requests repeating a singleValueQueryParams parameter
+// Otherwise we log a warning and the first value is used.
+// Returns true if the request was rejected (and the error response written).
+func rejectDuplicateQueryParams(w http.ResponseWriter, r *http.Request) bool {
+	duplicates := duplicateQueryParams(r, singleValueQueryParams)
+	if len(duplicates) == 0 {
+		return false
+	}
+	if !config.StrictQuery {
+		slog.Warn("duplicate query parameters, using the first of each", "params", duplicates)
+		return false
+	}
+	slog.Info("input error: duplicate query parameters", "params", duplicates)
+	http.Error(w, "Duplicate query parameters: "+strings.Join(duplicates, ", "), http.StatusBadRequest)
+	return true
+}
+
+// coordinatesFromRequest - validate the lat/lon query parameters
+// Coordinates outside the configured bounding box are refused with a 403.
+// If the request has neither and the operator configured a default location, that is used instead.
+// On failure the error response has already been written and ok is false.
+func coordinatesFromRequest(w http.ResponseWriter, r *http.Request) (latitude, longitude float64, ok bool) {
+	return coordinatesFromParams(w, r.URL.Query())
+}
+
+// coordinatesFromParams - as coordinatesFromRequest, for parameters that may not have come from the query
+// string (e.g. a POST body)
+func coordinatesFromParams(w http.ResponseWriter, params url.Values) (latitude, longitude float64, ok bool) {
+	if config.DefaultLocation != nil && !params.Has("lat") && !params.Has("lon") {
+		return config.DefaultLocation.Lat, config.DefaultLocation.Lon, true
+	}
+
+	latitude, err := validateLatitude(params.Get("lat"))
+	if err != nil {
+		slog.Info("input error", "error", err)
+		metrics.countError(reasonInvalidLat)
+		http.Error(w, "Invalid latitude", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	longitude, err = validateLongitude(params.Get("lon"))
 	if err != nil {
-		return 0, fmt.Errorf("invalid longitude format: %s", raw)
+		slog.Info("input error", "error", err)
+		metrics.countError(reasonInvalidLon)
+		http.Error(w, "Invalid longitude", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	if config.StrictCoords && looksSwapped(latitude, longitude, config.CoordRegion) {
+		slog.Info("coordinates look swapped", "lat", latitude, "lon", longitude)
+		w.Header().Set("X-Coord-Warning", "lat and lon look swapped")
 	}
-	if lon < -180 || lon > 180 {
-		return 0, fmt.Errorf("longitude out of range (-180 to 180 degrees): %f", lon)
+
+	if rejectOutsideBoundingBox(w, latitude, longitude) {
+		return 0, 0, false
+	}
+	return latitude, longitude, true
+}
+
+// looksSwapped - whether lat/lon falls outside region but lon/lat falls inside it
+// A heuristic for the common client bug of swapping the two: it can't catch swaps within the region, and
+// only flags what is plausibly a mistake, so we warn rather than reject.
+func looksSwapped(lat, lon float64, region *boundingBox) bool {
+	if region == nil || region.Contains(lat, lon) {
+		return false
 	}
-	return lon, nil
+	return math.Abs(lon) <= 90 && region.Contains(lon, lat)
 }
 
-// healthCheck - provide a simple healthcheck response
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	if _, err := w.Write([]byte("ok")); err != nil {
-		log.Printf("healthcheck failed: %v", err)
+// rejectOutsideBoundingBox - refuse coordinates outside the configured bounding box with a 403
+// Returns true if the request was rejected (and the error response written).
+func rejectOutsideBoundingBox(w http.ResponseWriter, latitude, longitude float64) bool {
+	if config.BoundingBox.Contains(latitude, longitude) {
+		return false
 	}
+	slog.Info("coordinates outside the bounding box", "lat", latitude, "lon", longitude)
+	http.Error(w, "Coordinates are outside the area served", http.StatusForbidden)
+	return true
+}
+
+// coordinatesFromZip - resolve the zip parameter to coordinates
+// zip can't be combined with lat/lon.  On failure the error response has already been written and ok is
+// false.
+func coordinatesFromZip(ctx context.Context, w http.ResponseWriter, params url.Values) (latitude, longitude float64, ok bool) {
+	if params.Has("lat") || params.Has("lon") {
+		slog.Info("input error: zip combined with lat/lon")
+		http.Error(w, "zip cannot be combined with lat/lon", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	zip, err := validateZip(params.Get("zip"))
+	if err != nil {
+		slog.Info("input error", "error", err)
+		http.Error(w, "Invalid ZIP code", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	location, err := config.Geocoder.LookupZip(ctx, zip)
+	if errors.Is(err, errZipNotFound) {
+		slog.Info("input error", "error", err)
+		http.Error(w, "Unknown ZIP code", http.StatusNotFound)
+		return 0, 0, false
+	}
+	if err != nil {
+		writeFetchError(w, err)
+		return 0, 0, false
+	}
+
+	if rejectOutsideBoundingBox(w, location.Lat, location.Lon) {
+		return 0, 0, false
+	}
+	return location.Lat, location.Lon, true
+}
+
+// clientGone - whether r's client has disconnected, in which case there is no one to answer
+// It is logged at debug level: a client going away is nothing wrong at our end.
+func clientGone(r *http.Request) bool {
+	if !errors.Is(r.Context().Err(), context.Canceled) {
+		return false
+	}
+	slog.Debug("request cancelled by the client", "path", r.URL.Path)
+	return true
+}
+
+// writeFetchError - translate a provider error into an http error response
+func writeFetchError(w http.ResponseWriter, err error) {
+	metrics.countFetchError(err)
+	if errors.Is(err, errInvalidAPIKey) {
+		slog.Error("configuration error", "error", err)
+		http.Error(w, "invalid API key", http.StatusInternalServerError)
+		return
+	}
+	if errors.Is(err, errEmptyResponse) {
+		// usually a passing provider incident, so suggest trying again shortly
+		slog.Error("upstream error", "error", err)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if errors.Is(err, errInvalidResponse) {
+		slog.Error("upstream error", "error", err)
+		http.Error(w, errInvalidResponse.Error(), http.StatusBadGateway)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Error("upstream error", "error", err)
+		http.Error(w, "weather provider did not respond in time", http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, errUpstreamBusy) {
+		slog.Warn("upstream error", "error", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errCircuitOpen) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errObservationTooOld) {
+		// the provider is answering, but with old data: usually an outage at its end
+		slog.Warn("upstream error", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		switch upstreamErr.StatusCode {
+		case http.StatusTooManyRequests:
+			// the provider is throttling us: pass its Retry-After on so our clients back off too
+			slog.Error("upstream error", "error", err)
+			if upstreamErr.RetryAfter != "" {
+				w.Header().Set("Retry-After", upstreamErr.RetryAfter)
+			}
+			http.Error(w, "weather provider is rate limiting requests", http.StatusServiceUnavailable)
+			return
+		case http.StatusUnauthorized:
+			slog.Error("configuration error", "error", err)
+			http.Error(w, "invalid API key", http.StatusInternalServerError)
+			return
+		case http.StatusBadRequest, http.StatusNotFound:
+			// the provider couldn't answer for these parameters; its message says why
+			slog.Info("upstream rejected the request", "error", err)
+			http.Error(w, err.Error(), upstreamErr.StatusCode)
+			return
+		}
+	}
+	slog.Error("upstream error", "error", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
 // weatherHandler - http handler
+// GET takes its parameters from the query string; POST may also send lat, lon and units as a JSON body.
 func weatherHandler(w http.ResponseWriter, r *http.Request) {
-	apiKey, err := getAPIKey()
-	if apiKey == "" {
-		http.Error(w, "invalid API key", http.StatusInternalServerError)
+	if rejectUnsupportedMethod(w, r) {
+		return
+	}
+	if rejectUnknownQueryParams(w, r, weatherQueryParams) || rejectDuplicateQueryParams(w, r) {
+		return
+	}
+
+	params := r.URL.Query()
+	if r.Method == http.MethodPost {
+		var valid bool
+		if params, valid = paramsFromJSONBody(w, r); !valid {
+			return
+		}
+	}
+
+	var latitude, longitude float64
+	var ok bool
+	switch {
+	case params.Has("location"):
+		latitude, longitude, ok = coordinatesFromLocation(w, params)
+	case params.Has("zip"):
+		latitude, longitude, ok = coordinatesFromZip(r.Context(), w, params)
+	default:
+		latitude, longitude, ok = coordinatesFromParams(w, params)
+	}
+	if !ok {
 		return
 	}
 
-	latitude, err := validateLatitude(r.URL.Query().Get("lat"))
+	units, err := validateUnits(params.Get("units"))
 	if err != nil {
-		log.Printf("input error: %v", err)
-		http.Error(w, "Invalid latitude", http.StatusBadRequest)
+		slog.Info("input error", "error", err)
+		http.Error(w, "Invalid units", http.StatusBadRequest)
 		return
 	}
 
-	longitude, err := validateLongitude(r.URL.Query().Get("lon"))
+	format, err := responseFormat(r)
 	if err != nil {
-		log.Printf("input error: %v", err)
-		http.Error(w, "Invalid longitude", http.StatusBadRequest)
+		slog.Info("input error", "error", err)
+		http.Error(w, "Invalid format", http.StatusBadRequest)
 		return
 	}
 
-	// Construct the API request URL
-	url := fmt.Sprintf("https://api.openweathermap.org/data/2.5/weather?lat=%f&lon=%f&units=metric&appid=%s",
-		latitude, longitude, apiKey)
+	at, err := validateTimestamp(params.Get("timestamp"), config.Clock.Now())
+	if err != nil {
+		slog.Info("input error", "error", err)
+		http.Error(w, "Invalid timestamp", http.StatusBadRequest)
+		return
+	}
 
-	// Make the HTTP request to OpenWeather API
-	resp, err := http.Get(url)
+	includes, err := validateIncludes(params.Get("include"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.Info("input error", "error", err)
+		http.Error(w, "Invalid include", http.StatusBadRequest)
 		return
 	}
 
-	defer func() {
-		if err = resp.Body.Close(); err != nil {
-			log.Printf("error closing body: %v", err)
-		}
-	}()
+	exclude, err := validateExcludes(params.Get("exclude"))
+	if err != nil {
+		slog.Info("input error", "error", err)
+		http.Error(w, "Invalid exclude", http.StatusBadRequest)
+		return
+	}
+	// only a One Call current lookup takes exclude; anywhere else it would be silently ignored
+	if exclude != "" && (!isOneCallPath(config.APIPath) || !at.IsZero()) {
+		slog.Info("input error", "error", "exclude without a One Call current lookup", "api_path", config.APIPath)
+		http.Error(w, "exclude only applies to current weather from a One Call OPENWEATHER_API_PATH", http.StatusBadRequest)
+		return
+	}
 
-	var weatherData WeatherData
-	if err := json.NewDecoder(resp.Body).Decode(&weatherData); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// every provider call made for this request (including retries) shares one time budget
+	ctx := r.Context()
+	if config.RequestBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.RequestBudget)
+		defer cancel()
+	}
+
+	query := weatherQuery{Lat: latitude, Lon: longitude, At: at, Exclude: exclude}
+	// enrichments describe conditions now, so historical lookups don't get them
+	var enrichments *enrichmentRun
+	if at.IsZero() {
+		enrichments = startEnrichments(ctx, query, includes)
+	}
+	weatherData, status, err := fetchWeather(ctx, query)
+	// the fetch carries on when the client goes (others may share it), so we check for ourselves
+	if clientGone(r) {
+		return
+	}
+	if err != nil {
+		if config.NotFoundPolicy == "structured" && isUpstreamNotFound(err) {
+			metrics.countFetchError(err)
+			slog.Info("no weather data for the coordinates", "lat", latitude, "lon", longitude, "error", err)
+			writeNoWeatherData(w, format, latitude, longitude)
+			return
+		}
+		writeFetchError(w, err)
 		return
 	}
+	openWater := at.IsZero() && isOpenWater(weatherData)
+	if openWater && config.OceanPolicy == "reject" {
+		slog.Info("coordinates point to open water", "lat", latitude, "lon", longitude)
+		http.Error(w, "Coordinates point to open water", http.StatusNotFound)
+		return
+	}
+	stale := status == cacheStale
+	w.Header().Set("X-Cache", string(status))
+	if stale {
+		w.Header().Set("X-Weather-Stale", "true")
+	}
+	if weatherData.Source != "" {
+		w.Header().Set("X-Weather-Source", weatherData.Source)
+	}
 
-	// Get the weather condition & temperature information
-	weatherCondition := weatherData.Weather[0].Description
-	temperature := weatherData.Main.Temperature
-	temperatureDesc := getTemperature(temperature)
+	if alert := temperatureAlert(weatherData.Main.Temperature, config.AlertAbove, config.AlertBelow); alert != "" {
+		w.Header().Set("X-Temp-Alert", alert)
+	}
 
-	httpResponse := fmt.Sprintf("Current Temperature:\n"+
-		"  Weather     : %s\n"+
-		"  Temperature : %s", weatherCondition, temperatureDesc)
+	if units == "" && config.InferUnits {
+		units = inferUnits(weatherData.Sys.Country, r.Header.Get("Accept-Language"))
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	opts := responseOptionsFromRequest(r)
+	opts.Units = units
+	response := newWeatherResponse(weatherData, opts)
+	if openWater && config.OceanPolicy == "annotate" {
+		response.Note = openWaterNote
+	}
+	// how old the observation is, whatever its age in our cache
+	// Not the Age header: caches would take it from max-age and expire the response early (RFC 9111).
+	if age, ok := observationAge(weatherData.Observed, config.Clock.Now()); ok {
+		w.Header().Set("X-Observation-Age", strconv.Itoa(int(age/time.Second)))
+		response.ObservedAt = time.Unix(weatherData.Observed, 0).UTC().Format(time.RFC3339)
+		response.Observed = formatObservationAge(age)
+	}
+	if response.Cached = status != cacheMiss; response.Cached && !weatherData.FetchedAt.IsZero() {
+		age := int(max(config.Clock.Now().Sub(weatherData.FetchedAt), 0) / time.Second)
+		response.CacheAge = &age
+	}
+	if config.Trend {
+		if previous, ok := config.Cache.Previous(r.Context(), requestCacheKey(r.Context(), query)); ok {
+			response.Trend = temperatureTrend(weatherData.Main.Temperature, previous, config.TrendThreshold)
+		}
+	}
+	if enrichments != nil {
+		enrichments.apply(&response)
+		if clientGone(r) {
+			return
+		}
+	}
+	if includeRaw, _ := strconv.ParseBool(params.Get("raw")); includeRaw && config.DebugEndpoints {
+		response.Raw = weatherData.Raw
+	}
+
+	// Send the response, cacheable downstream for as long as we would cache it ourselves
+	maxAge := config.CacheTTL
+	if stale {
+		maxAge = 0
+	}
+	writeWeatherResponse(w, r, format, response, maxAge)
+}
 
-	// Send the response
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	if _, err = fmt.Fprintf(w, httpResponse); err != nil {
-		log.Printf("error writing the response: %v", err)
+// conditionEmoji - map an OpenWeather condition code to an emoji
+// See https://openweathermap.org/weather-conditions for the code ranges.
+func conditionEmoji(id int) string {
+	switch {
+	case id >= 200 && id < 300:
+		return "⛈️" // thunderstorm
+	case id >= 300 && id < 400:
+		return "🌦️" // drizzle
+	case id == 511:
+		return "🧊" // freezing rain
+	case id >= 500 && id < 600:
+		return "🌧️" // rain
+	case id >= 600 && id < 700:
+		return "❄️" // snow
+	case id == 781:
+		return "🌪️" // tornado
+	case id >= 700 && id < 800:
+		return "🌫️" // mist, fog, haze, dust, etc.
+	case id == 800:
+		return "☀️" // clear sky
+	case id == 801 || id == 802:
+		return "⛅" // few or scattered clouds
+	case id > 802 && id < 900:
+		return "☁️" // broken or overcast clouds
+	default:
+		return "🌡️"
 	}
 }
 
-// getTemperature - Given temperature (in Celsius), determine hot/cold
-// I'm sure my European and Australian friends will appreciate this...
-// But we'll convert it to Fahrenheit as well for grins.
-func getTemperature(temp float64) string {
+// conditionGroup - map an OpenWeather condition code to its coarse condition group
+// See https://openweathermap.org/weather-conditions for the code ranges.
+func conditionGroup(id int) string {
+	switch {
+	case id >= 200 && id < 300:
+		return "Thunderstorm"
+	case id >= 300 && id < 400:
+		return "Drizzle"
+	case id >= 500 && id < 600:
+		return "Rain"
+	case id >= 600 && id < 700:
+		return "Snow"
+	case id >= 700 && id < 800:
+		return "Atmosphere"
+	case id == 800:
+		return "Clear"
+	case id > 800 && id < 900:
+		return "Clouds"
+	default:
+		return "Unknown"
+	}
+}
+
+// isSevereCondition - whether an OpenWeather condition code is dangerous enough to warn about
+// Thunderstorms, extreme rain, volcanic ash, squalls and tornadoes, plus the legacy extreme codes for
+// tornado, tropical storm, hurricane and hail.
+func isSevereCondition(id int) bool {
+	switch {
+	case id >= 200 && id < 300:
+		return true // thunderstorm
+	case id == 504, id == 762, id == 771, id == 781:
+		return true // extreme rain, volcanic ash, squalls, tornado
+	case id >= 900 && id <= 902, id == 906:
+		return true // tornado, tropical storm, hurricane, hail
+	default:
+		return false
+	}
+}
+
+// windDirection - convert a wind bearing (degrees) to a 16-point compass direction
+// Each point covers 22.5 degrees centered on its bearing, so N spans 348.75 through 11.25.
+func windDirection(deg float64) string {
+	points := [16]string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE",
+		"S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	return points[int((deg+11.25)/22.5)%16]
+}
+
+// getTemperature - describe a temperature (in Celsius), e.g. "Hot, 77°F (25°C)"
+// The requested units (metric, imperial or standard) come first; without any we lead with Fahrenheit.
+func getTemperature(temp float64, units string) string {
+	return fmt.Sprintf("%s, %s", temperatureFeel(temp), formatScales(temp, units, false))
+}
+
+// getTemperatureAllUnits - like getTemperature, but with Kelvin as well
+func getTemperatureAllUnits(temp float64, units string) string {
+	return fmt.Sprintf("%s, %s", temperatureFeel(temp), formatScales(temp, units, true))
+}
+
+// formatScales - render a temperature (in Celsius) in the requested units, with the other scales in
+// parentheses: "25°C (77°F)" for metric, "77°F (25°C)" for imperial (or no units).  withKelvin adds Kelvin
+// to the others; standard units always lead with it.
+// Every scale is rounded the same way (half away from zero, to TEMP_DECIMALS places) so the values agree
+// with each other.
+func formatScales(temp float64, units string, withKelvin bool) string {
+	var scales []string
+	switch units {
+	case "metric":
+		scales = []string{"C", "F"}
+	case "standard":
+		scales = []string{"K", "C", "F"}
+	default:
+		scales = []string{"F", "C"}
+	}
+	if withKelvin && units != "standard" {
+		scales = append(scales, "K")
+	}
+
+	formatted := make([]string, len(scales))
+	for i, scale := range scales {
+		formatted[i] = formatScale(temp, scale, config.TempDecimals)
+	}
+	return fmt.Sprintf("%s (%s)", formatted[0], strings.Join(formatted[1:], " / "))
+}
+
+// formatScale - a temperature (in Celsius) in one scale (C, F or K), rounded to decimals places
+// Nothing is colder than 0 K, so a reading below it (an upstream or conversion bug) is flagged as invalid
+// rather than shown as a negative Kelvin.
+func formatScale(temp float64, scale string, decimals int) string {
+	switch scale {
+	case "F":
+		return fmt.Sprintf("%.*f°F", decimals, roundTo(celsiusToFahrenheit(temp), decimals))
+	case "K":
+		kelvin := roundTo(celsiusToKelvin(temp), decimals)
+		if kelvin < 0 {
+			slog.Warn("temperature below absolute zero", "celsius", temp)
+			return invalidKelvin
+		}
+		return fmt.Sprintf("%.*f K", decimals, kelvin)
+	default:
+		return fmt.Sprintf("%.*f°C", decimals, roundTo(temp, decimals))
+	}
+}
+
+// invalidKelvin - what formatScale shows in place of a temperature below absolute zero
+const invalidKelvin = "invalid (below 0 K)"
+
+// roundTo - round v to the given number of decimal places, halves away from zero
+// (Printf alone rounds halves to even, so -2.5 would print as -2 rather than -3.)  Anything that rounds to
+// zero comes back as +0, so it never prints as "-0".
+func roundTo(v float64, decimals int) float64 {
+	scale := math.Pow10(decimals)
+	rounded := math.Round(v*scale) / scale
+	if rounded == 0 {
+		return 0 // -0 == 0, so this also replaces negative zero
+	}
+	return rounded
+}
+
+// temperatureFeel - classify a temperature (in Celsius) as Hot, Moderate or Cold
+func temperatureFeel(temp float64) string {
 	if temp > 24 {
-		return fmt.Sprintf("Hot (%.0f°F / %.0f°C)", celsiusToFahrenheit(temp), temp)
+		return "Hot"
 	} else if temp < 10 {
-		return fmt.Sprintf("Cold (%.0f°F / %.0f°C)", celsiusToFahrenheit(temp), temp)
+		return "Cold"
 	} else {
-		return fmt.Sprintf("Moderate (%.0f°F / %.0f°C)", celsiusToFahrenheit(temp), temp)
+		return "Moderate"
+	}
+}
+
+// dewPoint - approximate the dew point (Celsius) using the Magnus-Tetens formula
+// Humidity is a percentage; values above 100 are treated as saturated.  The dew point is undefined for
+// zero humidity (it tends to -Inf), so NaN is returned when humidity is not positive.
+func dewPoint(tempC, humidity float64) float64 {
+	const a, b = 17.62, 243.12
+	if humidity <= 0 {
+		return math.NaN()
 	}
+	humidity = math.Min(humidity, 100)
+	gamma := math.Log(humidity/100) + (a*tempC)/(b+tempC)
+	return (b * gamma) / (a - gamma)
 }
 
 // celsiusToFahrenheit - convert celsius to fahrenheit
@@ -154,24 +731,129 @@ func celsiusToFahrenheit(celsius float64) float64 {
 	return (celsius * 9.0 / 5.0) + 32.0
 }
 
+// celsiusToKelvin - convert celsius to kelvin
+func celsiusToKelvin(celsius float64) float64 {
+	return celsius + 273.15
+}
+
+// fahrenheitToCelsius - convert fahrenheit to celsius
+func fahrenheitToCelsius(fahrenheit float64) float64 {
+	return (fahrenheit - 32.0) * 5.0 / 9.0
+}
+
+// kelvinToCelsius - convert kelvin to celsius
+func kelvinToCelsius(kelvin float64) float64 {
+	return kelvin - 273.15
+}
+
+// toCelsius - normalize a temperature given in unit (C, F or K, case-insensitive) to Celsius
+// Provider data already comes in Celsius (units=metric); this is for configured temperatures such as the
+// alert thresholds, which may be given in any unit.
+func toCelsius(value float64, unit string) (float64, error) {
+	switch strings.ToUpper(strings.TrimSpace(unit)) {
+	case "C":
+		return value, nil
+	case "F":
+		return fahrenheitToCelsius(value), nil
+	case "K":
+		return kelvinToCelsius(value), nil
+	default:
+		return 0, fmt.Errorf("unknown temperature unit: %s", unit)
+	}
+}
+
+// validateListenHost - Verify the host portion of the listen address
+// An empty host, 0.0.0.0 or :: binds all interfaces.  Hostnames (e.g. localhost) are only accepted when
+// allowHostname (ALLOW_HOSTNAME) is set and the name resolves; otherwise we insist on a literal IP address.
+func validateListenHost(rawAddr string, allowHostname bool) (string, error) {
+	const hostnameRegex = `^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`
+
+	host := strings.TrimSpace(rawAddr)
+	if host == "" {
+		return "", nil // all interfaces
+	}
+
+	// IPv6 addresses may be given with or without brackets.
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); ip != nil {
+		return ip.String(), nil
+	}
+
+	if !allowHostname {
+		return "", fmt.Errorf("invalid IP address: %s", rawAddr)
+	}
+	if len(host) > 253 || !regexp.MustCompile(hostnameRegex).MatchString(host) {
+		return "", fmt.Errorf("invalid hostname: %s", rawAddr)
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return "", fmt.Errorf("unresolvable hostname: %s", rawAddr)
+	}
+	return host, nil
+}
+
+// errListenAddrNotSet - HTTP_LISTEN_ADDR is required to serve
+var errListenAddrNotSet = errors.New("missing IP address (HTTP_LISTEN_ADDR not set)")
+
 // GetHttpListenAddressAndPort - Get the IP addr and port we will listen on
-// Verify that the address and port are valid.
+// Verify that the address and port are valid.  HTTP_LISTEN_ADDR must be set, but may be set to an
+// empty string to listen on all interfaces.  loadConfig works out the addresses we serve on
+// (Config.ListenAddrs), which may be several; this reads a single one straight from the environment.
 func GetHttpListenAddressAndPort() (string, error) {
-	rawAddr := os.Getenv("HTTP_LISTEN_ADDR")
-	rawPort := os.Getenv("HTTP_LISTEN_PORT")
+	rawAddr, addrSet := os.LookupEnv("HTTP_LISTEN_ADDR")
+	if !addrSet {
+		return "", errListenAddrNotSet
+	}
+	allowHostname, err := getEnvBool("ALLOW_HOSTNAME", false)
+	if err != nil {
+		return "", err
+	}
+	addresses, err := listenAddresses(rawAddr, os.Getenv("HTTP_LISTEN_PORT"), allowHostname)
+	if err != nil {
+		return "", err
+	}
+	if len(addresses) != 1 {
+		return "", fmt.Errorf("expected one address in HTTP_LISTEN_ADDR, got %d", len(addresses))
+	}
+	return addresses[0], nil
+}
 
-	if strings.TrimSpace(rawAddr) == "" {
-		return "", fmt.Errorf("missing IP address (HTTP_LISTEN_ADDR not set)")
+// listenAddresses - Verify HTTP_LISTEN_ADDR (rawAddrs) and HTTP_LISTEN_PORT (rawPort), and join them into
+// the addresses we will listen on
+// rawAddrs may be a comma-separated list (e.g. "127.0.0.1,[::1]:9090"); each entry is a host, which listens
+// on rawPort, or a host:port of its own.  Every entry is verified, and one bad entry fails the lot.  An
+// empty rawAddrs listens on all interfaces.
+func listenAddresses(rawAddrs, rawPort string, allowHostname bool) ([]string, error) {
+	entries := strings.Split(rawAddrs, ",")
+	addresses := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		// a lone empty entry is all interfaces, but in a list it is more likely a stray comma
+		if len(entries) > 1 && strings.TrimSpace(entry) == "" {
+			return nil, fmt.Errorf("empty entry in HTTP_LISTEN_ADDR: %q", rawAddrs)
+		}
+		address, err := listenAddress(entry, rawPort, allowHostname)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(addresses, address) {
+			return nil, fmt.Errorf("duplicate listen address: %s", address)
+		}
+		addresses = append(addresses, address)
 	}
+	return addresses, nil
+}
 
-	if strings.TrimSpace(rawPort) == "" {
+// listenAddress - Verify one HTTP_LISTEN_ADDR entry, a host or a host:port, and join it with its port
+// A host without a port of its own listens on rawPort.
+func listenAddress(rawAddr, rawPort string, allowHostname bool) (string, error) {
+	host := strings.TrimSpace(rawAddr)
+	if splitHost, splitPort, err := net.SplitHostPort(host); err == nil {
+		host, rawPort = splitHost, splitPort
+	} else if strings.TrimSpace(rawPort) == "" {
 		return "", fmt.Errorf("missing port (HTTP_LISTEN_PORT not set)")
 	}
 
-	// Verify rawAddr is a valid IP address
-	ip := net.ParseIP(rawAddr)
-	if ip == nil {
-		return "", fmt.Errorf("invalid IP address: %s", rawAddr)
+	host, err := validateListenHost(host, allowHostname)
+	if err != nil {
+		return "", err
 	}
 
 	// Verify rawPort is a valid port number
@@ -180,18 +862,138 @@ func GetHttpListenAddressAndPort() (string, error) {
 		return "", fmt.Errorf("invalid port number: %s", rawPort)
 	}
 
-	return fmt.Sprintf("%s:%d", rawAddr, port), nil
+	// JoinHostPort brackets IPv6 addresses (e.g. [::1]:8080)
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// newServer - the http server for handler, with the connection timeouts from cfg
+// WriteTimeout covers the whole response, so the streaming endpoint lifts it for its own connections, and
+// ends them itself when the server shuts down.
+func newServer(address string, handler http.Handler, cfg *Config) *http.Server {
+	server := &http.Server{
+		Addr:         address,
+		Handler:      handler,
+		TLSConfig:    cfg.TLS,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	withShutdownSignal(server)
+	return server
+}
+
+// listen - bind the address the server will listen on
+// Bind failures are the most common startup problem, so the usual two get an explanation of what to do.
+func listen(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	switch {
+	case err == nil:
+		return listener, nil
+	case errors.Is(err, syscall.EACCES):
+		return nil, fmt.Errorf("permission denied binding %s: ports below 1024 need root or "+
+			"CAP_NET_BIND_SERVICE, or use a higher HTTP_LISTEN_PORT", address)
+	case errors.Is(err, syscall.EADDRINUSE):
+		return nil, fmt.Errorf("cannot bind %s: the address is already in use; stop whatever is listening "+
+			"there or choose another HTTP_LISTEN_PORT", address)
+	default:
+		return nil, fmt.Errorf("cannot bind %s: %w", address, err)
+	}
+}
+
+// serve - serve server on each of listeners (over TLS when certFile is set) until it is shut down
+// One server behind every listener means a single drain shuts them all down together.  The first failure,
+// other than the shutdown itself, closes the server and is returned once every listener has stopped.
+func serve(server *http.Server, listeners []net.Listener, certFile, keyFile string) error {
+	var group errgroup.Group
+	for _, listener := range listeners {
+		group.Go(func() error {
+			var err error
+			if certFile != "" {
+				slog.Info("server listening", "address", listener.Addr().String(), "tls", true)
+				err = server.ServeTLS(listener, certFile, keyFile)
+			} else {
+				slog.Info("server listening", "address", listener.Addr().String())
+				err = server.Serve(listener)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				_ = server.Close()
+				return err
+			}
+			return nil
+		})
+	}
+	return group.Wait()
 }
 
 func main() {
 
-	listenAddress, err := GetHttpListenAddressAndPort()
+	// weather-service check: validate the configuration, API key and provider, without serving anything
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(context.Background(), os.Args[2:], os.Stdout, loadConfig))
+	}
+
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("Error: %v", err)
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
 	}
+	config = cfg
+	slog.SetDefault(newLogger(os.Stderr, config.LogLevel))
 
-	http.HandleFunc("/health", healthCheck)
-	http.HandleFunc("/weather", weatherHandler)
-	fmt.Printf("Server listening on port %s...\n", listenAddress)
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
+	// SIGINT/SIGTERM cancel ctx, which stops the background work and shuts the server down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// weather-service fetch --lat <lat> --lon <lon>: print the weather once instead of serving it
+	if len(os.Args) > 1 && os.Args[1] == "fetch" {
+		code := runFetch(ctx, os.Args[2:], os.Stdout, os.Stderr)
+		stop()
+		os.Exit(code)
+	}
+
+	// a missing or bad key is not fatal: /weather reports it, and a SIGHUP can load a corrected key
+	_ = apiKeys.Reload(ctx)
+	reloadAPIKeyOnSignal(ctx)
+
+	if len(config.ListenAddrs) == 0 {
+		slog.Error("invalid listen address", "error", errListenAddrNotSet)
+		os.Exit(1)
+	}
+
+	var background sync.WaitGroup
+	if len(config.WarmCoords) > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			runCacheWarmer(ctx, config.WarmCoords, config.WarmInterval)
+		}()
+	}
+
+	// every address is bound before we serve any, so a bad one stops us before we have taken requests
+	listeners := make([]net.Listener, 0, len(config.ListenAddrs))
+	for _, address := range config.ListenAddrs {
+		listener, err := listen(address)
+		if err != nil {
+			slog.Error("server failed to start", "error", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	mux := http.NewServeMux()
+	setupRoutes(mux, config)
+	server := newServer(config.ListenAddrs[0], mux, config)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		<-ctx.Done()
+		drain(server, inFlight, config.ShutdownTimeout)
+	}()
+
+	if err := serve(server, listeners, config.TLSCertFile, config.TLSKeyFile); err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+	// Serve returns as soon as shutdown starts; wait for in-flight requests and the warmer
+	background.Wait()
 }
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetHttpListenAddressAndPort(t *testing.T) {
@@ -61,6 +72,128 @@ func TestGetHttpListenAddressAndPort(t *testing.T) {
 		}
 	})
 
+	t.Run("Valid IPv6 address", func(t *testing.T) {
+		t.Cleanup(func() {
+			// Clean up environment variables
+			_ = os.Unsetenv("HTTP_LISTEN_ADDR")
+			_ = os.Unsetenv("HTTP_LISTEN_PORT")
+		})
+		for _, rawAddr := range []string{"::1", "[::1]"} {
+			_ = os.Setenv("HTTP_LISTEN_ADDR", rawAddr)
+			_ = os.Setenv("HTTP_LISTEN_PORT", "8080")
+			addr, err := GetHttpListenAddressAndPort()
+			if err != nil {
+				t.Fatalf("Unexpected error (%s): %v", rawAddr, err)
+			}
+			if addr != "[::1]:8080" {
+				t.Errorf("Expected address '[::1]:8080', got '%s'", addr)
+			}
+		}
+	})
+
+	t.Run("IPv6 address can be bound", func(t *testing.T) {
+		t.Cleanup(func() {
+			// Clean up environment variables
+			_ = os.Unsetenv("HTTP_LISTEN_ADDR")
+			_ = os.Unsetenv("HTTP_LISTEN_PORT")
+		})
+		// find a free port on the IPv6 loopback (skip if the host has no IPv6 stack)
+		probe, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Skipf("IPv6 loopback not available: %v", err)
+		}
+		port := probe.Addr().(*net.TCPAddr).Port
+		_ = probe.Close()
+
+		_ = os.Setenv("HTTP_LISTEN_ADDR", "::1")
+		_ = os.Setenv("HTTP_LISTEN_PORT", strconv.Itoa(port))
+		addr, err := GetHttpListenAddressAndPort()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to bind to %s: %v", addr, err)
+		}
+		_ = listener.Close()
+	})
+
+	t.Run("Wildcard addresses", func(t *testing.T) {
+		t.Cleanup(func() {
+			// Clean up environment variables
+			_ = os.Unsetenv("HTTP_LISTEN_ADDR")
+			_ = os.Unsetenv("HTTP_LISTEN_PORT")
+		})
+		testCases := map[string]string{
+			"0.0.0.0": "0.0.0.0:8080",
+			"::":      "[::]:8080",
+			"":        ":8080",
+			"   ":     ":8080",
+		}
+		for rawAddr, expected := range testCases {
+			_ = os.Setenv("HTTP_LISTEN_ADDR", rawAddr)
+			_ = os.Setenv("HTTP_LISTEN_PORT", "8080")
+			addr, err := GetHttpListenAddressAndPort()
+			if err != nil {
+				t.Fatalf("Unexpected error (%q): %v", rawAddr, err)
+			}
+			if addr != expected {
+				t.Errorf("Expected address '%s', got '%s'", expected, addr)
+			}
+		}
+	})
+
+	t.Run("Hostname rejected by default", func(t *testing.T) {
+		t.Cleanup(func() {
+			// Clean up environment variables
+			_ = os.Unsetenv("HTTP_LISTEN_ADDR")
+			_ = os.Unsetenv("HTTP_LISTEN_PORT")
+			_ = os.Unsetenv("ALLOW_HOSTNAME")
+		})
+		_ = os.Unsetenv("ALLOW_HOSTNAME")
+		_ = os.Setenv("HTTP_LISTEN_ADDR", "localhost")
+		_ = os.Setenv("HTTP_LISTEN_PORT", "8080")
+		if _, err := GetHttpListenAddressAndPort(); err == nil {
+			t.Error("Expected error for hostname without ALLOW_HOSTNAME")
+		}
+	})
+
+	t.Run("Hostname allowed with ALLOW_HOSTNAME", func(t *testing.T) {
+		t.Cleanup(func() {
+			// Clean up environment variables
+			_ = os.Unsetenv("HTTP_LISTEN_ADDR")
+			_ = os.Unsetenv("HTTP_LISTEN_PORT")
+			_ = os.Unsetenv("ALLOW_HOSTNAME")
+		})
+		_ = os.Setenv("ALLOW_HOSTNAME", "true")
+		_ = os.Setenv("HTTP_LISTEN_ADDR", "localhost")
+		_ = os.Setenv("HTTP_LISTEN_PORT", "8080")
+		addr, err := GetHttpListenAddressAndPort()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if addr != "localhost:8080" {
+			t.Errorf("Expected address 'localhost:8080', got '%s'", addr)
+		}
+	})
+
+	t.Run("Garbage rejected even with ALLOW_HOSTNAME", func(t *testing.T) {
+		t.Cleanup(func() {
+			// Clean up environment variables
+			_ = os.Unsetenv("HTTP_LISTEN_ADDR")
+			_ = os.Unsetenv("HTTP_LISTEN_PORT")
+			_ = os.Unsetenv("ALLOW_HOSTNAME")
+		})
+		_ = os.Setenv("ALLOW_HOSTNAME", "true")
+		_ = os.Setenv("HTTP_LISTEN_PORT", "8080")
+		for _, rawAddr := range []string{"not a host!", "-bad-.example", "999.999.999.999:80", "http://localhost"} {
+			_ = os.Setenv("HTTP_LISTEN_ADDR", rawAddr)
+			if _, err := GetHttpListenAddressAndPort(); err == nil {
+				t.Errorf("Expected error for listen address %q", rawAddr)
+			}
+		}
+	})
+
 	t.Run("Invalid IP address", func(t *testing.T) {
 		t.Cleanup(func() {
 			// Clean up environment variables
@@ -91,6 +224,178 @@ func TestGetHttpListenAddressAndPort(t *testing.T) {
 
 }
 
+func TestListenAddresses(t *testing.T) {
+	t.Run("Multiple addresses", func(t *testing.T) {
+		addresses, err := listenAddresses("127.0.0.1, ::1 ,[::1]:9090,0.0.0.0:8081,:8082", "8080", false)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected := []string{"127.0.0.1:8080", "[::1]:8080", "[::1]:9090", "0.0.0.0:8081", ":8082"}
+		if !slices.Equal(addresses, expected) {
+			t.Errorf("Expected addresses %v, got %v", expected, addresses)
+		}
+	})
+
+	t.Run("Multiple addresses with their own ports", func(t *testing.T) {
+		// the port is only needed by entries without one
+		addresses, err := listenAddresses("127.0.0.1:8080,[::1]:8081", "", false)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !slices.Equal(addresses, []string{"127.0.0.1:8080", "[::1]:8081"}) {
+			t.Errorf("Unexpected addresses: %v", addresses)
+		}
+	})
+
+	t.Run("One invalid entry rejects the list", func(t *testing.T) {
+		testCases := map[string]string{
+			"127.0.0.1,invalid_address":   "invalid IP address: invalid_address",
+			"127.0.0.1,[::1]:0":           "invalid port number: 0",
+			"127.0.0.1,999.999.999.999":   "invalid IP address",
+			"127.0.0.1,,[::1]":            "empty entry in HTTP_LISTEN_ADDR",
+			"127.0.0.1,127.0.0.1:8080":    "duplicate listen address: 127.0.0.1:8080",
+			"127.0.0.1:8080,[::1]:999999": "invalid port number: 999999",
+		}
+		for rawAddrs, expected := range testCases {
+			addresses, err := listenAddresses(rawAddrs, "8080", false)
+			if err == nil {
+				t.Errorf("Expected error for %q, got %v", rawAddrs, addresses)
+				continue
+			}
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected %q in the error for %q, got %v", expected, rawAddrs, err)
+			}
+		}
+	})
+
+	t.Run("A list is not a single address", func(t *testing.T) {
+		t.Cleanup(func() {
+			// Clean up environment variables
+			_ = os.Unsetenv("HTTP_LISTEN_ADDR")
+			_ = os.Unsetenv("HTTP_LISTEN_PORT")
+		})
+		_ = os.Setenv("HTTP_LISTEN_ADDR", "127.0.0.1,::1")
+		_ = os.Setenv("HTTP_LISTEN_PORT", "8080")
+		if _, err := GetHttpListenAddressAndPort(); err == nil {
+			t.Error("Expected an error for a list of addresses")
+		}
+	})
+}
+
+func TestListen(t *testing.T) {
+	t.Run("Address in use", func(t *testing.T) {
+		taken, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to open a listener: %v", err)
+		}
+		defer func() { _ = taken.Close() }()
+
+		address := taken.Addr().String()
+		listener, err := listen(address)
+		if err == nil {
+			_ = listener.Close()
+			t.Fatal("Expected an error binding an address in use")
+		}
+		for _, expected := range []string{address, "already in use", "HTTP_LISTEN_PORT"} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected %q in the error, got %v", expected, err)
+			}
+		}
+	})
+
+	t.Run("Free address", func(t *testing.T) {
+		listener, err := listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_ = listener.Close()
+	})
+}
+
+func TestServe(t *testing.T) {
+	t.Run("Two listeners start and stop together", func(t *testing.T) {
+		captureLogs(t, slog.LevelInfo)
+		requests := &inFlightRequests{}
+		var listeners []net.Listener
+		for range 2 {
+			listener, err := listen("127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			listeners = append(listeners, listener)
+		}
+		server := newServer("", requests.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})), defaultConfig())
+		served := make(chan error, 1)
+		go func() {
+			served <- serve(server, listeners, "", "")
+		}()
+
+		client := &http.Client{Timeout: time.Second}
+		for _, listener := range listeners {
+			url := "http://" + listener.Addr().String()
+			var resp *http.Response
+			var err error
+			// the listeners are bound already, so this only waits for Serve to start accepting
+			for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+				if resp, err = client.Get(url); err == nil || time.Now().After(deadline) {
+					break
+				}
+			}
+			if err != nil {
+				t.Fatalf("Expected %s to be served: %v", url, err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Expected 200 from %s, got %d", url, resp.StatusCode)
+			}
+		}
+
+		drain(server, requests, time.Second)
+		select {
+		case err := <-served:
+			if err != nil {
+				t.Errorf("Expected a clean shutdown, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected serve to return once the server was drained")
+		}
+		for _, listener := range listeners {
+			if resp, err := client.Get("http://" + listener.Addr().String()); err == nil {
+				_ = resp.Body.Close()
+				t.Errorf("Expected %s to be closed after the drain", listener.Addr())
+			}
+		}
+	})
+
+	t.Run("A failing listener stops the others", func(t *testing.T) {
+		captureLogs(t, slog.LevelInfo)
+		good, err := listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		bad, err := listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_ = bad.Close() // Serve fails straight away on a closed listener
+		server := newServer("", http.NotFoundHandler(), defaultConfig())
+		served := make(chan error, 1)
+		go func() {
+			served <- serve(server, []net.Listener{good, bad}, "", "")
+		}()
+		select {
+		case err := <-served:
+			if err == nil {
+				t.Error("Expected the failed listener's error")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected serve to return when a listener failed")
+		}
+	})
+}
+
 func TestGetApiKey(t *testing.T) {
 
 	t.Run("unset ApiKey.  Expect error", func(t *testing.T) {
@@ -102,7 +407,7 @@ func TestGetApiKey(t *testing.T) {
 		_ = os.Setenv("HTTP_LISTEN_ADDR", "127.0.0.1")
 		_ = os.Setenv("HTTP_LISTEN_PORT", "8080")
 		_ = os.Unsetenv("OPENWEATHER_API_KEY")
-		_, err := getAPIKey()
+		_, err := getAPIKey(context.Background())
 		if err == nil {
 			t.Fatalf("Expected error.  got none.")
 		}
@@ -124,7 +429,7 @@ func TestGetApiKey(t *testing.T) {
 		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
 
 		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
-		apiKey, err := getAPIKey()
+		apiKey, err := getAPIKey(context.Background())
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
@@ -141,13 +446,77 @@ func TestGetApiKey(t *testing.T) {
 			_ = os.Unsetenv("OPENWEATHER_API_KEY")
 		})
 		_ = os.Setenv("OPENWEATHER_API_KEY", "def0123456789abcdef0123456789xyz")
-		_, err := getAPIKey()
+		_, err := getAPIKey(context.Background())
 		if err == nil {
 			t.Fatalf("Expected error for invalid API key")
 		}
 	})
 }
 
+func TestValidationErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		validate func(string) (float64, error)
+		raw      string
+		sentinel error
+		message  string
+	}{
+		{"non-numeric latitude", validateLatitude, "abc", ErrInvalidLatitude,
+			"invalid latitude format: abc"},
+		{"oversized latitude", validateLatitude, strings.Repeat("1", 40), ErrInvalidLatitude,
+			"invalid latitude format: too long (max 32 characters): 40"},
+		{"latitude out of range", validateLatitude, "91", ErrLatitudeOutOfRange,
+			"latitude out of range (-90 to 90 degrees): 91.000000"},
+		{"non-numeric longitude", validateLongitude, "xyz", ErrInvalidLongitude,
+			"invalid longitude format: xyz"},
+		{"longitude out of range", validateLongitude, "-181", ErrLongitudeOutOfRange,
+			"longitude out of range (-180 to 180 degrees): -181.000000"},
+		{"oversized longitude", validateLongitude, strings.Repeat("1", 40), ErrInvalidLongitude,
+			"invalid longitude format: too long (max 32 characters): 40"},
+		{"NaN latitude", validateLatitude, "NaN", ErrInvalidLatitude, "invalid latitude format: NaN"},
+		{"NaN longitude", validateLongitude, " nan ", ErrInvalidLongitude, "invalid longitude format: nan"},
+		{"infinite latitude", validateLatitude, "-Inf", ErrInvalidLatitude, "invalid latitude format: -Inf"},
+		{"infinite longitude", validateLongitude, "+infinity", ErrInvalidLongitude,
+			"invalid longitude format: +infinity"},
+		{"overflowing latitude", validateLatitude, "1e400", ErrInvalidLatitude, "invalid latitude format: 1e400"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.validate(tc.raw)
+			if !errors.Is(err, tc.sentinel) {
+				t.Fatalf("Expected errors.Is(%v, %v)", err, tc.sentinel)
+			}
+			if err.Error() != tc.message {
+				t.Errorf("Expected message '%s', got '%s'", tc.message, err.Error())
+			}
+		})
+	}
+
+	t.Run("missing API key", func(t *testing.T) {
+		_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		_, err := getAPIKey(context.Background())
+		if !errors.Is(err, ErrMissingAPIKey) {
+			t.Fatalf("Expected ErrMissingAPIKey, got %v", err)
+		}
+		// ... still identifiable once the provider has wrapped it
+		_, err = newOpenWeatherProvider("http://127.0.0.1:1").Fetch(context.Background(), weatherQuery{})
+		if !errors.Is(err, ErrMissingAPIKey) || !errors.Is(err, errInvalidAPIKey) {
+			t.Errorf("Expected wrapped ErrMissingAPIKey, got %v", err)
+		}
+	})
+
+	t.Run("malformed API key", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", "not-a-key")
+		if _, err := getAPIKey(context.Background()); !errors.Is(err, ErrMalformedAPIKey) {
+			t.Fatalf("Expected ErrMalformedAPIKey, got %v", err)
+		}
+	})
+}
+
 func TestValidateLatitude(t *testing.T) {
 	t.Run("Valid latitude within range", func(t *testing.T) {
 		latStr := "37.7749"
@@ -193,6 +562,25 @@ func TestValidateLatitude(t *testing.T) {
 		}
 	})
 
+	t.Run("Oversized latitude", func(t *testing.T) {
+		latStr := "1." + strings.Repeat("0", 1<<20)
+		_, err := validateLatitude(latStr)
+		if err == nil {
+			t.Error("Expected error for oversized latitude")
+		}
+	})
+
+	t.Run("Long but acceptable latitude", func(t *testing.T) {
+		latStr := "37.77490000000000000000000000000" // 32 characters
+		lat, err := validateLatitude(latStr)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if lat != 37.7749 {
+			t.Errorf("Expected latitude %f, got %f", 37.7749, lat)
+		}
+	})
+
 	t.Run("Invalid (non-numeric) latitude", func(t *testing.T) {
 		latStr := "invalid_latitude"
 		_, err := validateLatitude(latStr)
@@ -200,6 +588,30 @@ func TestValidateLatitude(t *testing.T) {
 			t.Error("Expected error for invalid latitude format")
 		}
 	})
+
+	t.Run("Whitespace and signs", func(t *testing.T) {
+		testCases := map[string]float64{
+			" 37.77 ":   37.77,
+			"+37.77 ":   37.77,
+			"\t-12.5\n": -12.5,
+			"+90":       90,
+			"-0.0":      0,
+		}
+		for raw, expected := range testCases {
+			lat, err := validateLatitude(raw)
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", raw, err)
+			}
+			if lat != expected || math.Signbit(lat) != math.Signbit(expected) {
+				t.Errorf("%q: expected latitude %v, got %v", raw, expected, lat)
+			}
+		}
+		for _, raw := range []string{"", "   ", "+ 37.77", "37. 77", "++37.77", "+-37.77", "+90.1", "37.77,"} {
+			if _, err := validateLatitude(raw); err == nil {
+				t.Errorf("%q: expected an error", raw)
+			}
+		}
+	})
 }
 
 func TestValidateLongitude(t *testing.T) {
@@ -249,6 +661,20 @@ func TestValidateLongitude(t *testing.T) {
 		}
 	})
 
+	t.Run("Oversized Longitude", func(t *testing.T) {
+		longStr := "-" + strings.Repeat("1", 33)
+		_, err := validateLongitude(longStr)
+		if err == nil {
+			t.Error("Expected error for oversized Longitude")
+		}
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon="+longStr, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", w.Code)
+		}
+	})
+
 	t.Run("Invalid (non-numeric) Longitude", func(t *testing.T) {
 		longStr := "non-numeric-longitude"
 		_, err := validateLongitude(longStr)
@@ -256,6 +682,68 @@ func TestValidateLongitude(t *testing.T) {
 			t.Error("Expected error for invalid Longitude format")
 		}
 	})
+
+	t.Run("Whitespace and signs", func(t *testing.T) {
+		testCases := map[string]float64{
+			" -122.42 ": -122.42,
+			"+122.42":   122.42,
+			"+180":      180,
+			"-0.0 ":     0,
+		}
+		for raw, expected := range testCases {
+			lon, err := validateLongitude(raw)
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", raw, err)
+			}
+			if lon != expected || math.Signbit(lon) != math.Signbit(expected) {
+				t.Errorf("%q: expected longitude %v, got %v", raw, expected, lon)
+			}
+		}
+		for _, raw := range []string{" ", "- 122.42", "+180.5", "122.42e", "east"} {
+			if _, err := validateLongitude(raw); err == nil {
+				t.Errorf("%q: expected an error", raw)
+			}
+		}
+	})
+}
+
+func TestValidateCoordinate(t *testing.T) {
+	// The wrappers are validateCoordinate with each coordinate's range, so the two only differ in name
+	axes := []struct {
+		name     string
+		max      float64
+		validate func(string) (float64, error)
+	}{
+		{"latitude", 90, validateLatitude},
+		{"longitude", 180, validateLongitude},
+	}
+	inputs := []string{"0", " 12.5 ", "-0", "+45", "90", "-90.0001", "180", "181", "abc", "", "NaN", "Inf",
+		strings.Repeat("9", 33)}
+	for _, axis := range axes {
+		for _, raw := range inputs {
+			expected, expectedErr := validateCoordinate(raw, -axis.max, axis.max, axis.name)
+			value, err := axis.validate(raw)
+			if value != expected || fmt.Sprint(err) != fmt.Sprint(expectedErr) {
+				t.Errorf("%s %q: expected %v, %v, got %v, %v", axis.name, raw, expected, expectedErr, value, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), axis.name) {
+				t.Errorf("%s %q: expected the coordinate named in %q", axis.name, raw, err.Error())
+			}
+		}
+	}
+
+	// The same failure reads the same way for either coordinate
+	for _, raw := range []string{"abc", "NaN", "200"} {
+		_, latErr := validateLatitude(raw)
+		_, lonErr := validateLongitude(raw)
+		if latErr == nil || lonErr == nil {
+			t.Fatalf("%q: expected both to fail, got %v and %v", raw, latErr, lonErr)
+		}
+		if strings.ReplaceAll(latErr.Error(), "latitude", "longitude") !=
+			strings.ReplaceAll(lonErr.Error(), "-180 to 180", "-90 to 90") {
+			t.Errorf("%q: inconsistent messages %q and %q", raw, latErr, lonErr)
+		}
+	}
 }
 
 func TestGetTemperature(t *testing.T) {
@@ -263,15 +751,15 @@ func TestGetTemperature(t *testing.T) {
 		temp     float64
 		expected string
 	}{
-		{25.0, "Hot (77F / 25C)"},
-		{15.0, "Moderate (59F / 15C)"},
-		{5.0, "Cold (41F / 5C)"},
-		{-5.0, "Cold (23F / -5C)"},
+		{25.0, "Hot, 77°F (25°C)"},
+		{15.0, "Moderate, 59°F (15°C)"},
+		{5.0, "Cold, 41°F (5°C)"},
+		{-5.0, "Cold, 23°F (-5°C)"},
 	}
 
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("Temperature %f", tc.temp), func(t *testing.T) {
-			result := getTemperature(tc.temp)
+			result := getTemperature(tc.temp, "")
 			if result != tc.expected {
 				t.Errorf("value mismatch\n"+
 					"    Temp:  %f\n"+
@@ -282,27 +770,985 @@ func TestGetTemperature(t *testing.T) {
 	}
 }
 
-func TestCelsiusToFahrenheit(t *testing.T) {
+func TestGetTemperatureAllUnits(t *testing.T) {
 	testCases := []struct {
-		celsius  float64
-		expected float64
+		temp     float64
+		expected string
 	}{
-		{0.0, 32.0},        // Freezing point of water
-		{100.0, 212.0},     // Boiling point of water
-		{-40.0, -40.0},     // -40 degrees Celsius is -40 degrees Fahrenheit
-		{37.0, 98.6},       // Normal body temperature in Fahrenheit
-		{-273.15, -459.67}, // Absolute zero in Celsius to Fahrenheit
+		{25.0, "Hot, 77°F (25°C / 298 K)"},
+		{15.0, "Moderate, 59°F (15°C / 288 K)"},
+		{-5.0, "Cold, 23°F (-5°C / 268 K)"},
+		{24.5, "Hot, 76°F (25°C / 298 K)"}, // halves round away from zero in every scale
+		{-40.0, "Cold, -40°F (-40°C / 233 K)"},
 	}
 
-	// Define a small tolerance for floating-point comparisons
-	tolerance := 0.001 // Adjust as needed based on precision requirements
-
 	for _, tc := range testCases {
-		t.Run(fmt.Sprintf("Celsius %.2f", tc.celsius), func(t *testing.T) {
-			result := celsiusToFahrenheit(tc.celsius)
-			if math.Abs(result-tc.expected) > tolerance {
-				t.Errorf("Expected %.2f°F, but got %.2f°F", tc.expected, result)
+		t.Run(fmt.Sprintf("Temperature %f", tc.temp), func(t *testing.T) {
+			result := getTemperatureAllUnits(tc.temp, "")
+			if result != tc.expected {
+				t.Errorf("value mismatch\n"+
+					"    Temp:  %f\n"+
+					"Expected: '%s'\n"+
+					"  Actual: '%s'", tc.temp, tc.expected, result)
 			}
 		})
 	}
+
+	t.Run("Requested with all_units=true", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25}}`)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42&all_units=true", nil))
+		if !strings.HasSuffix(w.Body.String(), "  Temperature : Hot, 77°F (25°C / 298 K)") {
+			t.Errorf("Expected all units, got '%s'", w.Body.String())
+		}
+	})
+}
+
+func TestRawProviderResponse(t *testing.T) {
+	const raw = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25},"visibility":10000}`
+	useRawWeather := func(t *testing.T, debugEndpoints bool) {
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			data := weatherDataFromJSON(t, raw)
+			data.Raw = json.RawMessage(raw)
+			return data, nil
+		}}
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		cfg.DebugEndpoints = debugEndpoints
+		withConfig(t, cfg)
+	}
+	getJSON := func(t *testing.T, target string) map[string]json.RawMessage {
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var response map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("bad json response: %v", err)
+		}
+		return response
+	}
+
+	t.Run("Requested", func(t *testing.T) {
+		useRawWeather(t, true)
+		response := getJSON(t, "/weather?lat=37.77&lon=-122.42&format=json&raw=true")
+		if string(response["raw"]) != raw {
+			t.Errorf("Expected the provider's response %s, got %s", raw, response["raw"])
+		}
+		if string(response["condition"]) != `"Clear Sky"` {
+			t.Errorf("Expected our own fields as well, got %s", response["condition"])
+		}
+	})
+
+	t.Run("Absent by default", func(t *testing.T) {
+		useRawWeather(t, true)
+		if response := getJSON(t, "/weather?lat=37.77&lon=-122.42&format=json"); response["raw"] != nil {
+			t.Errorf("Expected no raw response, got %s", response["raw"])
+		}
+	})
+
+	t.Run("XML from the provider", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			data := weatherDataFromJSON(t, raw)
+			data.Raw = rawResponse([]byte(sampleCurrentWeatherXML))
+			return data, nil
+		}}
+		cfg.DebugEndpoints = true
+		withConfig(t, cfg)
+		response := getJSON(t, "/weather?lat=37.77&lon=-122.42&format=json&raw=true")
+		var xmlBody string
+		if err := json.Unmarshal(response["raw"], &xmlBody); err != nil || xmlBody != sampleCurrentWeatherXML {
+			t.Errorf("Expected the XML response as a string, got %s (%v)", response["raw"], err)
+		}
+	})
+
+	t.Run("Without DEBUG_ENDPOINTS", func(t *testing.T) {
+		useRawWeather(t, false)
+		if response := getJSON(t, "/weather?lat=37.77&lon=-122.42&format=json&raw=true"); response["raw"] != nil {
+			t.Errorf("Expected no raw response, got %s", response["raw"])
+		}
+	})
+}
+
+func TestFetchErrorContext(t *testing.T) {
+	t.Run("Client disconnected", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelDebug)
+		started, release := make(chan struct{}), make(chan struct{})
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			close(started)
+			<-release
+			return nil, &upstreamError{StatusCode: http.StatusBadGateway}
+		}}
+		withConfig(t, cfg)
+
+		contexts := make(chan context.Context, 1)
+		handled := make(chan *statusRecorder, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contexts <- r.Context()
+			recorder := &statusRecorder{ResponseWriter: w}
+			weatherHandler(recorder, r)
+			handled <- recorder
+		}))
+		t.Cleanup(server.Close)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/weather?lat=1&lon=1", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if resp, err := http.DefaultClient.Do(req); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected the request to be cancelled, got %v %v", resp, err)
+		}
+		// the provider only fails once the server has seen the client go
+		<-(<-contexts).Done()
+		close(release)
+
+		if recorder := <-handled; recorder.status != 0 {
+			t.Errorf("Expected no response to be written, got %d", recorder.status)
+		}
+		if !strings.Contains(logs.String(), "level=DEBUG msg=\"request cancelled by the client\"") {
+			t.Errorf("Expected the cancellation logged at debug level: %s", logs.String())
+		}
+		if strings.Contains(logs.String(), "level=ERROR") {
+			t.Errorf("Expected no error logged: %s", logs.String())
+		}
+	})
+
+	t.Run("Deadline exceeded", func(t *testing.T) {
+		const fakeApiKey = "abcdef0123456789abcdef0123456789"
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		logs := captureLogs(t, slog.LevelDebug)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}))
+		t.Cleanup(upstream.Close)
+		cfg := defaultConfig()
+		cfg.Provider = newOpenWeatherProvider(upstream.URL)
+		cfg.RequestBudget = 50 * time.Millisecond
+		withConfig(t, cfg)
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "did not respond in time") {
+			t.Errorf("Expected 504, got %d %q", w.Code, w.Body.String())
+		}
+		if strings.Contains(logs.String(), "cancelled") {
+			t.Errorf("Expected a timeout, not a cancellation: %s", logs.String())
+		}
+	})
+}
+
+func TestTemperatureUnitOrder(t *testing.T) {
+	testCases := []struct {
+		units      string
+		withKelvin bool
+		expected   string
+	}{
+		{"metric", false, "Hot, 25°C (77°F)"},
+		{"imperial", false, "Hot, 77°F (25°C)"},
+		{"standard", false, "Hot, 298 K (25°C / 77°F)"},
+		{"", false, "Hot, 77°F (25°C)"},
+		{"metric", true, "Hot, 25°C (77°F / 298 K)"},
+		{"imperial", true, "Hot, 77°F (25°C / 298 K)"},
+		{"standard", true, "Hot, 298 K (25°C / 77°F)"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q kelvin=%v", tc.units, tc.withKelvin), func(t *testing.T) {
+			result := getTemperature(25, tc.units)
+			if tc.withKelvin {
+				result = getTemperatureAllUnits(25, tc.units)
+			}
+			if result != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, result)
+			}
+		})
+	}
+
+	t.Run("Requested with units=metric", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25}}`)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42&units=metric", nil))
+		if !strings.HasSuffix(w.Body.String(), "  Temperature : Hot, 25°C (77°F)") {
+			t.Errorf("Expected celsius first, got '%s'", w.Body.String())
+		}
+	})
+}
+
+func TestNoNegativeZero(t *testing.T) {
+	testCases := []struct {
+		temp     float64
+		expected string
+	}{
+		{-0.3, "Cold, 31°F (0°C / 273 K)"},
+		{math.Copysign(0, -1), "Cold, 32°F (0°C / 273 K)"},
+		{0.2, "Cold, 32°F (0°C / 273 K)"},
+		{-17.9, "Cold, 0°F (-18°C / 255 K)"}, // -0.22F
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Temperature %f", tc.temp), func(t *testing.T) {
+			result := getTemperatureAllUnits(tc.temp, "")
+			if result != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, result)
+			}
+			if strings.Contains(result, "-0") {
+				t.Errorf("negative zero in '%s'", result)
+			}
+		})
+	}
+
+	t.Run("With decimals", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.TempDecimals = 1
+		withConfig(t, cfg)
+		if result := getTemperature(-0.04, ""); strings.Contains(result, "-0.0") {
+			t.Errorf("negative zero in '%s'", result)
+		}
+	})
+
+	t.Run("Dew point", func(t *testing.T) {
+		dp := -0.4
+		text := formatWeather(WeatherResponse{Condition: "mist", DewPointC: &dp})
+		if strings.Contains(text, "-0") {
+			t.Errorf("negative zero in '%s'", text)
+		}
+	})
+}
+
+func TestTemperatureDecimals(t *testing.T) {
+	testCases := []struct {
+		temp     float64
+		decimals int
+		expected string
+	}{
+		{21.456, 0, "Moderate, 71°F (21°C / 295 K)"},
+		{21.456, 1, "Moderate, 70.6°F (21.5°C / 294.6 K)"},
+		{21.456, 2, "Moderate, 70.62°F (21.46°C / 294.61 K)"},
+		{-2.5, 0, "Cold, 28°F (-3°C / 271 K)"},
+		{-2.55, 1, "Cold, 27.4°F (-2.6°C / 270.6 K)"},
+		{-12.3456, 2, "Cold, 9.78°F (-12.35°C / 260.80 K)"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Temperature %f to %d places", tc.temp, tc.decimals), func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.TempDecimals = tc.decimals
+			withConfig(t, cfg)
+			if result := getTemperatureAllUnits(tc.temp, ""); result != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestCelsiusToKelvin(t *testing.T) {
+	testCases := []struct {
+		celsius  float64
+		expected float64
+	}{
+		{0.0, 273.15},
+		{100.0, 373.15},
+		{-273.15, 0.0},
+	}
+
+	tolerance := 0.001
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Celsius %.2f", tc.celsius), func(t *testing.T) {
+			result := celsiusToKelvin(tc.celsius)
+			if math.Abs(result-tc.expected) > tolerance {
+				t.Errorf("Expected %.2fK, but got %.2fK", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestCelsiusToFahrenheit(t *testing.T) {
+	testCases := []struct {
+		celsius  float64
+		expected float64
+	}{
+		{0.0, 32.0},        // Freezing point of water
+		{100.0, 212.0},     // Boiling point of water
+		{-40.0, -40.0},     // -40 degrees Celsius is -40 degrees Fahrenheit
+		{37.0, 98.6},       // Normal body temperature in Fahrenheit
+		{-273.15, -459.67}, // Absolute zero in Celsius to Fahrenheit
+	}
+
+	// Define a small tolerance for floating-point comparisons
+	tolerance := 0.001 // Adjust as needed based on precision requirements
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Celsius %.2f", tc.celsius), func(t *testing.T) {
+			result := celsiusToFahrenheit(tc.celsius)
+			if math.Abs(result-tc.expected) > tolerance {
+				t.Errorf("Expected %.2f°F, but got %.2f°F", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestTemperatureConversionRoundTrip(t *testing.T) {
+	const tolerance = 1e-9
+	for x := -100.0; x <= 100.0; x += 12.5 {
+		if got := celsiusToFahrenheit(fahrenheitToCelsius(x)); math.Abs(got-x) > tolerance {
+			t.Errorf("F->C->F: expected %f, got %f", x, got)
+		}
+		if got := fahrenheitToCelsius(celsiusToFahrenheit(x)); math.Abs(got-x) > tolerance {
+			t.Errorf("C->F->C: expected %f, got %f", x, got)
+		}
+		if got := kelvinToCelsius(celsiusToKelvin(x)); math.Abs(got-x) > tolerance {
+			t.Errorf("C->K->C: expected %f, got %f", x, got)
+		}
+	}
+
+	fixedPoints := []struct {
+		value    float64
+		unit     string
+		expected float64
+	}{
+		{212, "F", 100},
+		{-40, "f", -40},
+		{273.15, "K", 0},
+		{21.5, "C", 21.5},
+	}
+	for _, tc := range fixedPoints {
+		got, err := toCelsius(tc.value, tc.unit)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if math.Abs(got-tc.expected) > tolerance {
+			t.Errorf("toCelsius(%f, %s): expected %f, got %f", tc.value, tc.unit, tc.expected, got)
+		}
+	}
+	if _, err := toCelsius(1, "R"); err == nil {
+		t.Error("Expected error for unknown unit")
+	}
+}
+
+func TestDewPoint(t *testing.T) {
+	testCases := []struct {
+		tempC    float64
+		humidity float64
+		expected float64
+	}{
+		{20, 50, 9.26},
+		{30, 70, 23.93},
+		{10, 80, 6.71},
+		{-5, 60, -11.54},
+		{25, 100, 25}, // saturated air: dew point equals the temperature
+		{25, 120, 25}, // over-saturated readings are clamped
+	}
+
+	tolerance := 0.1
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%.0fC at %.0f%%", tc.tempC, tc.humidity), func(t *testing.T) {
+			result := dewPoint(tc.tempC, tc.humidity)
+			if math.Abs(result-tc.expected) > tolerance {
+				t.Errorf("Expected %.2fC, but got %.2fC", tc.expected, result)
+			}
+		})
+	}
+
+	t.Run("Zero humidity", func(t *testing.T) {
+		if result := dewPoint(20, 0); !math.IsNaN(result) {
+			t.Errorf("Expected NaN, got %f", result)
+		}
+	})
+}
+
+func TestWindDirection(t *testing.T) {
+	testCases := []struct {
+		deg      float64
+		expected string
+	}{
+		{0, "N"},
+		{11.24, "N"},
+		{11.25, "NNE"},
+		{33.75, "NE"},
+		{56.25, "ENE"},
+		{78.75, "E"},
+		{101.25, "ESE"},
+		{123.75, "SE"},
+		{146.25, "SSE"},
+		{168.75, "S"},
+		{191.25, "SSW"},
+		{213.75, "SW"},
+		{236.25, "WSW"},
+		{258.75, "W"},
+		{281.25, "WNW"},
+		{303.75, "NW"},
+		{326.25, "NNW"},
+		{348.74, "NNW"},
+		{348.75, "N"}, // wraparound into N
+		{359.99, "N"},
+		{360, "N"},
+		{450, "E"}, // bearings past a full turn
+		{-90, "W"}, // negative bearings
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Degrees %.2f", tc.deg), func(t *testing.T) {
+			if result := windDirection(tc.deg); result != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, result)
+			}
+		})
+	}
+
+	t.Run("Included in the response", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20},"wind":{"speed":3.1,"deg":350}}`)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42", nil))
+		if !strings.HasSuffix(w.Body.String(), "\n  Wind From   : N (350 degrees)") {
+			t.Errorf("Expected wind line, got '%s'", w.Body.String())
+		}
+	})
+}
+
+func TestIsSevereCondition(t *testing.T) {
+	testCases := []struct {
+		id       int
+		expected bool
+	}{
+		{200, true},  // thunderstorm with light rain
+		{211, true},  // thunderstorm
+		{232, true},  // thunderstorm with heavy drizzle
+		{300, false}, // light drizzle
+		{501, false}, // moderate rain
+		{504, true},  // extreme rain
+		{601, false}, // snow
+		{741, false}, // fog
+		{771, true},  // squalls
+		{781, true},  // tornado
+		{800, false}, // clear sky
+		{804, false}, // overcast clouds
+		{902, true},  // hurricane (legacy)
+		{904, false}, // hot (legacy)
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Condition %d", tc.id), func(t *testing.T) {
+			if result := isSevereCondition(tc.id); result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+
+	t.Run("Reported in the response", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":211,"description":"thunderstorm"}],"main":{"temp":20}}`)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if !strings.Contains(w.Body.String(), "  Warning     : Severe weather: Thunderstorm") {
+			t.Errorf("Expected a warning line, got '%s'", w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&format=json", nil))
+		if !strings.Contains(w.Body.String(), `"severe":true`) {
+			t.Errorf("Expected severe:true, got '%s'", w.Body.String())
+		}
+	})
+}
+
+func TestConditionGroup(t *testing.T) {
+	testCases := []struct {
+		id       int
+		expected string
+	}{
+		{200, "Thunderstorm"},
+		{232, "Thunderstorm"},
+		{300, "Drizzle"},
+		{321, "Drizzle"},
+		{500, "Rain"},
+		{531, "Rain"},
+		{600, "Snow"},
+		{622, "Snow"},
+		{701, "Atmosphere"},
+		{781, "Atmosphere"},
+		{800, "Clear"},
+		{801, "Clouds"},
+		{804, "Clouds"},
+		{0, "Unknown"},
+		{400, "Unknown"},
+		{900, "Unknown"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Condition %d", tc.id), func(t *testing.T) {
+			if result := conditionGroup(tc.id); result != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestConditionEmoji(t *testing.T) {
+	testCases := []struct {
+		id       int
+		expected string
+	}{
+		{211, "⛈️"}, // thunderstorm
+		{301, "🌦️"}, // drizzle
+		{501, "🌧️"}, // moderate rain
+		{511, "🧊"},  // freezing rain
+		{601, "❄️"}, // snow
+		{741, "🌫️"}, // fog
+		{781, "🌪️"}, // tornado
+		{800, "☀️"}, // clear sky
+		{802, "⛅"},  // scattered clouds
+		{804, "☁️"}, // overcast clouds
+		{0, "🌡️"},   // unknown
+		{999, "🌡️"}, // unknown
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Condition %d", tc.id), func(t *testing.T) {
+			if result := conditionEmoji(tc.id); result != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestWeatherHandler(t *testing.T) {
+	t.Run("Valid request", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return weatherDataFromJSON(t, `{"weather":[{"id":500,"description":"light rain"}],"main":{"temp":15}}`), nil
+		}}
+		withConfig(t, cfg)
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		expected := "Current Temperature:\n" +
+			"  Weather     : Light Rain\n" +
+			"  Temperature : Moderate, 59°F (15°C)"
+		if w.Body.String() != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, w.Body.String())
+		}
+	})
+
+	t.Run("Dew point when humidity is available", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20,"humidity":50}}`), nil
+		}}
+		withConfig(t, cfg)
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42", nil))
+		if !strings.HasSuffix(w.Body.String(), "\n  Dew Point   : 49°F (9°C)") {
+			t.Errorf("Expected dew point line, got '%s'", w.Body.String())
+		}
+	})
+
+	t.Run("Invalid API key", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return nil, errInvalidAPIKey
+		}}
+		withConfig(t, cfg)
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("Expected 500, got %d", w.Code)
+		}
+	})
+}
+
+func TestStrictQuery(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+
+	t.Run("Typo rejected in strict mode", func(t *testing.T) {
+		provider := useWeather(t, payload)
+		config.StrictQuery = true
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42&lng=1&latt=2", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "latt, lng") {
+			t.Errorf("Expected unknown keys in the response, got '%s'", w.Body.String())
+		}
+		if provider.Calls() != 0 {
+			t.Error("Expected no provider call")
+		}
+	})
+
+	t.Run("Known parameters accepted in strict mode", func(t *testing.T) {
+		useWeather(t, payload)
+		config.StrictQuery = true
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42&format=json&emoji=true", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("Duplicate rejected in strict mode", func(t *testing.T) {
+		provider := useWeather(t, payload)
+		config.StrictQuery = true
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet,
+			"/weather?lat=10&lon=-122.42&lat=20&units=metric&units=imperial", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "Duplicate query parameters: lat, units") {
+			t.Errorf("Expected the duplicated keys in the response, got '%s'", w.Body.String())
+		}
+		if provider.Calls() != 0 {
+			t.Error("Expected no provider call")
+		}
+	})
+
+	t.Run("Duplicate tolerated by default", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelWarn)
+		provider := useWeather(t, payload)
+		var requested weatherQuery
+		fetch := provider.fetch
+		provider.fetch = func(q weatherQuery) (*WeatherData, error) {
+			requested = q
+			return fetch(q)
+		}
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=10&lon=-122.42&lat=20", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if requested.Lat != 10 {
+			t.Errorf("Expected the first latitude, got %v", requested.Lat)
+		}
+		if !strings.Contains(logs.String(), "duplicate query parameters") {
+			t.Errorf("Expected a warning, got %s", logs.String())
+		}
+	})
+
+	t.Run("Typo ignored by default", func(t *testing.T) {
+		useWeather(t, payload)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42&lng=1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	})
+}
+
+func TestDefaultLocation(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+
+	t.Run("Defaults used when coordinates are omitted", func(t *testing.T) {
+		provider := useWeather(t, payload)
+		config.DefaultLocation = &weatherQuery{Lat: 40.71, Lon: -74.01}
+		var requested weatherQuery
+		fetch := provider.fetch
+		provider.fetch = func(q weatherQuery) (*WeatherData, error) {
+			requested = q
+			return fetch(q)
+		}
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if requested != *config.DefaultLocation {
+			t.Errorf("Expected the default location, got %v", requested)
+		}
+	})
+
+	t.Run("Partial coordinates are not defaulted", func(t *testing.T) {
+		useWeather(t, payload)
+		config.DefaultLocation = &weatherQuery{Lat: 40.71, Lon: -74.01}
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=10", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("No defaults configured", func(t *testing.T) {
+		useWeather(t, payload)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestValidateTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		raw     string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"1699990000", time.Unix(1699990000, 0), false},
+		{"1700000000", now, false},
+		{"1700000001", time.Time{}, true},   // future
+		{"-1", time.Time{}, true},           // before 1979
+		{"yesterday", time.Time{}, true},    // not a number
+		{"1699990000.5", time.Time{}, true}, // whole seconds only
+	}
+	for _, tc := range tests {
+		got, err := validateTimestamp(tc.raw, now)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("validateTimestamp(%q) error = %v, wantErr %v", tc.raw, err, tc.wantErr)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("validateTimestamp(%q) = %v, want %v", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestHistoricalLookup(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+
+	requestedTime := func(t *testing.T, target string) (time.Time, int) {
+		provider := useWeather(t, payload)
+		var requested weatherQuery
+		fetch := provider.fetch
+		provider.fetch = func(q weatherQuery) (*WeatherData, error) {
+			requested = q
+			return fetch(q)
+		}
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return requested.At, w.Code
+	}
+
+	t.Run("Past timestamp", func(t *testing.T) {
+		at, code := requestedTime(t, "/weather?lat=1&lon=1&timestamp=1700000000")
+		if code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+		if at.Unix() != 1700000000 {
+			t.Errorf("Expected a historical lookup, got %v", at)
+		}
+	})
+
+	t.Run("Future timestamp", func(t *testing.T) {
+		future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		if _, code := requestedTime(t, "/weather?lat=1&lon=1&timestamp="+future); code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", code)
+		}
+	})
+
+	t.Run("Judged by the configured clock", func(t *testing.T) {
+		clock := newFakeClock()
+		for offset, expected := range map[time.Duration]int{-time.Hour: http.StatusOK, time.Hour: http.StatusBadRequest} {
+			target := "/weather?lat=1&lon=1&timestamp=" + strconv.FormatInt(clock.Now().Add(offset).Unix(), 10)
+			provider := useWeather(t, payload)
+			config.Clock = clock
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != expected {
+				t.Errorf("%s from the clock's now: expected %d, got %d", offset, expected, w.Code)
+			}
+			if expected == http.StatusBadRequest && provider.Calls() != 0 {
+				t.Errorf("Expected no provider calls for a rejected timestamp")
+			}
+		}
+	})
+
+	t.Run("Current weather when omitted", func(t *testing.T) {
+		at, code := requestedTime(t, "/weather?lat=1&lon=1")
+		if code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+		if !at.IsZero() {
+			t.Errorf("Expected a current weather lookup, got %v", at)
+		}
+	})
+}
+
+func TestExclude(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+
+	requestedExclude := func(t *testing.T, apiPath, target string) (string, int, string) {
+		provider := useWeather(t, payload)
+		config.APIPath = apiPath
+		var requested weatherQuery
+		fetch := provider.fetch
+		provider.fetch = func(q weatherQuery) (*WeatherData, error) {
+			requested = q
+			return fetch(q)
+		}
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return requested.Exclude, w.Code, w.Body.String()
+	}
+
+	t.Run("Passed through", func(t *testing.T) {
+		exclude, code, _ := requestedExclude(t, "/data/3.0/onecall", "/weather?lat=1&lon=1&exclude=Hourly,+daily,hourly,")
+		if code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+		if exclude != "hourly,daily" {
+			t.Errorf("Expected the normalized exclude, got %q", exclude)
+		}
+	})
+
+	t.Run("Unknown part", func(t *testing.T) {
+		_, code, body := requestedExclude(t, "/data/3.0/onecall", "/weather?lat=1&lon=1&exclude=minutely,current")
+		if code != http.StatusBadRequest || !strings.Contains(body, "Invalid exclude") {
+			t.Errorf("Expected 400 Invalid exclude, got %d %q", code, body)
+		}
+	})
+
+	t.Run("Without a One Call path", func(t *testing.T) {
+		exclude, code, body := requestedExclude(t, defaultOpenWeatherAPIPath, "/weather?lat=1&lon=1&exclude=hourly")
+		if code != http.StatusBadRequest || !strings.Contains(body, "One Call") {
+			t.Errorf("Expected 400 for an exclude the provider would ignore, got %d %q", code, body)
+		}
+		if exclude != "" {
+			t.Errorf("Expected no provider call, got exclude %q", exclude)
+		}
+	})
+
+	t.Run("Historical lookup", func(t *testing.T) {
+		_, code, _ := requestedExclude(t, "/data/3.0/onecall", "/weather?lat=1&lon=1&timestamp=1700000000&exclude=hourly")
+		if code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for exclude on the timemachine path, got %d", code)
+		}
+	})
+
+	t.Run("Without exclude", func(t *testing.T) {
+		if _, code, _ := requestedExclude(t, defaultOpenWeatherAPIPath, "/weather?lat=1&lon=1&exclude="); code != http.StatusOK {
+			t.Errorf("Expected an empty exclude to be allowed, got %d", code)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		if _, err := validateExcludes("alerts,weekly"); !errors.Is(err, ErrUnknownExclude) {
+			t.Errorf("Expected ErrUnknownExclude, got %v", err)
+		}
+		if exclude, err := validateExcludes(" "); err != nil || exclude != "" {
+			t.Errorf("Expected nothing excluded, got %q, %v", exclude, err)
+		}
+	})
+}
+
+func TestBoundingBox(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+	colorado := &boundingBox{MinLat: 37, MaxLat: 41, MinLon: -109.05, MaxLon: -102.05}
+
+	testCases := []struct {
+		name     string
+		box      *boundingBox
+		target   string
+		expected int
+	}{
+		{"Inside the box", colorado, "/weather?lat=39.74&lon=-104.99", http.StatusOK},
+		{"On the edge", colorado, "/weather?lat=41&lon=-102.05", http.StatusOK},
+		{"Outside the box", colorado, "/weather?lat=40.71&lon=-74.01", http.StatusForbidden},
+		{"No box configured", nil, "/weather?lat=40.71&lon=-74.01", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := useWeather(t, payload)
+			config.BoundingBox = tc.box
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			if w.Code != tc.expected {
+				t.Fatalf("Expected %d, got %d", tc.expected, w.Code)
+			}
+			if tc.expected == http.StatusForbidden && provider.Calls() != 0 {
+				t.Error("Out of area requests should not reach the provider")
+			}
+		})
+	}
+}
+
+func TestCoordSwapWarning(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+	europe := &boundingBox{MinLat: 35, MaxLat: 60, MinLon: -10, MaxLon: 30}
+
+	testCases := []struct {
+		name   string
+		strict bool
+		target string
+		warned bool
+	}{
+		{"Paris", true, "/weather?lat=48.85&lon=2.35", false},
+		{"Paris swapped", true, "/weather?lat=2.35&lon=48.85", true},
+		{"Paris swapped, not strict", false, "/weather?lat=2.35&lon=48.85", false},
+		{"Lagos, outside the region either way", true, "/weather?lat=6.52&lon=3.38", false},
+		{"New York, longitude too large to be a latitude", true, "/weather?lat=40.71&lon=-74.01", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useWeather(t, payload)
+			config.StrictCoords = tc.strict
+			config.CoordRegion = europe
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", w.Code)
+			}
+			if warned := w.Header().Get("X-Coord-Warning") != ""; warned != tc.warned {
+				t.Errorf("Expected warning %v, got %q", tc.warned, w.Header().Get("X-Coord-Warning"))
+			}
+		})
+	}
+}
+
+func TestFormatScaleKelvin(t *testing.T) {
+	t.Run("Normal", func(t *testing.T) {
+		if kelvin := formatScale(-40, "K", 2); kelvin != "233.15 K" {
+			t.Errorf("Expected 233.15 K, got %s", kelvin)
+		}
+		if kelvin := formatScale(-273.15, "K", 1); kelvin != "0.0 K" {
+			t.Errorf("Expected absolute zero as 0.0 K, got %s", kelvin)
+		}
+	})
+
+	t.Run("Below absolute zero", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelWarn)
+		if kelvin := formatScale(-300, "K", 0); kelvin != invalidKelvin {
+			t.Errorf("Expected %q, got %s", invalidKelvin, kelvin)
+		}
+		if !strings.Contains(logs.String(), "temperature below absolute zero") {
+			t.Errorf("Expected a warning in the logs: %s", logs.String())
+		}
+		expected := "Cold, -508°F (-300°C / " + invalidKelvin + ")"
+		if result := getTemperatureAllUnits(-300, ""); result != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, result)
+		}
+	})
+}
+
+func TestNewServer(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout = 5*time.Second, 20*time.Second, time.Minute
+	handler := http.NewServeMux()
+	server := newServer("127.0.0.1:8080", handler, cfg)
+	if server.Addr != "127.0.0.1:8080" || server.Handler != handler {
+		t.Errorf("Expected the address and handler, got %q %v", server.Addr, server.Handler)
+	}
+	if server.ReadTimeout != 5*time.Second || server.WriteTimeout != 20*time.Second || server.IdleTimeout != time.Minute {
+		t.Errorf("Expected the configured timeouts, got read %s, write %s, idle %s",
+			server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// serviceMetrics - process-wide counters exposed at /metrics
+type serviceMetrics struct {
+	upstreamRequests   atomic.Int64
+	coalescedRequests  atomic.Int64
+	breakerTransitions atomic.Int64
+	cacheHits          atomic.Int64
+	cacheMisses        atomic.Int64
+	upstreamRejected   atomic.Int64
+	errors             map[string]*atomic.Int64 // by reason, one for each of errorReasons
+}
+
+// failure reasons, as labelled in weather_errors_total
+const (
+	reasonInvalidLat      = "invalid_lat"
+	reasonInvalidLon      = "invalid_lon"
+	reasonMissingKey      = "missing_key"
+	reasonUpstreamTimeout = "upstream_timeout"
+	reasonUpstream5xx     = "upstream_5xx"
+	reasonDecodeError     = "decode_error"
+	reasonEmptyWeather    = "empty_weather"
+)
+
+// errorReasons - every reason we count failures under, in the order /metrics lists them
+var errorReasons = []string{reasonInvalidLat, reasonInvalidLon, reasonMissingKey, reasonUpstreamTimeout,
+	reasonUpstream5xx, reasonDecodeError, reasonEmptyWeather}
+
+// newServiceMetrics - zeroed counters, with one for each error reason
+// The reasons are fixed, so the map is never written to after this and needs no lock.
+func newServiceMetrics() *serviceMetrics {
+	m := &serviceMetrics{errors: make(map[string]*atomic.Int64, len(errorReasons))}
+	for _, reason := range errorReasons {
+		m.errors[reason] = &atomic.Int64{}
+	}
+	return m
+}
+
+// countError - count a failure for reason, one of errorReasons
+func (m *serviceMetrics) countError(reason string) {
+	m.errors[reason].Add(1)
+}
+
+// countFetchError - count a failed provider fetch under its reason, if it is one we count
+func (m *serviceMetrics) countFetchError(err error) {
+	if reason := fetchErrorReason(err); reason != "" {
+		m.countError(reason)
+	}
+}
+
+// fetchErrorReason - the reason a failed provider fetch is counted under, or empty if it isn't one we count
+func fetchErrorReason(err error) string {
+	var upstreamErr *upstreamError
+	switch {
+	case errors.Is(err, errInvalidAPIKey):
+		return reasonMissingKey
+	case errors.Is(err, errNoConditions):
+		return reasonEmptyWeather
+	case errors.Is(err, errInvalidResponse), errors.Is(err, errEmptyResponse):
+		return reasonDecodeError
+	case errors.Is(err, context.DeadlineExceeded):
+		return reasonUpstreamTimeout
+	case errors.As(err, &upstreamErr) && upstreamErr.StatusCode >= 500:
+		return reasonUpstream5xx
+	default:
+		return ""
+	}
+}
+
+// cacheHitRatio - the fraction of cache lookups that were fresh hits (0 before any lookups)
+func (m *serviceMetrics) cacheHitRatio() float64 {
+	hits, misses := m.cacheHits.Load(), m.cacheMisses.Load()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// metrics - the counters for this process
+var metrics = newServiceMetrics()
+
+// metricsHandler - expose the counters in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var sb strings.Builder
+	writeCounter := func(name, help string, value int64) {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value))
+	}
+	writeGauge := func(name, help string, value float64) {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value))
+	}
+	writeCounter("weather_upstream_requests_total",
+		"Requests made to the weather provider.", metrics.upstreamRequests.Load())
+	writeCounter("weather_coalesced_requests_total",
+		"Requests that shared another request's upstream fetch.", metrics.coalescedRequests.Load())
+	writeCounter("weather_circuit_breaker_transitions_total",
+		"Circuit breaker state changes.", metrics.breakerTransitions.Load())
+	writeCounter("weather_upstream_rejected_total",
+		"Provider calls refused because too many were already in flight.", metrics.upstreamRejected.Load())
+	writeCounter("weather_cache_hits_total",
+		"Lookups answered from a fresh cache entry.", metrics.cacheHits.Load())
+	writeCounter("weather_cache_misses_total",
+		"Lookups that had to go to the provider.", metrics.cacheMisses.Load())
+	writeGauge("weather_cache_hit_ratio",
+		"Fraction of cache lookups that were hits.", metrics.cacheHitRatio())
+	sb.WriteString("# HELP weather_errors_total Failed requests, by reason.\n# TYPE weather_errors_total counter\n")
+	for _, reason := range errorReasons {
+		sb.WriteString(fmt.Sprintf("weather_errors_total{reason=%q} %d\n", reason, metrics.errors[reason].Load()))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := fmt.Fprint(w, sb.String()); err != nil {
+		slog.Error("error writing metrics", "error", err)
+	}
+}
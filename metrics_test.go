@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	for _, name := range []string{"weather_upstream_requests_total", "weather_coalesced_requests_total"} {
+		if !strings.Contains(w.Body.String(), "# TYPE "+name+" counter\n") {
+			t.Errorf("Expected counter %s in %s", name, w.Body.String())
+		}
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`)
+	hits, misses := metrics.cacheHits.Load(), metrics.cacheMisses.Load()
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=12.34&lon=56.78", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	}
+
+	if got := metrics.cacheMisses.Load() - misses; got != 1 {
+		t.Errorf("Expected 1 cache miss, got %d", got)
+	}
+	if got := metrics.cacheHits.Load() - hits; got != 1 {
+		t.Errorf("Expected 1 cache hit, got %d", got)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{"weather_cache_hits_total ", "weather_cache_misses_total ",
+		"# TYPE weather_cache_hit_ratio gauge\n"} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Expected %q in %s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestErrorMetrics(t *testing.T) {
+	before := make(map[string]int64)
+	for _, reason := range errorReasons {
+		before[reason] = metrics.errors[reason].Load()
+	}
+
+	failures := []error{
+		&upstreamError{StatusCode: http.StatusBadGateway},
+		&upstreamError{StatusCode: http.StatusServiceUnavailable},
+		errNoConditions,
+		&upstreamError{StatusCode: http.StatusNotFound}, // the provider's answer for these coordinates, not counted
+	}
+	for _, failure := range failures {
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return nil, failure
+		}}
+		withConfig(t, cfg)
+		weatherHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+	}
+	weatherHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/weather?lat=91&lon=1", nil))
+
+	expected := map[string]int64{reasonInvalidLat: 1, reasonUpstream5xx: 2, reasonEmptyWeather: 1}
+	for _, reason := range errorReasons {
+		if got := metrics.errors[reason].Load() - before[reason]; got != expected[reason] {
+			t.Errorf("%s: expected %d more, got %d", reason, expected[reason], got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{"# TYPE weather_errors_total counter\n", `weather_errors_total{reason="upstream_5xx"} `,
+		`weather_errors_total{reason="empty_weather"} `} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Expected %q in %s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestFetchErrorReason(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		{fmt.Errorf("%w: %w", errInvalidAPIKey, ErrMissingAPIKey), reasonMissingKey},
+		{fmt.Errorf("%w: %w", errRequestFailed, context.DeadlineExceeded), reasonUpstreamTimeout},
+		{fmt.Errorf("%w: %w", errRequestFailed, context.Canceled), ""},
+		{&upstreamError{StatusCode: http.StatusInternalServerError}, reasonUpstream5xx},
+		{fmt.Errorf("%w: unexpected EOF", errInvalidResponse), reasonDecodeError},
+		{errEmptyResponse, reasonDecodeError},
+		{errNoConditions, reasonEmptyWeather},
+		{&upstreamError{StatusCode: http.StatusTooManyRequests}, ""},
+		{errCircuitOpen, ""},
+	}
+	for _, tc := range testCases {
+		if reason := fetchErrorReason(tc.err); reason != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.err, tc.expected, reason)
+		}
+	}
+}
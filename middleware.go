@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Middleware - wraps a handler with some cross-cutting behavior (logging, recovery, limits...)
+type Middleware func(http.Handler) http.Handler
+
+// Chain - wrap h in the given middlewares
+// The first middleware is the outermost, so a request passes through them in the order they are listed.
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// timeout - answer 503 if the handler takes longer than d (no limit if d is 0)
+// The handler's context is cancelled at the deadline, so upstream calls it is making give up too.  Its
+// response is buffered, so this is no use on streaming routes.
+func timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		if d <= 0 {
+			return next
+		}
+		return http.TimeoutHandler(next, d, "request timed out")
+	}
+}
+
+// setupRoutes - register every endpoint on mux, each behind its own middleware chain
+// cfg is the configuration the routes are served with; optional middlewares are enabled from it, and
+// every endpoint is registered under cfg.BasePath.
+func setupRoutes(mux *http.ServeMux, cfg *Config) {
+	common := []Middleware{inFlight.track, accessLog, collectStats}
+	base := cfg.BasePath
+	// the routes calling the provider
+	weather := common
+	if cfg.KeyOverride {
+		weather = append(slices.Clip(common), keyOverride)
+	}
+
+	mux.Handle(base+"/health", Chain(http.HandlerFunc(healthCheck), append(common, timeout(cfg.HealthTimeout))...))
+	mux.Handle(base+"/weather", Chain(http.HandlerFunc(weatherHandler), append(weather, timeout(cfg.WeatherTimeout))...))
+	mux.Handle(base+"/weather/compare", Chain(http.HandlerFunc(compareWeatherHandler), append(weather, timeout(cfg.WeatherTimeout))...))
+	mux.Handle(base+"/weather/stream", Chain(http.HandlerFunc(weatherStreamHandler), weather...))
+	// no timeout: it would buffer a streamed batch (the request budget still bounds the provider calls)
+	mux.Handle(base+"/weather/batch", Chain(http.HandlerFunc(batchWeatherHandler), weather...))
+	mux.Handle(base+"/metrics", Chain(http.HandlerFunc(metricsHandler), common...))
+	mux.Handle(base+"/stats", Chain(http.HandlerFunc(statsHandler), common...))
+	mux.Handle(base+"/openapi.json", Chain(http.HandlerFunc(openAPIHandler), common...))
+	if cfg.DebugEndpoints {
+		mux.Handle(base+"/debug/config", Chain(http.HandlerFunc(debugConfigHandler), common...))
+	}
+
+	// the root page; everything else is a 404, but we still want it in the access log
+	mux.Handle("/", Chain(http.HandlerFunc(rootHandler), common...))
+}
+
+// externalBaseURL - the URL clients reach this service at, for self-referential output
+// Behind a reverse proxy the scheme comes from X-Forwarded-Proto, and the path from BASE_PATH.
+func externalBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// a proxy chain may list a proto per hop; the first is what the client used
+	forwarded, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	if forwarded = strings.ToLower(strings.TrimSpace(forwarded)); forwarded == "http" || forwarded == "https" {
+		scheme = forwarded
+	}
+	return scheme + "://" + r.Host + config.BasePath
+}
+
+// clientIP - the address of the client that made r
+// X-Forwarded-For is only believed when the peer is one of cfg.TrustedProxies (anyone can send the header).
+// We walk it from the right, past our own proxies, to the first address they didn't add themselves; if the
+// header is missing or malformed the peer is all we know.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(peer) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return peer.String()
+		}
+		client = addr.Unmap()
+		if !isTrustedProxy(client) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// isTrustedProxy - whether addr is in one of the configured TRUSTED_PROXIES
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	record := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), record("first"), record("second"), record("third"))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	expected := []string{"first", "second", "third", "handler"}
+	if !slices.Equal(order, expected) {
+		t.Errorf("Expected %v, got %v", expected, order)
+	}
+}
+
+func TestSetupRoutes(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo)
+	mux := http.NewServeMux()
+	setupRoutes(mux, config)
+
+	t.Run("Health", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "ok" {
+			t.Errorf("Expected 200 ok, got %d %q", w.Code, w.Body.String())
+		}
+		if !strings.Contains(logs.String(), "path=/health") {
+			t.Errorf("Expected the request in the access log: %s", logs.String())
+		}
+	})
+
+	t.Run("Unknown path", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nope", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", w.Code)
+		}
+		if !strings.Contains(logs.String(), "path=/nope") {
+			t.Errorf("Expected the request in the access log: %s", logs.String())
+		}
+	})
+}
+
+func TestSetupRoutesBasePath(t *testing.T) {
+	useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`)
+	config.BasePath = "/api/weather-service"
+	mux := http.NewServeMux()
+	setupRoutes(mux, config)
+
+	testCases := []struct {
+		target   string
+		expected int
+	}{
+		{"/api/weather-service/weather?lat=1&lon=1", http.StatusOK},
+		{"/api/weather-service/health", http.StatusOK},
+		{"/weather?lat=1&lon=1", http.StatusNotFound},
+		{"/health", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if w.Code != tc.expected {
+			t.Errorf("%s: expected %d, got %d", tc.target, tc.expected, w.Code)
+		}
+	}
+}
+
+func TestExternalBaseURL(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BasePath = "/api/weather-service"
+	withConfig(t, cfg)
+
+	testCases := []struct {
+		name      string
+		forwarded string
+		expected  string
+	}{
+		{"Direct", "", "http://example.com/api/weather-service"},
+		{"Behind a TLS proxy", "https", "https://example.com/api/weather-service"},
+		{"Several proxies", "HTTPS, http", "https://example.com/api/weather-service"},
+		{"Nonsense", "gopher", "http://example.com/api/weather-service"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/weather-service/openapi.json", nil)
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-Proto", tc.forwarded)
+			}
+			if got := externalBaseURL(r); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+// slowCache - Cache whose Len takes delay, or until ctx is done, telling lenDone when it returns
+type slowCache struct {
+	Cache
+	delay   time.Duration
+	lenDone chan struct{}
+}
+
+func (c slowCache) Len(ctx context.Context) (int, error) {
+	defer func() { c.lenDone <- struct{}{} }()
+	select {
+	case <-time.After(c.delay):
+		return c.Cache.Len(ctx)
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			_, _ = w.Write([]byte("done"))
+		case <-r.Context().Done():
+		}
+	})
+	testCases := []struct {
+		name     string
+		timeout  time.Duration
+		expected int
+	}{
+		{"Within the timeout", time.Second, http.StatusOK},
+		{"Over the timeout", 20 * time.Millisecond, http.StatusServiceUnavailable},
+		{"No timeout", 0, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Chain(slow, timeout(tc.timeout)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	provider := useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`)
+	provider.fetch = func(q weatherQuery) (*WeatherData, error) {
+		time.Sleep(delay)
+		return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`), nil
+	}
+	cache := slowCache{Cache: config.Cache, delay: delay, lenDone: make(chan struct{}, 1)}
+	config.Cache = cache
+	config.HealthTimeout = delay / 2
+	config.WeatherTimeout = 4 * delay
+	mux := http.NewServeMux()
+	setupRoutes(mux, config)
+
+	t.Run("Health uses the shorter timeout", func(t *testing.T) {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health?verbose=true", nil))
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "request timed out") {
+			t.Errorf("Expected the health check to time out, got %d %q", w.Code, w.Body.String())
+		}
+		if elapsed := time.Since(start); elapsed >= delay {
+			t.Errorf("Expected the health check to give up after %s, took %s", config.HealthTimeout, elapsed)
+		}
+		// the abandoned handler is still running; it is done with the config once the cache check returns
+		<-cache.lenDone
+	})
+
+	t.Run("Weather uses the longer timeout", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected the slow weather request to succeed, got %d %q", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+	withConfig(t, cfg)
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"No proxy", "203.0.113.7:4321", nil, "203.0.113.7"},
+		{"Trusted peer", "10.0.0.1:4321", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"Trusted peer, no header", "10.0.0.1:4321", nil, "10.0.0.1"},
+		{"Untrusted peer", "203.0.113.7:4321", []string{"198.51.100.9"}, "203.0.113.7"},
+		{"Chain of trusted proxies", "10.0.0.1:4321", []string{"198.51.100.9, 10.1.2.3"}, "198.51.100.9"},
+		{"Spoofed first hop", "10.0.0.1:4321", []string{"1.2.3.4, 198.51.100.9, 10.1.2.3"}, "198.51.100.9"},
+		{"Repeated headers", "10.0.0.1:4321", []string{"1.2.3.4", "198.51.100.9"}, "198.51.100.9"},
+		{"IPv6", "[fd00::1]:4321", []string{"2001:db8::9"}, "2001:db8::9"},
+		{"All hops trusted", "10.0.0.1:4321", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"Malformed header", "10.0.0.1:4321", []string{"not-an-ip"}, "10.0.0.1"},
+		{"Malformed hop", "10.0.0.1:4321", []string{"198.51.100.9, garbage"}, "10.0.0.1"},
+		{"Empty header", "10.0.0.1:4321", []string{""}, "10.0.0.1"},
+		{"No port", "203.0.113.7", nil, "203.0.113.7"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/weather", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, header := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if ip := clientIP(r); ip != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// schemaFor - a JSON schema for t, built from its fields' json tags
+// Fields tagged omitempty are optional; everything else is listed as required.
+func schemaFor(t reflect.Type) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]any{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaFor(field.Type)
+			if !strings.Contains(options, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		return map[string]any{"type": "object", "properties": properties, "required": required}
+	default:
+		return map[string]any{}
+	}
+}
+
+// queryParameter - an OpenAPI query parameter description
+func queryParameter(name, schemaType, description string) map[string]any {
+	return map[string]any{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"schema":      map[string]any{"type": schemaType},
+	}
+}
+
+// openAPISpec - the OpenAPI 3 description of the service, served from serverURL
+// Response schemas are generated from the response structs, so the spec can't drift from what we send.
+func openAPISpec(serverURL string) map[string]any {
+	weatherParameters := []any{
+		queryParameter("lat", "number", "Latitude, -90 to 90 (optional when a default location is configured)"),
+		queryParameter("lon", "number", "Longitude, -180 to 180 (optional when a default location is configured)"),
+		queryParameter("zip", "string", "US ZIP code (NNNNN or NNNNN,US), instead of lat/lon"),
+		queryParameter("location", "string", "A location named by the operator, instead of lat/lon"),
+		queryParameter("format", "string", "Response format: text (default), json or xml"),
+		queryParameter("emoji", "boolean", "Include an emoji for the weather condition"),
+		queryParameter("all_units", "boolean", "Include the temperature in Kelvin, and in every unit system"),
+		queryParameter("timestamp", "integer", "Unix time of a past observation (historical lookup)"),
+		queryParameter("units", "string", "Also report the temperature in metric, imperial or standard units"),
+		queryParameter("include", "string", "Extra data to include, comma separated: air_quality, uv, forecast, alerts"),
+		queryParameter("exclude", "string",
+			"One Call parts to leave out of the provider response, comma separated: minutely, hourly, daily, alerts (current weather only, and only when OPENWEATHER_API_PATH is a One Call path; otherwise 400)"),
+		queryParameter("pretty", "boolean", "Indent JSON responses by two spaces"),
+		queryParameter("indent", "integer", "Indent JSON responses by this many spaces (up to 8)"),
+		queryParameter("raw", "boolean", "Include the provider's response in JSON responses, as a string if it was XML (only when DEBUG_ENDPOINTS is set)"),
+	}
+	textResponse := func(description string) map[string]any {
+		return map[string]any{
+			"description": description,
+			"content":     map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+		}
+	}
+
+	weatherResponses := map[string]any{
+		"200": map[string]any{
+			"description": "The weather report",
+			"content": map[string]any{
+				"application/json": map[string]any{
+					"schema": map[string]any{"$ref": "#/components/schemas/WeatherResponse"},
+				},
+				"text/plain": map[string]any{"schema": map[string]any{"type": "string"}},
+			},
+		},
+		"304": map[string]any{"description": "Unchanged since the ETag sent in If-None-Match"},
+		"400": textResponse("Invalid request parameters"),
+		"403": textResponse("Coordinates outside the area served"),
+		"404": textResponse("Unknown ZIP code or location"),
+		"502": textResponse("The weather provider sent an unusable response"),
+		"503": textResponse("The weather provider is unavailable"),
+		"504": textResponse("The weather provider did not respond in time"),
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "weather-service",
+			"version": "1.0.0",
+		},
+		"servers": []map[string]any{{"url": serverURL}},
+		"paths": map[string]any{
+			"/weather": map[string]any{
+				"get": map[string]any{
+					"summary":    "Current (or historical) weather for a location",
+					"parameters": weatherParameters,
+					"responses":  weatherResponses,
+				},
+				"post": map[string]any{
+					"summary":    "As GET, with lat, lon and units in a JSON body",
+					"parameters": weatherParameters,
+					"requestBody": map[string]any{
+						"required": true,
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"type": "object",
+									"properties": map[string]any{
+										"lat":   map[string]any{"type": "number"},
+										"lon":   map[string]any{"type": "number"},
+										"units": map[string]any{"type": "string"},
+									},
+								},
+							},
+						},
+					},
+					"responses": weatherResponses,
+				},
+			},
+			"/weather/compare": map[string]any{
+				"get": map[string]any{
+					"summary": "The current weather at two locations, and which is warmer",
+					"parameters": []any{
+						queryParameter("lat1", "number", "Latitude of the first location, -90 to 90"),
+						queryParameter("lon1", "number", "Longitude of the first location, -180 to 180"),
+						queryParameter("lat2", "number", "Latitude of the second location, -90 to 90"),
+						queryParameter("lon2", "number", "Longitude of the second location, -180 to 180"),
+						queryParameter("units", "string", "Also report the temperatures in metric, imperial or standard units"),
+					},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "The comparison; a location that couldn't be fetched has an error instead of weather",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{"$ref": "#/components/schemas/ComparisonResponse"},
+								},
+							},
+						},
+						"400": textResponse("Invalid request parameters"),
+						"403": textResponse("Coordinates outside the area served"),
+						"502": textResponse("The weather provider sent an unusable response for both locations"),
+						"503": textResponse("The weather provider is unavailable"),
+						"504": textResponse("The weather provider did not respond in time"),
+					},
+				},
+			},
+			"/weather/batch": map[string]any{
+				"post": map[string]any{
+					"summary": "The current weather at up to MAX_BATCH_SIZE locations",
+					"parameters": []any{
+						map[string]any{
+							"name": "Idempotency-Key",
+							"in":   "header",
+							"description": "Replay the results of an earlier identical batch sent with this key " +
+								"(within IDEMPOTENCY_TTL_SECONDS) instead of fetching them again",
+							"schema": map[string]any{"type": "string", "maxLength": maxIdempotencyKeyLength},
+						},
+					},
+					"requestBody": map[string]any{
+						"required": true,
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"type": "object",
+									"properties": map[string]any{
+										"locations": map[string]any{
+											"type": "array",
+											"items": map[string]any{
+												"type": "object",
+												"properties": map[string]any{
+													"lat": map[string]any{"type": "number"},
+													"lon": map[string]any{"type": "number"},
+												},
+											},
+										},
+										"units": map[string]any{"type": "string"},
+									},
+								},
+							},
+						},
+					},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "The weather at each location, or why it couldn't be fetched. With Accept: " +
+								"application/x-ndjson, one line per location as each is ready, with its index in the request",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{"$ref": "#/components/schemas/BatchResponse"},
+								},
+								"application/x-ndjson": map[string]any{},
+							},
+						},
+						"400": textResponse("Invalid request body, or too many locations"),
+						"413": textResponse("Request body too large"),
+						"415": textResponse("Content-Type is not application/json"),
+					},
+				},
+			},
+			"/health": map[string]any{
+				"get": map[string]any{
+					"summary": "Liveness check (add ?verbose=true for a dependency report)",
+					"responses": map[string]any{
+						"200": textResponse("The service is up"),
+						"503": textResponse("A dependency is failing (verbose report only)"),
+					},
+				},
+			},
+		},
+		"components": map[string]any{
+			"schemas": map[string]any{
+				"WeatherResponse":    schemaFor(reflect.TypeOf(WeatherResponse{})),
+				"ComparisonResponse": schemaFor(reflect.TypeOf(ComparisonResponse{})),
+				"BatchResponse":      schemaFor(reflect.TypeOf(BatchResponse{})),
+			},
+		},
+	}
+}
+
+// openAPIHandler - serve the OpenAPI spec
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(openAPISpec(externalBaseURL(r))); err != nil {
+		slog.Error("error writing the openapi spec", "error", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestOpenAPIHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	openAPIHandler(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]struct {
+			Get struct {
+				Responses map[string]struct {
+					Content map[string]struct {
+						Schema struct {
+							Ref string `json:"$ref"`
+						} `json:"schema"`
+					} `json:"content"`
+				} `json:"responses"`
+			} `json:"get"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Type       string                     `json:"type"`
+				Properties map[string]json.RawMessage `json:"properties"`
+				Required   []string                   `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if spec.OpenAPI != "3.0.3" {
+		t.Errorf("Expected openapi 3.0.3, got %q", spec.OpenAPI)
+	}
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "http://example.com" {
+		t.Errorf("Expected the server http://example.com, got %+v", spec.Servers)
+	}
+
+	weather, ok := spec.Paths["/weather"]
+	if !ok {
+		t.Fatal("Expected the /weather path")
+	}
+	ref := weather.Get.Responses["200"].Content["application/json"].Schema.Ref
+	if ref != "#/components/schemas/WeatherResponse" {
+		t.Fatalf("Expected the WeatherResponse schema, got %q", ref)
+	}
+
+	schema := spec.Components.Schemas["WeatherResponse"]
+	if schema.Type != "object" {
+		t.Errorf("Expected an object schema, got %q", schema.Type)
+	}
+	for _, name := range []string{"condition", "group", "icon", "feel", "temperature_c", "temperature_f"} {
+		if !slices.Contains(schema.Required, name) {
+			t.Errorf("Expected %s to be required: %v", name, schema.Required)
+		}
+	}
+	for _, name := range []string{"location", "emoji", "temperature_k", "trend"} {
+		if _, ok := schema.Properties[name]; !ok {
+			t.Errorf("Expected property %s", name)
+		}
+		if slices.Contains(schema.Required, name) {
+			t.Errorf("Expected %s to be optional", name)
+		}
+	}
+	if _, ok := schema.Properties["XMLName"]; ok {
+		t.Error("XMLName should not appear in the json schema")
+	}
+}
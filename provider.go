@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamTimeout - the longest we will wait on a single OpenWeather API call
+const upstreamTimeout = 10 * time.Second
+
+// errInvalidAPIKey - the OpenWeather API key is missing or malformed
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// errRequestFailed - the request to the provider could not be completed (network error, timeout)
+var errRequestFailed = errors.New("weather provider request failed")
+
+// errEmptyResponse - the provider answered 200 with no body at all, which happens during its incidents
+var errEmptyResponse = errors.New("empty response from weather provider")
+
+// errInvalidResponse - the provider answered 200, but not with weather data we can use
+var errInvalidResponse = errors.New("invalid response from weather provider")
+
+// errNoConditions - the provider's weather data had no conditions in it (also an errInvalidResponse)
+var errNoConditions = fmt.Errorf("%w: no weather conditions", errInvalidResponse)
+
+// ErrUnknownExclude - exclude named something that isn't a part of a One Call response
+var ErrUnknownExclude = errors.New("unknown exclude")
+
+// oneCallExcludes - the parts of a One Call response that exclude may leave out
+var oneCallExcludes = []string{"minutely", "hourly", "daily", "alerts"}
+
+// weatherQuery - the parameters of a single weather lookup
+type weatherQuery struct {
+	Lat     float64
+	Lon     float64
+	At      time.Time // historical lookup time; zero means current weather
+	Exclude string    // One Call parts to leave out, comma separated; they don't change the data we decode
+}
+
+// validateExcludes - the One Call parts named in exclude (comma separated), normalized and without repeats
+// An empty exclude leaves nothing out; a name that isn't in oneCallExcludes is an error.
+func validateExcludes(raw string) (string, error) {
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || slices.Contains(names, name) {
+			continue
+		}
+		if !slices.Contains(oneCallExcludes, name) {
+			return "", fmt.Errorf("%w: %s", ErrUnknownExclude, name)
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ","), nil
+}
+
+// isOneCallPath - whether path is one of OpenWeather's One Call endpoints
+// A One Call OPENWEATHER_API_PATH (e.g. /data/3.0/onecall) is the only current weather API taking exclude.
+func isOneCallPath(path string) bool {
+	return strings.Contains(path, "/onecall")
+}
+
+// WeatherProvider - a source of current weather data
+type WeatherProvider interface {
+	Fetch(ctx context.Context, q weatherQuery) (*WeatherData, error)
+}
+
+// upstreamError - the weather provider responded with an error status
+// OpenWeather sometimes answers 200 with the real status in the body's cod field; StatusCode is that status.
+type upstreamError struct {
+	StatusCode int
+	RetryAfter string // the provider's Retry-After header, if any
+	Message    string // the provider's explanation, if it gave one
+}
+
+func (e *upstreamError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("weather provider returned status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("weather provider returned status %d", e.StatusCode)
+}
+
+// retryable - whether the request may succeed if we try again
+func (e *upstreamError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// openWeatherProvider - WeatherProvider backed by the OpenWeather current weather API
+type openWeatherProvider struct {
+	baseURL     string
+	apiPath     string // e.g. /data/2.5/weather
+	historyPath string // e.g. /data/3.0/onecall/timemachine
+	client      *http.Client
+	maxAttempts int           // total attempts, including the first
+	backoff     time.Duration // delay before the first retry, doubling for each one after
+	backoffCap  time.Duration // the most the delay doubles to
+	jitter      string        // how the delay is randomized: none, full or equal
+	random      func(n int64) int64
+	mode        string // the current weather response format: json or xml (history is always json)
+	keepRaw     bool   // keep each response as WeatherData.Raw, for raw=true
+}
+
+// openWeatherModes - the response formats OPENWEATHER_MODE may ask the current weather API for
+var openWeatherModes = []string{"json", "xml"}
+
+// retryJitters - the jitter strategies RETRY_JITTER may name
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/ for how they compare.
+var retryJitters = []string{"none", "full", "equal"}
+
+// newUpstreamTransport - the transport for requests to the provider
+// Requests go through proxyURL if it is set, otherwise through whatever HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+// say.
+func newUpstreamTransport(proxyURL *url.URL) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport
+}
+
+// newOpenWeatherProvider - create an OpenWeather provider for the given base URL
+func newOpenWeatherProvider(baseURL string) *openWeatherProvider {
+	return &openWeatherProvider{
+		baseURL:     baseURL,
+		apiPath:     defaultOpenWeatherAPIPath,
+		historyPath: defaultOpenWeatherHistoryPath,
+		client:      &http.Client{Timeout: upstreamTimeout, Transport: newUpstreamTransport(nil)},
+		maxAttempts: 3,
+		backoff:     200 * time.Millisecond,
+		backoffCap:  10 * time.Second,
+		jitter:      "none",
+		random:      rand.Int64N,
+		mode:        "json",
+	}
+}
+
+// Fetch - get the weather for the given coordinates, from the history endpoint if q.At is set
+// Network errors, 429s and 5xx responses are retried with exponential backoff up to maxAttempts, or until
+// ctx's deadline leaves no room for another attempt.  Under a deadline each attempt only gets its share of
+// the time left (see attemptTimeout), so one hung request can't use up the budget the retries need.
+func (p *openWeatherProvider) Fetch(ctx context.Context, q weatherQuery) (*WeatherData, error) {
+	apiKey, err := apiKeys.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidAPIKey, err)
+	}
+
+	// Construct the API request URL
+	params := url.Values{}
+	params.Set("lat", strconv.FormatFloat(q.Lat, 'f', 6, 64))
+	params.Set("lon", strconv.FormatFloat(q.Lon, 'f', 6, 64))
+	params.Set("units", "metric")
+	params.Set("appid", apiKey)
+	path, decode := p.apiPath, decodeCurrentWeather
+	switch {
+	case !q.At.IsZero():
+		params.Set("dt", strconv.FormatInt(q.At.Unix(), 10))
+		path, decode = p.historyPath, decodeHistoricalWeather
+	case p.mode == "xml":
+		params.Set("mode", "xml")
+		decode = decodeCurrentWeatherXML
+	case isOneCallPath(path):
+		decode = decodeOneCallWeather
+		if q.Exclude != "" {
+			params.Set("exclude", q.Exclude)
+		}
+	}
+	requestURL := p.baseURL + path + "?" + params.Encode()
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout := attemptTimeout(time.Until(deadline), p.maxAttempts-attempt+1, p.backoffCeiling(attempt))
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		weatherData, err := p.fetchOnce(attemptCtx, requestURL, decode)
+		cancel()
+		if err == nil {
+			weatherData.Source = "openweather"
+			// the response shouldn't echo our key, but raw=true mustn't be a way to find out if it does
+			if weatherData.Raw != nil {
+				weatherData.Raw = bytes.ReplaceAll(weatherData.Raw, []byte(apiKey), []byte("REDACTED"))
+			}
+			return weatherData, nil
+		}
+		var upstreamErr *upstreamError
+		transient := errors.As(err, &upstreamErr) && upstreamErr.retryable() || errors.Is(err, errRequestFailed)
+		if !transient || attempt >= p.maxAttempts {
+			return nil, err
+		}
+		delay := p.retryDelay(attempt)
+		// don't wait for a retry that the request's deadline won't let us make
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			slog.Warn("weather provider request failed, no time left to retry", "attempt", attempt, "error", err)
+			return nil, err
+		}
+		slog.Warn("weather provider request failed, retrying", "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoffCeiling - the delay before the retry following attempt, before any jitter
+// It doubles from backoff with each attempt, up to backoffCap.
+func (p *openWeatherProvider) backoffCeiling(attempt int) time.Duration {
+	ceiling := p.backoff
+	for i := 1; i < attempt && ceiling < p.backoffCap; i++ {
+		ceiling *= 2
+	}
+	return min(ceiling, p.backoffCap)
+}
+
+// retryDelay - how long to wait before retrying after attempt, with the provider's jitter applied
+// Full jitter waits anywhere up to the ceiling, equal jitter at least half of it; none waits all of it.
+func (p *openWeatherProvider) retryDelay(attempt int) time.Duration {
+	ceiling := p.backoffCeiling(attempt)
+	if ceiling <= 0 {
+		return 0
+	}
+	switch p.jitter {
+	case "full":
+		return time.Duration(p.random(int64(ceiling) + 1))
+	case "equal":
+		half := ceiling / 2
+		return ceiling - half + time.Duration(p.random(int64(half)+1))
+	default:
+		return ceiling
+	}
+}
+
+// attemptTimeout - how long the next of attemptsLeft attempts may take, with remaining until the deadline
+// The time left after the backoffs between the attempts (delay, doubling) is shared evenly between them.
+// When that doesn't leave every attempt some time, we plan for fewer; the last attempt gets all there is.
+func attemptTimeout(remaining time.Duration, attemptsLeft int, delay time.Duration) time.Duration {
+	for n := attemptsLeft; n > 1; n-- {
+		// delay + 2*delay + ... for the n-1 retries, stopping once it is more than we have
+		var backoffs time.Duration
+		for i, d := 1, delay; i < n && backoffs < remaining; i, d = i+1, d*2 {
+			backoffs += d
+		}
+		if share := (remaining - backoffs) / time.Duration(n); share > 0 {
+			return share
+		}
+	}
+	return remaining
+}
+
+// fetchOnce - make a single request to the OpenWeather API, decoding the body with decode
+func (p *openWeatherProvider) fetchOnce(ctx context.Context, requestURL string,
+	decode func(io.Reader) (*WeatherData, error)) (*WeatherData, error) {
+	slog.Debug("weather provider request", "url", redactURL(requestURL))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make the HTTP request to OpenWeather API
+	resp, err := p.client.Do(req)
+	if err != nil {
+		// the url.Error carries the full request URL, which includes our API key
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("%w: %w", errRequestFailed, err)
+	}
+
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			slog.Warn("error closing body", "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamError{StatusCode: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After")}
+	}
+
+	// with keepRaw, the body is copied as the decoder reads it
+	var body io.Reader = resp.Body
+	var raw bytes.Buffer
+	if p.keepRaw {
+		body = io.TeeReader(resp.Body, &raw)
+	}
+	weatherData, err := decode(body)
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		return nil, err
+	}
+	if err != nil {
+		// the detail stays in our logs; clients only learn that the provider's answer was unusable
+		if errors.Is(err, io.EOF) {
+			slog.Warn("weather provider returned an empty body", "url", redactURL(requestURL))
+			return nil, errEmptyResponse
+		}
+		slog.Warn("weather provider returned a malformed response", "url", redactURL(requestURL), "error", err)
+		return nil, fmt.Errorf("%w: %w", errInvalidResponse, err)
+	}
+	if len(weatherData.Weather) == 0 {
+		return nil, errNoConditions
+	}
+	if p.keepRaw {
+		// the decoder stops at the end of the value, and may not have read all that came after it
+		if _, err := io.Copy(io.Discard, body); err == nil {
+			weatherData.Raw = rawResponse(raw.Bytes())
+		}
+	}
+	return weatherData, nil
+}
+
+// rawResponse - a provider response body as JSON, for raw=true
+// A JSON body is kept as it is; anything else (the XML of OPENWEATHER_MODE=xml) becomes a JSON string.
+func rawResponse(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	encoded, _ := json.Marshal(string(body)) // a string always encodes
+	return encoded
+}
+
+// responseStatus - the cod and message fields OpenWeather includes in its responses
+type responseStatus struct {
+	Cod     json.RawMessage `json:"cod"` // a number or a string, depending on the endpoint
+	Message string          `json:"message"`
+}
+
+// err - an upstreamError if cod is an error status, nil if it is 200 or absent
+func (s responseStatus) err() error {
+	raw := strings.Trim(string(s.Cod), `"`)
+	if raw == "" || raw == "null" {
+		return nil
+	}
+	cod, err := strconv.Atoi(raw)
+	if err != nil {
+		return fmt.Errorf("%w: unexpected cod %s", errInvalidResponse, s.Cod)
+	}
+	if cod == http.StatusOK {
+		return nil
+	}
+	return &upstreamError{StatusCode: cod, Message: s.Message}
+}
+
+// decodeCurrentWeather - decode a current weather API response
+func decodeCurrentWeather(body io.Reader) (*WeatherData, error) {
+	var response struct {
+		WeatherData
+		responseStatus
+	}
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return nil, err
+	}
+	if err := response.err(); err != nil {
+		return nil, err
+	}
+	return &response.WeatherData, nil
+}
+
+// currentWeatherXML - the parts of a current weather API response in XML (mode=xml) we use
+// Values are attributes of their elements, e.g. <temperature value="16.45" unit="celsius"/>.
+type currentWeatherXML struct {
+	XMLName xml.Name `xml:"current"`
+	City    struct {
+		Name    string `xml:"name,attr"`
+		Country string `xml:"country"`
+	} `xml:"city"`
+	Temperature struct {
+		Value float64 `xml:"value,attr"`
+	} `xml:"temperature"`
+	Humidity struct {
+		Value float64 `xml:"value,attr"`
+	} `xml:"humidity"`
+	Wind struct {
+		Speed *struct {
+			Value float64 `xml:"value,attr"`
+		} `xml:"speed"`
+		Direction struct {
+			Value float64 `xml:"value,attr"`
+		} `xml:"direction"`
+	} `xml:"wind"`
+	Weather []struct {
+		Number int    `xml:"number,attr"`
+		Value  string `xml:"value,attr"`
+		Icon   string `xml:"icon,attr"`
+	} `xml:"weather"`
+	LastUpdate struct {
+		Value string `xml:"value,attr"` // UTC, without a zone
+	} `xml:"lastupdate"`
+}
+
+// decodeCurrentWeatherXML - decode a current weather API response in XML into the same WeatherData the
+// JSON response gives
+// Errors come with a non-200 status, so they never reach here; any other root element is a malformed
+// response.
+func decodeCurrentWeatherXML(body io.Reader) (*WeatherData, error) {
+	var current currentWeatherXML
+	if err := xml.NewDecoder(body).Decode(&current); err != nil {
+		return nil, err
+	}
+
+	var weatherData WeatherData
+	for _, condition := range current.Weather {
+		weatherData.Weather = append(weatherData.Weather, struct {
+			ID          int    `json:"id"`
+			Description string `json:"description"`
+			Icon        string `json:"icon"`
+		}{ID: condition.Number, Description: condition.Value, Icon: condition.Icon})
+	}
+	weatherData.Main.Temperature = current.Temperature.Value
+	weatherData.Main.Humidity = current.Humidity.Value
+	weatherData.Name = current.City.Name
+	weatherData.Sys.Country = current.City.Country
+	if speed := current.Wind.Speed; speed != nil {
+		weatherData.Wind = &struct {
+			Speed   float64 `json:"speed"`
+			Degrees float64 `json:"deg"`
+		}{Speed: speed.Value, Degrees: current.Wind.Direction.Value}
+	}
+	if raw := current.LastUpdate.Value; raw != "" {
+		observed, err := time.Parse("2006-01-02T15:04:05", raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad lastupdate %q", errInvalidResponse, raw)
+		}
+		weatherData.Observed = observed.Unix()
+	}
+	return &weatherData, nil
+}
+
+// oneCallConditions - the conditions at a point in time, as the One Call API reports them
+type oneCallConditions struct {
+	Observed    int64   `json:"dt"`
+	Temperature float64 `json:"temp"`
+	Humidity    float64 `json:"humidity"`
+	WindSpeed   float64 `json:"wind_speed"`
+	WindDegrees float64 `json:"wind_deg"`
+	Weather     []struct {
+		ID          int    `json:"id"`
+		Description string `json:"description"`
+		Icon        string `json:"icon"`
+	} `json:"weather"`
+}
+
+// weatherData - the conditions in the current weather shape
+// One Call responses have no location name, so Name and Sys are left empty.
+func (c oneCallConditions) weatherData() *WeatherData {
+	var weatherData WeatherData
+	weatherData.Weather = c.Weather
+	weatherData.Observed = c.Observed
+	weatherData.Main.Temperature = c.Temperature
+	weatherData.Main.Humidity = c.Humidity
+	weatherData.Wind = &struct {
+		Speed   float64 `json:"speed"`
+		Degrees float64 `json:"deg"`
+	}{Speed: c.WindSpeed, Degrees: c.WindDegrees}
+	return &weatherData
+}
+
+// oneCallWeather - the parts of a One Call response (OPENWEATHER_API_PATH=/data/3.0/onecall) we use
+// The minutely, hourly and daily forecasts and the alerts are what exclude may leave out.
+type oneCallWeather struct {
+	responseStatus
+	Current *oneCallConditions `json:"current"`
+}
+
+// decodeOneCallWeather - decode a One Call response's current conditions into the current weather shape
+func decodeOneCallWeather(body io.Reader) (*WeatherData, error) {
+	var oneCall oneCallWeather
+	if err := json.NewDecoder(body).Decode(&oneCall); err != nil {
+		return nil, err
+	}
+	if err := oneCall.err(); err != nil {
+		return nil, err
+	}
+	if oneCall.Current == nil {
+		return nil, fmt.Errorf("%w: no current weather", errInvalidResponse)
+	}
+	return oneCall.Current.weatherData(), nil
+}
+
+// historicalWeather - the parts of a One Call timemachine response we use
+type historicalWeather struct {
+	responseStatus
+	Data []oneCallConditions `json:"data"`
+}
+
+// decodeHistoricalWeather - decode a One Call timemachine response into the current weather shape
+func decodeHistoricalWeather(body io.Reader) (*WeatherData, error) {
+	var history historicalWeather
+	if err := json.NewDecoder(body).Decode(&history); err != nil {
+		return nil, err
+	}
+	if err := history.err(); err != nil {
+		return nil, err
+	}
+	if len(history.Data) == 0 {
+		return nil, fmt.Errorf("%w: no historical data", errInvalidResponse)
+	}
+	return history.Data[0].weatherData(), nil
+}
+
+// Ping - check that the OpenWeather API host is reachable
+// Any http response counts; we don't spend an API call (or need a key) to find out.
+func (p *openWeatherProvider) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.baseURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errRequestFailed, err)
+	}
+	return resp.Body.Close()
+}
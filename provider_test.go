@@ -0,0 +1,806 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockProvider - WeatherProvider returning canned data for tests
+type mockProvider struct {
+	mu    sync.Mutex
+	calls int
+	fetch func(q weatherQuery) (*WeatherData, error)
+}
+
+func (p *mockProvider) Fetch(_ context.Context, q weatherQuery) (*WeatherData, error) {
+	p.mu.Lock()
+	p.calls++
+	p.mu.Unlock()
+	return p.fetch(q)
+}
+
+// Calls - the number of times Fetch has been called
+func (p *mockProvider) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+// weatherDataFromJSON - decode a provider payload for use as test data
+func weatherDataFromJSON(t *testing.T, payload string) *WeatherData {
+	t.Helper()
+	var data WeatherData
+	if err := json.Unmarshal([]byte(payload), &data); err != nil {
+		t.Fatalf("bad test payload: %v", err)
+	}
+	return &data
+}
+
+func TestOpenWeatherProvider(t *testing.T) {
+	const fakeApiKey = "abcdef0123456789abcdef0123456789"
+
+	t.Run("Valid response", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/data/2.5/weather" {
+				t.Errorf("unexpected path: %s", r.URL.Path)
+			}
+			if r.URL.Query().Get("appid") != fakeApiKey {
+				t.Errorf("unexpected appid: %s", r.URL.Query().Get("appid"))
+			}
+			if r.URL.Query().Get("lat") != "37.774900" || r.URL.Query().Get("lon") != "-122.419400" {
+				t.Errorf("unexpected coordinates: %s", r.URL.RawQuery)
+			}
+			_, _ = w.Write([]byte(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`))
+		}))
+		t.Cleanup(server.Close)
+
+		data, err := newOpenWeatherProvider(server.URL).Fetch(context.Background(),
+			weatherQuery{Lat: 37.7749, Lon: -122.4194})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if data.Weather[0].Description != "clear sky" || data.Main.Temperature != 21.5 {
+			t.Errorf("unexpected weather data: %+v", data)
+		}
+	})
+
+	t.Run("Configured API path", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/custom/weather" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`))
+		}))
+		t.Cleanup(server.Close)
+
+		provider := newOpenWeatherProvider(server.URL)
+		provider.apiPath = "/custom/weather"
+		if _, err := provider.Fetch(context.Background(), weatherQuery{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Historical lookup", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/data/3.0/onecall/timemachine" {
+				t.Errorf("unexpected path: %s", r.URL.Path)
+			}
+			if r.URL.Query().Get("dt") != "1700000000" {
+				t.Errorf("unexpected dt: %s", r.URL.Query().Get("dt"))
+			}
+			_, _ = w.Write([]byte(`{"lat":1,"lon":1,"data":[{"dt":1700000000,"temp":3.5,"humidity":80,` +
+				`"wind_speed":4.1,"wind_deg":270,"weather":[{"id":600,"description":"light snow","icon":"13d"}]}]}`))
+		}))
+		t.Cleanup(server.Close)
+
+		data, err := newOpenWeatherProvider(server.URL).Fetch(context.Background(),
+			weatherQuery{Lat: 1, Lon: 1, At: time.Unix(1700000000, 0)})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if data.Weather[0].Description != "light snow" || data.Main.Temperature != 3.5 || data.Main.Humidity != 80 {
+			t.Errorf("unexpected weather data: %+v", data)
+		}
+		if data.Wind == nil || data.Wind.Degrees != 270 {
+			t.Errorf("unexpected wind: %+v", data.Wind)
+		}
+		if data.Observed != 1700000000 {
+			t.Errorf("unexpected observation time: %d", data.Observed)
+		}
+	})
+
+	t.Run("Exclude only on the One Call path", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		excludes := map[string]string{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			excludes[r.URL.Path] = r.URL.Query().Get("exclude")
+			switch r.URL.Path {
+			case "/data/3.0/onecall/timemachine":
+				_, _ = w.Write([]byte(`{"data":[{"dt":1700000000,"temp":3.5,"weather":[{"id":600,"description":"light snow"}]}]}`))
+			case "/data/3.0/onecall":
+				_, _ = w.Write([]byte(`{"lat":1,"lon":1,"current":{"dt":1700000600,"temp":12.5,"humidity":81,` +
+					`"wind_speed":4.1,"wind_deg":250,"weather":[{"id":500,"description":"light rain","icon":"10d"}]}}`))
+			default:
+				_, _ = w.Write([]byte(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`))
+			}
+		}))
+		t.Cleanup(server.Close)
+
+		provider := newOpenWeatherProvider(server.URL)
+		for _, q := range []weatherQuery{
+			{Lat: 1, Lon: 1, At: time.Unix(1700000000, 0), Exclude: "minutely,hourly"},
+			{Lat: 1, Lon: 1, Exclude: "minutely,hourly"},
+		} {
+			if _, err := provider.Fetch(context.Background(), q); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		provider.apiPath = "/data/3.0/onecall"
+		data, err := provider.Fetch(context.Background(), weatherQuery{Lat: 1, Lon: 1, Exclude: "minutely,hourly"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if exclude, ok := excludes["/data/3.0/onecall/timemachine"]; !ok || exclude != "" {
+			t.Errorf("Expected no exclude on the timemachine path, got %q (requested: %t)", exclude, ok)
+		}
+		if exclude, ok := excludes["/data/2.5/weather"]; !ok || exclude != "" {
+			t.Errorf("Expected no exclude on the current weather path, got %q (requested: %t)", exclude, ok)
+		}
+		if excludes["/data/3.0/onecall"] != "minutely,hourly" {
+			t.Errorf("Expected exclude passed to One Call, got %q", excludes["/data/3.0/onecall"])
+		}
+		if data.Main.Temperature != 12.5 || data.Main.Humidity != 81 || data.Observed != 1700000600 ||
+			data.Wind == nil || data.Wind.Speed != 4.1 || len(data.Weather) != 1 || data.Weather[0].Description != "light rain" {
+			t.Errorf("Expected the One Call current conditions, got %+v", data)
+		}
+	})
+
+	t.Run("One Call response without current conditions", func(t *testing.T) {
+		_, err := decodeOneCallWeather(strings.NewReader(`{"lat":1,"lon":1,"hourly":[]}`))
+		if !errors.Is(err, errInvalidResponse) {
+			t.Errorf("Expected errInvalidResponse, got %v", err)
+		}
+	})
+
+	t.Run("Raw response", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// a response echoing the key, which raw=true must not pass on
+			_, _ = w.Write([]byte(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5},` +
+				`"visibility":10000,"request":"` + r.URL.Query().Get("appid") + `"}` + "\n"))
+		}))
+		t.Cleanup(server.Close)
+
+		provider := newOpenWeatherProvider(server.URL)
+		data, err := provider.Fetch(context.Background(), weatherQuery{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if data.Raw != nil {
+			t.Errorf("Expected no raw response unless asked to keep it, got %s", data.Raw)
+		}
+
+		provider.keepRaw = true
+		data, err = provider.Fetch(context.Background(), weatherQuery{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if data.Main.Temperature != 21.5 {
+			t.Errorf("Expected the response decoded as well, got %+v", data)
+		}
+		expected := `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5},"visibility":10000,"request":"REDACTED"}` + "\n"
+		if string(data.Raw) != expected {
+			t.Errorf("Expected the raw response %s, got %s", expected, data.Raw)
+		}
+
+	})
+
+	t.Run("Raw XML response", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/xml")
+			_, _ = w.Write([]byte(sampleCurrentWeatherXML))
+		}))
+		t.Cleanup(server.Close)
+
+		provider := newOpenWeatherProvider(server.URL)
+		provider.mode = "xml"
+		provider.keepRaw = true
+		data, err := provider.Fetch(context.Background(), weatherQuery{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// XML isn't JSON, so it is kept as a string
+		var raw string
+		if err := json.Unmarshal(data.Raw, &raw); err != nil || raw != sampleCurrentWeatherXML {
+			t.Errorf("Expected the XML response as a JSON string, got %s (%v)", data.Raw, err)
+		}
+	})
+
+	t.Run("XML mode", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		modes := map[string]string{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			modes[r.URL.Path] = r.URL.Query().Get("mode")
+			if r.URL.Path == "/data/3.0/onecall/timemachine" {
+				_, _ = w.Write([]byte(`{"data":[{"dt":1700000000,"temp":3.5,"weather":[{"id":600,"description":"light snow"}]}]}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			_, _ = w.Write([]byte(sampleCurrentWeatherXML))
+		}))
+		t.Cleanup(server.Close)
+
+		provider := newOpenWeatherProvider(server.URL)
+		provider.mode = "xml"
+		data, err := provider.Fetch(context.Background(), weatherQuery{Lat: 51.51, Lon: -0.13})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if data.Name != "London" || data.Main.Temperature != 16.45 || data.Source != "openweather" {
+			t.Errorf("unexpected weather data: %+v", data)
+		}
+		// the history API has no XML, so it is still asked for JSON
+		if _, err := provider.Fetch(context.Background(), weatherQuery{Lat: 1, Lon: 1, At: time.Unix(1700000000, 0)}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if modes["/data/2.5/weather"] != "xml" || modes["/data/3.0/onecall/timemachine"] != "" {
+			t.Errorf("Expected mode=xml for current weather only, got %v", modes)
+		}
+	})
+
+	t.Run("Debug logging redacts the API key", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		logs := captureLogs(t, slog.LevelDebug)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`))
+		}))
+		t.Cleanup(server.Close)
+
+		if _, err := newOpenWeatherProvider(server.URL).Fetch(context.Background(), weatherQuery{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !strings.Contains(logs.String(), "appid=REDACTED") {
+			t.Errorf("Expected redacted upstream url in debug log: %s", logs.String())
+		}
+		if strings.Contains(logs.String(), fakeApiKey) {
+			t.Errorf("API key leaked into debug log: %s", logs.String())
+		}
+	})
+
+	t.Run("Non-200 response", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		t.Cleanup(server.Close)
+
+		_, err := newOpenWeatherProvider(server.URL).Fetch(context.Background(), weatherQuery{})
+		var upstreamErr *upstreamError
+		if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected upstream 401 error, got %v", err)
+		}
+	})
+
+	t.Run("Retries transient failures", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`))
+		}))
+		t.Cleanup(server.Close)
+
+		provider := newOpenWeatherProvider(server.URL)
+		provider.backoff = time.Millisecond
+		if _, err := provider.Fetch(context.Background(), weatherQuery{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if attempts != 2 {
+			t.Errorf("Expected 2 attempts, got %d", attempts)
+		}
+	})
+
+	t.Run("429 with Retry-After after exhausting retries", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		t.Cleanup(server.Close)
+
+		provider := newOpenWeatherProvider(server.URL)
+		provider.backoff = time.Millisecond
+		_, err := provider.Fetch(context.Background(), weatherQuery{})
+		var upstreamErr *upstreamError
+		if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("expected upstream 429 error, got %v", err)
+		}
+		if upstreamErr.RetryAfter != "30" {
+			t.Errorf("Expected Retry-After '30', got '%s'", upstreamErr.RetryAfter)
+		}
+		if attempts != provider.maxAttempts {
+			t.Errorf("Expected %d attempts, got %d", provider.maxAttempts, attempts)
+		}
+
+		// ... and the handler passes Retry-After on to the client
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		withConfig(t, cfg)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503, got %d", w.Code)
+		}
+		if w.Header().Get("Retry-After") != "30" {
+			t.Errorf("Expected Retry-After '30', got '%s'", w.Header().Get("Retry-After"))
+		}
+	})
+
+	t.Run("Error payload in a 200 response", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+
+		testCases := []struct {
+			name     string
+			body     string
+			expected int
+		}{
+			{"Bad parameters", `{"cod":"400","message":"wrong latitude"}`, http.StatusBadRequest},
+			{"Not found", `{"cod":"404","message":"city not found"}`, http.StatusNotFound},
+			{"Numeric cod", `{"cod":404,"message":"city not found"}`, http.StatusNotFound},
+			{"Invalid key", `{"cod":401,"message":"Invalid API key"}`, http.StatusInternalServerError},
+			{"Provider failure", `{"cod":"500","message":"internal error"}`, http.StatusInternalServerError},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, _ = w.Write([]byte(tc.body))
+				}))
+				t.Cleanup(server.Close)
+
+				provider := newOpenWeatherProvider(server.URL)
+				provider.backoff = time.Millisecond
+				_, err := provider.Fetch(context.Background(), weatherQuery{})
+				var upstreamErr *upstreamError
+				if !errors.As(err, &upstreamErr) || upstreamErr.Message == "" {
+					t.Fatalf("expected an upstream error with the provider's message, got %v", err)
+				}
+
+				cfg := defaultConfig()
+				cfg.Provider = provider
+				withConfig(t, cfg)
+				w := httptest.NewRecorder()
+				weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+				if w.Code != tc.expected {
+					t.Errorf("Expected %d, got %d: %s", tc.expected, w.Code, w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("Status 200 in the payload", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"cod":200,"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`))
+		}))
+		t.Cleanup(server.Close)
+
+		data, err := newOpenWeatherProvider(server.URL).Fetch(context.Background(), weatherQuery{})
+		if err != nil || data.Main.Temperature != 21.5 {
+			t.Fatalf("Unexpected result: %+v (%v)", data, err)
+		}
+	})
+
+	t.Run("Empty weather list", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"weather":[],"main":{"temp":21.5}}`))
+		}))
+		t.Cleanup(server.Close)
+
+		if _, err := newOpenWeatherProvider(server.URL).Fetch(context.Background(), weatherQuery{}); err == nil {
+			t.Fatal("expected error for empty weather list")
+		}
+	})
+
+	t.Run("Request budget stops retries", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		var mu sync.Mutex
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			attempts++
+			mu.Unlock()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		t.Cleanup(server.Close)
+
+		provider := newOpenWeatherProvider(server.URL)
+		provider.backoff = 500 * time.Millisecond
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		cfg.RequestBudget = 100 * time.Millisecond
+		withConfig(t, cfg)
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if elapsed := time.Since(start); elapsed >= provider.backoff {
+			t.Errorf("Expected to give up within the budget, took %v", elapsed)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts != 1 {
+			t.Errorf("Expected 1 attempt, got %d", attempts)
+		}
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected 500, got %d", w.Code)
+		}
+	})
+
+	t.Run("Request budget exceeded by a slow provider", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}))
+		t.Cleanup(server.Close)
+
+		cfg := defaultConfig()
+		cfg.Provider = newOpenWeatherProvider(server.URL)
+		cfg.RequestBudget = 50 * time.Millisecond
+		withConfig(t, cfg)
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("Expected 504, got %d", w.Code)
+		}
+	})
+
+	t.Run("Request budget split between attempts", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		const budget = 300 * time.Millisecond
+		// each pattern says how the provider answers each attempt: hang until the client gives up, fail or succeed
+		testCases := []struct {
+			name     string
+			pattern  []string
+			attempts int
+			ok       bool
+		}{
+			{"Every attempt hangs", []string{"hang", "hang", "hang"}, 3, false},
+			{"Hangs, then answers", []string{"hang", "ok"}, 2, true},
+			{"Hangs twice, then answers", []string{"hang", "hang", "ok"}, 3, true},
+			{"Fails, hangs, then answers", []string{"fail", "hang", "ok"}, 3, true},
+			{"Fails fast", []string{"fail", "fail", "fail"}, 3, false},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				var attempts atomic.Int32
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch tc.pattern[min(int(attempts.Add(1)), len(tc.pattern))-1] {
+					case "hang":
+						select {
+						case <-r.Context().Done():
+						case <-time.After(2 * time.Second):
+						}
+					case "fail":
+						w.WriteHeader(http.StatusServiceUnavailable)
+					default:
+						_, _ = w.Write([]byte(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`))
+					}
+				}))
+				t.Cleanup(server.Close)
+
+				provider := newOpenWeatherProvider(server.URL)
+				provider.backoff = 10 * time.Millisecond
+				ctx, cancel := context.WithTimeout(context.Background(), budget)
+				defer cancel()
+				start := time.Now()
+				_, err := provider.Fetch(ctx, weatherQuery{})
+				if elapsed := time.Since(start); elapsed > budget+50*time.Millisecond {
+					t.Errorf("Expected to finish within the %s budget, took %s", budget, elapsed)
+				}
+				if (err == nil) != tc.ok {
+					t.Errorf("Expected success %t, got %v", tc.ok, err)
+				}
+				if got := int(attempts.Load()); got != tc.attempts {
+					t.Errorf("Expected %d attempts, got %d", tc.attempts, got)
+				}
+			})
+		}
+	})
+
+	t.Run("Unusable response bodies", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		bodies := map[string]string{
+			"Truncated json": `{"weather":[{"id":800,"descr`,
+			"Not json":       `<html><body>Bad Gateway</body></html>`,
+		}
+		for name, body := range bodies {
+			t.Run(name, func(t *testing.T) {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, _ = w.Write([]byte(body))
+				}))
+				t.Cleanup(server.Close)
+				cfg := defaultConfig()
+				cfg.Provider = newOpenWeatherProvider(server.URL)
+				withConfig(t, cfg)
+
+				w := httptest.NewRecorder()
+				weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+				if w.Code != http.StatusBadGateway {
+					t.Fatalf("Expected 502, got %d", w.Code)
+				}
+				if strings.TrimSpace(w.Body.String()) != "invalid response from weather provider" {
+					t.Errorf("unexpected body: %s", w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("Empty response bodies", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		})
+		_ = os.Setenv("OPENWEATHER_API_KEY", fakeApiKey)
+		for name, body := range map[string]string{"Zero length": "", "Whitespace": " \n"} {
+			t.Run(name, func(t *testing.T) {
+				logs := captureLogs(t, slog.LevelInfo)
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, _ = w.Write([]byte(body))
+				}))
+				t.Cleanup(server.Close)
+				cfg := defaultConfig()
+				cfg.Provider = newOpenWeatherProvider(server.URL)
+				withConfig(t, cfg)
+
+				w := httptest.NewRecorder()
+				weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+				if w.Code != http.StatusBadGateway {
+					t.Fatalf("Expected 502, got %d", w.Code)
+				}
+				if strings.TrimSpace(w.Body.String()) != "empty response from weather provider" {
+					t.Errorf("unexpected body: %s", w.Body.String())
+				}
+				if w.Header().Get("Retry-After") == "" {
+					t.Error("Expected a Retry-After header")
+				}
+				if !strings.Contains(logs.String(), "weather provider returned an empty body") ||
+					strings.Contains(logs.String(), "malformed response") {
+					t.Errorf("Expected the empty body to be logged as such: %s", logs.String())
+				}
+			})
+		}
+	})
+
+	t.Run("Missing API key", func(t *testing.T) {
+		_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		_, err := newOpenWeatherProvider("http://127.0.0.1:1").Fetch(context.Background(), weatherQuery{})
+		if !errors.Is(err, errInvalidAPIKey) {
+			t.Fatalf("expected invalid API key error, got %v", err)
+		}
+	})
+}
+
+// sampleCurrentWeatherXML - a current weather API response with mode=xml and units=metric
+const sampleCurrentWeatherXML = `<?xml version="1.0" encoding="UTF-8"?>
+<current>
+  <city id="2643743" name="London">
+    <coord lon="-0.13" lat="51.51"></coord>
+    <country>GB</country>
+    <timezone>0</timezone>
+    <sun rise="2017-01-30T07:40:36" set="2017-01-30T16:47:56"></sun>
+  </city>
+  <temperature value="16.45" min="15" max="17.78" unit="celsius"></temperature>
+  <feels_like value="16.1" unit="celsius"></feels_like>
+  <humidity value="82" unit="%"></humidity>
+  <pressure value="1012" unit="hPa"></pressure>
+  <wind>
+    <speed value="4.1" unit="m/s" name="Gentle Breeze"></speed>
+    <gusts></gusts>
+    <direction value="80" code="E" name="East"></direction>
+  </wind>
+  <clouds value="90" name="overcast clouds"></clouds>
+  <visibility value="10000"></visibility>
+  <precipitation mode="no"></precipitation>
+  <weather number="701" value="mist" icon="50d"></weather>
+  <lastupdate value="2017-01-30T15:50:00"></lastupdate>
+</current>`
+
+func TestDecodeCurrentWeatherXML(t *testing.T) {
+	t.Run("Same fields as the JSON response", func(t *testing.T) {
+		fromXML, err := decodeCurrentWeatherXML(strings.NewReader(sampleCurrentWeatherXML))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// the same observation, as the JSON API reports it
+		fromJSON, err := decodeCurrentWeather(strings.NewReader(`{"weather":[{"id":701,"description":"mist","icon":"50d"}],` +
+			`"main":{"temp":16.45,"humidity":82},"name":"London","sys":{"country":"GB"},"wind":{"speed":4.1,"deg":80},` +
+			`"dt":1485791400}`))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(fromXML, fromJSON) {
+			t.Errorf("Expected the XML to decode as the JSON does:\n%+v\n%+v", fromXML, fromJSON)
+		}
+	})
+
+	t.Run("No wind or update time", func(t *testing.T) {
+		data, err := decodeCurrentWeatherXML(strings.NewReader(`<current><temperature value="-3.2"/>` +
+			`<weather number="600" value="light snow" icon="13n"/></current>`))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if data.Wind != nil || data.Observed != 0 || data.Main.Temperature != -3.2 || data.Weather[0].ID != 600 {
+			t.Errorf("unexpected weather data: %+v", data)
+		}
+	})
+
+	t.Run("Unusable bodies", func(t *testing.T) {
+		testCases := map[string]string{
+			"Wrong root":      `<ClientError><cod>404</cod><message>city not found</message></ClientError>`,
+			"Not XML":         `{"weather":[]}`,
+			"Bad update time": `<current><lastupdate value="yesterday"/></current>`,
+		}
+		for name, body := range testCases {
+			if _, err := decodeCurrentWeatherXML(strings.NewReader(body)); err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}
+		if _, err := decodeCurrentWeatherXML(strings.NewReader("")); !errors.Is(err, io.EOF) {
+			t.Errorf("Expected io.EOF for an empty body, got %v", err)
+		}
+	})
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	testCases := []struct {
+		name         string
+		remaining    time.Duration
+		attemptsLeft int
+		delay        time.Duration
+		expected     time.Duration
+	}{
+		{"Last attempt gets it all", time.Second, 1, 100 * time.Millisecond, time.Second},
+		{"Shared evenly", 900 * time.Millisecond, 3, 0, 300 * time.Millisecond},
+		{"Backoffs set aside", time.Second, 3, 100 * time.Millisecond, 700 * time.Millisecond / 3},
+		{"Too little for every retry", 500 * time.Millisecond, 3, 200 * time.Millisecond, 150 * time.Millisecond},
+		{"Too little for any retry", 100 * time.Millisecond, 3, 200 * time.Millisecond, 100 * time.Millisecond},
+		{"Many attempts", time.Second, 1000, time.Millisecond, (time.Second - 511*time.Millisecond) / 10},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			timeout := attemptTimeout(tc.remaining, tc.attemptsLeft, tc.delay)
+			if timeout != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, timeout)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	// ceilings of 100ms, 200ms, 400ms, then capped at 500ms
+	ceilings := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		500 * time.Millisecond, 500 * time.Millisecond}
+	testCases := map[string]func(ceiling time.Duration) (low, high time.Duration){
+		"none":  func(ceiling time.Duration) (time.Duration, time.Duration) { return ceiling, ceiling },
+		"full":  func(ceiling time.Duration) (time.Duration, time.Duration) { return 0, ceiling },
+		"equal": func(ceiling time.Duration) (time.Duration, time.Duration) { return ceiling / 2, ceiling },
+	}
+	for jitter, bounds := range testCases {
+		t.Run(jitter, func(t *testing.T) {
+			provider := newOpenWeatherProvider("http://127.0.0.1:1")
+			provider.backoff = 100 * time.Millisecond
+			provider.backoffCap = 500 * time.Millisecond
+			provider.jitter = jitter
+			provider.random = rand.New(rand.NewPCG(1, 2)).Int64N
+			for attempt, ceiling := range ceilings {
+				if got := provider.backoffCeiling(attempt + 1); got != ceiling {
+					t.Errorf("Attempt %d: expected a ceiling of %s, got %s", attempt+1, ceiling, got)
+				}
+				low, high := bounds(ceiling)
+				distinct := map[time.Duration]bool{}
+				for range 100 {
+					delay := provider.retryDelay(attempt + 1)
+					if delay < low || delay > high {
+						t.Fatalf("Attempt %d: expected a delay between %s and %s, got %s", attempt+1, low, high, delay)
+					}
+					distinct[delay] = true
+				}
+				if jittered := low != high; jittered && len(distinct) < 10 {
+					t.Errorf("Attempt %d: expected the delays to vary, got %v", attempt+1, distinct)
+				}
+			}
+		})
+	}
+
+	t.Run("No backoff", func(t *testing.T) {
+		provider := newOpenWeatherProvider("http://127.0.0.1:1")
+		provider.backoff = 0
+		provider.jitter = "full"
+		if delay := provider.retryDelay(3); delay != 0 {
+			t.Errorf("Expected no delay, got %s", delay)
+		}
+	})
+}
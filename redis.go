@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix - namespaces our keys, so the Redis instance can be shared
+const redisKeyPrefix = "weather:"
+
+// redisEntry - a cached provider response as stored in Redis
+// WeatherData doesn't serialize its Source, FetchedAt or Raw, so we carry them alongside.
+type redisEntry struct {
+	Data      *WeatherData    `json:"data"`
+	Source    string          `json:"source"`
+	FetchedAt time.Time       `json:"fetched_at"`
+	TTL       time.Duration   `json:"ttl"` // the cache's ttl, jittered for this entry
+	Raw       json.RawMessage `json:"raw,omitempty"`
+}
+
+// redisReadings - the latest temperature stored for a key and the one before it
+type redisReadings struct {
+	Latest   redisReading  `json:"latest"`
+	Previous *redisReading `json:"previous,omitempty"`
+}
+
+// redisReading - a temperature observed at a point in time
+type redisReading struct {
+	Temp float64   `json:"temp"`
+	At   time.Time `json:"at"`
+}
+
+// redisCache - Cache backed by Redis, so entries survive restarts and are shared between instances
+// Redis expires entries once they are past the stale window; readings expire after trendWindow.
+type redisCache struct {
+	client      *redis.Client
+	ttl         time.Duration
+	ttlJitter   int // CACHE_TTL_JITTER_PERCENT
+	staleWindow time.Duration
+	clock       Clock // for freshness; Redis expires the keys by its own clock
+}
+
+// newRedisCache - create a cache using the Redis server at addr, judging freshness by clock
+func newRedisCache(addr string, ttl, staleWindow time.Duration, clock Clock) *redisCache {
+	return &redisCache{
+		client:      redis.NewClient(&redis.Options{Addr: addr}),
+		ttl:         ttl,
+		staleWindow: staleWindow,
+		clock:       clock,
+	}
+}
+
+// entryKey - the Redis key for a cache entry
+func (c *redisCache) entryKey(key string) string {
+	return redisKeyPrefix + "entry:" + key
+}
+
+// readingsKey - the Redis key for a cache key's readings
+func (c *redisCache) readingsKey(key string) string {
+	return redisKeyPrefix + "readings:" + key
+}
+
+// resultKey - the Redis key for a stored response
+func (c *redisCache) resultKey(key string) string {
+	return redisKeyPrefix + "result:" + key
+}
+
+// getJSON - read and decode the value at key; ok is false if there isn't one (or it can't be read)
+func (c *redisCache) getJSON(ctx context.Context, key string, v any) (ok bool) {
+	raw, err := c.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Warn("redis cache read failed", "key", key, "error", err)
+		}
+		return false
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		slog.Warn("redis cache holds an unreadable value", "key", key, "error", err)
+		return false
+	}
+	return true
+}
+
+// setJSON - encode v and store it at key for expiration
+func (c *redisCache) setJSON(ctx context.Context, key string, v any, expiration time.Duration) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		slog.Warn("redis cache write failed", "key", key, "error", err)
+		return
+	}
+	if err := c.client.Set(ctx, key, raw, expiration).Err(); err != nil {
+		slog.Warn("redis cache write failed", "key", key, "error", err)
+	}
+}
+
+// Get - look up an entry.  stale is true when the entry is past its ttl but still within the stale window.
+func (c *redisCache) Get(ctx context.Context, key string) (data *WeatherData, stale bool, ok bool) {
+	var entry redisEntry
+	if !c.getJSON(ctx, c.entryKey(key), &entry) || entry.Data == nil {
+		return nil, false, false
+	}
+	entry.Data.Source = entry.Source
+	entry.Data.FetchedAt = entry.FetchedAt
+	entry.Data.Raw = entry.Raw
+	age := c.clock.Now().Sub(entry.FetchedAt)
+	if age < entry.TTL {
+		return entry.Data, false, true
+	}
+	if age < entry.TTL+c.staleWindow {
+		return entry.Data, true, true
+	}
+	return nil, false, false
+}
+
+// Set - store a freshly fetched entry, and record its temperature for the trend
+func (c *redisCache) Set(ctx context.Context, key string, data *WeatherData) {
+	now := c.clock.Now()
+	ttl := jitteredTTL(c.ttl, c.ttlJitter)
+	// a zero expiration would keep the entry forever, when it should not be kept at all
+	if expiration := ttl + c.staleWindow; expiration > 0 {
+		entry := redisEntry{Data: data, Source: data.Source, FetchedAt: now, TTL: ttl, Raw: data.Raw}
+		c.setJSON(ctx, c.entryKey(key), entry, expiration)
+	}
+
+	readings := redisReadings{Latest: redisReading{Temp: data.Main.Temperature, At: now}}
+	var last redisReadings
+	if c.getJSON(ctx, c.readingsKey(key), &last) && now.Sub(last.Latest.At) < trendWindow {
+		readings.Previous = &last.Latest
+	}
+	c.setJSON(ctx, c.readingsKey(key), readings, trendWindow)
+}
+
+// Previous - the temperature fetched before the latest one for key, if there is one within trendWindow
+func (c *redisCache) Previous(ctx context.Context, key string) (temp float64, ok bool) {
+	var readings redisReadings
+	if !c.getJSON(ctx, c.readingsKey(key), &readings) || readings.Previous == nil ||
+		c.clock.Now().Sub(readings.Previous.At) >= trendWindow {
+		return 0, false
+	}
+	return readings.Previous.Temp, true
+}
+
+// Len - the number of entries held (fresh or stale)
+// This scans our keys, so it is only meant for the health check.
+func (c *redisCache) Len(ctx context.Context) (int, error) {
+	entries := 0
+	iter := c.client.Scan(ctx, 0, c.entryKey("*"), 0).Iterator()
+	for iter.Next(ctx) {
+		entries++
+	}
+	return entries, iter.Err()
+}
+
+// GetResult - look up a stored response
+func (c *redisCache) GetResult(ctx context.Context, key string) (body []byte, ok bool) {
+	ok = c.getJSON(ctx, c.resultKey(key), &body)
+	return body, ok
+}
+
+// SetResult - store a response for ttl; Redis expires it
+func (c *redisCache) SetResult(ctx context.Context, key string, body []byte, ttl time.Duration) {
+	if ttl > 0 {
+		c.setJSON(ctx, c.resultKey(key), body, ttl)
+	}
+}
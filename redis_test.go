@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisCache - a redisCache backed by an in-process miniredis server
+func newTestRedisCache(t *testing.T, ttl, staleWindow time.Duration) (*redisCache, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	c := newRedisCache(server.Addr(), ttl, staleWindow, realClock{})
+	t.Cleanup(func() {
+		_ = c.client.Close()
+	})
+	return c, server
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Round trip", func(t *testing.T) {
+		c, _ := newTestRedisCache(t, time.Minute, time.Minute)
+		data := weatherDataFromJSON(t, `{"name":"Denver","weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21.5}}`)
+		data.Source = "openweather"
+		data.Raw = json.RawMessage(`{"name":"Denver","visibility":10000}`)
+		c.Set(ctx, "k", data)
+
+		got, stale, ok := c.Get(ctx, "k")
+		if !ok || stale {
+			t.Fatalf("Expected a fresh entry, got ok=%v stale=%v", ok, stale)
+		}
+		if got.Name != "Denver" || got.Main.Temperature != 21.5 || got.Source != "openweather" ||
+			len(got.Weather) != 1 || got.Weather[0].Description != "clear sky" {
+			t.Errorf("unexpected round trip: %+v", got)
+		}
+		if string(got.Raw) != `{"name":"Denver","visibility":10000}` {
+			t.Errorf("Expected the raw response kept, got %s", got.Raw)
+		}
+		if entries, err := c.Len(ctx); err != nil || entries != 1 {
+			t.Errorf("Expected 1 entry, got %d (%v)", entries, err)
+		}
+	})
+
+	t.Run("Miss", func(t *testing.T) {
+		c, _ := newTestRedisCache(t, time.Minute, time.Minute)
+		if _, _, ok := c.Get(ctx, "k"); ok {
+			t.Error("Expected a miss")
+		}
+	})
+
+	t.Run("Stale, then expired", func(t *testing.T) {
+		clock := newFakeClock()
+		c, server := newTestRedisCache(t, time.Minute, time.Minute)
+		c.clock = clock
+		c.Set(ctx, "k", &WeatherData{})
+		if ttl := server.TTL(c.entryKey("k")); ttl != 2*time.Minute {
+			t.Errorf("Expected the entry to expire after ttl + stale window, got %v", ttl)
+		}
+
+		// fetched_at decides staleness by our clock; Redis expires the key by its own
+		clock.Advance(90 * time.Second)
+		server.FastForward(90 * time.Second)
+		if _, stale, ok := c.Get(ctx, "k"); !ok || !stale {
+			t.Errorf("Expected a stale entry, got ok=%v stale=%v", ok, stale)
+		}
+
+		clock.Advance(30 * time.Second)
+		server.FastForward(30 * time.Second)
+		if _, _, ok := c.Get(ctx, "k"); ok {
+			t.Error("Expected the entry to have expired")
+		}
+	})
+
+	t.Run("Jittered ttl", func(t *testing.T) {
+		c, server := newTestRedisCache(t, 100*time.Second, 0)
+		c.ttlJitter = 10
+		c.Set(ctx, "k", &WeatherData{})
+		var entry redisEntry
+		c.getJSON(ctx, c.entryKey("k"), &entry)
+		if entry.TTL < 90*time.Second || entry.TTL > 110*time.Second {
+			t.Errorf("Expected a ttl between 90s and 110s, got %v", entry.TTL)
+		}
+		// redis keeps expirations to the millisecond
+		if expiration := server.TTL(c.entryKey("k")); expiration != entry.TTL.Truncate(time.Millisecond) {
+			t.Errorf("Expected redis to expire the entry with its ttl, got %v", expiration)
+		}
+	})
+
+	t.Run("No ttl", func(t *testing.T) {
+		c, server := newTestRedisCache(t, 0, 0)
+		c.Set(ctx, "k", &WeatherData{})
+		if server.Exists(c.entryKey("k")) {
+			t.Error("Expected nothing to be stored without a ttl")
+		}
+	})
+
+	t.Run("Previous", func(t *testing.T) {
+		c, _ := newTestRedisCache(t, 0, 0)
+		c.Set(ctx, "k", weatherDataFromJSON(t, `{"main":{"temp":10}}`))
+		if _, ok := c.Previous(ctx, "k"); ok {
+			t.Error("Expected no previous reading after the first")
+		}
+		c.Set(ctx, "k", weatherDataFromJSON(t, `{"main":{"temp":12}}`))
+		if temp, ok := c.Previous(ctx, "k"); !ok || temp != 10 {
+			t.Errorf("Expected a previous reading of 10, got %v (%v)", temp, ok)
+		}
+	})
+
+	t.Run("Stored result", func(t *testing.T) {
+		c, server := newTestRedisCache(t, 0, 0)
+		c.SetResult(ctx, "r", []byte(`{"results":[]}`), time.Hour)
+		if body, ok := c.GetResult(ctx, "r"); !ok || string(body) != `{"results":[]}` {
+			t.Errorf("Expected the stored result, got %q (%v)", body, ok)
+		}
+		if ttl := server.TTL(c.resultKey("r")); ttl != time.Hour {
+			t.Errorf("Expected the result to expire after an hour, got %v", ttl)
+		}
+		if _, ok := c.GetResult(ctx, "other"); ok {
+			t.Error("Expected a miss")
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		c := &redisCache{
+			client: redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1}), // fail fast
+			ttl:    time.Minute,
+			clock:  realClock{},
+		}
+		server.Close()
+		c.Set(ctx, "k", &WeatherData{})
+		if _, _, ok := c.Get(ctx, "k"); ok {
+			t.Error("Expected a miss when redis is down")
+		}
+		if _, err := c.Len(ctx); err == nil {
+			t.Error("Expected an error when redis is down")
+		}
+	})
+}
+
+func TestCacheBackendConfig(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.Unsetenv("CACHE_BACKEND")
+		_ = os.Unsetenv("REDIS_ADDR")
+	})
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := cfg.Cache.(*weatherCache); !ok {
+		t.Errorf("Expected the memory cache by default, got %T", cfg.Cache)
+	}
+
+	_ = os.Setenv("CACHE_BACKEND", "redis")
+	if _, err := loadConfig(); err == nil {
+		t.Error("Expected error for CACHE_BACKEND=redis without REDIS_ADDR")
+	}
+	_ = os.Setenv("REDIS_ADDR", "127.0.0.1:6379")
+	if cfg, err = loadConfig(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := cfg.Cache.(*redisCache); !ok {
+		t.Errorf("Expected the redis cache, got %T", cfg.Cache)
+	}
+
+	_ = os.Setenv("CACHE_BACKEND", "memcached")
+	if _, err := loadConfig(); err == nil {
+		t.Error("Expected error for CACHE_BACKEND=memcached")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// maxRequestBodyBytes - the largest POST /weather body we will read
+const maxRequestBodyBytes = 4 << 10
+
+// weatherRequestBody - the JSON body accepted by POST /weather (when WEATHER_POST_ENABLED is set)
+// lat and lon are kept as json.Number so they go through the same validators as query parameters.
+type weatherRequestBody struct {
+	Lat   json.Number `json:"lat"`
+	Lon   json.Number `json:"lon"`
+	Units string      `json:"units"`
+}
+
+// rejectUnsupportedMethod - write a 405 unless the method is GET, HEAD, or POST with WEATHER_POST_ENABLED
+// Returns true if the request was rejected.
+func rejectUnsupportedMethod(w http.ResponseWriter, r *http.Request) bool {
+	allowed := []string{http.MethodGet, http.MethodHead}
+	if config.PostEnabled {
+		allowed = append(allowed, http.MethodPost)
+	}
+	if slices.Contains(allowed, r.Method) {
+		return false
+	}
+	slog.Info("input error: method not allowed", "method", r.Method)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return true
+}
+
+// paramsFromJSONBody - read a POST /weather body into the equivalent query parameters
+// Values in the body take precedence over any in the query string.  On failure the error response has
+// already been written and ok is false.
+func paramsFromJSONBody(w http.ResponseWriter, r *http.Request) (params url.Values, ok bool) {
+	var body weatherRequestBody
+	if !decodeJSONBody(w, r, maxRequestBodyBytes, &body) {
+		return nil, false
+	}
+
+	params = r.URL.Query()
+	for name, value := range map[string]string{"lat": body.Lat.String(), "lon": body.Lon.String(), "units": body.Units} {
+		if value = strings.TrimSpace(value); value != "" {
+			params.Set(name, value)
+		}
+	}
+	return params, true
+}
+
+// decodeJSONBody - decode r's JSON body, of at most maxBytes, into v
+// In strict mode fields v doesn't have are refused, as unknown query parameters are.  On failure the error
+// response has already been written and ok is false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, maxBytes int64, v any) (ok bool) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		slog.Info("input error: unsupported content type", "content_type", r.Header.Get("Content-Type"))
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes))
+	if config.StrictQuery {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		slog.Info("input error: invalid request body", "error", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWeatherPost(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25}}`
+
+	post := func(body, contentType string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/weather?format=json", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		config.PostEnabled = true
+		w := httptest.NewRecorder()
+		weatherHandler(w, r)
+		return w
+	}
+
+	t.Run("Valid body", func(t *testing.T) {
+		provider := useWeather(t, payload)
+		var requested weatherQuery
+		fetch := provider.fetch
+		provider.fetch = func(q weatherQuery) (*WeatherData, error) {
+			requested = q
+			return fetch(q)
+		}
+
+		w := post(`{"lat": 37.77, "lon": -122.42, "units": "imperial"}`, "application/json; charset=utf-8")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if requested.Lat != 37.77 || requested.Lon != -122.42 {
+			t.Errorf("unexpected coordinates: %+v", requested)
+		}
+		var response WeatherResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid json: %v", err)
+		}
+		if response.Units != "imperial" || response.Temperature == nil || *response.Temperature != 77 {
+			t.Errorf("Expected 77 imperial, got %s %v", response.Units, response.Temperature)
+		}
+	})
+
+	t.Run("Malformed body", func(t *testing.T) {
+		useWeather(t, payload)
+		if w := post(`{"lat": 37.77, "lon":`, "application/json"); w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Invalid coordinates in body", func(t *testing.T) {
+		useWeather(t, payload)
+		if w := post(`{"lat": 137.77, "lon": -122.42}`, "application/json"); w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Invalid units", func(t *testing.T) {
+		useWeather(t, payload)
+		if w := post(`{"lat": 37.77, "lon": -122.42, "units": "furlongs"}`, "application/json"); w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Wrong content type", func(t *testing.T) {
+		useWeather(t, payload)
+		if w := post(`lat=37.77&lon=-122.42`, "application/x-www-form-urlencoded"); w.Code != http.StatusUnsupportedMediaType {
+			t.Fatalf("Expected 415, got %d", w.Code)
+		}
+	})
+
+	t.Run("Body too large", func(t *testing.T) {
+		useWeather(t, payload)
+		body := `{"lat": 37.77, "lon": -122.42, "units": "` + strings.Repeat("x", maxRequestBodyBytes) + `"}`
+		if w := post(body, "application/json"); w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Expected 413, got %d", w.Code)
+		}
+	})
+
+	t.Run("GET is unchanged", func(t *testing.T) {
+		useWeather(t, payload)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "Hot, 77°F (25°C)") {
+			t.Errorf("unexpected body: %s", w.Body.String())
+		}
+	})
+}
+
+func TestWeatherMethods(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25}}`
+
+	t.Run("POST disabled", func(t *testing.T) {
+		useWeather(t, payload)
+		r := httptest.NewRequest(http.MethodPost, "/weather", strings.NewReader(`{"lat": 37.77, "lon": -122.42}`))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		weatherHandler(w, r)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("Expected 405, got %d", w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+			t.Errorf("Expected 'Allow: GET, HEAD', got '%s'", allow)
+		}
+	})
+
+	t.Run("POST enabled", func(t *testing.T) {
+		useWeather(t, payload)
+		config.PostEnabled = true
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodDelete, "/weather?lat=37.77&lon=-122.42", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("Expected 405, got %d", w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != "GET, HEAD, POST" {
+			t.Errorf("Expected 'Allow: GET, HEAD, POST', got '%s'", allow)
+		}
+	})
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		t.Run(method, func(t *testing.T) {
+			useWeather(t, payload)
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(method, "/weather?lat=37.77&lon=-122.42", nil))
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("Expected 405, got %d", w.Code)
+			}
+		})
+	}
+
+	t.Run("GET", func(t *testing.T) {
+		useWeather(t, payload)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// WeatherResponse - the weather report we return to clients (json and xml formats)
+type WeatherResponse struct {
+	XMLName      xml.Name      `json:"-" xml:"weather"`
+	Location     string        `json:"location,omitempty" xml:"location,omitempty"`
+	Condition    string        `json:"condition" xml:"condition"`
+	Group        string        `json:"group" xml:"group"`
+	Icon         string        `json:"icon" xml:"icon"`
+	Emoji        string        `json:"emoji,omitempty" xml:"emoji,omitempty"`
+	Feel         string        `json:"feel" xml:"feel"`
+	Severe       bool          `json:"severe" xml:"severe"`
+	Warning      string        `json:"warning,omitempty" xml:"warning,omitempty"`
+	TemperatureC float64       `json:"temperature_c" xml:"temperature_c"`
+	TemperatureF float64       `json:"temperature_f" xml:"temperature_f"`
+	TemperatureK *float64      `json:"temperature_k,omitempty" xml:"temperature_k,omitempty"`
+	Temperatures *temperatures `json:"temperatures,omitempty" xml:"temperatures,omitempty"` // with all_units=true
+	DewPointC    *float64      `json:"dew_point_c,omitempty" xml:"dew_point_c,omitempty"`
+	WindDegrees  *float64      `json:"wind_deg,omitempty" xml:"wind_deg,omitempty"`
+	WindDir      string        `json:"wind_direction,omitempty" xml:"wind_direction,omitempty"`
+	WindSpeed    *float64      `json:"wind_speed,omitempty" xml:"wind_speed,omitempty"`           // in WindUnit
+	WindUnit     string        `json:"wind_speed_unit,omitempty" xml:"wind_speed_unit,omitempty"` // km/h, mph or m/s
+	Trend        string        `json:"trend,omitempty" xml:"trend,omitempty"`
+	Units        string        `json:"units,omitempty" xml:"units,omitempty"`
+	Temperature  *float64      `json:"temperature,omitempty" xml:"temperature,omitempty"` // in Units
+	AirQuality   *airQuality   `json:"air_quality,omitempty" xml:"air_quality,omitempty"`
+	UVIndex      *float64      `json:"uv_index,omitempty" xml:"uv_index,omitempty"`
+	UVRisk       string        `json:"uv_risk,omitempty" xml:"uv_risk,omitempty"`
+	Note         string        `json:"note,omitempty" xml:"note,omitempty"`
+	ObservedAt   string        `json:"observed_at,omitempty" xml:"observed_at,omitempty"` // RFC 3339, UTC
+	Observed     string        `json:"observed,omitempty" xml:"observed,omitempty"`       // e.g. "5 minutes ago"
+	Cached       bool          `json:"cached" xml:"cached"`                               // served from our cache
+	CacheAge     *int          `json:"cache_age,omitempty" xml:"cache_age,omitempty"`     // seconds since we fetched it
+	// Raw - the provider's response as it sent it, with raw=true when DEBUG_ENDPOINTS is set (json only)
+	// An XML response (OPENWEATHER_MODE=xml) is included as a string.
+	Raw json.RawMessage `json:"raw,omitempty" xml:"-"`
+	// EnrichmentErrors - the enrichments asked for with include= that couldn't be fetched
+	EnrichmentErrors []enrichmentError `json:"enrichment_errors,omitempty" xml:"enrichment_error,omitempty"`
+}
+
+// temperatures - the temperature in each unit system
+type temperatures struct {
+	Metric   float64 `json:"metric" xml:"metric"`     // Celsius
+	Imperial float64 `json:"imperial" xml:"imperial"` // Fahrenheit
+	Standard float64 `json:"standard" xml:"standard"` // Kelvin
+}
+
+// responseOptions - optional extras requested by the client
+type responseOptions struct {
+	Emoji    bool   // emoji=true
+	AllUnits bool   // all_units=true
+	Units    string // metric, imperial or standard; empty if the client didn't ask
+}
+
+// responseOptionsFromRequest - read the optional extras from the query string
+// These are simple on/off flags, so anything other than a recognizable true is off.
+func responseOptionsFromRequest(r *http.Request) responseOptions {
+	var opts responseOptions
+	opts.Emoji, _ = strconv.ParseBool(r.URL.Query().Get("emoji"))
+	opts.AllUnits, _ = strconv.ParseBool(r.URL.Query().Get("all_units"))
+	return opts
+}
+
+// maxJSONIndent - the most spaces a client can ask JSON to be indented by
+const maxJSONIndent = 8
+
+// jsonIndent - the indent a client asked for with pretty=true (two spaces) or indent=<n> (n spaces), for
+// reading JSON responses by eye.  Like the other flags, anything unrecognizable leaves the JSON compact.
+func jsonIndent(r *http.Request) string {
+	params := r.URL.Query()
+	if n, err := strconv.Atoi(params.Get("indent")); err == nil && n > 0 {
+		return strings.Repeat(" ", min(n, maxJSONIndent))
+	}
+	if pretty, _ := strconv.ParseBool(params.Get("pretty")); pretty {
+		return "  "
+	}
+	return ""
+}
+
+// newWeatherResponse - build the client response from the provider's weather data
+func newWeatherResponse(weatherData *WeatherData, opts responseOptions) WeatherResponse {
+	temperature := weatherData.Main.Temperature
+	response := WeatherResponse{
+		Location:     locationName(weatherData),
+		Condition:    formatDescription(weatherData.Weather[0].Description),
+		Group:        conditionGroup(weatherData.Weather[0].ID),
+		Icon:         weatherData.Weather[0].Icon,
+		Feel:         temperatureFeel(temperature),
+		TemperatureC: temperature,
+		TemperatureF: celsiusToFahrenheit(temperature),
+	}
+	if isSevereCondition(weatherData.Weather[0].ID) {
+		response.Severe = true
+		response.Warning = "Severe weather: " + response.Condition
+	}
+	if opts.AllUnits {
+		kelvin := celsiusToKelvin(temperature)
+		response.TemperatureK = &kelvin
+		response.Temperatures = &temperatures{
+			Metric:   temperatureInUnits(temperature, "metric"),
+			Imperial: temperatureInUnits(temperature, "imperial"),
+			Standard: temperatureInUnits(temperature, "standard"),
+		}
+	}
+	if opts.Emoji {
+		response.Emoji = conditionEmoji(weatherData.Weather[0].ID)
+	}
+	if opts.Units != "" {
+		inUnits := temperatureInUnits(temperature, opts.Units)
+		response.Units = opts.Units
+		response.Temperature = &inUnits
+	}
+	if dp := dewPoint(temperature, weatherData.Main.Humidity); !math.IsNaN(dp) {
+		response.DewPointC = &dp
+	}
+	if wind := weatherData.Wind; wind != nil {
+		response.WindDegrees = &wind.Degrees
+		response.WindDir = windDirection(wind.Degrees)
+		speed, unit := windSpeedConvert(wind.Speed, opts.Units)
+		speed = roundTo(speed, config.WindDecimals)
+		response.WindSpeed, response.WindUnit = &speed, unit
+	}
+	return response
+}
+
+// formatDescription - tidy a provider condition description for display, e.g. "broken  clouds " becomes
+// "Broken Clouds"
+func formatDescription(s string) string {
+	words := strings.Fields(s)
+	for i, word := range words {
+		first, size := utf8.DecodeRuneInString(word)
+		words[i] = string(unicode.ToTitle(first)) + word[size:]
+	}
+	return strings.Join(words, " ")
+}
+
+// locationName - "<name>, <country>" for the place the provider resolved the coordinates to
+// Either part may be missing (e.g. open water has no name); if both are, the result is empty.
+func locationName(weatherData *WeatherData) string {
+	var parts []string
+	for _, part := range []string{weatherData.Name, weatherData.Sys.Country} {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// openWaterNote - the note OCEAN_POLICY=annotate adds for coordinates the provider names no place for
+const openWaterNote = "no named place at these coordinates, likely open water"
+
+// isOpenWater - whether the provider named no place for the coordinates, as it does for open water
+// Only meaningful for current weather: historical lookups never come with a name.
+func isOpenWater(weatherData *WeatherData) bool {
+	return strings.TrimSpace(weatherData.Name) == ""
+}
+
+// formatWeather - render the weather response as the plain text response body
+func formatWeather(response WeatherResponse) string {
+	// Get the weather condition & temperature information
+	weatherCondition := response.Condition
+	if response.Emoji != "" {
+		weatherCondition = response.Emoji + " " + weatherCondition
+	}
+	temperatureDesc := getTemperature(response.TemperatureC, response.Units)
+	if response.TemperatureK != nil {
+		temperatureDesc = getTemperatureAllUnits(response.TemperatureC, response.Units)
+	}
+
+	text := fmt.Sprintf("Current Temperature:\n"+
+		"  Weather     : %s\n"+
+		"  Temperature : %s", weatherCondition, temperatureDesc)
+
+	if response.Location != "" {
+		text += "\n  Location    : " + response.Location
+	}
+	if response.Note != "" {
+		text += "\n  Note        : " + response.Note
+	}
+	if response.Warning != "" {
+		text += "\n  Warning     : " + response.Warning
+	}
+	if dp := response.DewPointC; dp != nil {
+		primary, secondary := formatScale(*dp, "F", 0), formatScale(*dp, "C", 0)
+		if response.Units == "metric" || response.Units == "standard" {
+			primary, secondary = secondary, primary
+		}
+		text += fmt.Sprintf("\n  Dew Point   : %s (%s)", primary, secondary)
+	}
+	if speed := response.WindSpeed; speed != nil {
+		text += fmt.Sprintf("\n  Wind Speed  : %.*f %s", config.WindDecimals, *speed, response.WindUnit)
+	}
+	if deg := response.WindDegrees; deg != nil {
+		text += fmt.Sprintf("\n  Wind From   : %s (%.0f degrees)", response.WindDir, roundTo(*deg, 0))
+	}
+	if response.Trend != "" {
+		text += "\n  Trend       : " + response.Trend
+	}
+	if response.Observed != "" {
+		text += "\n  Observed    : " + response.Observed
+	}
+	if aq := response.AirQuality; aq != nil {
+		text += fmt.Sprintf("\n  Air Quality : %s (%d)", aq.Description, aq.Index)
+	}
+	if uv := response.UVIndex; uv != nil {
+		text += fmt.Sprintf("\n  UV Index    : %.1f (%s)", *uv, response.UVRisk)
+	}
+	for _, failed := range response.EnrichmentErrors {
+		text += fmt.Sprintf("\n  %-12s: %s", enrichmentLabels[failed.Name], failed.Error)
+	}
+	return text
+}
+
+// observationAge - how long before now the provider observed the conditions, at dt (unix seconds)
+// ok is false if the provider didn't say.  An observation from the future (clock skew) is brand new.
+func observationAge(dt int64, now time.Time) (age time.Duration, ok bool) {
+	if dt <= 0 {
+		return 0, false
+	}
+	return max(now.Sub(time.Unix(dt, 0)), 0), true
+}
+
+// formatObservationAge - describe the age of an observation, e.g. "just now" or "5 minutes ago"
+func formatObservationAge(age time.Duration) string {
+	switch minutes := int(age / time.Minute); minutes {
+	case 0:
+		return "just now"
+	case 1:
+		return "1 minute ago"
+	default:
+		return fmt.Sprintf("%d minutes ago", minutes)
+	}
+}
+
+// temperatureAlert - "above" or "below" if the temperature (Celsius) is past either threshold, or empty
+// A nil threshold never alerts.
+func temperatureAlert(temp float64, above, below *float64) string {
+	switch {
+	case above != nil && temp > *above:
+		return "above"
+	case below != nil && temp < *below:
+		return "below"
+	default:
+		return ""
+	}
+}
+
+// temperatureTrend - "rising", "falling" or "steady", comparing current to previous (both Celsius)
+// Changes no larger than threshold count as steady.
+func temperatureTrend(current, previous, threshold float64) string {
+	switch delta := current - previous; {
+	case delta > threshold:
+		return "rising"
+	case delta < -threshold:
+		return "falling"
+	default:
+		return "steady"
+	}
+}
+
+// templateTemperature - getTemperature for templates, where the units are optional
+// ({{temperature .TemperatureC .Units}} leads with the requested units)
+func templateTemperature(temp float64, units ...string) string {
+	if len(units) > 0 {
+		return getTemperature(temp, units[0])
+	}
+	return getTemperature(temp, "")
+}
+
+// templateFuncs - helpers available to RESPONSE_TEMPLATE templates
+var templateFuncs = template.FuncMap{
+	"temperature": templateTemperature, // {{temperature .TemperatureC}} is e.g. "Hot, 77°F (25°C)"
+	"fahrenheit":  celsiusToFahrenheit, // {{fahrenheit .TemperatureC}}
+	"kelvin":      celsiusToKelvin,     // {{kelvin .TemperatureC}}
+	"round":       roundTo,             // {{round .TemperatureF 1}}
+}
+
+// parseResponseTemplate - compile a text response template, checking it renders a typical response
+// Templates refer to fields by name, so a typo only shows up when the template runs; we find out now
+// rather than on the first request.
+func parseResponseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("response").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := newWeatherResponse(&WeatherData{Weather: []struct {
+		ID          int    `json:"id"`
+		Description string `json:"description"`
+		Icon        string `json:"icon"`
+	}{{ID: 800, Description: "clear sky", Icon: "01d"}}}, responseOptions{})
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderText - the plain text response body: the operator's RESPONSE_TEMPLATE if set, else formatWeather
+func renderText(response WeatherResponse) string {
+	if config.ResponseTemplate == nil {
+		return formatWeather(response)
+	}
+	var sb strings.Builder
+	if err := config.ResponseTemplate.Execute(&sb, response); err != nil {
+		slog.Error("response template failed, using the default", "error", err)
+		return formatWeather(response)
+	}
+	return sb.String()
+}
+
+// validateFormat - Verify the requested response format (text, json or xml).  Empty means text.
+func validateFormat(raw string) (string, error) {
+	format := strings.ToLower(strings.TrimSpace(raw))
+	switch format {
+	case "":
+		return "text", nil
+	case "text", "json", "xml":
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported format: %s", raw)
+	}
+}
+
+// validateUnits - Verify the requested unit system (OpenWeather's names).  Empty means none was requested.
+func validateUnits(raw string) (string, error) {
+	units := strings.ToLower(strings.TrimSpace(raw))
+	switch units {
+	case "", "metric", "imperial", "standard":
+		return units, nil
+	default:
+		return "", fmt.Errorf("unsupported units: %s", raw)
+	}
+}
+
+// imperialCountries - the countries that still use Fahrenheit (ISO 3166 alpha-2)
+var imperialCountries = []string{"US", "LR", "MM"}
+
+// inferUnits - guess a client's unit system when they didn't ask for one
+// The location's country decides if we know it, otherwise the region of the client's preferred
+// Accept-Language (e.g. en-US).  Everything else is metric.
+func inferUnits(country, acceptLanguage string) string {
+	if country == "" {
+		tag, _, _ := strings.Cut(acceptLanguage, ",")
+		tag, _, _ = strings.Cut(tag, ";")
+		if parts := strings.FieldsFunc(tag, func(r rune) bool { return r == '-' || r == '_' }); len(parts) > 1 {
+			country = parts[1]
+		}
+	}
+	if slices.Contains(imperialCountries, strings.ToUpper(strings.TrimSpace(country))) {
+		return "imperial"
+	}
+	return "metric"
+}
+
+// temperatureInUnits - convert a temperature (in Celsius) to the given unit system
+func temperatureInUnits(celsius float64, units string) float64 {
+	switch units {
+	case "imperial":
+		return celsiusToFahrenheit(celsius)
+	case "standard":
+		return celsiusToKelvin(celsius)
+	default:
+		return celsius
+	}
+}
+
+// metersPerSecondToMPH - how many miles per hour one meter per second is (3600 / 1609.344)
+const metersPerSecondToMPH = 2.2369362920544023
+
+// windSpeedConvert - a wind speed from the provider (in m/s, as we always ask it for metric) in the
+// client's units, with the unit's label: km/h for metric, m/s for standard, and mph for imperial or when
+// no units were asked for (as the text response then leads with Fahrenheit).
+func windSpeedConvert(metersPerSecond float64, units string) (speed float64, unit string) {
+	switch units {
+	case "metric":
+		return metersPerSecond * 3.6, "km/h"
+	case "standard":
+		return metersPerSecond, "m/s"
+	default:
+		return metersPerSecond * metersPerSecondToMPH, "mph"
+	}
+}
+
+// responseFormat - decide which format to respond in
+// An explicit format query parameter wins; otherwise we honor the first json or xml media type in the
+// Accept header, and fall back to text.
+func responseFormat(r *http.Request) (string, error) {
+	if raw := r.URL.Query().Get("format"); raw != "" {
+		return validateFormat(raw)
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return "json", nil
+		case "application/xml", "text/xml":
+			return "xml", nil
+		case "text/plain":
+			return "text", nil
+		}
+	}
+	return "text", nil
+}
+
+// encodeWeatherResponse - the response in the requested format, and its content type
+// JSON is indented with indent, or compact if it is empty.
+func encodeWeatherResponse(format string, response WeatherResponse, indent string) (body []byte, contentType string,
+	err error) {
+	var buf bytes.Buffer
+	switch format {
+	case "json":
+		contentType = "application/json"
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", indent)
+		err = encoder.Encode(response)
+	case "xml":
+		contentType = "application/xml; charset=utf-8"
+		buf.WriteString(xml.Header)
+		err = xml.NewEncoder(&buf).Encode(response)
+	default:
+		contentType = "text/plain; charset=utf-8"
+		buf.WriteString(renderText(response))
+	}
+	return buf.Bytes(), contentType, err
+}
+
+// noWeatherDataMessage - what NOT_FOUND_POLICY=structured tells clients when the provider has no weather
+const noWeatherDataMessage = "no weather data for this location"
+
+// noWeatherData - the 404 body NOT_FOUND_POLICY=structured sends when the provider has no weather for the
+// coordinates, echoing them back
+type noWeatherData struct {
+	XMLName xml.Name `json:"-" xml:"no_weather_data"`
+	Lat     float64  `json:"lat" xml:"lat"`
+	Lon     float64  `json:"lon" xml:"lon"`
+	Error   string   `json:"error" xml:"error"`
+}
+
+// isUpstreamNotFound - whether err is the provider answering 404, as it does for some remote coordinates
+func isUpstreamNotFound(err error) bool {
+	var upstreamErr *upstreamError
+	return errors.As(err, &upstreamErr) && upstreamErr.StatusCode == http.StatusNotFound
+}
+
+// writeNoWeatherData - answer 404 saying there's no weather data at the coordinates, in the requested format
+func writeNoWeatherData(w http.ResponseWriter, format string, latitude, longitude float64) {
+	body := noWeatherData{Lat: latitude, Lon: longitude, Error: noWeatherDataMessage}
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(&buf).Encode(body)
+	case "xml":
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		buf.WriteString(xml.Header)
+		err = xml.NewEncoder(&buf).Encode(body)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = fmt.Fprintf(&buf, "No weather data for this location (lat %g, lon %g)\n", latitude, longitude)
+	}
+	if err != nil {
+		slog.Error("error encoding the response", "error", err)
+		http.Error(w, noWeatherDataMessage, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		slog.Error("error writing the response", "error", err)
+	}
+}
+
+// writeWeatherResponse - encode the response in the requested format, cacheable for maxAge
+// The ETag is a hash of the body, so a client holding the same report (If-None-Match) gets a 304 instead.
+// Fields that only say how old the report is are left out of the hash, so it holds while the report is unchanged.
+func writeWeatherResponse(w http.ResponseWriter, r *http.Request, format string, response WeatherResponse,
+	maxAge time.Duration) {
+	body, contentType, err := encodeWeatherResponse(format, response, jsonIndent(r))
+	if err != nil {
+		slog.Error("error encoding the response", "error", err)
+		http.Error(w, "error encoding the response", http.StatusInternalServerError)
+		return
+	}
+
+	// the ETag identifies the weather, not how old it is or whether this copy came from our cache
+	tagged := body
+	if response.Cached || response.Observed != "" {
+		response.Cached, response.CacheAge, response.Observed = false, nil, ""
+		if tagged, _, err = encodeWeatherResponse(format, response, jsonIndent(r)); err != nil {
+			tagged = body
+		}
+	}
+	sum := sha256.Sum256(tagged)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge/time.Second)))
+	// the format can come from Accept, so shared caches must keep the formats apart
+	w.Header().Add("Vary", "Accept")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(body); err != nil {
+		slog.Error("error writing the response", "error", err)
+	}
+}
+
+// etagMatches - whether an If-None-Match header matches etag (weak comparison, as RFC 9110 asks)
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
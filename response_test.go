@@ -0,0 +1,843 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useWeather - install a mock provider that always returns the given payload
+func useWeather(t *testing.T, payload string) *mockProvider {
+	t.Helper()
+	provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		return weatherDataFromJSON(t, payload), nil
+	}}
+	cfg := defaultConfig()
+	cfg.Provider = provider
+	withConfig(t, cfg)
+	return provider
+}
+
+func TestValidateFormat(t *testing.T) {
+	testCases := []struct {
+		raw      string
+		expected string
+		valid    bool
+	}{
+		{"", "text", true},
+		{"text", "text", true},
+		{"JSON", "json", true},
+		{" xml ", "xml", true},
+		{"yaml", "", false},
+		{"html", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run("Format "+tc.raw, func(t *testing.T) {
+			format, err := validateFormat(tc.raw)
+			if tc.valid && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatalf("Expected error for format %q", tc.raw)
+			}
+			if format != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, format)
+			}
+		})
+	}
+}
+
+func TestWeatherHandlerFormats(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25,"humidity":50}}`
+	const target = "/weather?lat=37.77&lon=-122.42"
+
+	t.Run("Text is the default", func(t *testing.T) {
+		useWeather(t, payload)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Errorf("Expected text/plain, got %s", ct)
+		}
+		if !strings.HasPrefix(w.Body.String(), "Current Temperature:\n") {
+			t.Errorf("unexpected text body: %s", w.Body.String())
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		useWeather(t, payload)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target+"&format=json", nil))
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected application/json, got %s", ct)
+		}
+		var response WeatherResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid json: %v", err)
+		}
+		if response.Condition != "Clear Sky" || response.Feel != "Hot" ||
+			response.TemperatureC != 25 || response.TemperatureF != 77 || response.DewPointC == nil {
+			t.Errorf("unexpected json response: %s", w.Body.String())
+		}
+	})
+
+	t.Run("JSON with all units", func(t *testing.T) {
+		useWeather(t, payload)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target+"&format=json&all_units=true", nil))
+		var body struct {
+			Temperatures map[string]float64 `json:"temperatures"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid json: %v", err)
+		}
+		expected := map[string]float64{"metric": 25, "imperial": 77, "standard": 298.15}
+		if len(body.Temperatures) != len(expected) {
+			t.Errorf("Expected %v, got %s", expected, w.Body.String())
+		}
+		for units, value := range expected {
+			if got, ok := body.Temperatures[units]; !ok || math.Abs(got-value) > 1e-9 {
+				t.Errorf("Expected %s temperature %g, got %g (%v)", units, value, got, ok)
+			}
+		}
+
+		// and only when asked for
+		w = httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target+"&format=json", nil))
+		if strings.Contains(w.Body.String(), "temperatures") {
+			t.Errorf("Expected no temperatures object without all_units, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("XML", func(t *testing.T) {
+		useWeather(t, payload)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target+"&format=xml", nil))
+		if ct := w.Header().Get("Content-Type"); ct != "application/xml; charset=utf-8" {
+			t.Errorf("Expected application/xml, got %s", ct)
+		}
+		if !strings.HasPrefix(w.Body.String(), xml.Header+"<weather>") {
+			t.Errorf("unexpected xml body: %s", w.Body.String())
+		}
+		var response WeatherResponse
+		if err := xml.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid xml: %v", err)
+		}
+		if response.Condition != "Clear Sky" || response.TemperatureC != 25 {
+			t.Errorf("unexpected xml response: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Pretty JSON", func(t *testing.T) {
+		useWeather(t, payload)
+		config.Clock = newFakeClock() // so the cache age doesn't move between requests
+		get := func(query string) string {
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, target+"&format=json"+query, nil))
+			return w.Body.String()
+		}
+		get("") // every request after this is a cache hit
+		compact := get("")
+		if strings.Count(compact, "\n") != 1 || strings.Contains(compact, "  ") {
+			t.Errorf("Expected compact json by default: %s", compact)
+		}
+		testCases := map[string]string{
+			"&pretty=true": "\n  \"condition\"",
+			"&indent=4":    "\n    \"condition\"",
+			"&indent=99":   "\n        \"condition\"",
+		}
+		for query, expected := range testCases {
+			pretty := get(query)
+			if !strings.Contains(pretty, expected) {
+				t.Errorf("%s: expected indented json, got %s", query, pretty)
+			}
+			var compactResponse, prettyResponse WeatherResponse
+			if err := json.Unmarshal([]byte(compact), &compactResponse); err != nil {
+				t.Fatalf("bad json response: %v", err)
+			}
+			if err := json.Unmarshal([]byte(pretty), &prettyResponse); err != nil {
+				t.Fatalf("%s: bad json response: %v", query, err)
+			}
+			if !reflect.DeepEqual(compactResponse, prettyResponse) {
+				t.Errorf("%s: expected the same response, got %+v and %+v", query, compactResponse, prettyResponse)
+			}
+		}
+		for _, query := range []string{"&pretty=false", "&pretty=yes-please", "&indent=0", "&indent=-2", "&indent=x"} {
+			if body := get(query); body != compact {
+				t.Errorf("%s: expected compact json, got %s", query, body)
+			}
+		}
+	})
+
+	t.Run("Accept header", func(t *testing.T) {
+		useWeather(t, payload)
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", "text/html;q=0.9, application/json")
+		w := httptest.NewRecorder()
+		weatherHandler(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected application/json, got %s", ct)
+		}
+	})
+
+	t.Run("Format parameter wins over Accept header", func(t *testing.T) {
+		useWeather(t, payload)
+		req := httptest.NewRequest(http.MethodGet, target+"&format=xml", nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		weatherHandler(w, req)
+		if ct := w.Header().Get("Content-Type"); ct != "application/xml; charset=utf-8" {
+			t.Errorf("Expected application/xml, got %s", ct)
+		}
+	})
+
+	t.Run("Invalid format", func(t *testing.T) {
+		provider := useWeather(t, payload)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target+"&format=yaml", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", w.Code)
+		}
+		if provider.Calls() != 0 {
+			t.Error("Expected no provider call for an invalid format")
+		}
+	})
+}
+
+func TestWeatherResponseIcon(t *testing.T) {
+	useWeather(t, `{"weather":[{"id":803,"description":"broken clouds","icon":"04d"}],"main":{"temp":18}}`)
+	w := httptest.NewRecorder()
+	weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42&format=json", nil))
+
+	var response WeatherResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if response.Icon != "04d" {
+		t.Errorf("Expected icon '04d', got '%s'", response.Icon)
+	}
+	if response.Group != "Clouds" {
+		t.Errorf("Expected group 'Clouds', got '%s'", response.Group)
+	}
+}
+
+func TestFormatDescription(t *testing.T) {
+	testCases := map[string]string{
+		"broken clouds":              "Broken Clouds",
+		"":                           "",
+		"  light rain \n":            "Light Rain",
+		"thunderstorm":               "Thunderstorm",
+		"thunderstorm with  drizzle": "Thunderstorm With Drizzle",
+		"Already Titled":             "Already Titled",
+		"ébullition":                 "Ébullition",
+	}
+	for raw, expected := range testCases {
+		if got := formatDescription(raw); got != expected {
+			t.Errorf("%q: expected %q, got %q", raw, expected, got)
+		}
+	}
+}
+
+func TestLocationName(t *testing.T) {
+	testCases := []struct {
+		payload  string
+		expected string
+	}{
+		{`{"name":"San Francisco","sys":{"country":"US"}}`, "San Francisco, US"},
+		{`{"name":"","sys":{"country":"US"}}`, "US"},
+		{`{"name":"Atlantis"}`, "Atlantis"},
+		{`{}`, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.payload, func(t *testing.T) {
+			if result := locationName(weatherDataFromJSON(t, tc.payload)); result != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, result)
+			}
+		})
+	}
+
+	t.Run("Location line in the response", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20},`+
+			`"name":"San Francisco","sys":{"country":"US"}}`)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42", nil))
+		if !strings.Contains(w.Body.String(), "\n  Location    : San Francisco, US") {
+			t.Errorf("Expected location line, got '%s'", w.Body.String())
+		}
+	})
+
+	t.Run("No location line when absent", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=37.77&lon=-122.42&format=json", nil))
+		if strings.Contains(w.Body.String(), "location") {
+			t.Errorf("Expected no location, got '%s'", w.Body.String())
+		}
+	})
+}
+
+func TestResponseTemplate(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25},"name":"Paris","sys":{"country":"FR"}}`
+
+	t.Run("Custom template", func(t *testing.T) {
+		useWeather(t, payload)
+		tmpl, err := parseResponseTemplate(`{{.Location}}: {{.Condition}}, {{round .TemperatureC 0}}C ({{.Feel}})`)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		config.ResponseTemplate = tmpl
+
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=48.85&lon=2.35", nil))
+		if expected := "Paris, FR: Clear Sky, 25C (Hot)"; w.Body.String() != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, w.Body.String())
+		}
+
+		// json is unaffected
+		w = httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=48.85&lon=2.35&format=json", nil))
+		if !strings.HasPrefix(w.Body.String(), "{") {
+			t.Errorf("Expected json, got '%s'", w.Body.String())
+		}
+	})
+
+	t.Run("Invalid templates fail at startup", func(t *testing.T) {
+		t.Cleanup(func() {
+			_ = os.Unsetenv("RESPONSE_TEMPLATE")
+		})
+		for _, text := range []string{
+			`{{.Condition`,              // syntax error
+			`{{.Humidity}}`,             // no such field
+			`{{celsius .TemperatureF}}`, // no such function
+		} {
+			_ = os.Setenv("RESPONSE_TEMPLATE", text)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("Expected error for template %q", text)
+			}
+		}
+	})
+
+	t.Run("Template file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "response.tmpl")
+		if err := os.WriteFile(path, []byte(`{{.Condition}}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = os.Unsetenv("RESPONSE_TEMPLATE_FILE")
+		})
+		_ = os.Setenv("RESPONSE_TEMPLATE_FILE", path)
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cfg.ResponseTemplate == nil {
+			t.Error("Expected the template to be loaded")
+		}
+	})
+}
+
+func TestWeatherCachingHeaders(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&format=json", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		weatherHandler(w, r)
+		return w
+	}
+
+	t.Run("Cache-Control and ETag", func(t *testing.T) {
+		useWeather(t, payload)
+		config.CacheTTL = 90 * time.Second
+		w := get("")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "max-age=90" {
+			t.Errorf("Expected 'max-age=90', got '%s'", cc)
+		}
+		if etag := w.Header().Get("ETag"); !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+			t.Errorf("Expected a quoted ETag, got '%s'", etag)
+		}
+	})
+
+	t.Run("Matching If-None-Match", func(t *testing.T) {
+		useWeather(t, payload)
+		etag := get("").Header().Get("ETag")
+		for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+			w := get(ifNoneMatch)
+			if w.Code != http.StatusNotModified {
+				t.Errorf("If-None-Match %s: expected 304, got %d", ifNoneMatch, w.Code)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("If-None-Match %s: expected no body, got %q", ifNoneMatch, w.Body.String())
+			}
+			if w.Header().Get("ETag") != etag {
+				t.Errorf("If-None-Match %s: expected the ETag on the 304", ifNoneMatch)
+			}
+		}
+	})
+
+	t.Run("Changed response", func(t *testing.T) {
+		useWeather(t, payload)
+		etag := get("").Header().Get("ETag")
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25}}`)
+		if w := get(etag); w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("Expected 200 with a body once the weather changed, got %d", w.Code)
+		}
+	})
+
+	t.Run("Stale responses are not cacheable", func(t *testing.T) {
+		useWeather(t, payload)
+		config.Cache = newWeatherCache(time.Minute, time.Hour, config.Clock)
+		config.Coalescer = newCoalescer(0)
+		get("")
+		backdate(config.Cache.(*weatherCache), cacheKey(weatherQuery{Lat: 1, Lon: 1}), 2*time.Minute)
+		config.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return nil, &upstreamError{StatusCode: http.StatusBadGateway}
+		}}
+		w := get("")
+		if w.Header().Get("X-Weather-Stale") != "true" {
+			t.Fatal("Expected a stale response")
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "max-age=0" {
+			t.Errorf("Expected 'max-age=0', got '%s'", cc)
+		}
+	})
+}
+
+func TestInferUnits(t *testing.T) {
+	testCases := []struct {
+		country        string
+		acceptLanguage string
+		expected       string
+	}{
+		{"US", "", "imperial"},
+		{"us", "", "imperial"},
+		{"LR", "", "imperial"},
+		{"MM", "", "imperial"},
+		{"FR", "", "metric"},
+		{"GB", "en-US", "metric"}, // the location's country wins
+		{"", "en-US,en;q=0.9", "imperial"},
+		{"", "en_US", "imperial"},
+		{"", "fr-FR,en-US;q=0.5", "metric"},
+		{"", "en", "metric"},
+		{"", "", "metric"},
+	}
+	for _, tc := range testCases {
+		if got := inferUnits(tc.country, tc.acceptLanguage); got != tc.expected {
+			t.Errorf("inferUnits(%q, %q): expected %s, got %s", tc.country, tc.acceptLanguage, tc.expected, got)
+		}
+	}
+}
+
+func TestWeatherHandlerInferredUnits(t *testing.T) {
+	const payload = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":25},"sys":{"country":"US"}}`
+	get := func(target string) WeatherResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		var response WeatherResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid json: %v", err)
+		}
+		return response
+	}
+
+	t.Run("Inferred from the country", func(t *testing.T) {
+		useWeather(t, payload)
+		config.InferUnits = true
+		response := get("/weather?lat=1&lon=1&format=json")
+		if response.Units != "imperial" || response.Temperature == nil || *response.Temperature != 77 {
+			t.Errorf("Expected 77 imperial, got %s %v", response.Units, response.Temperature)
+		}
+	})
+
+	t.Run("Explicit units win", func(t *testing.T) {
+		useWeather(t, payload)
+		config.InferUnits = true
+		response := get("/weather?lat=1&lon=1&format=json&units=metric")
+		if response.Units != "metric" || response.Temperature == nil || *response.Temperature != 25 {
+			t.Errorf("Expected 25 metric, got %s %v", response.Units, response.Temperature)
+		}
+	})
+
+	t.Run("Off by default", func(t *testing.T) {
+		useWeather(t, payload)
+		if response := get("/weather?lat=1&lon=1&format=json"); response.Units != "" {
+			t.Errorf("Expected no units, got %s", response.Units)
+		}
+	})
+}
+
+func TestTemperatureAlert(t *testing.T) {
+	above, below := 30.0, -5.0
+	testCases := []struct {
+		name     string
+		temp     float64
+		expected string
+	}{
+		{"Above the upper threshold", 31, "above"},
+		{"Below the lower threshold", -6, "below"},
+		{"Within range", 20, ""},
+		{"On a threshold", 30, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useWeather(t, fmt.Sprintf(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":%g}}`, tc.temp))
+			config.AlertAbove, config.AlertBelow = &above, &below
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", w.Code)
+			}
+			if got := w.Header().Get("X-Temp-Alert"); got != tc.expected {
+				t.Errorf("Expected X-Temp-Alert %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	t.Run("No thresholds", func(t *testing.T) {
+		if alert := temperatureAlert(100, nil, nil); alert != "" {
+			t.Errorf("Expected no alert without thresholds, got %q", alert)
+		}
+	})
+}
+
+func TestObservationAge(t *testing.T) {
+	clock := newFakeClock()
+	testCases := []struct {
+		name     string
+		at       time.Time
+		age      string
+		observed string
+	}{
+		{"Just now", clock.Now().Add(-20 * time.Second), "20", "just now"},
+		{"A minute ago", clock.Now().Add(-90 * time.Second), "90", "1 minute ago"},
+		{"Minutes ago", clock.Now().Add(-12 * time.Minute), "720", "12 minutes ago"},
+		{"Clock skew", clock.Now().Add(time.Minute), "0", "just now"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useWeather(t, fmt.Sprintf(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20},"dt":%d}`,
+				tc.at.Unix()))
+			config.Clock = clock
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&format=json", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", w.Code)
+			}
+			if age := w.Header().Get("X-Observation-Age"); age != tc.age {
+				t.Errorf("Expected X-Observation-Age %s, got %q", tc.age, age)
+			}
+			if age := w.Header().Get("Age"); age != "" {
+				t.Errorf("Expected no Age header, got %q", age)
+			}
+			var response WeatherResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("bad json response: %v", err)
+			}
+			if response.Observed != tc.observed {
+				t.Errorf("Expected observed %q, got %q", tc.observed, response.Observed)
+			}
+			if expected := tc.at.UTC().Format(time.RFC3339); response.ObservedAt != expected {
+				t.Errorf("Expected observed_at %s, got %s", expected, response.ObservedAt)
+			}
+		})
+	}
+
+	t.Run("Text", func(t *testing.T) {
+		useWeather(t, fmt.Sprintf(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20},"dt":%d}`,
+			clock.Now().Add(-5*time.Minute).Unix()))
+		config.Clock = clock
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if !strings.Contains(w.Body.String(), "\n  Observed    : 5 minutes ago") {
+			t.Errorf("Expected the observation age in %s", w.Body.String())
+		}
+	})
+
+	t.Run("Headers and ETag as the observation ages", func(t *testing.T) {
+		useWeather(t, fmt.Sprintf(`{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20},"dt":%d}`,
+			clock.Now().Add(-5*time.Minute).Unix()))
+		config.Clock = clock
+		first := httptest.NewRecorder()
+		weatherHandler(first, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&format=json", nil))
+		if cacheControl, expected := first.Header().Get("Cache-Control"),
+			fmt.Sprintf("max-age=%d", int(config.CacheTTL/time.Second)); cacheControl != expected {
+			t.Errorf("Expected the full cache lifetime despite the observation age, got %q", cacheControl)
+		}
+		if age := first.Header().Get("Age"); age != "" {
+			t.Errorf("Expected no Age header to cut max-age short, got %q", age)
+		}
+		if age := first.Header().Get("X-Observation-Age"); age != "300" {
+			t.Errorf("Expected X-Observation-Age 300, got %q", age)
+		}
+
+		clock.Advance(time.Minute)
+		request := httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&format=json", nil)
+		request.Header.Set("If-None-Match", first.Header().Get("ETag"))
+		second := httptest.NewRecorder()
+		weatherHandler(second, request)
+		if second.Code != http.StatusNotModified {
+			t.Errorf("Expected 304 for the same observation a minute on, got %d", second.Code)
+		}
+		if age := second.Header().Get("X-Observation-Age"); age != "360" {
+			t.Errorf("Expected X-Observation-Age 360, got %q", age)
+		}
+	})
+
+	t.Run("No dt", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1", nil))
+		if age := w.Header().Get("X-Observation-Age"); age != "" {
+			t.Errorf("Expected no X-Observation-Age header, got %q", age)
+		}
+		if strings.Contains(w.Body.String(), "Observed") {
+			t.Errorf("Expected no observation age in %s", w.Body.String())
+		}
+	})
+}
+
+func TestOceanPolicy(t *testing.T) {
+	const openWater = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":18},"name":"","sys":{}}`
+	const named = `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":18},"name":"Paris","sys":{"country":"FR"}}`
+	testCases := []struct {
+		policy  string
+		payload string
+		status  int
+		note    bool
+	}{
+		{"allow", openWater, http.StatusOK, false},
+		{"annotate", openWater, http.StatusOK, true},
+		{"reject", openWater, http.StatusNotFound, false},
+		{"annotate", named, http.StatusOK, false},
+		{"reject", named, http.StatusOK, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.policy+" "+tc.payload, func(t *testing.T) {
+			useWeather(t, tc.payload)
+			config.OceanPolicy = tc.policy
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=30&lon=-40", nil))
+			if w.Code != tc.status {
+				t.Fatalf("Expected %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if note := strings.Contains(w.Body.String(), "\n  Note        : "+openWaterNote); note != tc.note {
+				t.Errorf("Expected note %t, got %s", tc.note, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("annotate json", func(t *testing.T) {
+		useWeather(t, openWater)
+		config.OceanPolicy = "annotate"
+		if response := getWeatherJSON(t, "/weather?lat=30&lon=-40&format=json"); response.Note != openWaterNote {
+			t.Errorf("Expected the open water note, got %q", response.Note)
+		}
+	})
+
+	t.Run("reject skips historical lookups", func(t *testing.T) {
+		useWeather(t, openWater)
+		config.OceanPolicy = "reject"
+		target := "/weather?lat=30&lon=-40&timestamp=" + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for a historical lookup, which never has a name, got %d", w.Code)
+		}
+	})
+}
+
+func TestNotFoundPolicy(t *testing.T) {
+	// useNotFound - a provider answering 404 for every location
+	useNotFound := func(t *testing.T, policy string) {
+		t.Helper()
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return nil, &upstreamError{StatusCode: http.StatusNotFound, Message: "city not found"}
+		}}
+		cfg.NotFoundPolicy = policy
+		withConfig(t, cfg)
+	}
+	const target = "/weather?lat=-48.876667&lon=-123.393333"
+
+	t.Run("Text", func(t *testing.T) {
+		useNotFound(t, "structured")
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("Expected 404, got %d", w.Code)
+		}
+		expected := "No weather data for this location (lat -48.876667, lon -123.393333)\n"
+		if w.Body.String() != expected || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("Expected %q as text, got %q (%s)", expected, w.Body.String(), w.Header().Get("Content-Type"))
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		useNotFound(t, "structured")
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target+"&format=json", nil))
+		if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("Expected a JSON 404, got %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		var body noWeatherData
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("bad json response: %v", err)
+		}
+		if body.Lat != -48.876667 || body.Lon != -123.393333 || body.Error != "no weather data for this location" {
+			t.Errorf("Unexpected body: %+v", body)
+		}
+	})
+
+	t.Run("XML", func(t *testing.T) {
+		useNotFound(t, "structured")
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Accept", "application/xml")
+		w := httptest.NewRecorder()
+		weatherHandler(w, r)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "<no_weather_data><lat>-48.876667</lat>") {
+			t.Errorf("Expected an XML 404, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Passthrough by default", func(t *testing.T) {
+		useNotFound(t, defaultConfig().NotFoundPolicy)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, target+"&format=json", nil))
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "city not found") {
+			t.Errorf("Expected the provider's 404, got %d %q", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestTextEmoji(t *testing.T) {
+	testCases := []struct {
+		id          int
+		description string
+		expected    string
+	}{
+		{800, "clear sky", "☀️ Clear Sky"},
+		{501, "moderate rain", "🌧️ Moderate Rain"},
+		{601, "snow", "❄️ Snow"},
+		{211, "thunderstorm", "⛈️ Thunderstorm"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			useWeather(t, fmt.Sprintf(`{"weather":[{"id":%d,"description":%q}],"main":{"temp":10}}`, tc.id, tc.description))
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&emoji=true", nil))
+			if !strings.Contains(w.Body.String(), "  Weather     : "+tc.expected+"\n") {
+				t.Errorf("Expected %q in %s", tc.expected, w.Body.String())
+			}
+
+			// off unless asked for
+			for _, query := range []string{"", "&emoji=false"} {
+				w = httptest.NewRecorder()
+				weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=2&lon=2"+query, nil))
+				if emoji := conditionEmoji(tc.id); strings.Contains(w.Body.String(), emoji) {
+					t.Errorf("%q: expected no emoji, got %s", query, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestWindSpeedConvert(t *testing.T) {
+	testCases := []struct {
+		metersPerSecond float64
+		units           string
+		expected        float64
+		unit            string
+	}{
+		{0, "metric", 0, "km/h"},
+		{1, "metric", 3.6, "km/h"},
+		{10, "metric", 36, "km/h"},
+		{27.78, "metric", 100.008, "km/h"},
+		{0, "imperial", 0, "mph"},
+		{1, "imperial", 2.2369, "mph"},
+		{10, "imperial", 22.3694, "mph"},
+		{44.704, "imperial", 100, "mph"},
+		{10, "", 22.3694, "mph"}, // no units: as the text response, imperial first
+		{10, "standard", 10, "m/s"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%g m/s %s", tc.metersPerSecond, tc.units), func(t *testing.T) {
+			speed, unit := windSpeedConvert(tc.metersPerSecond, tc.units)
+			if math.Abs(speed-tc.expected) > 0.0001 {
+				t.Errorf("Expected %g, got %g", tc.expected, speed)
+			}
+			if unit != tc.unit {
+				t.Errorf("Expected %q, got %q", tc.unit, unit)
+			}
+		})
+	}
+
+	t.Run("Included in the response", func(t *testing.T) {
+		testCases := []struct {
+			units    string
+			expected float64
+			unit     string
+			text     string
+		}{
+			{"metric", 11.2, "km/h", "11.2 km/h"},
+			{"imperial", 6.9, "mph", "6.9 mph"},
+			{"standard", 3.1, "m/s", "3.1 m/s"},
+		}
+		for _, tc := range testCases {
+			useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20},"wind":{"speed":3.1,"deg":350}}`)
+			w := httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&format=json&units="+tc.units, nil))
+			var response WeatherResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("bad json response: %v", err)
+			}
+			if response.WindSpeed == nil || *response.WindSpeed != tc.expected || response.WindUnit != tc.unit {
+				t.Errorf("%s: expected %g %s, got %v %q", tc.units, tc.expected, tc.unit, response.WindSpeed, response.WindUnit)
+			}
+
+			w = httptest.NewRecorder()
+			weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&units="+tc.units, nil))
+			if !strings.Contains(w.Body.String(), "\n  Wind Speed  : "+tc.text+"\n") {
+				t.Errorf("%s: expected %q in %s", tc.units, tc.text, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Rounded to WIND_DECIMALS", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20},"wind":{"speed":3.1,"deg":350}}`)
+		config.WindDecimals = 2
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&units=imperial", nil))
+		if !strings.Contains(w.Body.String(), "\n  Wind Speed  : 6.93 mph\n") {
+			t.Errorf("Expected the speed to 2 places in %s", w.Body.String())
+		}
+	})
+
+	t.Run("No wind", func(t *testing.T) {
+		useWeather(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`)
+		w := httptest.NewRecorder()
+		weatherHandler(w, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=1&format=json", nil))
+		if strings.Contains(w.Body.String(), "wind_speed") {
+			t.Errorf("Expected no wind speed, got %s", w.Body.String())
+		}
+	})
+}
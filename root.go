@@ -0,0 +1,50 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+// rootPage - the page served at the root, a form for looking up the weather by hand
+var rootPage = template.Must(template.New("root").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Weather Service</title>
+</head>
+<body>
+<h1>Weather Service</h1>
+<form action="{{.BasePath}}/weather" method="get">
+<label>Latitude <input name="lat" type="number" step="any" min="-90" max="90" required></label>
+<label>Longitude <input name="lon" type="number" step="any" min="-180" max="180" required></label>
+<button type="submit">Get weather</button>
+</form>
+<ul>
+<li><a href="{{.BasePath}}/health">Health</a></li>
+<li><a href="{{.BasePath}}/openapi.json">API description</a></li>
+</ul>
+</body>
+</html>
+`))
+
+// rootHandler - serve the HTML page at the root, and 404 for every other path
+// The mux sends anything no other route matches here, so the path has to be checked.
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != config.BasePath+"/" && (config.BasePath == "" || r.URL.Path != config.BasePath) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := rootPage.Execute(w, struct{ BasePath string }{config.BasePath}); err != nil {
+		slog.Error("error writing the root page", "error", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRootHandler(t *testing.T) {
+	withConfig(t, defaultConfig())
+	mux := http.NewServeMux()
+	setupRoutes(mux, config)
+
+	t.Run("Root page", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+			t.Errorf("Expected an html page, got %q", contentType)
+		}
+		for _, expected := range []string{`<form action="/weather"`, `name="lat"`, `name="lon"`,
+			`href="/health"`, `href="/openapi.json"`} {
+			if !strings.Contains(w.Body.String(), expected) {
+				t.Errorf("Expected %q in %s", expected, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Unknown paths", func(t *testing.T) {
+		for _, target := range []string{"/nope", "/index.html", "/weather/nope/deeper"} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s: expected 404, got %d", target, w.Code)
+			}
+		}
+	})
+
+	t.Run("HEAD", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/", nil))
+		if w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Errorf("Expected 200 with no body, got %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Other methods", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("Expected 405 allowing GET, HEAD, got %d %q", w.Code, w.Header().Get("Allow"))
+		}
+	})
+}
+
+func TestRootHandlerBasePath(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BasePath = "/api/weather-service"
+	withConfig(t, cfg)
+	mux := http.NewServeMux()
+	setupRoutes(mux, config)
+
+	for _, target := range []string{"/api/weather-service", "/api/weather-service/"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", target, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), `<form action="/api/weather-service/weather"`) {
+			t.Errorf("%s: expected the form to use the base path: %s", target, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 outside the base path, got %d", w.Code)
+	}
+}
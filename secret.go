@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SecretSource - somewhere the OpenWeather API key can be read from
+// Sources are read each time the key is (re)loaded, so a rotated secret is picked up on SIGHUP.  A vault
+// client only needs to implement Get to be plugged in here.
+type SecretSource interface {
+	Get(ctx context.Context) (string, error)
+}
+
+// envSecretSource - a secret held in an environment variable
+type envSecretSource struct {
+	name string
+}
+
+// Get - the value of the environment variable (empty if it is unset)
+func (s envSecretSource) Get(_ context.Context) (string, error) {
+	return os.Getenv(s.name), nil
+}
+
+// fileSecretSource - a secret held in a file, e.g. a mounted Kubernetes or Docker secret
+type fileSecretSource struct {
+	path string
+}
+
+// Get - the contents of the file
+func (s fileSecretSource) Get(_ context.Context) (string, error) {
+	contents, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("reading OPENWEATHER_API_KEY_FILE: %w", err)
+	}
+	return string(contents), nil
+}
+
+// loadSecretSource - the API key source named by SECRET_SOURCE (env or file)
+// Without SECRET_SOURCE we use the file if OPENWEATHER_API_KEY_FILE is set, and OPENWEATHER_API_KEY if not.
+func loadSecretSource() (SecretSource, error) {
+	keyFile := strings.TrimSpace(os.Getenv("OPENWEATHER_API_KEY_FILE"))
+	switch source := strings.ToLower(strings.TrimSpace(os.Getenv("SECRET_SOURCE"))); source {
+	case "":
+		if keyFile != "" {
+			return fileSecretSource{path: keyFile}, nil
+		}
+		return envSecretSource{name: "OPENWEATHER_API_KEY"}, nil
+	case "env":
+		return envSecretSource{name: "OPENWEATHER_API_KEY"}, nil
+	case "file":
+		if keyFile == "" {
+			return nil, fmt.Errorf("SECRET_SOURCE=file requires OPENWEATHER_API_KEY_FILE")
+		}
+		return fileSecretSource{path: keyFile}, nil
+	default:
+		return nil, fmt.Errorf("invalid SECRET_SOURCE (want env or file): %s", source)
+	}
+}
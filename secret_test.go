@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvSecretSource(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.Unsetenv("TEST_SECRET")
+	})
+	_ = os.Setenv("TEST_SECRET", "s3cret")
+	secret, err := envSecretSource{name: "TEST_SECRET"}.Get(context.Background())
+	if err != nil || secret != "s3cret" {
+		t.Errorf("Expected 's3cret', got '%s' (%v)", secret, err)
+	}
+}
+
+func TestFileSecretSource(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(keyFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := fileSecretSource{path: keyFile}.Get(context.Background())
+	if err != nil || secret != "s3cret\n" {
+		t.Errorf("Expected 's3cret\\n', got '%s' (%v)", secret, err)
+	}
+
+	_, err = fileSecretSource{path: filepath.Join(t.TempDir(), "missing")}.Get(context.Background())
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a not-exist error, got %v", err)
+	}
+}
+
+func TestLoadSecretSource(t *testing.T) {
+	const fakeApiKey = "abcdef0123456789abcdef0123456789"
+	keyFile := filepath.Join(t.TempDir(), "api-key")
+	if err := os.WriteFile(keyFile, []byte(fakeApiKey), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Unsetenv("SECRET_SOURCE")
+		_ = os.Unsetenv("OPENWEATHER_API_KEY")
+		_ = os.Unsetenv("OPENWEATHER_API_KEY_FILE")
+	})
+	_ = os.Setenv("OPENWEATHER_API_KEY", "0123456789abcdef0123456789abcdef")
+
+	testCases := []struct {
+		source   string
+		keyFile  string
+		expected SecretSource
+	}{
+		{"", "", envSecretSource{name: "OPENWEATHER_API_KEY"}},
+		{"", keyFile, fileSecretSource{path: keyFile}},
+		{"env", keyFile, envSecretSource{name: "OPENWEATHER_API_KEY"}},
+		{"file", keyFile, fileSecretSource{path: keyFile}},
+	}
+	for _, tc := range testCases {
+		_ = os.Setenv("SECRET_SOURCE", tc.source)
+		_ = os.Setenv("OPENWEATHER_API_KEY_FILE", tc.keyFile)
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("SECRET_SOURCE=%s: unexpected error: %v", tc.source, err)
+		}
+		if cfg.SecretSource != tc.expected {
+			t.Errorf("SECRET_SOURCE=%s: expected %#v, got %#v", tc.source, tc.expected, cfg.SecretSource)
+		}
+	}
+
+	// getAPIKey reads through whichever source is configured
+	_ = os.Setenv("SECRET_SOURCE", "file")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	withConfig(t, cfg)
+	if apiKey, err := getAPIKey(context.Background()); err != nil || apiKey != fakeApiKey {
+		t.Errorf("Expected the key from the file, got '%s' (%v)", apiKey, err)
+	}
+
+	_ = os.Setenv("OPENWEATHER_API_KEY_FILE", "")
+	if _, err := loadConfig(); err == nil {
+		t.Error("Expected error for SECRET_SOURCE=file without OPENWEATHER_API_KEY_FILE")
+	}
+	_ = os.Setenv("SECRET_SOURCE", "vault")
+	if _, err := loadConfig(); err == nil {
+		t.Error("Expected error for SECRET_SOURCE=vault")
+	}
+}
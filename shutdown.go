@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inFlightRequests - the requests being served right now, so a shutdown can wait for them and say how many
+// it is waiting for
+type inFlightRequests struct {
+	wg     sync.WaitGroup
+	active atomic.Int64
+}
+
+// inFlight - the requests this process is serving
+var inFlight = &inFlightRequests{}
+
+// track - Middleware counting each request as in flight until its handler returns
+func (f *inFlightRequests) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.wg.Add(1)
+		f.active.Add(1)
+		defer func() {
+			f.active.Add(-1)
+			f.wg.Done()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Active - how many requests are being served
+func (f *inFlightRequests) Active() int64 {
+	return f.active.Load()
+}
+
+// wait - wait for the in-flight requests to finish, or for ctx to be done
+func (f *inFlightRequests) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdownKey - the request context key for the server's shutdown signal
+type shutdownKey struct{}
+
+// withShutdownSignal - give server's request contexts a channel that is closed when the server starts shutting down
+// Ordinary requests ignore it and finish as usual; long-lived handlers (the SSE stream) end on it, so a drain
+// doesn't sit out its whole timeout waiting for clients that never leave.
+func withShutdownSignal(server *http.Server) {
+	shuttingDown := make(chan struct{})
+	var once sync.Once
+	server.RegisterOnShutdown(func() {
+		once.Do(func() { close(shuttingDown) })
+	})
+	base := server.BaseContext
+	server.BaseContext = func(listener net.Listener) context.Context {
+		ctx := context.Background()
+		if base != nil {
+			ctx = base(listener)
+		}
+		return context.WithValue(ctx, shutdownKey{}, shuttingDown)
+	}
+}
+
+// shutdownSignal - closed once the server handling ctx's request starts shutting down
+// Outside such a server it is nil, which never becomes ready in a select.
+func shutdownSignal(ctx context.Context) <-chan struct{} {
+	shuttingDown, _ := ctx.Value(shutdownKey{}).(chan struct{})
+	return shuttingDown
+}
+
+// drain - shut server down gracefully, giving the requests in flight up to timeout to finish
+// New connections are refused straight away; whatever is still running at the timeout has its connection
+// closed.
+func drain(server *http.Server, requests *inFlightRequests, timeout time.Duration) {
+	slog.Info("shutting down", "in_flight", requests.Active(), "drain_timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Shutdown waits for the connections to go idle, and the handlers of hijacked or abandoned connections
+	// can outlive that, so we wait for those as well
+	err := server.Shutdown(ctx)
+	if err == nil {
+		err = requests.wait(ctx)
+	}
+	if err != nil {
+		slog.Warn("drain timed out, closing the remaining connections", "in_flight", requests.Active(), "error", err)
+		if err := server.Close(); err != nil {
+			slog.Error("server close failed", "error", err)
+		}
+		return
+	}
+	slog.Info("in-flight requests drained")
+}
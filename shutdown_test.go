@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveSlowly - serve a handler taking delay to answer, behind requests.track
+// The server is closed at the end of the test.
+func serveSlowly(t *testing.T, requests *inFlightRequests, delay time.Duration) (server *http.Server, url string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	server = &http.Server{Handler: requests.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		_, _ = w.Write([]byte("done"))
+	}))}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return server, "http://" + listener.Addr().String()
+}
+
+// startRequest - GET url in the background, returning its body (or error) on the channel
+// It returns once the request is in flight.
+func startRequest(t *testing.T, requests *inFlightRequests, url string) <-chan string {
+	t.Helper()
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		result <- string(body)
+	}()
+	for deadline := time.Now().Add(time.Second); requests.Active() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("The request never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return result
+}
+
+func TestDrain(t *testing.T) {
+	t.Run("In-flight requests finish", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelInfo)
+		requests := &inFlightRequests{}
+		server, url := serveSlowly(t, requests, 200*time.Millisecond)
+		result := startRequest(t, requests, url)
+
+		start := time.Now()
+		drain(server, requests, 2*time.Second)
+		if elapsed := time.Since(start); elapsed >= 2*time.Second {
+			t.Errorf("Expected the drain to end with the request, took %s", elapsed)
+		}
+		if body := <-result; body != "done" {
+			t.Errorf("Expected the in-flight request to complete, got %q", body)
+		}
+		if requests.Active() != 0 {
+			t.Errorf("Expected no requests in flight, got %d", requests.Active())
+		}
+		for _, expected := range []string{"shutting down", "in_flight=1", "in-flight requests drained"} {
+			if !strings.Contains(logs.String(), expected) {
+				t.Errorf("Expected %q in the logs: %s", expected, logs.String())
+			}
+		}
+	})
+
+	t.Run("Open streams end on shutdown", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelInfo)
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21}}`), nil
+		}}
+		cfg.StreamInterval = time.Hour
+		cfg.StreamHeartbeat = time.Hour
+		withConfig(t, cfg)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		requests := &inFlightRequests{}
+		server := newServer("", requests.track(http.HandlerFunc(weatherStreamHandler)), cfg)
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+		t.Cleanup(func() {
+			_ = server.Close()
+		})
+		result := startRequest(t, requests, "http://"+listener.Addr().String()+"/weather/stream?lat=1&lon=1")
+
+		start := time.Now()
+		drain(server, requests, 5*time.Second)
+		if elapsed := time.Since(start); elapsed >= time.Second {
+			t.Errorf("Expected the stream to end with the shutdown, the drain took %s", elapsed)
+		}
+		if body := <-result; !strings.Contains(body, "event: weather") {
+			t.Errorf("Expected the stream's first update before it ended, got %q", body)
+		}
+		if !strings.Contains(logs.String(), "in-flight requests drained") {
+			t.Errorf("Expected a clean drain in the logs: %s", logs.String())
+		}
+	})
+
+	t.Run("Drain timeout", func(t *testing.T) {
+		logs := captureLogs(t, slog.LevelInfo)
+		requests := &inFlightRequests{}
+		server, url := serveSlowly(t, requests, 2*time.Second)
+		result := startRequest(t, requests, url)
+
+		start := time.Now()
+		drain(server, requests, 100*time.Millisecond)
+		if elapsed := time.Since(start); elapsed >= time.Second {
+			t.Errorf("Expected the drain to give up after its timeout, took %s", elapsed)
+		}
+		if body := <-result; body == "done" {
+			t.Error("Expected the request to be cut off")
+		}
+		if !strings.Contains(logs.String(), "drain timed out") {
+			t.Errorf("Expected the timeout in the logs: %s", logs.String())
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// statsWindow - how many of the most recent request latencies the percentiles are computed over
+const statsWindow = 1024
+
+// requestStats - request and error counts, and a window of recent latencies, for /stats
+// A quick dependency-free view for operators who don't run Prometheus; the window keeps memory fixed and
+// the percentiles current.
+type requestStats struct {
+	mu        sync.Mutex
+	requests  int64
+	errors    int64
+	latencies []time.Duration // ring buffer of the latest statsWindow latencies
+	next      int             // where the next latency goes once the buffer is full
+}
+
+// statsSnapshot - the JSON served at /stats
+type statsSnapshot struct {
+	Requests int64   `json:"requests"`
+	Errors   int64   `json:"errors"`
+	P50Ms    float64 `json:"p50_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+	P99Ms    float64 `json:"p99_ms"`
+}
+
+// newRequestStats - create an empty collector keeping the latest window latencies
+func newRequestStats(window int) *requestStats {
+	return &requestStats{latencies: make([]time.Duration, 0, window)}
+}
+
+// stats - the request stats for this process
+var stats = newRequestStats(statsWindow)
+
+// Record - count a request that took d; failed requests are also counted as errors
+func (s *requestStats) Record(d time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if failed {
+		s.errors++
+	}
+	if len(s.latencies) < cap(s.latencies) {
+		s.latencies = append(s.latencies, d)
+		return
+	}
+	s.latencies[s.next] = d
+	s.next = (s.next + 1) % len(s.latencies)
+}
+
+// Snapshot - the current counts and latency percentiles (zero before any requests)
+func (s *requestStats) Snapshot() statsSnapshot {
+	s.mu.Lock()
+	snapshot := statsSnapshot{Requests: s.requests, Errors: s.errors}
+	sorted := slices.Clone(s.latencies)
+	s.mu.Unlock()
+
+	slices.Sort(sorted)
+	snapshot.P50Ms = percentileMs(sorted, 50)
+	snapshot.P95Ms = percentileMs(sorted, 95)
+	snapshot.P99Ms = percentileMs(sorted, 99)
+	return snapshot
+}
+
+// percentileMs - the nearest-rank p-th percentile of sorted, in milliseconds
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return float64(sorted[max(rank-1, 0)]) / float64(time.Millisecond)
+}
+
+// collectStats - record each request's latency, counting 5xx responses as errors
+func collectStats(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		stats.Record(time.Since(start), recorder.status >= http.StatusInternalServerError)
+	})
+}
+
+// statsHandler - serve the request stats as JSON
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats.Snapshot()); err != nil {
+		slog.Error("error writing stats", "error", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestStats(t *testing.T) {
+	s := newRequestStats(statsWindow)
+	if snapshot := s.Snapshot(); snapshot != (statsSnapshot{}) {
+		t.Errorf("Expected an empty snapshot, got %+v", snapshot)
+	}
+
+	// 1ms..100ms, recorded concurrently; every tenth one failed
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Record(time.Duration(i)*time.Millisecond, i%10 == 0)
+		}()
+	}
+	wg.Wait()
+
+	snapshot := s.Snapshot()
+	if snapshot.Requests != 100 || snapshot.Errors != 10 {
+		t.Errorf("Expected 100 requests and 10 errors, got %+v", snapshot)
+	}
+	for _, tc := range []struct {
+		name     string
+		got      float64
+		min, max float64
+	}{
+		{"p50", snapshot.P50Ms, 49, 51},
+		{"p95", snapshot.P95Ms, 94, 96},
+		{"p99", snapshot.P99Ms, 98, 100},
+	} {
+		if tc.got < tc.min || tc.got > tc.max {
+			t.Errorf("Expected %s between %gms and %gms, got %gms", tc.name, tc.min, tc.max, tc.got)
+		}
+	}
+}
+
+func TestRequestStatsWindow(t *testing.T) {
+	s := newRequestStats(10)
+	for i := 0; i < 10; i++ {
+		s.Record(time.Second, false)
+	}
+	// the slow requests age out of the window, but are still counted
+	for i := 0; i < 10; i++ {
+		s.Record(time.Millisecond, false)
+	}
+	snapshot := s.Snapshot()
+	if snapshot.Requests != 20 || snapshot.P99Ms != 1 {
+		t.Errorf("Expected 20 requests with a p99 of 1ms, got %+v", snapshot)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	previous := stats
+	stats = newRequestStats(statsWindow)
+	t.Cleanup(func() {
+		stats = previous
+	})
+
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusBadGateway)
+	}), collectStats)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/weather", nil))
+
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if snapshot.Requests != 1 || snapshot.Errors != 1 {
+		t.Errorf("Expected 1 request and 1 error, got %+v", snapshot)
+	}
+}
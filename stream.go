@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// writeEvent - write a single Server-Sent Event
+// Multi-line payloads are split into one data: line per line, as the SSE framing requires.
+func writeEvent(w http.ResponseWriter, event, payload string) error {
+	var sb strings.Builder
+	if event != "" {
+		sb.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(payload, "\n") {
+		sb.WriteString("data: " + line + "\n")
+	}
+	sb.WriteString("\n")
+	_, err := fmt.Fprint(w, sb.String())
+	return err
+}
+
+// weatherStreamHandler - stream periodic weather updates as Server-Sent Events
+// An update is sent immediately, then every StreamInterval until the client disconnects.  A heartbeat
+// comment is sent every StreamHeartbeat to keep idle proxies from closing the connection.
+func weatherStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectUnknownQueryParams(w, r, weatherQueryParams) || rejectDuplicateQueryParams(w, r) {
+		return
+	}
+
+	latitude, longitude, ok := coordinatesFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	opts := responseOptionsFromRequest(r)
+	query := weatherQuery{Lat: latitude, Lon: longitude}
+	ctx := r.Context()
+
+	// the server's WriteTimeout is meant for ordinary responses; a stream is written to for as long as the
+	// client stays, and the heartbeat tells us when it has gone
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.Debug("could not lift the write deadline for the stream", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	sendUpdate := func() error {
+		weatherData, _, err := fetchWeather(ctx, query)
+		if err != nil {
+			slog.Error("stream update failed", "error", err)
+			return writeEvent(w, "error", "failed to fetch weather")
+		}
+		return writeEvent(w, "weather", formatWeather(newWeatherResponse(weatherData, opts)))
+	}
+
+	if err := sendUpdate(); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(config.StreamInterval)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(config.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	shuttingDown := shutdownSignal(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-shuttingDown:
+			// the client's EventSource reconnects, to another instance or to this one once it is back
+			slog.Debug("ending the stream for shutdown")
+			return
+		case <-ticker.C:
+			if err := sendUpdate(); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWeatherStreamHandler(t *testing.T) {
+	t.Run("Streams periodic updates until cancelled", func(t *testing.T) {
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21}}`), nil
+		}}
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		cfg.StreamInterval = 20 * time.Millisecond
+		cfg.StreamHeartbeat = time.Hour
+		cfg.Cache = newWeatherCache(0, 0, cfg.Clock) // every update goes to the provider
+		cfg.Coalescer = newCoalescer(0)
+		withConfig(t, cfg)
+
+		server := httptest.NewServer(http.HandlerFunc(weatherStreamHandler))
+		t.Cleanup(server.Close)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?lat=37.77&lon=-122.42", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Expected text/event-stream, got %s", ct)
+		}
+
+		// read two complete events
+		var events []string
+		var current strings.Builder
+		scanner := bufio.NewScanner(resp.Body)
+		for len(events) < 2 && scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				events = append(events, current.String())
+				current.Reset()
+				continue
+			}
+			current.WriteString(line + "\n")
+		}
+		cancel()
+
+		if len(events) != 2 {
+			t.Fatalf("Expected 2 events, got %d", len(events))
+		}
+		for _, event := range events {
+			if !strings.HasPrefix(event, "event: weather\n") {
+				t.Errorf("unexpected event framing: %q", event)
+			}
+			if !strings.Contains(event, "data:   Weather     : Clear Sky\n") {
+				t.Errorf("expected weather data line in event: %q", event)
+			}
+		}
+		if provider.Calls() < 2 {
+			t.Errorf("Expected at least 2 provider calls, got %d", provider.Calls())
+		}
+	})
+
+	t.Run("Heartbeat comment", func(t *testing.T) {
+		provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21}}`), nil
+		}}
+		cfg := defaultConfig()
+		cfg.Provider = provider
+		cfg.StreamInterval = time.Hour
+		cfg.StreamHeartbeat = 10 * time.Millisecond
+		withConfig(t, cfg)
+
+		server := httptest.NewServer(http.HandlerFunc(weatherStreamHandler))
+		t.Cleanup(server.Close)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?lat=1&lon=1", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() == ": heartbeat" {
+				return
+			}
+		}
+		t.Fatal("stream ended without a heartbeat")
+	})
+
+	t.Run("Invalid coordinates", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/weather/stream?lat=100&lon=0", nil)
+		w := httptest.NewRecorder()
+		weatherStreamHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Outlives the server's write timeout", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Provider = &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+			return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":21}}`), nil
+		}}
+		cfg.StreamInterval = 20 * time.Millisecond
+		cfg.StreamHeartbeat = time.Hour
+		cfg.WriteTimeout = 100 * time.Millisecond
+		withConfig(t, cfg)
+
+		// through the real routes, so the middlewares' response writers are in the way too
+		mux := http.NewServeMux()
+		setupRoutes(mux, cfg)
+		server := httptest.NewUnstartedServer(mux)
+		server.Config = newServer("", mux, cfg)
+		server.Start()
+		t.Cleanup(server.Close)
+
+		resp, err := http.Get(server.URL + "/weather/stream?lat=37.77&lon=-122.42")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		start := time.Now()
+		scanner := bufio.NewScanner(resp.Body)
+		for time.Since(start) < 3*cfg.WriteTimeout {
+			if !scanner.Scan() {
+				t.Fatalf("Stream ended after %s: %v", time.Since(start), scanner.Err())
+			}
+		}
+	})
+}
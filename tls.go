@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tlsVersions - the TLS_MIN_VERSION values we accept; anything older than 1.2 is an insecure downgrade
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadTLSConfig - build the server's TLS settings from TLS_MIN_VERSION (default 1.2) and TLS_CIPHER_SUITES
+// TLS_CIPHER_SUITES is a comma separated list of Go cipher suite names (e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256); only suites Go considers secure are allowed.  It applies to
+// TLS 1.2 only: TLS 1.3 suites are not configurable.
+func loadTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if raw := strings.TrimSpace(os.Getenv("TLS_MIN_VERSION")); raw != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(raw, "TLS")]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS_MIN_VERSION (want 1.2 or 1.3): %s", raw)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("TLS_CIPHER_SUITES")); raw != "" {
+		secure := map[string]uint16{}
+		for _, suite := range tls.CipherSuites() {
+			secure[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(raw, ",") {
+			id, ok := secure[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite in TLS_CIPHER_SUITES: %s", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestLoadTLSConfig(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.Unsetenv("TLS_MIN_VERSION")
+		_ = os.Unsetenv("TLS_CIPHER_SUITES")
+	})
+
+	t.Run("Defaults to TLS 1.2", func(t *testing.T) {
+		tlsConfig, err := loadTLSConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.CipherSuites != nil {
+			t.Errorf("Expected TLS 1.2 with Go's default suites, got %+v", tlsConfig)
+		}
+	})
+
+	t.Run("Minimum version", func(t *testing.T) {
+		for raw, expected := range map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13, "TLS1.3": tls.VersionTLS13} {
+			_ = os.Setenv("TLS_MIN_VERSION", raw)
+			tlsConfig, err := loadTLSConfig()
+			if err != nil {
+				t.Fatalf("TLS_MIN_VERSION=%s: unexpected error: %v", raw, err)
+			}
+			if tlsConfig.MinVersion != expected {
+				t.Errorf("TLS_MIN_VERSION=%s: expected %x, got %x", raw, expected, tlsConfig.MinVersion)
+			}
+		}
+		for _, raw := range []string{"1.0", "1.1", "2.0", "latest"} {
+			_ = os.Setenv("TLS_MIN_VERSION", raw)
+			if _, err := loadTLSConfig(); err == nil {
+				t.Errorf("Expected error for TLS_MIN_VERSION=%s", raw)
+			}
+		}
+		_ = os.Unsetenv("TLS_MIN_VERSION")
+	})
+
+	t.Run("Cipher suites", func(t *testing.T) {
+		_ = os.Setenv("TLS_CIPHER_SUITES", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+		tlsConfig, err := loadTLSConfig()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+		if !slices.Equal(tlsConfig.CipherSuites, expected) {
+			t.Errorf("Expected %v, got %v", expected, tlsConfig.CipherSuites)
+		}
+
+		for _, raw := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_MADE_UP"} {
+			_ = os.Setenv("TLS_CIPHER_SUITES", raw)
+			if _, err := loadTLSConfig(); err == nil {
+				t.Errorf("Expected error for TLS_CIPHER_SUITES=%s", raw)
+			}
+		}
+	})
+}
+
+func TestTLSFilesConfig(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.Unsetenv("TLS_CERT_FILE")
+		_ = os.Unsetenv("TLS_KEY_FILE")
+	})
+	_ = os.Setenv("TLS_CERT_FILE", "/etc/weather/tls.crt")
+	if _, err := loadConfig(); err == nil {
+		t.Error("Expected error for TLS_CERT_FILE without TLS_KEY_FILE")
+	}
+	_ = os.Setenv("TLS_KEY_FILE", "/etc/weather/tls.key")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.TLSCertFile != "/etc/weather/tls.crt" || cfg.TLSKeyFile != "/etc/weather/tls.key" || cfg.TLS == nil {
+		t.Errorf("unexpected tls config: %+v", cfg)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// parseWarmCoords - parse WARM_COORDS, a semicolon separated list of lat,lon pairs
+// e.g. "40.71,-74.01;51.51,-0.13".  Each coordinate goes through the usual validators.
+func parseWarmCoords(raw string) ([]weatherQuery, error) {
+	var coords []weatherQuery
+	for _, pair := range strings.Split(raw, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		q, err := parseCoordPair(pair)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WARM_COORDS entry %s: %w", pair, err)
+		}
+		coords = append(coords, q)
+	}
+	return coords, nil
+}
+
+// parseCoordPair - parse a "lat,lon" pair, checking each coordinate with the usual validators
+func parseCoordPair(pair string) (weatherQuery, error) {
+	rawLat, rawLon, found := strings.Cut(pair, ",")
+	if !found {
+		return weatherQuery{}, fmt.Errorf("want lat,lon: %s", pair)
+	}
+	lat, err := validateLatitude(strings.TrimSpace(rawLat))
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	lon, err := validateLongitude(strings.TrimSpace(rawLon))
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	return weatherQuery{Lat: lat, Lon: lon}, nil
+}
+
+// warmCache - refresh the cache entry for each of coords
+// Failures are logged and otherwise ignored: the entry just stays as it was until the next round.
+func warmCache(ctx context.Context, coords []weatherQuery) {
+	for _, q := range coords {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, _, err := refreshWeather(ctx, cacheKey(q), q); err != nil {
+			slog.Warn("cache warming failed", "key", cacheKey(q), "error", err)
+		}
+	}
+}
+
+// runCacheWarmer - warm coords now and then every interval, until ctx is done
+func runCacheWarmer(ctx context.Context, coords []weatherQuery, interval time.Duration) {
+	slog.Info("cache warmer started", "locations", len(coords), "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		warmCache(ctx, coords)
+		select {
+		case <-ctx.Done():
+			slog.Info("cache warmer stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseWarmCoords(t *testing.T) {
+	coords, err := parseWarmCoords(" 40.71,-74.01 ; 51.51, -0.13;")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []weatherQuery{{Lat: 40.71, Lon: -74.01}, {Lat: 51.51, Lon: -0.13}}
+	if len(coords) != len(expected) || coords[0] != expected[0] || coords[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, coords)
+	}
+
+	if coords, err := parseWarmCoords(""); err != nil || len(coords) != 0 {
+		t.Errorf("Expected no coordinates, got %v %v", coords, err)
+	}
+	for _, raw := range []string{"40.71", "40.71,-274.01", "north,-74.01"} {
+		if _, err := parseWarmCoords(raw); err == nil {
+			t.Errorf("Expected error for %q", raw)
+		}
+	}
+}
+
+func TestCacheWarmer(t *testing.T) {
+	coords := []weatherQuery{{Lat: 40.71, Lon: -74.01}, {Lat: 51.51, Lon: -0.13}, {Lat: 0, Lon: 0}}
+	provider := &mockProvider{fetch: func(q weatherQuery) (*WeatherData, error) {
+		if q.Lat == 0 {
+			return nil, errors.New("provider down") // logged, and doesn't stop the others
+		}
+		return weatherDataFromJSON(t, `{"weather":[{"id":800,"description":"clear sky"}],"main":{"temp":20}}`), nil
+	}}
+	cfg := defaultConfig()
+	cfg.Provider = provider
+	cfg.Coalescer = newCoalescer(0)
+	withConfig(t, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runCacheWarmer(ctx, coords, 10*time.Millisecond)
+	}()
+
+	// wait for a couple of rounds: every round tries every location
+	deadline := time.Now().Add(2 * time.Second)
+	for provider.Calls() < 2*len(coords) {
+		if time.Now().After(deadline) {
+			t.Fatalf("warmer made only %d calls", provider.Calls())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("warmer did not stop when cancelled")
+	}
+
+	for _, q := range coords[:2] {
+		if _, stale, ok := config.Cache.Get(context.Background(), cacheKey(q)); !ok || stale {
+			t.Errorf("Expected a fresh cache entry for %v", q)
+		}
+	}
+	if _, _, ok := config.Cache.Get(context.Background(), cacheKey(coords[2])); ok {
+		t.Error("Expected no entry for the failing location")
+	}
+}